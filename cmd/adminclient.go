@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//访问运行中vipsidecar管理接口的命令共用的参数
+func addAdminFlags(cmd *cobra.Command) {
+	cmd.Flags().String("token", "", "admin api bearer token (default $VIPSIDECAR_ADMIN_TOKEN)")
+	cmd.Flags().String("cacert", "", "CA certificate used to verify the admin api when admin.tlscert is set")
+	cmd.Flags().String("cert", "", "client certificate for mTLS")
+	cmd.Flags().String("key", "", "client certificate key for mTLS")
+}
+
+//调用本机管理接口，path为/v1之后的部分
+func adminRequest(cmd *cobra.Command, parameter *common.Parameters, method string, path string) (*http.Response, error) {
+	return adminRequestBody(cmd, parameter, method, path, nil)
+}
+
+//409为接口正常返回的业务失败，由调用方解析响应
+func adminRequestBody(cmd *cobra.Command, parameter *common.Parameters, method string, path string, body io.Reader) (*http.Response, error) {
+	return adminDo(cmd, parameter, method, path, body, 10*time.Second)
+}
+
+//流式接口不限制读取响应的时间
+func adminStream(cmd *cobra.Command, parameter *common.Parameters, path string) (*http.Response, error) {
+	return adminDo(cmd, parameter, "GET", path, nil, 0)
+}
+
+func adminDo(cmd *cobra.Command, parameter *common.Parameters, method string, path string, body io.Reader, timeout time.Duration) (*http.Response, error) {
+	if parameter.MetricsAddr == "" {
+		return nil, errors.New("metricsaddr is not configured, admin api is not exposed")
+	}
+	addr := parameter.MetricsAddr
+	if strings.HasPrefix(addr, ":") {
+		addr = "127.0.0.1" + addr
+	}
+	scheme := "http"
+	client := &http.Client{Timeout: timeout}
+	if parameter.Admin.TlsCert != "" {
+		scheme = "https"
+		tlsconfig := &tls.Config{}
+		if cacert, _ := cmd.Flags().GetString("cacert"); cacert != "" {
+			pem, err := ioutil.ReadFile(cacert)
+			if err != nil {
+				return nil, err
+			}
+			tlsconfig.RootCAs = x509.NewCertPool()
+			tlsconfig.RootCAs.AppendCertsFromPEM(pem)
+		}
+		certfile, _ := cmd.Flags().GetString("cert")
+		keyfile, _ := cmd.Flags().GetString("key")
+		if certfile != "" {
+			cert, err := tls.LoadX509KeyPair(certfile, keyfile)
+			if err != nil {
+				return nil, err
+			}
+			tlsconfig.Certificates = []tls.Certificate{cert}
+		}
+		client.Transport = &http.Transport{TLSClientConfig: tlsconfig}
+	}
+	req, err := http.NewRequest(method, scheme+"://"+addr+common.AdminApiPrefix+path, body)
+	if err != nil {
+		return nil, err
+	}
+	token, _ := cmd.Flags().GetString("token")
+	if token == "" {
+		token = os.Getenv("VIPSIDECAR_ADMIN_TOKEN")
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 && resp.StatusCode != http.StatusConflict {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errors.New(resp.Status + ": " + strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
@@ -0,0 +1,52 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+//扫描一次集群中与vips冲突的对象，存在冲突时以1退出
+var conflictsCmd = &cobra.Command{
+	Use:   "conflicts",
+	Short: "Scan the cluster for services, endpoints, nodes and gateways using a managed vip",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		scanner, err := common.NewConflictScanner(parameter)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		conflicts, err := scanner.Scan()
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if asjson, _ := cmd.Flags().GetBool("json"); asjson {
+			json.NewEncoder(os.Stdout).Encode(conflicts)
+		} else if len(conflicts) == 0 {
+			fmt.Println("no conflicts for", len(parameter.Vips), "vips")
+		} else {
+			fmt.Printf("%-15s  %-36s  %-40s  %s\n", "VIP", "REASON", "OBJECT", "FIELD")
+			for _, c := range conflicts {
+				fmt.Printf("%-15s  %-36s  %-40s  %s\n", c.Vip, c.Reason, c.Object(), c.Field)
+			}
+		}
+		if len(conflicts) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(conflictsCmd)
+	conflictsCmd.Flags().Bool("json", false, "print conflicts as json")
+}
@@ -0,0 +1,39 @@
+package cmd
+
+import (
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+//只读方式比较期望状态与云上实际状态，类似terraform plan
+var diffCmd = &cobra.Command{
+	Use:   "diff",
+	Short: "Show the difference between desired and actual cloud state without changing anything",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		CheckParameter(parameter)
+		provider := common.NewProvider(parameter, common.NewRegionClients(parameter))
+		differ, ok := provider.(common.Differ)
+		if !ok {
+			log.Println("diff is not supported in mode", provider.Name())
+			os.Exit(1)
+		}
+		fmt.Println("mode:", provider.Name())
+		fmt.Println()
+		for _, line := range differ.Diff(LocalVips(parameter)) {
+			fmt.Println(line)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+}
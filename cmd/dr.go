@@ -0,0 +1,42 @@
+package cmd
+
+import (
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+var drCmd = &cobra.Command{
+	Use:   "dr",
+	Short: "Disaster-recovery mode operations",
+}
+
+//manual模式下确认切换到备vip
+var drConfirmCmd = &cobra.Command{
+	Use:   "confirm",
+	Short: "Confirm a pending disaster-recovery failover",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		if parameter.Dr.ConfirmFile == "" {
+			log.Println("dr.confirmfile is not set")
+			os.Exit(1)
+		}
+		if err := ioutil.WriteFile(parameter.Dr.ConfirmFile, []byte("confirmed\n"), 0644); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		log.Println("dr failover confirmed")
+	},
+}
+
+func init() {
+	drCmd.AddCommand(drConfirmCmd)
+	rootCmd.AddCommand(drCmd)
+}
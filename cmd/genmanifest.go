@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+//根据配置文件生成kubernetes清单，capabilities及volumes与配置保持一致
+var genManifestCmd = &cobra.Command{
+	Use:   "genmanifest",
+	Short: "Render a sidecar container spec or DaemonSet with the capabilities and volumes the configuration needs",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		CheckParameter(parameter)
+		options := common.ManifestOptions{}
+		options.Kind, _ = cmd.Flags().GetString("kind")
+		options.Name, _ = cmd.Flags().GetString("name")
+		options.Namespace, _ = cmd.Flags().GetString("namespace")
+		options.Image, _ = cmd.Flags().GetString("image")
+		options.ConfigSecret, _ = cmd.Flags().GetString("config-secret")
+		options.TokenAudience, _ = cmd.Flags().GetString("token-audience")
+		manifest, err := common.GenManifest(parameter, options)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("# generated by vipsidecar genmanifest from %s\n", configfile)
+		fmt.Printf("# create the config secret with: kubectl -n %s create secret generic %s --from-file=config.yaml=%s\n", options.Namespace, options.ConfigSecret, configfile)
+		fmt.Print(string(manifest))
+	},
+}
+
+func init() {
+	genManifestCmd.Flags().String("kind", common.ManifestDaemonSet, "container or daemonset")
+	genManifestCmd.Flags().String("name", "vipsidecar", "name of the container, service account and daemonset")
+	genManifestCmd.Flags().String("namespace", "kube-system", "namespace of the daemonset")
+	genManifestCmd.Flags().String("image", "vipsidecar:latest", "container image")
+	genManifestCmd.Flags().String("config-secret", "vipsidecar-config", "secret holding config.yaml")
+	genManifestCmd.Flags().String("token-audience", "jdcloud", "audience of the projected service account token used by federation")
+	rootCmd.AddCommand(genManifestCmd)
+}
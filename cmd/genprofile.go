@@ -0,0 +1,74 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+//根据配置文件生成seccomp及AppArmor profile，配置中的功能变化后需要重新生成，--check用于在发布流程中发现过期的profile
+var genProfileCmd = &cobra.Command{
+	Use:   "genprofile",
+	Short: "Write a seccomp profile and an AppArmor policy limited to the syscalls and paths the configuration uses",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		CheckParameter(parameter)
+		options := common.ProfileOptions{ConfigFile: configfile}
+		options.Name, _ = cmd.Flags().GetString("name")
+		options.Binary, _ = cmd.Flags().GetString("binary")
+		options.Writable, _ = cmd.Flags().GetStringSlice("writable")
+		dir, _ := cmd.Flags().GetString("output-dir")
+		check, _ := cmd.Flags().GetBool("check")
+
+		seccomp, err := common.GenSeccompProfile(parameter)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		files := map[string][]byte{
+			filepath.Join(dir, options.Name+"-seccomp.json"): seccomp,
+			filepath.Join(dir, options.Name+".apparmor"):     common.GenAppArmorProfile(parameter, options),
+		}
+		stale := []string{}
+		for path, data := range files {
+			if check {
+				if current, err := ioutil.ReadFile(path); err != nil || !bytes.Equal(current, data) {
+					stale = append(stale, path)
+				}
+				continue
+			}
+			if err := ioutil.WriteFile(path, data, 0644); err != nil {
+				log.Println(err)
+				os.Exit(1)
+			}
+			fmt.Println("wrote", path)
+		}
+		fmt.Println("features:", strings.Join(common.ProfileFeatures(parameter), ","))
+		if len(stale) > 0 {
+			sort.Strings(stale)
+			fmt.Println("stale:", strings.Join(stale, ", "), "- regenerate with vipsidecar genprofile")
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	genProfileCmd.Flags().String("output-dir", ".", "directory the profiles are written to or checked in")
+	genProfileCmd.Flags().String("name", "vipsidecar", "profile name, also the prefix of the file names")
+	genProfileCmd.Flags().String("binary", "/usr/local/bin/vipsidecar", "path of the vipsidecar binary in the container, the AppArmor profile attaches to it")
+	genProfileCmd.Flags().StringSlice("writable", nil, "additional files the process writes, such as --terminal-status-file")
+	genProfileCmd.Flags().Bool("check", false, "compare the profiles in output-dir with the configuration and exit 1 when they are stale")
+	rootCmd.AddCommand(genProfileCmd)
+}
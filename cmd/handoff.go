@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+//计划内迁移：让本机vipsidecar将vip交给对端vipsidecar
+var handoffCmd = &cobra.Command{
+	Use:   "handoff",
+	Short: "Hand a vip held by this node to a peer vipsidecar, rolling back if the peer cannot bind it",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		vip, _ := cmd.Flags().GetString("vip")
+		peer, _ := cmd.Flags().GetString("to")
+		if configfile == "" || vip == "" || peer == "" {
+			cmd.Help()
+			return
+		}
+		confirm, _ := cmd.Flags().GetBool("confirm")
+		parameter := common.GetConfigParameters(configfile)
+		body, _ := json.Marshal(common.HandoffRequest{Vip: vip, Peer: peer, Confirm: confirm})
+		resp, err := adminRequestBody(cmd, parameter, "POST", "/handoff", bytes.NewReader(body))
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		result := common.HandoffResult{}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		if impact := result.Impact; impact != nil {
+			fmt.Printf("impact of moving %s: expected downtime %.1fs (from %d recent failovers), listening ports %v, %d established connections, %d conntrack entries\n",
+				vip, impact.ExpectedDowntime, impact.Failovers, impact.ListeningPorts, impact.Connections, impact.Conntrack)
+			for _, note := range impact.Notes {
+				fmt.Println("  note:", note)
+			}
+		}
+		if result.State == "unconfirmed" {
+			fmt.Println("nothing changed, re-run with --confirm to hand off", vip)
+			os.Exit(1)
+		}
+		fmt.Printf("vip %s -> %s: %s in %.1fs %s\n", result.Vip, peer, result.State, result.Duration, result.Message)
+		if result.State != "completed" {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	addAdminFlags(handoffCmd)
+	handoffCmd.Flags().String("vip", "", "vip to hand off")
+	handoffCmd.Flags().String("to", "", "admin api url of the peer vipsidecar, e.g. https://10.0.0.12:9100")
+	handoffCmd.Flags().Bool("confirm", false, "hand off after reviewing the impact estimate, without it only the estimate is shown")
+	rootCmd.AddCommand(handoffCmd)
+}
@@ -0,0 +1,89 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+//从运行中的vipsidecar获取最近的vip状态转换记录
+var historyCmd = &cobra.Command{
+	Use:   "history",
+	Short: "Show recent vip state transitions of a running vipsidecar",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		if follow, _ := cmd.Flags().GetBool("follow"); follow {
+			followStatus(cmd, parameter)
+			return
+		}
+		resp, err := adminRequest(cmd, parameter, "GET", "/history")
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close()
+		transitions := []common.Transition{}
+		if err := json.NewDecoder(resp.Body).Decode(&transitions); err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		for _, t := range transitions {
+			printTransition(t)
+		}
+	},
+}
+
+func printTransition(t common.Transition) {
+	fmt.Printf("%s  %-15s  %-9s -> %-9s  %s  %s\n", t.Time.Format(time.RFC3339), t.Vip, t.From, t.To, t.Reason, t.RequestId)
+}
+
+//订阅/v1/status/watch，实时输出状态转换及健康检查变化，连接断开时退出
+func followStatus(cmd *cobra.Command, parameter *common.Parameters) {
+	resp, err := adminStream(cmd, parameter, "/status/watch")
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data: ") {
+			continue
+		}
+		event := common.StatusEvent{}
+		if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &event); err != nil {
+			continue
+		}
+		switch event.Type {
+		case "transition":
+			printTransition(*event.Transition)
+		case "health":
+			state := "healthy"
+			if !*event.Healthy {
+				state = "unhealthy"
+			}
+			fmt.Printf("%s  health check %s %s\n", event.Time.Format(time.RFC3339), event.Check, state)
+		}
+	}
+	log.Println("watch closed", scanner.Err())
+	os.Exit(1)
+}
+
+func init() {
+	addAdminFlags(historyCmd)
+	historyCmd.Flags().BoolP("follow", "f", false, "stream new transitions and health check changes")
+	rootCmd.AddCommand(historyCmd)
+}
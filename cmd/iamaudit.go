@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+)
+
+//列出当前配置所需的最小IAM权限并逐个检查
+var iamAuditCmd = &cobra.Command{
+	Use:   "iam-audit",
+	Short: "List the JD Cloud IAM actions required by the configuration, probe them and print a minimal policy",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		CheckParameter(parameter)
+		results := common.IamAudit(parameter, common.NewRegionClients(parameter))
+
+		mode := parameter.Mode
+		if mode == "" {
+			mode = common.ModeSecondaryIp
+		}
+		missing := false
+		fmt.Println("mode:", mode)
+		fmt.Println()
+		for _, r := range results {
+			flag := "required"
+			if !r.Required {
+				flag = "not required"
+			}
+			note := r.Detail
+			if !r.Required && r.Result == common.IamAllowed {
+				note = "excess permission, can be removed"
+			}
+			if r.Required && r.Result == common.IamDenied {
+				missing = true
+			}
+			fmt.Printf("%-32s %-13s %-9s %s\n", r.Action, flag, r.Result, note)
+		}
+
+		policy, err := common.IamPolicy(common.RequiredIamActions(parameter))
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println()
+		fmt.Println(string(policy))
+		if missing {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(iamAuditCmd)
+}
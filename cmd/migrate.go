@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v2"
+	"log"
+	"os"
+)
+
+//从已有的高可用方案生成vipsidecar配置
+var migrateCmd = &cobra.Command{
+	Use:   "migrate",
+	Short: "Generate a vipsidecar configuration from an existing HA setup",
+}
+
+//解析keepalived.conf，vrrp_script转为exec健康检查，virtual_ipaddress转为vips
+var migrateKeepalivedCmd = &cobra.Command{
+	Use:   "keepalived",
+	Short: "Convert a keepalived.conf into an equivalent vipsidecar configuration",
+	Run: func(cmd *cobra.Command, args []string) {
+		conf, _ := cmd.Flags().GetString("conf")
+		c, err := common.ParseKeepalivedConf(conf)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		config, notes := c.Migrate()
+		out, err := yaml.Marshal(config)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("# generated by vipsidecar migrate keepalived from %s\n", conf)
+		for _, note := range notes {
+			fmt.Println("# " + note)
+		}
+		fmt.Print(string(out))
+	},
+}
+
+func init() {
+	migrateKeepalivedCmd.Flags().String("conf", "/etc/keepalived/keepalived.conf", "keepalived configuration file")
+	migrateCmd.AddCommand(migrateKeepalivedCmd)
+	rootCmd.AddCommand(migrateCmd)
+}
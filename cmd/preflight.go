@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+//启动前检查配置及到各region endpoint的网络连通性(含代理)
+var preflightCmd = &cobra.Command{
+	Use:   "preflight",
+	Short: "Check the configuration and connectivity to the JD Cloud endpoints through the configured proxies",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		CheckParameter(parameter)
+		fmt.Println("config: ok")
+
+		if parameter.Sysctl.Managed {
+			warnings := common.NewSysctlManager(parameter.Sysctl).Check()
+			for _, warning := range warnings {
+				fmt.Println("warning:", warning)
+			}
+			if len(warnings) == 0 {
+				fmt.Println("sysctl: ok")
+			}
+		}
+
+		failed := false
+		for _, r := range common.CheckConnectivity(parameter) {
+			proxy := r.Proxy
+			if proxy == "" {
+				proxy = "direct"
+			}
+			if r.Err != nil {
+				failed = true
+				fmt.Printf("region %-12s %-8s via %s: %v\n", r.RangId, "failed", proxy, r.Err)
+				continue
+			}
+			fmt.Printf("region %-12s %-8s via %s in %v\n", r.RangId, "ok", proxy, r.Duration)
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(preflightCmd)
+}
@@ -0,0 +1,79 @@
+package cmd
+
+import (
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"time"
+)
+
+//故障转移演练：对影子vip执行完整转移路径并统计各步骤耗时，用于定期验证转移时间是否满足要求
+var rehearseCmd = &cobra.Command{
+	Use:   "rehearse",
+	Short: "Run the failover path against a canary vip (or read-only against a real one) and report the latency of each step",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		vip, _ := cmd.Flags().GetString("vip")
+		dryrun, _ := cmd.Flags().GetBool("dry-run")
+		if configfile == "" || vip == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		CheckParameter(parameter)
+		//生产vip只允许dryrun
+		if ok, _ := common.Contain(vip, parameter.VipIps()); ok && !dryrun {
+			log.Println("vip", vip, "is a production vip, use a canary vip or --dry-run")
+			os.Exit(1)
+		}
+		provider := common.NewProvider(parameter, common.NewRegionClients(parameter))
+		rehearser, ok := provider.(common.Rehearser)
+		if !ok {
+			log.Println("rehearse is not supported in mode", provider.Name())
+			os.Exit(1)
+		}
+
+		fmt.Println("mode:", provider.Name(), "vip:", vip, "dry-run:", dryrun)
+		fmt.Println()
+		steps := rehearser.Rehearse(vip, dryrun)
+		failed := false
+		for _, step := range steps {
+			name := step.Name
+			if step.Restore {
+				name = "restore: " + name
+			}
+			switch {
+			case step.Skipped:
+				fmt.Printf("  %-36s %10s\n", name, "skipped")
+			case step.Err != nil:
+				failed = true
+				fmt.Printf("  %-36s %10s  %v\n", name, "failed", step.Err)
+			default:
+				fmt.Printf("  %-36s %8dms\n", name, step.Duration.Milliseconds())
+			}
+		}
+		fmt.Println()
+		total := common.RehearsalDuration(steps)
+		fmt.Printf("failover path: %dms", total.Milliseconds())
+		if parameter.FailoverBudget > 0 {
+			budget := time.Duration(parameter.FailoverBudget) * time.Second
+			verdict := "within"
+			if total > budget {
+				verdict, failed = "exceeds", true
+			}
+			fmt.Printf(", %s failoverbudget %v", verdict, budget)
+		}
+		fmt.Println()
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rehearseCmd.Flags().String("vip", "", "canary vip to move, or a production vip together with --dry-run")
+	rehearseCmd.Flags().Bool("dry-run", false, "only run read-only steps, mutating steps are reported as skipped")
+	rootCmd.AddCommand(rehearseCmd)
+}
@@ -0,0 +1,145 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"github.com/spf13/cobra"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//单个vip的故障转移汇总
+type failoverSummary struct {
+	Vip       string         `json:"vip"`
+	Count     int            `json:"count"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Mttr      float64        `json:"mttrSeconds"`
+	Max       float64        `json:"maxSeconds"`
+	Total     float64        `json:"totalSeconds"`
+	Causes    map[string]int `json:"causes"`
+	Failures  map[string]int `json:"failures,omitempty"`
+}
+
+//根据failoverlog汇总各vip的故障转移次数、原因及耗时，用于月度可用性回顾
+var reportCmd = &cobra.Command{
+	Use:   "report",
+	Short: "Summarize recorded failovers per vip",
+	Run: func(cmd *cobra.Command, args []string) {
+		configfile, _ := cmd.Flags().GetString("config")
+		if configfile == "" {
+			cmd.Help()
+			return
+		}
+		parameter := common.GetConfigParameters(configfile)
+		if parameter.FailoverLog == "" {
+			log.Println("failoverlog is not configured")
+			os.Exit(1)
+		}
+		sincearg, _ := cmd.Flags().GetString("since")
+		since, err := parseSince(sincearg)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		records, err := common.ReadFailoverRecords(parameter.FailoverLog, since)
+		if err != nil {
+			log.Println(err)
+			os.Exit(1)
+		}
+		summaries := summarizeFailovers(records)
+		if asjson, _ := cmd.Flags().GetBool("json"); asjson {
+			json.NewEncoder(os.Stdout).Encode(summaries)
+			return
+		}
+		fmt.Println("failovers since", since.Format(time.RFC3339))
+		fmt.Println()
+		fmt.Printf("%-15s  %5s  %9s  %6s  %8s  %8s  %s\n", "VIP", "COUNT", "SUCCEEDED", "FAILED", "MTTR", "MAX", "CAUSES / FAILURES")
+		for _, s := range summaries {
+			fmt.Printf("%-15s  %5d  %9d  %6d  %7.1fs  %7.1fs  %s", s.Vip, s.Count, s.Succeeded, s.Failed, s.Mttr, s.Max, formatCounts(s.Causes))
+			if len(s.Failures) > 0 {
+				fmt.Print(" / ", formatCounts(s.Failures))
+			}
+			fmt.Println()
+		}
+	},
+}
+
+//支持time.ParseDuration的格式及以d结尾的天数，如30d
+func parseSince(s string) (time.Time, error) {
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || days < 0 {
+			return time.Time{}, errors.New("invalid --since " + s)
+		}
+		return time.Now().AddDate(0, 0, -days), nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return time.Time{}, errors.New("invalid --since " + s)
+	}
+	return time.Now().Add(-d), nil
+}
+
+//mttr为成功的故障转移的平均耗时，最后一行为所有vip的合计
+func summarizeFailovers(records []common.FailoverRecord) []*failoverSummary {
+	byvip := map[string]*failoverSummary{}
+	total := &failoverSummary{Vip: "TOTAL", Causes: map[string]int{}, Failures: map[string]int{}}
+	for _, r := range records {
+		s, ok := byvip[r.Vip]
+		if !ok {
+			s = &failoverSummary{Vip: r.Vip, Causes: map[string]int{}, Failures: map[string]int{}}
+			byvip[r.Vip] = s
+		}
+		for _, s := range []*failoverSummary{s, total} {
+			s.Count++
+			s.Causes[r.Cause]++
+			if r.Result != common.FailoverSucceeded {
+				s.Failed++
+				s.Failures[r.Reason]++
+				continue
+			}
+			s.Succeeded++
+			s.Total += r.Duration
+			if r.Duration > s.Max {
+				s.Max = r.Duration
+			}
+		}
+	}
+	summaries := []*failoverSummary{}
+	for _, s := range byvip {
+		summaries = append(summaries, s)
+	}
+	sort.Slice(summaries, func(i, j int) bool { return summaries[i].Vip < summaries[j].Vip })
+	for _, s := range append(summaries, total) {
+		if s.Succeeded > 0 {
+			s.Mttr = s.Total / float64(s.Succeeded)
+		}
+	}
+	return append(summaries, total)
+}
+
+func formatCounts(counts map[string]int) string {
+	keys := []string{}
+	for k := range counts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := []string{}
+	for _, k := range keys {
+		pairs = append(pairs, k+"="+strconv.Itoa(counts[k]))
+	}
+	return strings.Join(pairs, ",")
+}
+
+func init() {
+	reportCmd.Flags().String("since", "30d", "report failovers that started within this period, e.g. 30d or 12h")
+	reportCmd.Flags().Bool("json", false, "print the summary as json")
+	rootCmd.AddCommand(reportCmd)
+}
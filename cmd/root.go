@@ -15,6 +15,7 @@
 package cmd
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	common "github.com/jiashiwen/vipsidecar/common"
@@ -23,14 +24,19 @@ import (
 	"github.com/spf13/viper"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"sync"
+	"strings"
 	// "github.com/jdcloud-api/jdcloud-sdk-go/services/vpc/models"
 	"time"
 )
 
 var cfgFile string
 
+//--debug-http及每个body最多输出的字节数
+var debugHttp bool
+var debugHttpMaxBody int
+
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
 	Use:   "vipsidecar",
@@ -44,77 +50,208 @@ to quickly create a Cobra application.`,
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	//	Run: func(cmd *cobra.Command, args []string) { },
+	//所有子命令共用--debug-http
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		if debugHttp {
+			common.EnableHttpDump(debugHttpMaxBody)
+		}
+	},
 	Run: func(cmd *cobra.Command, args []string) {
 
+		starttime := time.Now()
 		configfile, _ := cmd.Flags().GetString("config")
-		var wg sync.WaitGroup
-		var mutex = &sync.Mutex{}
-		//健康检查map[ip地址]是否ping通
-		// var healtcheckmap map[string]bool
 
 		if configfile != "" {
 
 			defer os.Exit(0)
+			statusfile, _ := cmd.Flags().GetString("terminal-status-file")
+			common.SetTerminalStatusFile(statusfile)
 			parameter := common.GetConfigParameters(configfile)
+			if err := common.ConfigureLogging(parameter.Log, parameter.Vips); err != nil {
+				common.Exit(common.ExitConfigError, err)
+			}
 			CheckParameter(parameter)
-			vpcclient := common.InitVpcClient(parameter.AccessKeyID, parameter.AccessKeySecret)
-
-			for {
-				//本地网卡绑定的vip
-				vipsonlocal := []string{}
-
-				//当前网络接口与vip绑定关系
-				var networkinterfacevips = make(map[common.JdNetworkInterface][]string)
-				for _, networkinterface := range parameter.Allnetworkinterfaces {
-					wg.Add(1)
-					nf := networkinterface
-					go func() {
-						defer wg.Done()
-						secondaryips := common.GetNetworkInterfaceIps(vpcclient, nf.RangId, nf.NetWorkInterfaceId)
-						ips := []string{}
-						for i := 0; i < len(secondaryips); i++ {
-							ips = append(ips, secondaryips[i].PrivateIpAddress)
-						}
-						mutex.Lock()
-						networkinterfacevips[nf] = ips
-						mutex.Unlock()
-
-					}()
+			if err := common.MigrateFailoverLog(parameter.FailoverLog); err != nil {
+				common.Exit(common.ExitConfigError, err)
+			}
+			if err := common.DefaultDetachJournal.Open(parameter.DetachJournal); err != nil {
+				common.Exit(common.ExitConfigError, err)
+			}
+			if err := common.DefaultHookResults.Load(parameter.HookResults); err != nil {
+				common.Exit(common.ExitConfigError, err)
+			}
+			//state文件以root升级及压缩后再切换用户，切换后重新执行的进程再次读取时不需要改写
+			//sysctl、策略路由及本机vip在切换后通过保留的NET_ADMIN修改，netlink监听不需要特权
+			if err := common.DropPrivileges(parameter); err != nil {
+				common.Exit(common.ExitConfigError, err)
+			}
+			common.DefaultHistory.Resize(parameter.Historysize)
+			common.DefaultStatus.SetFeatures(common.Features())
+			log.Println("features", common.Features())
+			enabledebug, _ := cmd.Flags().GetBool("enable-debug")
+			if enabledebug {
+				if parameter.MetricsAddr == "" {
+					log.Println("metricsaddr is not configured, /debug endpoints are disabled")
+				}
+				common.DumpGoroutinesOnSignal()
+			}
+			common.HandleShutdownSignals()
+			common.DefaultHealthChecks.Start()
+			if parameter.Sysctl.Managed {
+				sysctls := common.NewSysctlManager(parameter.Sysctl)
+				for _, warning := range sysctls.Check() {
+					log.Println(warning)
+				}
+				sysctls.Apply()
+				common.RegisterShutdownHook("restore sysctls", sysctls.Restore)
+			}
+			common.DefaultSelfChecks.Expect(common.SelfCheckCloudApi, 0)
+			common.DefaultSelfChecks.Expect(common.SelfCheckCredentials, 0)
+			common.DefaultSelfChecks.Expect(common.SelfCheckClock, 0)
+			go common.WatchConfigFreshness(configfile, 30*time.Second)
+			admin := common.NewAdminServer(parameter)
+			admin.RegisterDefaults(enabledebug)
+			common.DefaultEligibility.Register(admin)
+			common.DefaultFlags.Register(admin)
+			if parameter.Admin.Dashboard {
+				admin.RegisterDashboard()
+			}
+			go common.DefaultClockGuard.Run(common.ClockSkewUrl(parameter), time.Duration(parameter.ClockSkew.MaxSkew)*time.Second, parameter.ClockSkew.PauseMutations, time.Duration(parameter.ClockSkew.CheckInterval)*time.Second)
+			clients := common.NewRegionClients(parameter)
+			provider := common.NewProvider(parameter, clients)
+			common.DefaultFailoverLog.Load(parameter.FailoverLog, provider.Name())
 
+			localvips := func() []string {
+				return LocalVips(parameter)
+			}
+			queue := common.NewEventQueue()
+			watcher := common.NewChangeWatcher(queue, localvips, provider, parameter.Watchinterval, parameter.Cloudwatchinterval)
+			watcher.Start()
+			if !parameter.DisableNetlink {
+				common.DefaultSelfChecks.Expect(common.SelfCheckNetlink, 0)
+				err := common.WatchNetlink(parameter.VipIps, func(reason string) {
+					log.Println("netlink", reason)
+					queue.Push(common.PriorityFailover, "netlink")
+				})
+				if err != nil {
+					log.Println("netlink watch disabled", err)
+				}
+				common.DefaultSelfChecks.Report(common.SelfCheckNetlink, err)
+			}
+			go queue.Tick(time.Duration(parameter.Pollinginterval) * time.Second)
+			if parameter.Probe.Enabled {
+				common.DefaultProber.Run(func(region string) {
+					queue.Push(common.PriorityFailover, "cloudapi")
+				})
+			}
+			go common.DefaultTraffic.Run()
+			if parameter.Heartbeat.Url != "" {
+				publisher, err := common.NewHeartbeatPublisher(parameter.Heartbeat, localvips)
+				if err != nil {
+					log.Println("heartbeat disabled", err)
+				} else {
+					go publisher.Run()
 				}
+			}
 
-				wg.Wait()
-				// fmt.Println("networkinterfacevips", networkinterfacevips)
-				//获取本地vip列表
-				localips := GetIntranetIp()
-				for _, ip := range localips {
-					ok, _ := common.Contain(ip, parameter.Vips)
-					if ok {
-						vipsonlocal = append(vipsonlocal, ip)
-					}
+			if parameter.Metrics.Push.Type != "" {
+				pusher, err := common.NewMetricsPusher(parameter.Metrics.Push)
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
+				}
+				go pusher.Run()
+				common.RegisterShutdownHook("push metrics", pusher.PushOnce)
+			}
+			if parameter.Metrics.Backend == common.MetricsBackendStatsd {
+				emitter, err := common.NewStatsdEmitter(parameter.Metrics.Statsd)
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
 				}
+				go emitter.Run()
+				common.RegisterShutdownHook("flush statsd", emitter.Flush)
+			}
 
-				//如果在本地检查到vip,同时vip的注册网络端口不是本地网路端口，或所有网络端口中都没有注册，则注册vip到本地网络端口,同时删除老旧注册
-				for _, localvip := range vipsonlocal {
-					vipnotonanyinterface := true
-					for k, v := range networkinterfacevips {
-						ok, _ := common.Contain(v, localvip)
-						if ok {
-							vipnotonanyinterface = false
-							if k.RangId != parameter.Localnetworkinterface.RangId || k.NetWorkInterfaceId != parameter.Localnetworkinterface.NetWorkInterfaceId {
-								common.UnAssignVips(vpcclient, k.RangId, k.NetWorkInterfaceId, []string{localvip})
-								common.AssignVips(vpcclient, parameter.Localnetworkinterface.RangId, parameter.Localnetworkinterface.NetWorkInterfaceId, []string{localvip})
-							}
-						}
-					}
-					if vipnotonanyinterface {
-						common.AssignVips(vpcclient, parameter.Localnetworkinterface.RangId, parameter.Localnetworkinterface.NetWorkInterfaceId, []string{localvip})
-					}
+			//手动触发一次reconcile
+			admin.HandleFunc(common.AdminApiPrefix+"/reconcile", common.RoleOperator, func(w http.ResponseWriter, r *http.Request) {
+				if r.Method != "POST" {
+					http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+					return
+				}
+				queue.Push(common.PriorityFailover, "admin")
+				w.WriteHeader(http.StatusAccepted)
+			})
+			handoff := common.NewHandoff(parameter, provider, queue)
+			handoff.Register(admin)
+			if parameter.Drain.Enabled {
+				drain, err := common.NewDrainWatcher(parameter.Drain, handoff, parameter.VipIps())
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
+				}
+				go drain.Run()
+			}
+			if parameter.Spot.Enabled {
+				spot, err := common.NewSpotWatcher(parameter.Spot, handoff, parameter.VipIps())
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
+				}
+				go spot.Run()
+			}
+			if parameter.Maintenance.Enabled {
+				maintenance, err := common.NewMaintenanceWatcher(parameter.Maintenance, handoff, parameter.VipIps())
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
+				}
+				go maintenance.Run()
+			}
+			if parameter.LoadBalancer.Class != "" {
+				loadbalancer, err := common.NewLoadBalancerController(parameter.LoadBalancer, parameter.VipIps(), queue)
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
+				}
+				go loadbalancer.Run()
+			}
+			if parameter.Gateway.Class != "" {
+				gateway, err := common.NewGatewayController(parameter.Gateway, parameter.VipIps(), queue)
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
+				}
+				go gateway.Run()
+			}
+			if parameter.Conflicts.Enabled {
+				scanner, err := common.NewConflictScanner(parameter)
+				if err != nil {
+					common.Exit(common.ExitConfigError, err)
 				}
+				go scanner.Run()
+			}
+			common.DefaultHealthChecks.Register(admin)
+			admin.Start()
+
+			//启动阶段并行发现状态后立即执行首次reconcile
+			vipsonlocal := common.Discover(provider, localvips, time.Duration(parameter.Startuptimeout)*time.Second)
+			//启动阶段云上接口返回不可恢复的错误(凭证无效、网卡不存在等)时退出，由重启策略根据退出码处理
+			if last := common.DefaultStatus.Last(); last != nil && common.ExitCodeOf(last.Reason) != common.ExitOk {
+				common.Exit(common.ExitCodeOf(last.Reason), errors.New("startup discovery failed: "+last.Operation+": "+last.Message))
+			}
+			//上次运行在卸载与挂载之间退出时，先完成或回滚未完成的卸载
+			common.RecoverDetachJournal(provider, vipsonlocal)
+			common.DefaultFailoverLog.Detected(common.Event{Source: "startup", Time: time.Now()})
+			provider.Reconcile(context.Background(), vipsonlocal)
+			common.DefaultStatus.SetLocalVips(provider.Name(), vipsonlocal)
+			common.DefaultMetrics.Set("vipsidecar_startup_duration_seconds", nil, time.Since(starttime).Seconds())
+			log.Println("startup completed in", time.Since(starttime), "vipsonlocal", vipsonlocal)
 
-				log.Println("vipsonlocal", vipsonlocal)
-				log.Println("networkinterfacevips", networkinterfacevips)
-				time.Sleep(time.Duration(parameter.Pollinginterval) * time.Second)
+			for {
+				event := queue.Pop()
+				ctx := queue.Begin(event)
+
+				//本地网卡绑定的vip
+				vipsonlocal := LocalVips(parameter)
+				provider.Reconcile(ctx, vipsonlocal)
+				queue.Done()
+				common.DefaultStatus.SetLocalVips(provider.Name(), vipsonlocal)
+
+				log.Println("event", event.Source, "vipsonlocal", vipsonlocal)
 			}
 
 		}
@@ -140,10 +277,14 @@ func init() {
 	// Cobra supports persistent flags, which, if defined here,
 	// will be global for your application.
 	rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.vipsidecar.yaml)")
+	rootCmd.PersistentFlags().BoolVar(&debugHttp, "debug-http", false, "log outbound http requests and responses with credentials redacted")
+	rootCmd.PersistentFlags().IntVar(&debugHttpMaxBody, "debug-http-max-body", 4096, "bytes of each request and response body logged by --debug-http")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+	rootCmd.Flags().String("terminal-status-file", "", "write the exit code, reason and last error as json to this file when exiting")
+	rootCmd.Flags().Bool("enable-debug", false, "expose /debug/pprof and /debug/vars on metricsaddr and dump goroutines on SIGQUIT")
 }
 
 // initConfig reads in config file and ENV variables if set.
@@ -194,21 +335,213 @@ func GetIntranetIp() []string {
 	return localips
 }
 
+//本地网卡上绑定的vip
+func LocalVips(parameter *common.Parameters) []string {
+	vipsonlocal := []string{}
+	for _, ip := range GetIntranetIp() {
+		ok, _ := common.Contain(ip, parameter.VipIps())
+		if ok {
+			vipsonlocal = append(vipsonlocal, ip)
+		}
+	}
+	return vipsonlocal
+}
+
 //配置文件参数检查
 func CheckParameter(p *common.Parameters) {
-	//检查ak
-	if p.AccessKeyID == "" {
-		log.Println(errors.New("AccessKeyID must be set"))
-		os.Exit(1)
+	//使用OIDC联合身份时不需要ak/sk
+	if p.Federation.TokenFile != "" {
+		if p.Federation.RoleArn == "" || p.Federation.Endpoint == "" {
+			common.Exit(common.ExitConfigError, errors.New("federation.rolearn and federation.endpoint must be set when federation.tokenfile is set"))
+		}
+	} else {
+		//检查ak
+		if p.AccessKeyID == "" {
+			common.Exit(common.ExitConfigError, errors.New("AccessKeyID must be set"))
+		}
+
+		//检查sk
+		if p.AccessKeySecret == "" {
+			common.Exit(common.ExitConfigError, errors.New("AccessKeySecret must be set"))
+		}
 	}
 
-	//检查sk
-	if p.AccessKeySecret == "" {
-		log.Println(errors.New("AccessKeySecret must be set"))
-		os.Exit(1)
+	//natdnat模式需要NAT网关及本机地址
+	if p.Mode == common.ModeNatDnat {
+		if p.NatGateway.NatGatewayId == "" || p.NatGateway.LocalIp == "" {
+			common.Exit(common.ExitConfigError, errors.New("natgateway.natgatewayid and natgateway.localip must be set in natdnat mode"))
+		}
+	}
+
+	//dr模式需要主备vip及备用网卡
+	if p.Mode == common.ModeDr {
+		if p.Dr.PrimaryVip == "" || p.Dr.StandbyVip == "" || p.Dr.StandbyNetworkInterface.NetWorkInterfaceId == "" {
+			common.Exit(common.ExitConfigError, errors.New("dr.primaryvip, dr.standbyvip and dr.standbynetworkinterface must be set in dr mode"))
+		}
+		//未配置dr.health时通过tcp探测checkport判断主vip是否可用，端口为0时探测总是失败
+		if p.Dr.Health == "" && (p.Dr.CheckPort < 1 || p.Dr.CheckPort > 65535) {
+			common.Exit(common.ExitConfigError, errors.New("dr.checkport must be between 1 and 65535 when dr.health is not set"))
+		}
+		if p.Dr.Confirm == common.DrConfirmManual && p.Dr.ConfirmFile == "" {
+			common.Exit(common.ExitConfigError, errors.New("dr.confirmfile must be set when dr.confirm is manual"))
+		}
+		if p.Dr.FailureThreshold <= 0 {
+			p.Dr.FailureThreshold = 3
+		}
+	}
+
+	//eni模式需要本机云主机id及每个vip对应的网卡
+	if p.Mode == common.ModeEni {
+		if p.Eni.RangId == "" || p.Eni.InstanceId == "" || p.Eni.Gateway == "" || len(p.Eni.Interfaces) == 0 {
+			common.Exit(common.ExitConfigError, errors.New("eni.rangid, eni.instanceid, eni.gateway and eni.interfaces must be set in eni mode"))
+		}
+		for _, nic := range p.Eni.Interfaces {
+			if ok, _ := common.Contain(nic.Vip, p.VipIps()); !ok || nic.NetworkInterfaceId == "" {
+				common.Exit(common.ExitConfigError, errors.New("eni.interfaces entry "+nic.NetworkInterfaceId+" must have a networkinterfaceid and a vip listed in vips"))
+			}
+		}
+	}
+
+	for _, t := range p.Admin.Tokens {
+		if t.Token == "" || (t.Role != common.RoleViewer && t.Role != common.RoleOperator) {
+			common.Exit(common.ExitConfigError, errors.New("admin token "+t.Name+" must have a token and role viewer or operator"))
+		}
+	}
+	if (p.SecondaryAccessKeyID == "") != (p.SecondaryAccessKeySecret == "") {
+		common.Exit(common.ExitConfigError, errors.New("secondaryaccesskeyid and secondaryaccesskeysecret must be set together"))
+	}
+
+	if _, err := common.ParseAllowCidrs(p.Admin.AllowCidrs); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if p.Admin.ClientCa != "" && p.Admin.TlsCert == "" {
+		common.Exit(common.ExitConfigError, errors.New("admin.tlscert and admin.tlskey must be set when admin.clientca is set"))
+	}
+	//clientca无法使用时管理接口不能启动，handoff、健康检查结果及状态都依赖它
+	if p.Admin.ClientCa != "" {
+		if _, err := common.LoadCaPool(p.Admin.ClientCa); err != nil {
+			common.Exit(common.ExitConfigError, errors.New("admin.clientca: "+err.Error()))
+		}
+	}
+
+	if features := common.PlumbingFeatures(p); p.Privileges.NoPlumbing && len(features) > 0 {
+		common.Exit(common.ExitConfigError, errors.New("privileges.noplumbing cannot be used with "+strings.Join(features, ", ")))
+	}
+
+	if err := common.CheckFips(p.Fips); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+
+	if err := common.ConfigureTransport(p.Transport); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+
+	if err := common.InstallProxy(p); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+
+	if err := common.DefaultSchedule.Load(p.Schedule); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	common.DefaultFlapDamper.Load(p.FlapDamping)
+	if err := common.DefaultPlugins.Load(p.Plugins); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if p.Mode == common.ModePlugin {
+		if _, err := common.DefaultPlugins.Get(p.ProviderPlugin, common.PluginTypeProvider); err != nil {
+			common.Exit(common.ExitConfigError, errors.New("providerplugin: "+err.Error()))
+		}
+	}
+	if err := common.DefaultHealthChecks.Load(p); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	ipam, err := common.NewIpam(p.Ipam)
+	if err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	common.DefaultIpam = ipam
+	if err := common.DefaultKafka.Load(p.Kafka); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if err := common.DefaultExternalDns.Load(p.ExternalDns); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if err := common.DefaultSlo.Load(p.Slo, p.FailoverBudget); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if err := common.DefaultSafety.Load(p.Safety); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if err := common.DefaultFlags.Load(p.FeatureFlags); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if err := common.DefaultProber.Load(p.Probe, p); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if err := common.DefaultTraffic.Load(p.Traffic, p.VipIps()); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	if err := common.DefaultCapture.Load(p.Capture); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
+	//loadbalancer及gateway会删除本机上不由自己持有的pool地址，pool不能重叠
+	if p.LoadBalancer.Class != "" && p.Gateway.Class != "" {
+		for _, vip := range p.Gateway.Pool {
+			if ok, _ := common.Contain(vip, p.LoadBalancer.Pool); ok {
+				common.Exit(common.ExitConfigError, errors.New("gateway.pool address "+vip+" is also in loadbalancer.pool"))
+			}
+		}
+	}
+	switch p.Metrics.Backend {
+	case "", common.MetricsBackendPrometheus, common.MetricsBackendStatsd:
+	default:
+		common.Exit(common.ExitConfigError, errors.New("metrics.backend must be prometheus or statsd"))
+	}
+
+	//心跳发布及校验都需要签名密钥
+	heartbeat := p.Heartbeat.Url != ""
+	for _, c := range p.HealthChecks {
+		heartbeat = heartbeat || c.Type == common.HealthCheckHeartbeat
+	}
+	if heartbeat {
+		if _, err := common.NewHeartbeatKeys(p.Heartbeat); err != nil {
+			common.Exit(common.ExitConfigError, err)
+		}
+		//读取方重启后重放窗口为空，按时间戳拒绝被写回的旧心跳
+		if p.Heartbeat.MaxAge == 0 {
+			p.Heartbeat.MaxAge = 300
+		}
+	}
+
+	for _, region := range p.Regions {
+		if !common.SignerSupported(region.Signer) {
+			common.Exit(common.ExitConfigError, errors.New("signer "+region.Signer+" of region "+region.RangId+" is not supported by this build"))
+		}
+	}
+
+	if p.ClockSkew.MaxSkew == 0 {
+		p.ClockSkew.MaxSkew = 60
+	}
+
+	if p.ClockSkew.CheckInterval <= 0 {
+		p.ClockSkew.CheckInterval = 300
+	}
+
+	if p.Concurrency <= 0 {
+		p.Concurrency = 4
+	}
+
+	if p.Startuptimeout <= 0 {
+		p.Startuptimeout = 30
 	}
 
 	if p.Pollinginterval <= 5 {
 		p.Pollinginterval = 5
 	}
+	if p.SnapshotMaxAge <= 0 {
+		p.SnapshotMaxAge = 5
+	}
+	if err := common.DefaultBackpressure.Load(p.AdaptiveInterval, p.Pollinginterval); err != nil {
+		common.Exit(common.ExitConfigError, err)
+	}
 }
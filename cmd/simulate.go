@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/jiashiwen/vipsidecar/pkg/simulator"
+	"github.com/spf13/cobra"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+//运行故障转移场景文件，检查不变式是否按预期成立，用于验证状态机在健康抖动、接口错误、节点故障、时钟跳变下的行为
+var simulateCmd = &cobra.Command{
+	Use:   "simulate <scenario.yaml>...",
+	Short: "Run scripted failover scenarios against the vip state machine and check invariants",
+	Run: func(cmd *cobra.Command, args []string) {
+		if len(args) == 0 {
+			cmd.Help()
+			return
+		}
+		verbose, _ := cmd.Flags().GetBool("verbose")
+		jsonoutput, _ := cmd.Flags().GetBool("json")
+		//状态机的转换日志由trace代替
+		log.SetOutput(ioutil.Discard)
+		failed := false
+		results := []*simulator.Result{}
+		for _, path := range args {
+			scenario, err := simulator.LoadScenario(path)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			result, err := simulator.Run(scenario)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			passed := result.Passed(scenario)
+			failed = failed || !passed
+			results = append(results, result)
+			if jsonoutput {
+				continue
+			}
+			verdict := "PASS"
+			if !passed {
+				verdict = "FAIL"
+			}
+			fmt.Printf("%s %s: %d failovers, %d violations, expected %v\n", verdict, scenario.Name, result.Failovers, len(result.Violations), scenario.Expect)
+			lines := result.Trace
+			if !verbose {
+				lines = []string{}
+				for _, v := range result.Violations {
+					lines = append(lines, v.String())
+				}
+			}
+			for _, line := range lines {
+				fmt.Println("    " + line)
+			}
+		}
+		if jsonoutput {
+			data, _ := json.MarshalIndent(results, "", "  ")
+			fmt.Println(string(data))
+		}
+		if failed {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	simulateCmd.Flags().BoolP("verbose", "v", false, "print the full trace of each scenario")
+	simulateCmd.Flags().Bool("json", false, "output results as json")
+	rootCmd.AddCommand(simulateCmd)
+}
@@ -0,0 +1,299 @@
+package common
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//管理接口角色，viewer只能读取，operator可以执行修改类调用
+const (
+	RoleViewer   string = "viewer"
+	RoleOperator string = "operator"
+)
+
+//管理接口版本前缀
+const AdminApiPrefix string = "/v1"
+
+//管理接口，与metrics共用metricsaddr
+//配置了admin.tokens或admin.clientca时启用认证，每个接口按角色授权，修改类调用写入审计记录
+type AdminServer struct {
+	addr   string
+	config JdAdmin
+	mux    *http.ServeMux
+	audit  *log.Logger
+	mutex  sync.Mutex
+	//已注册的路径及所需角色，不需要认证的路径角色为空，用于生成/openapi.json
+	routes map[string]string
+	//admin.allowcidrs解析后的结果
+	allowed []*net.IPNet
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_admin_rejected_total", MetricCounter, "Admin and metrics requests rejected by admin.allowcidrs or admin.allowprincipals.")
+}
+
+//解析admin.allowcidrs，单个地址按/32(ipv6为/128)处理
+func ParseAllowCidrs(entries []string) ([]*net.IPNet, error) {
+	cidrs := []*net.IPNet{}
+	for _, entry := range entries {
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, errors.New("admin.allowcidrs: invalid address " + entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, errors.New("admin.allowcidrs: " + err.Error())
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
+}
+
+//一次修改类管理调用的审计记录
+type AuditRecord struct {
+	Time      time.Time `json:"time"`
+	Principal string    `json:"principal"`
+	Role      string    `json:"role"`
+	Method    string    `json:"method"`
+	Path      string    `json:"path"`
+	Remote    string    `json:"remote"`
+	Status    int       `json:"status"`
+}
+
+func NewAdminServer(p *Parameters) *AdminServer {
+	a := &AdminServer{addr: p.MetricsAddr, config: p.Admin, mux: http.NewServeMux(), routes: make(map[string]string)}
+	a.allowed, _ = ParseAllowCidrs(p.Admin.AllowCidrs)
+	a.audit = log.New(os.Stderr, "audit ", log.LstdFlags)
+	if p.Admin.AuditLog != "" {
+		f, err := os.OpenFile(p.Admin.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			log.Println("open audit log", err)
+		} else {
+			a.audit = log.New(f, "", 0)
+		}
+	}
+	return a
+}
+
+//注册内置接口：/metrics、/healthz、/openapi.json及/v1/status、/v1/status/watch、/v1/history，debug为true时注册/debug/pprof及/debug/vars
+///status、/history为兼容旧版本保留的别名，/healthz供探针使用，与/openapi.json一样不需要认证
+func (a *AdminServer) RegisterDefaults(debug bool) {
+	a.handlePublic("/healthz", DefaultSelfChecks)
+	a.RegisterOpenApi()
+	a.Handle("/metrics", RoleViewer, DefaultMetrics)
+	a.Handle(AdminApiPrefix+"/status", RoleViewer, DefaultStatus)
+	a.Handle(AdminApiPrefix+"/status/watch", RoleViewer, DefaultStatusWatch)
+	a.Handle(AdminApiPrefix+"/history", RoleViewer, DefaultHistory)
+	a.Handle("/status", RoleViewer, DefaultStatus)
+	a.Handle("/history", RoleViewer, DefaultHistory)
+	if debug {
+		debugmux := http.NewServeMux()
+		registerDebugHandlers(debugmux)
+		a.Handle("/debug/", RoleOperator, debugmux)
+	}
+}
+
+//注册接口，调用方需要具备role
+func (a *AdminServer) Handle(path string, role string, handler http.Handler) {
+	a.mutex.Lock()
+	a.routes[path] = role
+	a.mutex.Unlock()
+	a.mux.Handle(path, a.authorize(role, handler))
+}
+
+//注册不需要认证的接口
+func (a *AdminServer) handlePublic(path string, handler http.Handler) {
+	a.mutex.Lock()
+	a.routes[path] = ""
+	a.mutex.Unlock()
+	a.mux.Handle(path, handler)
+}
+
+func (a *AdminServer) HandleFunc(path string, role string, handler func(http.ResponseWriter, *http.Request)) {
+	a.Handle(path, role, http.HandlerFunc(handler))
+}
+
+func (a *AdminServer) authEnabled() bool {
+	return len(a.config.Tokens) > 0 || a.config.ClientCa != ""
+}
+
+//识别调用方，返回名称及角色
+func (a *AdminServer) authenticate(r *http.Request) (string, string, error) {
+	if !a.authEnabled() {
+		return "anonymous", RoleOperator, nil
+	}
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token := strings.TrimPrefix(auth, "Bearer ")
+		for _, t := range a.config.Tokens {
+			if subtle.ConstantTimeCompare([]byte(t.Token), []byte(token)) == 1 {
+				return t.Name, t.Role, nil
+			}
+		}
+		return "", "", errors.New("invalid token")
+	}
+	//客户端证书已由tls层校验
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 {
+		cn := r.TLS.VerifiedChains[0][0].Subject.CommonName
+		role := a.config.CertRoles[cn]
+		if role == "" {
+			role = RoleViewer
+		}
+		return "cert:" + cn, role, nil
+	}
+	return "", "", errors.New("missing credentials")
+}
+
+func roleAllows(have string, need string) bool {
+	return have == RoleOperator || have == need
+}
+
+func (a *AdminServer) authorize(role string, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principal, have, err := a.authenticate(r)
+		mutating := r.Method != "GET" && r.Method != "HEAD"
+		need := role
+		if mutating {
+			need = RoleOperator
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		switch {
+		case err != nil:
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(recorder, err.Error(), http.StatusUnauthorized)
+		case !a.principalAllowed(principal):
+			DefaultMetrics.Add("vipsidecar_admin_rejected_total", map[string]string{"reason": "principal"}, 1)
+			http.Error(recorder, principal+" is not in admin.allowprincipals", http.StatusForbidden)
+		case !roleAllows(have, need):
+			http.Error(recorder, "role "+have+" is not allowed, "+need+" required", http.StatusForbidden)
+		default:
+			handler.ServeHTTP(recorder, r)
+		}
+		if mutating {
+			a.record(AuditRecord{Time: time.Now(), Principal: principal, Role: have, Method: r.Method, Path: r.URL.Path, Remote: r.RemoteAddr, Status: recorder.status})
+		}
+	})
+}
+
+//未启用认证时调用方为anonymous，allowprincipals不为空时拒绝
+func (a *AdminServer) principalAllowed(principal string) bool {
+	if len(a.config.AllowPrincipals) == 0 {
+		return true
+	}
+	ok, _ := Contain(principal, a.config.AllowPrincipals)
+	return ok
+}
+
+//来源地址不在admin.allowcidrs中时拒绝，/healthz供节点上的探针使用，不受限制
+func (a *AdminServer) filter(handler http.Handler) http.Handler {
+	if len(a.allowed) == 0 {
+		return handler
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/healthz" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if ip := net.ParseIP(host); err == nil && ip != nil {
+			for _, cidr := range a.allowed {
+				if cidr.Contains(ip) {
+					handler.ServeHTTP(w, r)
+					return
+				}
+			}
+		}
+		DefaultMetrics.Add("vipsidecar_admin_rejected_total", map[string]string{"reason": "cidr"}, 1)
+		http.Error(w, "source address "+host+" is not in admin.allowcidrs", http.StatusForbidden)
+	})
+}
+
+func (a *AdminServer) record(rec AuditRecord) {
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.audit.Println(string(line))
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (s *statusRecorder) WriteHeader(status int) {
+	s.status = status
+	s.ResponseWriter.WriteHeader(status)
+}
+
+//流式接口需要逐条刷新
+func (s *statusRecorder) Flush() {
+	if flusher, ok := s.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+//读取PEM格式的CA证书，文件中没有可用的证书时返回错误
+func LoadCaPool(path string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New(path + " contains no PEM certificates")
+	}
+	return pool, nil
+}
+
+//启动管理接口，配置了tlscert时使用https，配置了clientca时校验客户端证书
+func (a *AdminServer) Start() {
+	if a.addr == "" {
+		return
+	}
+	//监听所有地址(如hostNetwork节点)且既没有认证也没有来源限制时，任何能访问节点的客户端都可以调用修改类接口
+	if host, _, err := net.SplitHostPort(a.addr); err == nil && (host == "" || net.ParseIP(host).IsUnspecified()) && !a.authEnabled() && len(a.allowed) == 0 {
+		log.Println("warning: admin api on", a.addr, "listens on all addresses without admin.tokens, admin.clientca or admin.allowcidrs")
+	}
+	server := &http.Server{Addr: a.addr, Handler: a.filter(a.mux)}
+	if a.config.ClientCa != "" {
+		//启动时已检查，之后文件被删除或改坏时同样以配置错误退出，不在没有管理接口的情况下继续运行
+		pool, err := LoadCaPool(a.config.ClientCa)
+		if err != nil {
+			Exit(ExitConfigError, errors.New("admin.clientca: "+err.Error()))
+		}
+		//携带token的请求可以不提供证书
+		server.TLSConfig = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	}
+	go func() {
+		var err error
+		if a.config.TlsCert != "" {
+			err = server.ListenAndServeTLS(a.config.TlsCert, a.config.TlsKey)
+		} else {
+			err = server.ListenAndServe()
+		}
+		if err != nil {
+			log.Println("admin server", err)
+		}
+	}()
+}
@@ -0,0 +1,140 @@
+package common
+
+import (
+	"fmt"
+	"strings"
+)
+
+//错误原因，机器可读，用于重试策略及status
+const (
+	ReasonThrottled       string = "Throttled"
+	ReasonNotFound        string = "NotFound"
+	ReasonConflict        string = "Conflict"
+	ReasonAuthExpired     string = "AuthExpired"
+	ReasonQuotaExceeded   string = "QuotaExceeded"
+	ReasonServerError     string = "ServerError"
+	ReasonInvalid         string = "Invalid"
+	ReasonUnavailable     string = "Unavailable"
+	ReasonClockSkew       string = "ClockSkew"
+	ReasonForbidden       string = "Forbidden"
+	ReasonAddressConflict string = "AddressConflict"
+	ReasonNotReserved     string = "NotReserved"
+	ReasonSafetyHalt      string = "SafetyHalt"
+	ReasonStaleEpoch      string = "StaleEpoch"
+	ReasonFlagDisabled    string = "FlagDisabled"
+)
+
+//云上接口返回的错误，携带x-jdcloud-request-id便于向京东云提交工单
+type ApiError struct {
+	RequestId string
+	Code      int
+	Status    string
+	Message   string
+}
+
+func (e *ApiError) Error() string {
+	return fmt.Sprintf("%s: %s (reason %s, requestId %s)", e.Status, e.Message, e.Reason(), e.RequestId)
+}
+
+//根据京东云错误码(http状态码)及status解析错误原因
+func (e *ApiError) Reason() string {
+	status := strings.ToUpper(e.Status)
+	switch {
+	case status == "CLOCK_SKEW":
+		return ReasonClockSkew
+	case status == "ADDRESS_CONFLICT":
+		return ReasonAddressConflict
+	case status == "NOT_RESERVED":
+		return ReasonNotReserved
+	case status == "SAFETY_HALT":
+		return ReasonSafetyHalt
+	case status == "STALE_EPOCH":
+		return ReasonStaleEpoch
+	case strings.Contains(status, "QUOTA") || strings.Contains(strings.ToLower(e.Message), "quota"):
+		return ReasonQuotaExceeded
+	case e.Code == 429 || status == "RESOURCE_EXHAUSTED" || status == "TOO_MANY_REQUESTS":
+		return ReasonThrottled
+	case e.Code == 401 || status == "UNAUTHENTICATED" || strings.Contains(status, "SIGNATURE"):
+		return ReasonAuthExpired
+	case e.Code == 403 || status == "PERMISSION_DENIED" || status == "FORBIDDEN":
+		return ReasonForbidden
+	case e.Code == 404 || status == "NOT_FOUND":
+		return ReasonNotFound
+	case e.Code == 409 || status == "ALREADY_EXISTS" || status == "ABORTED" || status == "CONFLICT":
+		return ReasonConflict
+	case e.Code >= 500:
+		return ReasonServerError
+	default:
+		return ReasonInvalid
+	}
+}
+
+//本地配额检查失败时构造的错误，不经过云上接口
+func NewQuotaExceededError(message string) error {
+	return &ApiError{Code: 400, Status: "QUOTA_EXCEEDED", Message: message}
+}
+
+//本机时钟偏差过大时构造的错误，修改类操作被暂停
+func NewClockSkewError(message string) error {
+	return &ApiError{Code: 400, Status: "CLOCK_SKEW", Message: message}
+}
+
+//重复地址检测发现其他主机持有vip时构造的错误
+func NewAddressConflictError(message string) error {
+	return &ApiError{Code: 409, Status: "ADDRESS_CONFLICT", Message: message}
+}
+
+//IPAM/CMDB中vip未预留给本服务时构造的错误
+func NewNotReservedError(message string) error {
+	return &ApiError{Code: 409, Status: "NOT_RESERVED", Message: message}
+}
+
+//vip指定的region中没有本机网卡时构造的错误，不能跨region绑定
+func NewRegionMismatchError(message string) error {
+	return &ApiError{Code: 400, Status: "REGION_MISMATCH", Message: message}
+}
+
+//安全不变式被违反后修改类操作被停止时构造的错误
+func NewSafetyHaltError(message string) error {
+	return &ApiError{Code: 409, Status: "SAFETY_HALT", Message: message}
+}
+
+//修改操作携带的epoch已被新的绑定或释放取代时构造的错误
+func NewStaleEpochError(message string) error {
+	return &ApiError{Code: 409, Status: "STALE_EPOCH", Message: message}
+}
+
+//获取错误对应的requestId，非接口错误返回空
+func RequestIdOf(err error) string {
+	if apierr, ok := err.(*ApiError); ok {
+		return apierr.RequestId
+	}
+	return ""
+}
+
+//获取错误原因，非接口错误(网络等)视为Unavailable
+func ReasonOf(err error) string {
+	if err == nil {
+		return ""
+	}
+	if apierr, ok := err.(*ApiError); ok {
+		return apierr.Reason()
+	}
+	return ReasonUnavailable
+}
+
+func IsThrottled(err error) bool        { return ReasonOf(err) == ReasonThrottled }
+func IsNotFound(err error) bool         { return ReasonOf(err) == ReasonNotFound }
+func IsConflict(err error) bool         { return ReasonOf(err) == ReasonConflict }
+func IsAuthExpired(err error) bool      { return ReasonOf(err) == ReasonAuthExpired }
+func IsQuotaExceeded(err error) bool    { return ReasonOf(err) == ReasonQuotaExceeded }
+func IsPermissionDenied(err error) bool { return ReasonOf(err) == ReasonForbidden }
+
+//可重试的错误：限流、服务端错误及网络不可达
+func IsRetryable(err error) bool {
+	switch ReasonOf(err) {
+	case ReasonThrottled, ReasonServerError, ReasonUnavailable:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,92 @@
+package common
+
+import (
+	"errors"
+	"log"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_apply_rollbacks_total", MetricCounter, "Binds rolled back after a required step failed, step is the failed step, result=ok or error.")
+}
+
+//绑定过程中已完成的步骤及其补偿操作
+type applyStep struct {
+	name string
+	undo func() error
+}
+
+//分步执行vip的绑定：必需步骤失败时按相反顺序执行已完成步骤的补偿操作，使vip回到绑定前的状态
+//补偿失败时vip处于部分配置的状态，由调用方标记为Degraded并记录失败的步骤
+type ApplyPlan struct {
+	vip  string
+	done []applyStep
+}
+
+//步骤失败的详情，Err为步骤返回的原始错误
+type ApplyError struct {
+	Step     string
+	Err      error
+	Rollback string
+	Undo     error
+}
+
+func (e *ApplyError) Error() string {
+	msg := e.Step + " failed: " + e.Err.Error()
+	if e.Undo != nil {
+		msg += ", rollback of " + e.Rollback + " failed: " + e.Undo.Error()
+	}
+	return msg
+}
+
+func NewApplyPlan(vip string) *ApplyPlan {
+	return &ApplyPlan{vip: vip}
+}
+
+//执行必需步骤，undo为nil表示该步骤无需补偿，失败时回滚已完成的步骤并返回*ApplyError
+func (p *ApplyPlan) Step(name string, do func() error, undo func() error) error {
+	err := do()
+	if err == nil {
+		if undo != nil {
+			p.done = append(p.done, applyStep{name: name, undo: undo})
+		}
+		return nil
+	}
+	applyerr := &ApplyError{Step: name, Err: err}
+	if len(p.done) == 0 {
+		return applyerr
+	}
+	log.Println("bind", p.vip, name, "failed, rolling back", err)
+	result := "ok"
+	for i := len(p.done) - 1; i >= 0; i-- {
+		if undo := p.done[i].undo(); undo != nil {
+			log.Println("bind", p.vip, "rollback of", p.done[i].name, "failed", undo)
+			applyerr.Rollback, applyerr.Undo, result = p.done[i].name, undo, "error"
+			break
+		}
+	}
+	p.done = nil
+	DefaultMetrics.Add("vipsidecar_apply_rollbacks_total", map[string]string{"step": name, "result": result}, 1)
+	return applyerr
+}
+
+//可选步骤，失败时不回滚，返回的错误用于将vip标记为Degraded
+func (p *ApplyPlan) Optional(name string, do func() error) error {
+	if err := do(); err != nil {
+		return &ApplyError{Step: name, Err: err}
+	}
+	return nil
+}
+
+//必需步骤失败后更新vip状态：已回滚时Failed，补偿失败时Degraded并记录失败的步骤
+func (p *ApplyPlan) Fail(states *VipStateMachine, err error, requestid string) {
+	var applyerr *ApplyError
+	if !errors.As(err, &applyerr) {
+		states.Fail(p.vip, ReasonOf(err), requestid)
+		return
+	}
+	if applyerr.Undo != nil {
+		states.Degrade(p.vip, applyerr.Error())
+		return
+	}
+	states.Fail(p.vip, ReasonOf(applyerr.Err), requestid)
+}
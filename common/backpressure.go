@@ -0,0 +1,110 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_reconcile_interval_seconds", MetricGauge, "Current interval of the routine reconcile, adapted to cloud API backpressure when adaptiveinterval is enabled.")
+	DefaultMetrics.Register("vipsidecar_api_latency_seconds_total", MetricCounter, "Total time spent in cloud API calls.")
+	DefaultMetrics.Register("vipsidecar_api_calls_total", MetricCounter, "Cloud API calls, including failed ones.")
+}
+
+//根据云上接口的限流及延迟调整周期性reconcile的间隔：上一周期内出现限流或平均延迟超过latency时间隔加倍，
+//延迟低于latency一半时每周期缩短四分之一，始终在[min, max]内。云上变化检测的间隔按相同比例缩放
+type Backpressure struct {
+	mutex     sync.Mutex
+	config    JdAdaptiveInterval
+	base      time.Duration
+	current   time.Duration
+	calls     int
+	throttled int
+	latency   time.Duration
+}
+
+var DefaultBackpressure = &Backpressure{}
+
+//base为pollinginterval，未启用时间隔固定为base
+func (b *Backpressure) Load(config JdAdaptiveInterval, base int) error {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Min <= 0 {
+		config.Min = base
+	}
+	if config.Max <= 0 {
+		config.Max = 10 * base
+	}
+	if config.Min > config.Max {
+		return errors.New("adaptiveinterval.min must not be larger than adaptiveinterval.max")
+	}
+	if config.Latency <= 0 {
+		config.Latency = 2000
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.config, b.base = config, time.Duration(base)*time.Second
+	b.current = b.base
+	return nil
+}
+
+//记录一次云上接口调用
+func (b *Backpressure) Observe(err error, latency time.Duration) {
+	DefaultMetrics.Add("vipsidecar_api_calls_total", nil, 1)
+	DefaultMetrics.Add("vipsidecar_api_latency_seconds_total", nil, latency.Seconds())
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.calls++
+	b.latency += latency
+	if IsThrottled(err) {
+		b.throttled++
+	}
+}
+
+//根据上一周期的调用结果计算下一次周期性reconcile前的等待时间
+func (b *Backpressure) Next(base time.Duration) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.config.Enabled {
+		DefaultMetrics.Set("vipsidecar_reconcile_interval_seconds", nil, base.Seconds())
+		return base
+	}
+	previous := b.current
+	min, max := time.Duration(b.config.Min)*time.Second, time.Duration(b.config.Max)*time.Second
+	threshold := time.Duration(b.config.Latency) * time.Millisecond
+	if b.calls > 0 {
+		average := b.latency / time.Duration(b.calls)
+		switch {
+		case b.throttled > 0 || average > threshold:
+			b.current *= 2
+		case average < threshold/2:
+			b.current -= b.current / 4
+		}
+	}
+	b.current = b.current.Round(time.Second)
+	if b.current > max {
+		b.current = max
+	}
+	if b.current < min {
+		b.current = min
+	}
+	if b.current != previous {
+		log.Println("reconcile interval", previous, "->", b.current, "calls", b.calls, "throttled", b.throttled)
+	}
+	b.calls, b.throttled, b.latency = 0, 0, 0
+	DefaultMetrics.Set("vipsidecar_reconcile_interval_seconds", nil, b.current.Seconds())
+	return b.current
+}
+
+//按当前间隔与pollinginterval的比例缩放其他轮询云上接口的间隔
+func (b *Backpressure) Scale(interval time.Duration) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if !b.config.Enabled || b.base <= 0 {
+		return interval
+	}
+	return time.Duration(float64(interval) * float64(b.current) / float64(b.base))
+}
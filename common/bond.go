@@ -0,0 +1,61 @@
+package common
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+//bond/team设备当前的活动成员接口，非bond/team设备或无法获取时返回空
+//bond从sysfs读取，team通过teamdctl查询
+func activeSlave(ifname string) string {
+	if data, err := ioutil.ReadFile("/sys/class/net/" + ifname + "/bonding/active_slave"); err == nil {
+		return strings.TrimSpace(string(data))
+	}
+	if _, err := os.Stat("/sys/class/net/" + ifname + "/bonding"); err == nil {
+		return ""
+	}
+	if _, err := exec.LookPath("teamdctl"); err != nil {
+		return ""
+	}
+	out, err := exec.Command("teamdctl", ifname, "state", "item", "get", "runner.active_port").Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(out))
+}
+
+//所有bond/team设备及其活动成员
+func activeSlaves() map[string]string {
+	slaves := make(map[string]string)
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return slaves
+	}
+	for _, iface := range interfaces {
+		if slave := activeSlave(iface.Name); slave != "" {
+			slaves[iface.Name] = slave
+		}
+	}
+	return slaves
+}
+
+//周期性检查bond/team活动成员，发生切换时调用onchange重新发送免费arp
+func WatchBondFailover(interval time.Duration, onchange func(bond string, from string, to string)) {
+	last := activeSlaves()
+	for {
+		time.Sleep(interval)
+		current := activeSlaves()
+		for bond, slave := range current {
+			if previous, ok := last[bond]; ok && previous != slave {
+				log.Println("bond", bond, "active slave changed", previous, "->", slave)
+				onchange(bond, previous, slave)
+			}
+		}
+		last = current
+	}
+}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//单次故障转移的时间预算，决定转移后各步骤(解绑、绑定、校验等)共用
+//剩余时间不足时跳过可选步骤、不再重试，超出预算单独计数
+type Budget struct {
+	name     string
+	mode     string
+	total    time.Duration
+	deadline time.Time
+	start    time.Time
+	fence    func() error
+	//各阶段累计耗时，Finish时输出到vipsidecar_failover_phase_seconds
+	phase   string
+	entered time.Time
+	phases  map[string]time.Duration
+}
+
+//故障转移的阶段
+const (
+	//事件加入队列到开始处理
+	PhaseDetect string = "detect"
+	//开始处理到决定由本机接管(查询云上状态、接管条件检查)
+	PhaseElect string = "elect"
+	//确认没有其他持有者(epoch、地址冲突检测、IPAM、strict模式下的持有者检查)
+	PhaseFence string = "fence"
+	//解除其他网卡/云主机上的绑定
+	PhaseCloudDetach string = "cloud-detach"
+	//绑定到本机(含等待挂载完成)
+	PhaseCloudAttach string = "cloud-attach"
+	//本机配置(启用接口、路由、策略路由)
+	PhasePlumb string = "plumb"
+	//免费arp、dns切换
+	PhaseAnnounce string = "announce"
+	//校验云上绑定
+	PhaseVerify string = "verify"
+)
+
+//超出预算的故障转移，通过/v1/status暴露
+type BudgetOverrun struct {
+	Time     time.Time `json:"time"`
+	Vip      string    `json:"vip"`
+	Budget   float64   `json:"budgetSeconds"`
+	Duration float64   `json:"durationSeconds"`
+}
+
+//校验步骤预计耗时
+const verifyStepTime = 2 * time.Second
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_failover_budget_overruns_total", MetricCounter, "Failovers that took longer than failoverbudget.")
+	DefaultMetrics.Register("vipsidecar_failover_steps_skipped_total", MetricCounter, "Optional failover steps skipped because the budget was running out.")
+	DefaultMetrics.RegisterHistogram("vipsidecar_failover_phase_seconds", "Time spent in each phase of a failover.", []float64{0.1, 0.25, 0.5, 1, 2, 5, 10, 20, 30, 60})
+}
+
+//total为0时不限制
+func NewBudget(name string, mode string, total time.Duration) *Budget {
+	b := &Budget{name: name, mode: mode, total: total, start: time.Now(), phases: map[string]time.Duration{}}
+	if total > 0 {
+		b.deadline = b.start.Add(total)
+	}
+	return b
+}
+
+//ctx为EventQueue.Begin创建时记录detect阶段，并从开始处理事件起计入elect阶段
+func (b *Budget) Track(ctx context.Context) {
+	if b == nil {
+		return
+	}
+	t, ok := ctx.Value(eventTimeKey{}).(eventTime)
+	if !ok {
+		return
+	}
+	b.phases[PhaseDetect] = t.started.Sub(t.pushed)
+	b.phase, b.entered = PhaseElect, t.started
+}
+
+//进入下一阶段，之前阶段的耗时累计到该阶段，同一阶段可多次进入
+func (b *Budget) Enter(phase string) {
+	if b == nil {
+		return
+	}
+	now := time.Now()
+	if b.phase != "" {
+		b.phases[b.phase] += now.Sub(b.entered)
+	}
+	b.phase, b.entered = phase, now
+}
+
+//可选步骤预计耗时need，剩余时间不足时跳过
+func (b *Budget) Allow(step string, need time.Duration) bool {
+	if b == nil || b.deadline.IsZero() {
+		return true
+	}
+	remaining := time.Until(b.deadline)
+	if remaining >= need {
+		return true
+	}
+	log.Println("failover", b.name, "skipping", step, "remaining budget", remaining)
+	DefaultMetrics.Add("vipsidecar_failover_steps_skipped_total", map[string]string{"step": step}, 1)
+	return false
+}
+
+//deadline与预算截止时间中较早的一个，用于限制轮询等不经过RetryPolicy的等待
+func (b *Budget) Limit(deadline time.Time) time.Time {
+	if b == nil || b.deadline.IsZero() || deadline.Before(b.deadline) {
+		return deadline
+	}
+	return b.deadline
+}
+
+//本次故障转移的fencing token检查，epoch失效后不再调用修改类接口
+func (b *Budget) SetFence(fence func() error) {
+	if b != nil {
+		b.fence = fence
+	}
+}
+
+//预算内使用的重试策略，退避时间超出预算或epoch失效时不再重试
+func (b *Budget) RetryPolicy() RetryPolicy {
+	policy := DefaultRetryPolicy
+	if b != nil {
+		policy.Deadline, policy.Fence = b.deadline, b.fence
+	}
+	return policy
+}
+
+//故障转移结束，记录各阶段耗时，超出预算时计数并记录
+func (b *Budget) Finish() {
+	if b == nil {
+		return
+	}
+	b.Enter("")
+	for phase, elapsed := range b.phases {
+		DefaultMetrics.Observe("vipsidecar_failover_phase_seconds", map[string]string{"mode": b.mode, "phase": phase}, elapsed.Seconds())
+	}
+	DefaultPhaseLatencies.Record(b.mode, b.phases)
+	if b.deadline.IsZero() {
+		return
+	}
+	elapsed := time.Since(b.start)
+	if elapsed <= b.total {
+		return
+	}
+	log.Println("failover", b.name, "took", elapsed, "exceeding budget", b.total)
+	DefaultMetrics.Add("vipsidecar_failover_budget_overruns_total", map[string]string{"mode": b.mode}, 1)
+	DefaultStatus.SetBudgetOverrun(&BudgetOverrun{Time: time.Now(), Vip: b.name, Budget: b.total.Seconds(), Duration: elapsed.Seconds()})
+}
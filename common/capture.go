@@ -0,0 +1,130 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_captures_total", MetricCounter, "Packet captures taken when a failover started, by result.")
+}
+
+//故障转移开始(vip进入Acquiring)时在vip所在网段的接口上抓取duration秒内与vip有关的arp及ipv4报文，
+//用于事后分析免费arp的传播问题。每个报文最多保留snaplen字节，单个文件不超过maxbytes，dir中只保留最近keep个文件
+type PacketCapture struct {
+	mutex    sync.Mutex
+	config   JdCapture
+	inflight map[string]bool
+}
+
+var DefaultCapture = &PacketCapture{inflight: map[string]bool{}}
+
+//pcap文件名前缀，轮转时只删除此前缀的文件
+const capturePrefix = "vipsidecar-"
+
+func (c *PacketCapture) Load(config JdCapture) error {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Dir == "" {
+		return errors.New("capture.dir must be set when capture is enabled")
+	}
+	if config.Duration <= 0 {
+		config.Duration = 5
+	}
+	if config.SnapLen <= 0 {
+		config.SnapLen = 256
+	}
+	if config.MaxBytes <= 0 {
+		config.MaxBytes = 1 << 20
+	}
+	if config.Keep <= 0 {
+		config.Keep = 10
+	}
+	if err := os.MkdirAll(config.Dir, 0700); err != nil {
+		return errors.New("capture.dir: " + err.Error())
+	}
+	//抓包需要NET_RAW，缺少时只关闭抓包，不影响故障转移
+	if !canCapture() {
+		log.Println("packet capture disabled, CAP_NET_RAW is not effective")
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.config = config
+	return nil
+}
+
+func (c *PacketCapture) OnTransition(vip string, from VipState, to VipState) {
+	if to != StateAcquiring {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.config.Enabled || c.inflight[vip] {
+		return
+	}
+	c.inflight[vip] = true
+	go c.capture(vip, c.config)
+}
+
+func (c *PacketCapture) capture(vip string, config JdCapture) {
+	defer func() {
+		c.mutex.Lock()
+		delete(c.inflight, vip)
+		c.mutex.Unlock()
+	}()
+	result := "ok"
+	if err := c.write(vip, config); err != nil {
+		log.Println("capture of", vip, "failed", err)
+		result = "error"
+	}
+	DefaultMetrics.Add("vipsidecar_captures_total", map[string]string{"result": result}, 1)
+	c.rotate(config)
+}
+
+func (c *PacketCapture) write(vip string, config JdCapture) error {
+	ip := net.ParseIP(vip)
+	names := SubnetInterfaces(ip)
+	if len(names) == 0 {
+		return errors.New("no interface in the subnet of " + vip)
+	}
+	name := capturePrefix + strings.Replace(vip, ":", "_", -1) + "-" + time.Now().UTC().Format("20060102T150405Z") + ".pcap"
+	f, err := os.OpenFile(filepath.Join(config.Dir, name), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	packets, err := capturePackets(names[0], ip, time.Duration(config.Duration)*time.Second, config.SnapLen, config.MaxBytes, f)
+	log.Println("captured", packets, "packets of", vip, "on", names[0], "to", f.Name())
+	return err
+}
+
+//按文件名(含时间)排序，删除最旧的文件直到只剩keep个
+func (c *PacketCapture) rotate(config JdCapture) {
+	infos, err := ioutil.ReadDir(config.Dir)
+	if err != nil {
+		return
+	}
+	files := []string{}
+	for _, info := range infos {
+		if strings.HasPrefix(info.Name(), capturePrefix) && strings.HasSuffix(info.Name(), ".pcap") {
+			files = append(files, info.Name())
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i][strings.LastIndex(files[i], "-"):] < files[j][strings.LastIndex(files[j], "-"):]
+	})
+	for len(files) > config.Keep {
+		os.Remove(filepath.Join(config.Dir, files[0]))
+		files = files[1:]
+	}
+}
@@ -0,0 +1,127 @@
+package common
+
+import (
+	"encoding/binary"
+	"errors"
+	"golang.org/x/sys/unix"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+func init() {
+	registerFeature("capture")
+}
+
+//CAP_NET_RAW的位
+const capNetRaw = 13
+
+//当前进程的有效capabilities中是否有CAP_NET_RAW
+func canCapture() bool {
+	data, err := ioutil.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			capeff, err := strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+			return err == nil && capeff&(1<<capNetRaw) != 0
+		}
+	}
+	return false
+}
+
+//只接受sender/target ip为vip的arp及源/目的地址为vip的ipv4报文，截断为snaplen字节
+func captureFilter(vip uint32, snaplen uint32) []unix.SockFilter {
+	const (
+		ldh = unix.BPF_LD | unix.BPF_H | unix.BPF_ABS
+		ldw = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		ret = unix.BPF_RET | unix.BPF_K
+	)
+	return []unix.SockFilter{
+		{Code: ldh, K: 12},                   //0 以太网类型
+		{Code: jeq, K: 0x0806, Jt: 0, Jf: 4}, //1 arp
+		{Code: ldw, K: 28},                   //2 sender ip
+		{Code: jeq, K: vip, Jt: 7, Jf: 0},    //3
+		{Code: ldw, K: 38},                   //4 target ip
+		{Code: jeq, K: vip, Jt: 5, Jf: 6},    //5
+		{Code: jeq, K: 0x0800, Jt: 0, Jf: 5}, //6 ipv4
+		{Code: ldw, K: 26},                   //7 源地址
+		{Code: jeq, K: vip, Jt: 2, Jf: 0},    //8
+		{Code: ldw, K: 30},                   //9 目的地址
+		{Code: jeq, K: vip, Jt: 0, Jf: 1},    //10
+		{Code: ret, K: snaplen},              //11
+		{Code: ret, K: 0},                    //12
+	}
+}
+
+//在接口上抓取duration内与vip有关的报文(含本机发出的)，以pcap格式写入w，写入maxbytes后提前结束，返回报文数
+func capturePackets(ifname string, vip net.IP, duration time.Duration, snaplen int, maxbytes int, w io.Writer) (int, error) {
+	ip4 := vip.To4()
+	if ip4 == nil {
+		return 0, errors.New("packet capture only supports ipv4 vips")
+	}
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return 0, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return 0, err
+	}
+	defer unix.Close(fd)
+	filter := captureFilter(binary.BigEndian.Uint32(ip4), uint32(snaplen))
+	prog := unix.SockFprog{Len: uint16(len(filter)), Filter: &filter[0]}
+	if _, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_SOCKET, unix.SO_ATTACH_FILTER, uintptr(unsafe.Pointer(&prog)), unsafe.Sizeof(prog), 0); errno != 0 {
+		return 0, errno
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}); err != nil {
+		return 0, err
+	}
+
+	//pcap文件头：版本2.4，链路类型1(以太网)
+	header := make([]byte, 24)
+	binary.LittleEndian.PutUint32(header[0:], 0xa1b2c3d4)
+	binary.LittleEndian.PutUint16(header[4:], 2)
+	binary.LittleEndian.PutUint16(header[6:], 4)
+	binary.LittleEndian.PutUint32(header[16:], uint32(snaplen))
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	written, packets := len(header), 0
+	deadline := time.Now().Add(duration)
+	buf := make([]byte, snaplen)
+	record := make([]byte, 16)
+	for written < maxbytes {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			break
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return packets, err
+		}
+		now := time.Now()
+		binary.LittleEndian.PutUint32(record[0:], uint32(now.Unix()))
+		binary.LittleEndian.PutUint32(record[4:], uint32(now.Nanosecond()/1000))
+		binary.LittleEndian.PutUint32(record[8:], uint32(n))
+		binary.LittleEndian.PutUint32(record[12:], uint32(n))
+		if _, err := w.Write(append(record, buf[:n]...)); err != nil {
+			return packets, err
+		}
+		written += len(record) + n
+		packets++
+	}
+	return packets, nil
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"errors"
+	"io"
+	"net"
+	"time"
+)
+
+func canCapture() bool {
+	return false
+}
+
+func capturePackets(ifname string, vip net.IP, duration time.Duration, snaplen int, maxbytes int, w io.Writer) (int, error) {
+	return 0, errors.New("packet capture is only supported on linux")
+}
@@ -0,0 +1,121 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//本机时钟与京东云endpoint的偏差，通过/status暴露
+type ClockSkewCondition struct {
+	CheckedAt time.Time `json:"checkedAt"`
+	Skew      float64   `json:"skewSeconds"`
+	Exceeded  bool      `json:"exceeded"`
+	Paused    bool      `json:"mutationsPaused"`
+	Message   string    `json:"message,omitempty"`
+}
+
+//时钟偏差检查，偏差过大时签名请求会被拒绝，可选择暂停所有修改类操作
+type ClockGuard struct {
+	mutex    sync.Mutex
+	maxskew  time.Duration
+	pause    bool
+	exceeded bool
+}
+
+var DefaultClockGuard = &ClockGuard{}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_clock_skew_seconds", MetricGauge, "Local clock minus the Date reported by the JD Cloud endpoint.")
+}
+
+//通过endpoint响应的Date头估算本机时钟偏差，精度为秒
+func MeasureClockSkew(url string) (time.Duration, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	start := time.Now()
+	resp, err := client.Head(url)
+	if err != nil {
+		return 0, err
+	}
+	resp.Body.Close()
+	rtt := time.Since(start)
+	servertime, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return 0, err
+	}
+	return start.Add(rtt / 2).Sub(servertime), nil
+}
+
+//按interval检查url的时钟偏差，maxskew为0时不检查
+func (g *ClockGuard) Run(url string, maxskew time.Duration, pause bool, interval time.Duration) {
+	if maxskew <= 0 {
+		return
+	}
+	g.mutex.Lock()
+	g.maxskew, g.pause = maxskew, pause
+	g.mutex.Unlock()
+	for {
+		g.Check(url)
+		time.Sleep(interval)
+	}
+}
+
+func (g *ClockGuard) Check(url string) {
+	skew, err := MeasureClockSkew(url)
+	condition := &ClockSkewCondition{CheckedAt: time.Now(), Skew: skew.Seconds()}
+	g.mutex.Lock()
+	if err != nil {
+		//无法获取服务端时间时保持上次结论
+		condition.Message = "clock skew check failed: " + err.Error()
+		condition.Exceeded = g.exceeded
+		DefaultSelfChecks.Report(SelfCheckCloudApi, err)
+	} else {
+		if skew < 0 {
+			skew = -skew
+		}
+		g.exceeded = skew > g.maxskew
+		condition.Exceeded = g.exceeded
+		if g.exceeded {
+			condition.Message = "local clock is off by " + skew.String() + ", signed requests will be rejected, fix NTP on this node"
+			DefaultSelfChecks.Report(SelfCheckClock, errors.New(condition.Message))
+		} else {
+			DefaultSelfChecks.Report(SelfCheckClock, nil)
+		}
+		DefaultMetrics.Set("vipsidecar_clock_skew_seconds", nil, condition.Skew)
+	}
+	condition.Paused = g.exceeded && g.pause
+	g.mutex.Unlock()
+	if condition.Message != "" {
+		log.Println(condition.Message)
+	}
+	DefaultStatus.SetClockSkew(condition)
+}
+
+//时钟偏差过大且配置了暂停时拒绝修改类操作
+func (g *ClockGuard) Allow(operation string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.exceeded && g.pause {
+		return NewClockSkewError(operation + " paused: local clock skew exceeds " + g.maxskew.String())
+	}
+	return nil
+}
+
+//用于检查时钟的地址，使用本机网卡所在region的vpc endpoint
+func ClockSkewUrl(p *Parameters) string {
+	scheme, endpoint := DefaultVpcScheme, DefaultVpcEndpoint
+	for _, region := range p.Regions {
+		if region.RangId != p.Localnetworkinterface.RangId {
+			continue
+		}
+		if region.Scheme != "" {
+			scheme = region.Scheme
+		}
+		if region.Endpoint != "" {
+			endpoint = region.Endpoint
+		}
+	}
+	return scheme + "://" + endpoint + "/"
+}
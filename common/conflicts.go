@@ -0,0 +1,229 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"encoding/json"
+	"log"
+	"net/url"
+	"sort"
+	"time"
+)
+
+func init() {
+	registerFeature("kube-conflicts")
+	DefaultMetrics.Register("vipsidecar_vip_conflicts", MetricGauge, "Conflicts found by the last cluster scan, a managed vip used by another object or allocated to more than one object.")
+}
+
+//vip在集群对象中的一次使用，ours表示由loadbalancer或gateway分配
+type vipUse struct {
+	conflict VipConflict
+	ours     bool
+}
+
+//定期将vips与集群中的Service、EndpointSlice、节点地址及Gateway交叉比对，
+//vip被其他对象使用或被分配给多个对象时记为冲突，新出现的冲突在相关对象上生成Warning事件
+type ConflictScanner struct {
+	config   JdConflicts
+	vips     []string
+	lbclass  string
+	gwclass  string
+	node     string
+	kube     *kubeClient
+	reported map[string]bool
+}
+
+func NewConflictScanner(p *Parameters) (*ConflictScanner, error) {
+	config := p.Conflicts
+	if config.Interval <= 0 {
+		config.Interval = 300
+	}
+	kube, err := newKubeClient(config.ApiServer, "conflicts.apiserver")
+	if err != nil {
+		return nil, err
+	}
+	return &ConflictScanner{config: config, vips: p.VipIps(), lbclass: p.LoadBalancer.Class, gwclass: p.Gateway.Class, node: kubeNodeName(""), kube: kube, reported: map[string]bool{}}, nil
+}
+
+func (c *ConflictScanner) Run() {
+	for {
+		conflicts, err := c.Scan()
+		if err != nil {
+			log.Println("conflict scan", err)
+		} else {
+			c.report(conflicts)
+		}
+		time.Sleep(time.Duration(c.config.Interval) * time.Second)
+	}
+}
+
+//扫描一次，结果按vip排序
+func (c *ConflictScanner) Scan() ([]VipConflict, error) {
+	uses := []vipUse{}
+	use := func(vip string, kind string, namespace string, name string, field string, ours bool) {
+		if ok, _ := Contain(vip, c.vips); ok {
+			uses = append(uses, vipUse{conflict: VipConflict{Vip: vip, Kind: kind, Namespace: namespace, Name: name, Field: field}, ours: ours})
+		}
+	}
+
+	services := struct {
+		Items []struct {
+			Metadata kubeObjectMeta `json:"metadata"`
+			Spec     struct {
+				Type              string   `json:"type"`
+				LoadBalancerClass string   `json:"loadBalancerClass"`
+				ClusterIPs        []string `json:"clusterIPs"`
+				ExternalIPs       []string `json:"externalIPs"`
+			} `json:"spec"`
+			Status struct {
+				LoadBalancer struct {
+					Ingress []struct {
+						Ip string `json:"ip"`
+					} `json:"ingress"`
+				} `json:"loadBalancer"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := c.kube.do("GET", "/api/v1/services", "", nil, &services); err != nil {
+		return nil, err
+	}
+	for _, svc := range services.Items {
+		m := svc.Metadata
+		for _, ip := range svc.Spec.ClusterIPs {
+			use(ip, "Service", m.Namespace, m.Name, "spec.clusterIPs", false)
+		}
+		for _, ip := range svc.Spec.ExternalIPs {
+			use(ip, "Service", m.Namespace, m.Name, "spec.externalIPs", false)
+		}
+		ours := c.lbclass != "" && svc.Spec.Type == "LoadBalancer" && svc.Spec.LoadBalancerClass == c.lbclass
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			use(ingress.Ip, "Service", m.Namespace, m.Name, "status.loadBalancer.ingress", ours)
+		}
+	}
+
+	slices := struct {
+		Items []struct {
+			Metadata  kubeObjectMeta `json:"metadata"`
+			Endpoints []struct {
+				Addresses []string `json:"addresses"`
+				TargetRef struct {
+					Kind string `json:"kind"`
+					Name string `json:"name"`
+				} `json:"targetRef"`
+			} `json:"endpoints"`
+		} `json:"items"`
+	}{}
+	if err := c.kube.do("GET", "/apis/discovery.k8s.io/v1/endpointslices", "", nil, &slices); err != nil {
+		return nil, err
+	}
+	for _, slice := range slices.Items {
+		for _, endpoint := range slice.Endpoints {
+			kind, name, field := "EndpointSlice", slice.Metadata.Name, "endpoints.addresses"
+			if endpoint.TargetRef.Name != "" {
+				kind, name, field = endpoint.TargetRef.Kind, endpoint.TargetRef.Name, "endpoint in "+slice.Metadata.Name
+			}
+			for _, ip := range endpoint.Addresses {
+				use(ip, kind, slice.Metadata.Namespace, name, field, false)
+			}
+		}
+	}
+
+	nodes := struct {
+		Items []struct {
+			Metadata kubeObjectMeta `json:"metadata"`
+			Status   struct {
+				Addresses []struct {
+					Type    string `json:"type"`
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		} `json:"items"`
+	}{}
+	if err := c.kube.do("GET", "/api/v1/nodes", "", nil, &nodes); err != nil {
+		return nil, err
+	}
+	for _, node := range nodes.Items {
+		for _, address := range node.Status.Addresses {
+			use(address.Address, "Node", "", node.Metadata.Name, "status.addresses "+address.Type, false)
+		}
+	}
+
+	//只在配置了gateway时检查，未安装Gateway API CRD时不影响其他检查
+	if c.gwclass != "" {
+		gateways := struct {
+			Items []kubeGateway `json:"items"`
+		}{}
+		if err := c.kube.do("GET", "/apis/gateway.networking.k8s.io/v1/gateways", "", nil, &gateways); err != nil {
+			return nil, err
+		}
+		for _, gw := range gateways.Items {
+			for _, address := range gw.Spec.Addresses {
+				use(address.Value, "Gateway", gw.Metadata.Namespace, gw.Metadata.Name, "spec.addresses", gw.Spec.GatewayClassName == c.gwclass)
+			}
+		}
+	}
+
+	ours := map[string]int{}
+	for _, u := range uses {
+		if u.ours {
+			ours[u.conflict.Vip]++
+		}
+	}
+	conflicts := []VipConflict{}
+	for _, u := range uses {
+		switch {
+		case !u.ours:
+			u.conflict.Reason = "used by another object"
+		case ours[u.conflict.Vip] > 1:
+			u.conflict.Reason = "allocated to more than one object"
+		default:
+			continue
+		}
+		conflicts = append(conflicts, u.conflict)
+	}
+	sort.SliceStable(conflicts, func(i, j int) bool { return conflicts[i].Vip < conflicts[j].Vip })
+	return conflicts, nil
+}
+
+//更新指标及status，新出现的冲突写日志并在启用events时生成事件，冲突消失后再次出现时重新报告
+func (c *ConflictScanner) report(conflicts []VipConflict) {
+	DefaultMetrics.Set("vipsidecar_vip_conflicts", nil, float64(len(conflicts)))
+	DefaultStatus.SetConflicts(conflicts)
+	current := map[string]bool{}
+	for _, conflict := range conflicts {
+		key := conflict.String()
+		current[key] = true
+		if c.reported[key] {
+			continue
+		}
+		log.Println("vip conflict", key)
+		if c.config.Events {
+			if err := c.event(conflict); err != nil {
+				log.Println("conflict event", err)
+			}
+		}
+	}
+	c.reported = current
+}
+
+//在冲突对象上生成Warning事件，节点等cluster级别对象的事件写入default namespace
+func (c *ConflictScanner) event(conflict VipConflict) error {
+	namespace := conflict.Namespace
+	if namespace == "" {
+		namespace = "default"
+	}
+	now := time.Now().UTC().Format(time.RFC3339)
+	body, _ := json.Marshal(map[string]interface{}{
+		"metadata":       map[string]string{"generateName": "vipsidecar-conflict-", "namespace": namespace},
+		"involvedObject": map[string]string{"kind": conflict.Kind, "namespace": conflict.Namespace, "name": conflict.Name},
+		"reason":         "VipConflict",
+		"message":        "vip " + conflict.Vip + " managed by vipsidecar " + conflict.Reason + " (" + conflict.Field + ")",
+		"type":           "Warning",
+		"source":         map[string]string{"component": "vipsidecar", "host": c.node},
+		"firstTimestamp": now,
+		"lastTimestamp":  now,
+		"count":          1,
+	})
+	return c.kube.do("POST", "/api/v1/namespaces/"+url.PathEscape(namespace)+"/events", "application/json", body, nil)
+}
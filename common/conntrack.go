@@ -0,0 +1,100 @@
+package common
+
+import (
+	"bufio"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var conntrackFile = "/proc/net/nf_conntrack"
+
+//conntrack表中的一个连接，tuples[0]为发起方向，tuples[1]为应答方向
+type conntrackEntry struct {
+	proto  string
+	state  string
+	tuples [2]conntrackTuple
+}
+
+type conntrackTuple struct {
+	src, dst     string
+	sport, dport string
+	//开启net.netfilter.nf_conntrack_acct时才有
+	bytes uint64
+}
+
+//发起方向的五元组，用于在两次采样间识别同一连接
+func (e conntrackEntry) key() string {
+	t := e.tuples[0]
+	return e.proto + " " + t.src + ":" + t.sport + " " + t.dst + ":" + t.dport
+}
+
+func (e conntrackEntry) involves(vip string) bool {
+	for _, t := range e.tuples {
+		if t.src == vip || t.dst == vip {
+			return true
+		}
+	}
+	return false
+}
+
+//读取/proc/net/nf_conntrack，需要加载nf_conntrack模块
+//每行依次为三层协议名、协议号、四层协议名、协议号、超时秒数，tcp等有状态的协议之后为状态，然后是两个方向的五元组
+func readConntrack() ([]conntrackEntry, error) {
+	f, err := os.Open(conntrackFile)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	entries := []conntrackEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		e, tuple := conntrackEntry{proto: fields[2]}, -1
+		if !strings.Contains(fields[5], "=") {
+			e.state = fields[5]
+		}
+		for _, field := range fields[5:] {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			if kv[0] == "src" && tuple < 1 {
+				tuple++
+			}
+			if tuple < 0 {
+				continue
+			}
+			t := &e.tuples[tuple]
+			switch kv[0] {
+			case "src":
+				t.src = kv[1]
+			case "dst":
+				t.dst = kv[1]
+			case "sport":
+				t.sport = kv[1]
+			case "dport":
+				t.dport = kv[1]
+			case "bytes":
+				t.bytes, _ = strconv.ParseUint(kv[1], 10, 64)
+			}
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+//conntrack表中源或目的地址为vip的条目数
+func vipConntrackEntries(vip string) (int, error) {
+	entries, err := readConntrack()
+	count := 0
+	for _, e := range entries {
+		if e.involves(vip) {
+			count++
+		}
+	}
+	return count, err
+}
@@ -3,6 +3,18 @@ package common
 const (
 	ReportFilePrefix string = "report-"
 	ReportFileSuffix string = ".txt"
+
+	//vip漂移方式
+	ModeSecondaryIp string = "secondaryip"
+	ModeNatDnat     string = "natdnat"
+	ModeDr          string = "dr"
+	ModeEni         string = "eni"
+	//由provider插件执行云上操作
+	ModePlugin string = "plugin"
+
+	//dr模式切换确认方式
+	DrConfirmAuto   string = "auto"
+	DrConfirmManual string = "manual"
 )
 
 var (
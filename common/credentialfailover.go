@@ -0,0 +1,135 @@
+package common
+
+import (
+	"log"
+	"sync"
+)
+
+var credentialNames = []string{"primary", "secondary"}
+
+//主备两组全局凭证，正在使用的凭证返回认证错误(密钥被吊销或轮换)时切换到另一组
+//两组凭证交替使用，密钥轮换期间任意一组有效即可继续工作
+type CredentialFailover struct {
+	mutex  sync.Mutex
+	active int
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_credential_failovers_total", MetricCounter, "Switches between the primary and secondary credential pairs.")
+}
+
+func (c *CredentialFailover) Active() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.active
+}
+
+//index为出错请求使用的凭证，并发请求同时出错时只切换一次
+func (c *CredentialFailover) Failover(index int, err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.active != index {
+		return
+	}
+	c.active = 1 - index
+	log.Println("credentials", credentialNames[index], "rejected, switching to", credentialNames[c.active], err)
+	DefaultMetrics.Add("vipsidecar_credential_failovers_total", map[string]string{"to": credentialNames[c.active]}, 1)
+	DefaultStatus.SetCredentials(credentialNames[c.active])
+}
+
+//按当前凭证调用，认证失败时切换凭证后重试一次
+type failoverVpcApi struct {
+	apis     [2]VpcApi
+	failover *CredentialFailover
+}
+
+func (f *failoverVpcApi) call(fn func(api VpcApi) error) error {
+	index := f.failover.Active()
+	err := fn(f.apis[index])
+	if !IsAuthExpired(err) {
+		return err
+	}
+	f.failover.Failover(index, err)
+	return fn(f.apis[f.failover.Active()])
+}
+
+func (f *failoverVpcApi) DescribeNetworkInterfacesIps(regionId string, networkInterfaceIds []string) (map[string][]string, error) {
+	var result map[string][]string
+	err := f.call(func(api VpcApi) (err error) {
+		result, err = api.DescribeNetworkInterfacesIps(regionId, networkInterfaceIds)
+		return err
+	})
+	return result, err
+}
+
+func (f *failoverVpcApi) AssignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	var requestid string
+	err := f.call(func(api VpcApi) (err error) {
+		requestid, err = api.AssignSecondaryIps(regionId, networkInterfaceId, ips)
+		return err
+	})
+	return requestid, err
+}
+
+func (f *failoverVpcApi) UnassignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	var requestid string
+	err := f.call(func(api VpcApi) (err error) {
+		requestid, err = api.UnassignSecondaryIps(regionId, networkInterfaceId, ips)
+		return err
+	})
+	return requestid, err
+}
+
+func (f *failoverVpcApi) DescribeDnatRule(regionId string, natGatewayId string, dnatRuleId string) (*DnatRule, error) {
+	var dnatrule *DnatRule
+	err := f.call(func(api VpcApi) (err error) {
+		dnatrule, err = api.DescribeDnatRule(regionId, natGatewayId, dnatRuleId)
+		return err
+	})
+	return dnatrule, err
+}
+
+func (f *failoverVpcApi) ModifyDnatRule(regionId string, natGatewayId string, dnatRuleId string, internalIp string) (string, error) {
+	var requestid string
+	err := f.call(func(api VpcApi) (err error) {
+		requestid, err = api.ModifyDnatRule(regionId, natGatewayId, dnatRuleId, internalIp)
+		return err
+	})
+	return requestid, err
+}
+
+func (f *failoverVpcApi) DescribeNetworkInterface(regionId string, networkInterfaceId string) (*NetworkInterface, error) {
+	var networkinterface *NetworkInterface
+	err := f.call(func(api VpcApi) (err error) {
+		networkinterface, err = api.DescribeNetworkInterface(regionId, networkInterfaceId)
+		return err
+	})
+	return networkinterface, err
+}
+
+func (f *failoverVpcApi) DescribeNetworkInterfaces(regionId string, networkInterfaceIds []string) (map[string]*NetworkInterface, error) {
+	var networkinterfaces map[string]*NetworkInterface
+	err := f.call(func(api VpcApi) (err error) {
+		networkinterfaces, err = api.DescribeNetworkInterfaces(regionId, networkInterfaceIds)
+		return err
+	})
+	return networkinterfaces, err
+}
+
+func (f *failoverVpcApi) AttachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	var requestid string
+	err := f.call(func(api VpcApi) (err error) {
+		requestid, err = api.AttachNetworkInterface(regionId, instanceId, networkInterfaceId)
+		return err
+	})
+	return requestid, err
+}
+
+func (f *failoverVpcApi) DetachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	var requestid string
+	err := f.call(func(api VpcApi) (err error) {
+		requestid, err = api.DetachNetworkInterface(regionId, instanceId, networkInterfaceId)
+		return err
+	})
+	return requestid, err
+}
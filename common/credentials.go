@@ -0,0 +1,133 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+//签名使用的凭证，SessionToken不为空时为临时凭证，需要随请求携带x-jdcloud-security-token
+type Credentials struct {
+	AccessKey    string
+	SecretKey    string
+	SessionToken string
+	Expiration   time.Time
+}
+
+//每次请求前获取凭证，临时凭证由实现负责刷新
+type CredentialProvider interface {
+	Credentials() (Credentials, error)
+}
+
+//固定的AK/SK
+type StaticCredentials Credentials
+
+func (s StaticCredentials) Credentials() (Credentials, error) {
+	return Credentials(s), nil
+}
+
+//全局凭证，配置了federation时使用OIDC token换取的临时凭证，否则使用accessskeyid/accesskeysecret
+func NewCredentialProvider(p *Parameters) CredentialProvider {
+	if p.Federation.TokenFile != "" {
+		return NewOidcCredentialProvider(p.Federation)
+	}
+	return StaticCredentials{AccessKey: p.AccessKeyID, SecretKey: p.AccessKeySecret}
+}
+
+//临时凭证到期前提前刷新的时间
+const credentialRefreshMargin = 5 * time.Minute
+
+//读取projected service account token(OIDC)，通过federation endpoint换取京东云临时凭证
+//token文件由kubelet定期轮换，每次刷新凭证时重新读取
+type OidcCredentialProvider struct {
+	config     JdFederation
+	httpclient *http.Client
+	mutex      sync.Mutex
+	cached     Credentials
+}
+
+func NewOidcCredentialProvider(config JdFederation) *OidcCredentialProvider {
+	if config.Duration <= 0 {
+		config.Duration = 3600
+	}
+	if config.SessionName == "" {
+		config.SessionName = "vipsidecar"
+	}
+	return &OidcCredentialProvider{config: config, httpclient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (o *OidcCredentialProvider) Credentials() (Credentials, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.cached.AccessKey != "" && time.Until(o.cached.Expiration) > credentialRefreshMargin {
+		return o.cached, nil
+	}
+	credentials, err := o.exchange()
+	if err != nil {
+		//换取失败时继续使用未过期的旧凭证
+		if o.cached.AccessKey != "" && time.Now().Before(o.cached.Expiration) {
+			log.Println("refresh federated credentials failed, using cached credentials", err)
+			return o.cached, nil
+		}
+		DefaultStatus.RecordError("AssumeRoleWithOidc", err)
+		return Credentials{}, err
+	}
+	DefaultRedactor.Add(credentials.AccessKey, credentials.SecretKey, credentials.SessionToken)
+	log.Println("federated credentials refreshed, expire at", credentials.Expiration)
+	o.cached = credentials
+	return credentials, nil
+}
+
+func (o *OidcCredentialProvider) exchange() (Credentials, error) {
+	token, err := ioutil.ReadFile(o.config.TokenFile)
+	if err != nil {
+		return Credentials{}, err
+	}
+	body, err := json.Marshal(map[string]interface{}{
+		"roleArn":         o.config.RoleArn,
+		"roleSessionName": o.config.SessionName,
+		"durationSeconds": o.config.Duration,
+		"oidcToken":       strings.TrimSpace(string(token)),
+	})
+	if err != nil {
+		return Credentials{}, err
+	}
+	resp, err := o.httpclient.Post(o.config.Endpoint, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer resp.Body.Close()
+	jdResp := struct {
+		RequestID string `json:"requestId"`
+		Error     struct {
+			Code    int    `json:"code"`
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"error"`
+		Result struct {
+			Credentials struct {
+				AccessKeyId     string    `json:"accessKeyId"`
+				SecretAccessKey string    `json:"secretAccessKey"`
+				SessionToken    string    `json:"sessionToken"`
+				Expiration      time.Time `json:"expiration"`
+			} `json:"credentials"`
+		} `json:"result"`
+	}{}
+	if err := json.NewDecoder(resp.Body).Decode(&jdResp); err != nil {
+		return Credentials{}, err
+	}
+	if jdResp.Error.Code != 0 {
+		return Credentials{}, &ApiError{RequestId: jdResp.RequestID, Code: jdResp.Error.Code, Status: jdResp.Error.Status, Message: jdResp.Error.Message}
+	}
+	c := jdResp.Result.Credentials
+	if c.AccessKeyId == "" {
+		return Credentials{}, errors.New("federation endpoint returned no credentials, requestId " + jdResp.RequestID)
+	}
+	return Credentials{AccessKey: c.AccessKeyId, SecretKey: c.SecretAccessKey, SessionToken: c.SessionToken, Expiration: c.Expiration}, nil
+}
@@ -0,0 +1,51 @@
+package common
+
+import (
+	"errors"
+	"net"
+	"time"
+)
+
+//重复地址检测：接管vip前在vip所在接口发送arp探测，有其他主机应答时放弃接管，避免产生重复地址
+type AddressConflictDetector struct {
+	config    JdDad
+	announcer *GarpAnnouncer
+}
+
+func NewAddressConflictDetector(config JdDad, announcer *GarpAnnouncer) *AddressConflictDetector {
+	if config.Timeout <= 0 {
+		config.Timeout = 1000
+	}
+	return &AddressConflictDetector{config: config, announcer: announcer}
+}
+
+//在vip所在的每个接口上探测，发现冲突时返回AddressConflict错误
+func (d *AddressConflictDetector) Check(vip string) error {
+	if d == nil || !d.config.Enabled {
+		return nil
+	}
+	ip := net.ParseIP(vip).To4()
+	if ip == nil {
+		return nil
+	}
+	for _, name := range d.announcer.Interfaces(ip) {
+		iface, err := net.InterfaceByName(name)
+		if err != nil {
+			return err
+		}
+		sendif := name
+		if slave := activeSlave(name); slave != "" {
+			sendif = slave
+		}
+		owner, err := probeArp(sendif, iface.HardwareAddr, ip, time.Duration(d.config.Timeout)*time.Millisecond)
+		if err != nil {
+			return err
+		}
+		if owner != nil {
+			return NewAddressConflictError("vip " + vip + " is answered by " + owner.String() + " on " + name + ", refusing to take it over")
+		}
+	}
+	return nil
+}
+
+var errArpUnsupported = errors.New("arp probing is only supported on linux")
@@ -0,0 +1,70 @@
+package common
+
+import (
+	"bytes"
+	"golang.org/x/sys/unix"
+	"net"
+	"time"
+)
+
+func init() {
+	registerFeature("dad")
+}
+
+//发送arp探测(sender ip为0.0.0.0)，在timeout内收到其他mac对ip的应答或声明时返回该mac
+func probeArp(ifname string, hwaddr net.HardwareAddr, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return nil, err
+	}
+	defer unix.Close(fd)
+	addr := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index, Halen: 6}
+	if err := unix.Bind(fd, addr); err != nil {
+		return nil, err
+	}
+
+	broadcast := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, hwaddr...)
+	frame = append(frame, 0x08, 0x06)
+	frame = append(frame, 0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, 0x01)
+	frame = append(frame, hwaddr...)
+	frame = append(frame, 0, 0, 0, 0)
+	frame = append(frame, 0, 0, 0, 0, 0, 0)
+	frame = append(frame, ip...)
+	copy(addr.Addr[:], broadcast)
+	if err := unix.Sendto(fd, frame, 0, addr); err != nil {
+		return nil, err
+	}
+
+	deadline := time.Now().Add(timeout)
+	buf := make([]byte, 1500)
+	for {
+		remaining := time.Until(deadline)
+		if remaining <= 0 {
+			return nil, nil
+		}
+		tv := unix.NsecToTimeval(remaining.Nanoseconds())
+		unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EAGAIN || err == unix.EINTR {
+				continue
+			}
+			return nil, err
+		}
+		//以太网头14字节，arp 28字节，sender mac位于22:28，sender ip位于28:32
+		if n < 42 || buf[12] != 0x08 || buf[13] != 0x06 {
+			continue
+		}
+		sendermac := net.HardwareAddr(append([]byte{}, buf[22:28]...))
+		if net.IP(buf[28:32]).Equal(ip) && !bytes.Equal(sendermac, hwaddr) {
+			return sendermac, nil
+		}
+	}
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"net"
+	"time"
+)
+
+func probeArp(ifname string, hwaddr net.HardwareAddr, ip net.IP, timeout time.Duration) (net.HardwareAddr, error) {
+	return nil, errArpUnsupported
+}
@@ -0,0 +1,160 @@
+package common
+
+import (
+	"net/http"
+)
+
+//注册/dashboard，页面本身不含数据，不需要认证；页面中的数据及操作通过管理接口获取，使用页面中输入的token认证
+func (a *AdminServer) RegisterDashboard() {
+	a.handlePublic("/dashboard", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+		w.Write([]byte(dashboardHtml))
+	}))
+}
+
+//单页面，vip状态及健康检查来自/v1/status，最近的状态转换来自/v1/history，之后通过/v1/status/watch实时更新
+//EventSource不能设置Authorization头，使用fetch读取事件流
+const dashboardHtml = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>vipsidecar</title>
+<style>
+body { font-family: sans-serif; margin: 20px; color: #222; }
+h1 { font-size: 20px; } h2 { font-size: 16px; margin-top: 24px; }
+table { border-collapse: collapse; width: 100%; }
+th, td { text-align: left; padding: 4px 8px; border-bottom: 1px solid #ddd; font-size: 13px; }
+.Bound { color: #080; } .Failed, .Degraded { color: #c00; } .Acquiring, .Releasing { color: #a60; }
+.bar { margin-bottom: 12px; } .bar input { width: 260px; }
+#banner { padding: 6px; background: #fee; display: none; }
+button { margin-right: 6px; }
+</style>
+</head>
+<body>
+<h1>vipsidecar <span id="host"></span> <small id="mode"></small></h1>
+<div class="bar">token <input id="token" type="password" placeholder="admin token, empty when auth is off">
+<button onclick="saveToken()">connect</button>
+<button onclick="post('/v1/reconcile', 'POST')">reconcile</button>
+<button id="pause" onclick="togglePause()">pause</button></div>
+<div id="banner"></div>
+<h2>VIPs</h2>
+<table><thead><tr><th>vip</th><th>state</th><th>holder</th><th>since</th><th>reason</th><th>epoch</th><th></th></tr></thead><tbody id="vips"></tbody></table>
+<h2>Health</h2>
+<table><thead><tr><th>check</th><th>healthy</th></tr></thead><tbody id="health"></tbody></table>
+<h2>Recent transitions</h2>
+<table><thead><tr><th>time</th><th>vip</th><th>from</th><th>to</th><th>reason</th><th>requestId</th></tr></thead><tbody id="history"></tbody></table>
+<script>
+var state = {}, transitions = [], paused = false, controller = null;
+document.getElementById('host').textContent = location.host;
+document.getElementById('token').value = sessionStorage.getItem('vipsidecar-token') || '';
+function headers() {
+  var h = {}, token = document.getElementById('token').value;
+  if (token) { h['Authorization'] = 'Bearer ' + token; }
+  return h;
+}
+function text(s) { var d = document.createElement('div'); d.textContent = s == null ? '' : String(s); return d.innerHTML; }
+function banner(msg) { var b = document.getElementById('banner'); b.textContent = msg || ''; b.style.display = msg ? 'block' : 'none'; }
+function post(path, method, body) {
+  var h = headers();
+  if (body) { h['Content-Type'] = 'application/json'; }
+  return fetch(path, {method: method, headers: h, body: body ? JSON.stringify(body) : undefined}).then(function (r) {
+    return r.text().then(function (t) { if (!r.ok && r.status != 409 && r.status != 428) { throw new Error(r.status + ' ' + t); } banner(r.status == 409 ? t : ''); return t; });
+  }).catch(function (e) { banner(method + ' ' + path + ': ' + e.message); });
+}
+function handoff(vip) {
+  var peer = prompt('hand off ' + vip + ' to peer admin address (host:port)', localStorage.getItem('vipsidecar-peer') || '');
+  if (!peer) { return; }
+  localStorage.setItem('vipsidecar-peer', peer);
+  post('/v1/handoff', 'POST', {vip: vip, peer: peer}).then(function (t) {
+    var result = t ? JSON.parse(t) : null, impact = result && result.impact;
+    if (!result || result.state != 'unconfirmed') { if (t) { banner('handoff: ' + t); } return; }
+    var summary = 'hand off ' + vip + ' to ' + peer + '?\nexpected downtime ' + impact.expectedDowntimeSeconds.toFixed(1) + 's (' + impact.failoversObserved + ' recent failovers)' +
+      '\nlistening ports ' + impact.listeningPorts.join(', ') + '\n' + impact.establishedConnections + ' established connections, ' + impact.conntrackEntries + ' conntrack entries' +
+      (impact.notes ? '\n' + impact.notes.join('\n') : '');
+    if (!confirm(summary)) { return; }
+    post('/v1/handoff', 'POST', {vip: vip, peer: peer, confirm: true}).then(function (t) { if (t) { banner('handoff: ' + t); } });
+  });
+}
+function togglePause() {
+  if (paused) { post('/v1/pause', 'DELETE'); }
+  else if (confirm('stop this node from taking over vips?')) { post('/v1/pause', 'POST'); }
+}
+function render() {
+  document.getElementById('mode').textContent = state.mode || '';
+  var ineligible = state.ineligible || {};
+  paused = 'admin' in ineligible;
+  document.getElementById('pause').textContent = paused ? 'resume' : 'pause';
+  var notes = Object.keys(ineligible).map(function (k) { return k + ': ' + ineligible[k]; });
+  if (state.safetyViolation) { notes.push('SAFETY: ' + JSON.stringify(state.safetyViolation)); }
+  if (notes.length) { banner('not taking over vips, ' + notes.join('; ')); }
+  var rows = '', vips = state.vips || {};
+  Object.keys(vips).sort().forEach(function (vip) {
+    var v = vips[vip], bound = v.state == 'Bound';
+    rows += '<tr><td>' + text(vip) + '</td><td class="' + text(v.state) + '">' + text(v.state) + '</td><td>' + (bound ? text(location.host) : '') +
+      '</td><td>' + text(v.since) + '</td><td>' + text(v.reason) + '</td><td>' + text(v.epoch) + '</td><td>' +
+      (bound ? '<button data-vip="' + text(vip) + '" onclick="handoff(this.dataset.vip)">hand off</button>' : '') + '</td></tr>';
+  });
+  document.getElementById('vips').innerHTML = rows;
+  rows = '';
+  var checks = state.healthChecks || {};
+  Object.keys(checks).sort().forEach(function (c) { rows += '<tr><td>' + text(c) + '</td><td class="' + (checks[c] ? 'Bound' : 'Failed') + '">' + checks[c] + '</td></tr>'; });
+  document.getElementById('health').innerHTML = rows;
+  rows = '';
+  transitions.slice(-50).reverse().forEach(function (t) {
+    rows += '<tr><td>' + text(t.time) + '</td><td>' + text(t.vip) + '</td><td>' + text(t.from) + '</td><td class="' + text(t.to) + '">' + text(t.to) +
+      '</td><td>' + text(t.reason) + '</td><td>' + text(t.requestId) + '</td></tr>';
+  });
+  document.getElementById('history').innerHTML = rows;
+}
+function apply(type, data) {
+  if (type == 'status') { state = data; }
+  if (type == 'transition') {
+    var t = data.transition;
+    transitions.push(t);
+    state.vips = state.vips || {};
+    state.vips[t.vip] = {state: t.to, since: t.time, reason: t.reason, epoch: t.epoch};
+  }
+  if (type == 'health') { state.healthChecks = state.healthChecks || {}; state.healthChecks[data.check] = data.healthy; }
+  render();
+}
+//连接断开后重新获取快照，暂停、恢复等不产生事件的变化也通过定期重新连接刷新
+function watch() {
+  if (controller) { controller.abort(); }
+  controller = new AbortController();
+  var signal = controller.signal;
+  fetch('/v1/history', {headers: headers(), signal: signal}).then(function (r) { return r.ok ? r.json() : []; }).then(function (h) { transitions = h || []; });
+  fetch('/v1/status/watch', {headers: headers(), signal: signal}).then(function (r) {
+    if (!r.ok) { throw new Error(r.status + ' ' + r.statusText); }
+    var reader = r.body.getReader(), decoder = new TextDecoder(), buffer = '';
+    function read() {
+      return reader.read().then(function (chunk) {
+        if (chunk.done) { throw new Error('stream closed'); }
+        buffer += decoder.decode(chunk.value, {stream: true});
+        var blocks = buffer.split('\n\n');
+        buffer = blocks.pop();
+        blocks.forEach(function (block) {
+          var type = '', data = '';
+          block.split('\n').forEach(function (line) {
+            if (line.indexOf('event: ') == 0) { type = line.slice(7); }
+            if (line.indexOf('data: ') == 0) { data = line.slice(6); }
+          });
+          if (type && data) { apply(type, JSON.parse(data)); }
+        });
+        return read();
+      });
+    }
+    return read();
+  }).catch(function (e) {
+    if (signal.aborted) { return; }
+    banner('watch: ' + e.message + ', reconnecting');
+    setTimeout(watch, 3000);
+  });
+}
+function saveToken() { sessionStorage.setItem('vipsidecar-token', document.getElementById('token').value); banner(''); watch(); }
+setInterval(watch, 60000);
+watch();
+</script>
+</body>
+</html>
+`
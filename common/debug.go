@@ -0,0 +1,34 @@
+package common
+
+import (
+	"expvar"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"os/signal"
+	runtimepprof "runtime/pprof"
+	"syscall"
+)
+
+//注册/debug/pprof及/debug/vars，仅在--enable-debug时启用
+func registerDebugHandlers(mux *http.ServeMux) {
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+}
+
+//收到SIGQUIT时将所有goroutine堆栈输出到stderr，进程继续运行
+func DumpGoroutinesOnSignal() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGQUIT)
+	go func() {
+		for range ch {
+			log.Println("SIGQUIT received, dumping goroutines")
+			runtimepprof.Lookup("goroutine").WriteTo(os.Stderr, 2)
+		}
+	}()
+}
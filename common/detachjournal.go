@@ -0,0 +1,260 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//记录类型，intent在卸载前写入，done在绑定完成或回滚完成后写入
+const (
+	journalIntent string = "intent"
+	journalDone   string = "done"
+)
+
+//一次卸载操作：将vip对应的资源(eni模式为网卡，secondaryip模式为网卡上的secondaryip)从from卸载后绑定到to
+type DetachIntent struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Id            string    `json:"id"`
+	Type          string    `json:"type"`
+	Time          time.Time `json:"time"`
+	Vip           string    `json:"vip"`
+	Mode          string    `json:"mode,omitempty"`
+	Region        string    `json:"region,omitempty"`
+	Resource      string    `json:"resource,omitempty"`
+	From          string    `json:"from,omitempty"`
+	To            string    `json:"to,omitempty"`
+	Epoch         uint64    `json:"epoch,omitempty"`
+	Outcome       string    `json:"outcome,omitempty"`
+}
+
+//启动时处理未完成卸载的Provider，返回处理结果，返回空字符串表示留给之后的reconcile完成
+type DetachRecoverer interface {
+	RecoverDetach(intent DetachIntent, vipsonlocal []string) (string, error)
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_detach_journal_pending", MetricGauge, "Detach operations recorded in the detach journal that have not completed or been rolled back.")
+	DefaultMetrics.Register("vipsidecar_detach_journal_recovered_total", MetricCounter, "Unfinished detach operations found in the detach journal at startup, result=completed, resumed or error.")
+}
+
+//卸载前写入意图记录(写入后fsync)，绑定完成或回滚完成后写入done记录，进程在卸载与绑定之间退出时重启后根据未完成的记录处理
+//未配置detachjournal时不记录
+type DetachJournal struct {
+	mutex   sync.Mutex
+	path    string
+	pending []DetachIntent
+	seq     uint64
+}
+
+var DefaultDetachJournal = &DetachJournal{}
+
+//读取未完成的记录，有已结束的记录时将文件压缩为只包含未完成的记录
+func (j *DetachJournal) Open(path string) error {
+	if path == "" {
+		return nil
+	}
+	pending, records, err := readDetachJournal(path)
+	if err != nil {
+		return err
+	}
+	//没有需要去掉的记录时不改写，privileges.drop后重新执行的进程不需要state文件所在目录的写权限
+	if records != len(pending) {
+		if err := writeDetachJournal(path, pending); err != nil {
+			return err
+		}
+	}
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.path, j.pending = path, pending
+	j.updateMetrics()
+	for _, intent := range pending {
+		log.Println("detach journal: unfinished detach of", intent.Resource, "for vip", intent.Vip, "from", intent.From, "at", intent.Time.Format(time.RFC3339))
+	}
+	return nil
+}
+
+//按顺序读取记录，返回没有对应done记录的intent及文件中的行数
+func readDetachJournal(path string) ([]DetachIntent, int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return []DetachIntent{}, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	pending := []DetachIntent{}
+	records := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		records++
+		raw := map[string]interface{}{}
+		//写入intent时退出可能留下不完整的最后一行，此时卸载尚未发起
+		if json.Unmarshal(scanner.Bytes(), &raw) != nil {
+			continue
+		}
+		if err := migrateRecord(path, raw, DetachJournalSchemaVersion, detachJournalMigrations); err != nil {
+			return nil, 0, err
+		}
+		data, _ := json.Marshal(raw)
+		r := DetachIntent{}
+		if json.Unmarshal(data, &r) != nil {
+			continue
+		}
+		switch r.Type {
+		case journalIntent:
+			pending = append(pending, r)
+		case journalDone:
+			pending = removeIntent(pending, r.Id)
+		}
+	}
+	return pending, records, scanner.Err()
+}
+
+func removeIntent(intents []DetachIntent, id string) []DetachIntent {
+	result := []DetachIntent{}
+	for _, intent := range intents {
+		if intent.Id != id {
+			result = append(result, intent)
+		}
+	}
+	return result
+}
+
+//写临时文件后改名替换
+func writeDetachJournal(path string, intents []DetachIntent) error {
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for _, intent := range intents {
+		data, _ := json.Marshal(intent)
+		tmp.Write(append(data, '\n'))
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+//追加一条记录，返回前fsync
+func (j *DetachJournal) append(r DetachIntent) error {
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(j.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//发起卸载前调用，记录写入失败时不应发起卸载
+func (j *DetachJournal) Begin(intent DetachIntent) error {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	if j.path == "" {
+		return nil
+	}
+	intent.SchemaVersion, intent.Type, intent.Time = DetachJournalSchemaVersion, journalIntent, time.Now()
+	j.seq++
+	intent.Id = strconv.FormatInt(intent.Time.UnixNano(), 36) + "-" + strconv.FormatUint(j.seq, 10)
+	if err := j.append(intent); err != nil {
+		return errors.New("write detach journal: " + err.Error())
+	}
+	j.pending = append(j.pending, intent)
+	j.updateMetrics()
+	return nil
+}
+
+//vip的卸载已有结果(绑定完成、回滚完成或启动时已处理)，结束该vip所有未完成的记录
+func (j *DetachJournal) Complete(vip string, outcome string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	for _, intent := range j.pending {
+		if intent.Vip == vip {
+			j.complete(intent, outcome)
+		}
+	}
+}
+
+//结束一条记录
+func (j *DetachJournal) Resolve(intent DetachIntent, outcome string) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	j.complete(intent, outcome)
+}
+
+func (j *DetachJournal) complete(intent DetachIntent, outcome string) {
+	done := DetachIntent{SchemaVersion: DetachJournalSchemaVersion, Id: intent.Id, Type: journalDone, Time: time.Now(), Vip: intent.Vip, Outcome: outcome}
+	//done记录写入失败时记录保留在文件中，重启后再次处理，结果相同
+	if err := j.append(done); err != nil {
+		log.Println("write detach journal", err)
+	}
+	j.pending = removeIntent(j.pending, intent.Id)
+	j.updateMetrics()
+	log.Println("detach journal: detach of", intent.Resource, "for vip", intent.Vip, outcome)
+}
+
+//未完成的记录
+func (j *DetachJournal) Pending() []DetachIntent {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+	return append([]DetachIntent{}, j.pending...)
+}
+
+func (j *DetachJournal) updateMetrics() {
+	DefaultMetrics.Set("vipsidecar_detach_journal_pending", nil, float64(len(j.pending)))
+}
+
+//首次reconcile前处理上次运行未完成的卸载，其他模式写入的记录及处理失败的记录保留到下次启动
+func RecoverDetachJournal(provider Provider, vipsonlocal []string) {
+	intents := DefaultDetachJournal.Pending()
+	if len(intents) == 0 {
+		return
+	}
+	recoverer, ok := provider.(DetachRecoverer)
+	if !ok {
+		log.Println("detach journal:", len(intents), "unfinished detaches cannot be recovered in mode", provider.Name())
+		return
+	}
+	for _, intent := range intents {
+		if intent.Mode != provider.Name() {
+			log.Println("detach journal: skipping detach of", intent.Resource, "recorded in mode", intent.Mode)
+			continue
+		}
+		outcome, err := recoverer.RecoverDetach(intent, vipsonlocal)
+		if err != nil {
+			log.Println("detach journal: recover detach of", intent.Resource, "for vip", intent.Vip, "failed", err)
+			DefaultMetrics.Add("vipsidecar_detach_journal_recovered_total", map[string]string{"result": "error"}, 1)
+			continue
+		}
+		//vip在本机，由首次reconcile完成绑定后结束记录
+		if outcome == "" {
+			log.Println("detach journal: vip", intent.Vip, "is on this node, resuming attach of", intent.Resource)
+			DefaultMetrics.Add("vipsidecar_detach_journal_recovered_total", map[string]string{"result": "resumed"}, 1)
+			continue
+		}
+		DefaultMetrics.Add("vipsidecar_detach_journal_recovered_total", map[string]string{"result": "completed"}, 1)
+		DefaultDetachJournal.Resolve(intent, outcome)
+	}
+}
@@ -0,0 +1,153 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//hosts文件中由vipsidecar维护的区块
+const (
+	hostsOverrideBegin string = "# BEGIN vipsidecar dns override"
+	hostsOverrideEnd   string = "# END vipsidecar dns override"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_dns_override_active", MetricGauge, "1 while the dr dns override points the configured names at the standby vip.")
+}
+
+//dns切换后记录TTL过期前，集群内按名称访问的客户端仍会解析到主vip
+//切换时在本机hosts文件及CoreDNS hosts插件读取的ConfigMap中将names指向备vip，duration秒后撤销
+type DnsOverride struct {
+	config  JdDnsOverride
+	coredns func(content string) error
+	mutex   sync.Mutex
+	timer   *time.Timer
+}
+
+//未配置names时返回nil，nil的DnsOverride不做任何操作
+func NewDnsOverride(config JdDnsOverride) (*DnsOverride, error) {
+	if len(config.Names) == 0 {
+		return nil, nil
+	}
+	if config.HostsFile == "" && config.CoreDns.ConfigMap == "" {
+		return nil, errors.New("dr.override.hostsfile or dr.override.coredns.configmap must be set when dr.override.names is set")
+	}
+	if config.Duration <= 0 {
+		config.Duration = 300
+	}
+	if config.CoreDns.Namespace == "" {
+		config.CoreDns.Namespace = "kube-system"
+	}
+	if config.CoreDns.Key == "" {
+		config.CoreDns.Key = "vipsidecar.hosts"
+	}
+	o := &DnsOverride{config: config}
+	if config.CoreDns.ConfigMap != "" {
+		coredns, err := newCoreDnsOverride(config.CoreDns)
+		if err != nil {
+			return nil, err
+		}
+		o.coredns = coredns
+	}
+	return o, nil
+}
+
+//将names指向ip，duration秒后自动撤销
+func (o *DnsOverride) Apply(ip string) error {
+	if o == nil {
+		return nil
+	}
+	lines := []string{}
+	for _, name := range o.config.Names {
+		lines = append(lines, ip+" "+name)
+	}
+	err := o.write(lines)
+	if err == nil {
+		log.Println("dns override", o.config.Names, "->", ip, "for", o.config.Duration, "seconds")
+		DefaultMetrics.Set("vipsidecar_dns_override_active", nil, 1)
+	}
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.timer != nil {
+		o.timer.Stop()
+	}
+	o.timer = time.AfterFunc(time.Duration(o.config.Duration)*time.Second, func() {
+		if err := o.Remove(); err != nil {
+			log.Println("remove dns override", err)
+		}
+	})
+	return err
+}
+
+//撤销覆盖，dns记录已在各处生效
+func (o *DnsOverride) Remove() error {
+	if o == nil {
+		return nil
+	}
+	if err := o.write(nil); err != nil {
+		return err
+	}
+	log.Println("dns override", o.config.Names, "removed")
+	DefaultMetrics.Set("vipsidecar_dns_override_active", nil, 0)
+	return nil
+}
+
+//hosts文件与ConfigMap都尝试写入，返回第一个错误
+func (o *DnsOverride) write(lines []string) error {
+	var first error
+	if o.config.HostsFile != "" {
+		if err := writeHostsOverride(o.config.HostsFile, lines); err != nil {
+			log.Println("dns override hosts file", err)
+			first = err
+		}
+	}
+	if o.coredns != nil {
+		content := ""
+		if len(lines) > 0 {
+			content = strings.Join(lines, "\n") + "\n"
+		}
+		if err := o.coredns(content); err != nil {
+			log.Println("dns override configmap", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+//替换hosts文件中vipsidecar维护的区块，lines为空时删除区块
+//容器内的/etc/hosts为bind mount，不能rename替换，直接原地写入
+func writeHostsOverride(path string, lines []string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	kept := []string{}
+	inblock := false
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		switch {
+		case line == hostsOverrideBegin:
+			inblock = true
+		case line == hostsOverrideEnd:
+			inblock = false
+		case !inblock:
+			kept = append(kept, line)
+		}
+	}
+	if len(lines) > 0 {
+		kept = append(kept, hostsOverrideBegin)
+		kept = append(kept, lines...)
+		kept = append(kept, hostsOverrideEnd)
+	}
+	return ioutil.WriteFile(path, []byte(strings.Join(kept, "\n")+"\n"), info.Mode())
+}
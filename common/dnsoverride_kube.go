@@ -0,0 +1,22 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"encoding/json"
+	"net/url"
+)
+
+//将CoreDNS hosts插件读取的ConfigMap中的key改为content
+func newCoreDnsOverride(config JdCoreDnsOverride) (func(content string) error, error) {
+	kube, err := newKubeClient(config.ApiServer, "dr.override.coredns.apiserver")
+	if err != nil {
+		return nil, err
+	}
+	path := "/api/v1/namespaces/" + url.PathEscape(config.Namespace) + "/configmaps/" + url.PathEscape(config.ConfigMap)
+	return func(content string) error {
+		patch, _ := json.Marshal(map[string]interface{}{"data": map[string]string{config.Key: content}})
+		return kube.do("PATCH", path, "application/merge-patch+json", patch, nil)
+	}, nil
+}
@@ -0,0 +1,100 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"errors"
+	"log"
+	"net/url"
+	"time"
+)
+
+func init() {
+	registerFeature("kube-drain")
+	DefaultMetrics.Register("vipsidecar_node_draining", MetricGauge, "1 while the kubernetes node is cordoned and vips are being moved off it.")
+}
+
+//监视本机所在kubernetes节点，节点被cordon/drain(spec.unschedulable或unschedulable污点)时通过handoff将本机持有的vip交给对端
+//sidecar以DaemonSet运行，drain不会驱逐它，因此能在业务pod被驱逐前完成迁移
+type DrainWatcher struct {
+	config   JdDrain
+	handoff  *Handoff
+	vips     []string
+	kube     *kubeClient
+	draining bool
+}
+
+//节点对象中用到的字段
+type kubeNode struct {
+	Spec struct {
+		Unschedulable bool `json:"unschedulable"`
+		Taints        []struct {
+			Key    string `json:"key"`
+			Effect string `json:"effect"`
+		} `json:"taints"`
+	} `json:"spec"`
+}
+
+func NewDrainWatcher(config JdDrain, handoff *Handoff, vips []string) (*DrainWatcher, error) {
+	if len(config.Peers) == 0 {
+		return nil, errors.New("drain.peers must be set when drain is enabled")
+	}
+	config.Node = kubeNodeName(config.Node)
+	if config.Interval <= 0 {
+		config.Interval = 10
+	}
+	kube, err := newKubeClient(config.ApiServer, "drain.apiserver")
+	if err != nil {
+		return nil, err
+	}
+	return &DrainWatcher{config: config, handoff: handoff, vips: vips, kube: kube}, nil
+}
+
+func (d *DrainWatcher) Run() {
+	for {
+		if err := d.Check(); err != nil {
+			log.Println("drain watch", err)
+		}
+		time.Sleep(time.Duration(d.config.Interval) * time.Second)
+	}
+}
+
+//读取节点状态，cordon期间每次检查都把仍然Bound的vip交给对端，直到全部迁出
+func (d *DrainWatcher) Check() error {
+	unschedulable, err := d.unschedulable()
+	if err != nil {
+		return err
+	}
+	if unschedulable != d.draining {
+		log.Println("node", d.config.Node, "unschedulable", unschedulable)
+		d.draining = unschedulable
+		value := 0.0
+		if unschedulable {
+			value = 1
+		}
+		DefaultMetrics.Set("vipsidecar_node_draining", nil, value)
+		DefaultStatus.SetDraining(unschedulable)
+	}
+	if !d.draining {
+		return nil
+	}
+	d.handoff.MoveOff(d.vips, d.config.Peers, "drain")
+	return nil
+}
+
+func (d *DrainWatcher) unschedulable() (bool, error) {
+	node := kubeNode{}
+	if err := d.kube.do("GET", "/api/v1/nodes/"+url.PathEscape(d.config.Node), "", nil, &node); err != nil {
+		return false, err
+	}
+	if node.Spec.Unschedulable {
+		return true, nil
+	}
+	for _, taint := range node.Spec.Taints {
+		if taint.Key == "node.kubernetes.io/unschedulable" {
+			return true, nil
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,137 @@
+package common
+
+import (
+	"context"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+//容灾切换：主vip判定为不健康(连续failurethreshold次探测失败)后，在备region网卡上启用备vip并执行dns切换命令
+type DrProvider struct {
+	parameter *Parameters
+	clients   *RegionClients
+	health    *HealthEvaluator
+	override  *DnsOverride
+	activated bool
+}
+
+//最近一次启用备vip的结果，error不为空时备vip未启用，dns未切换
+type DrActivation struct {
+	Time       time.Time `json:"time"`
+	StandbyVip string    `json:"standbyVip"`
+	Activated  bool      `json:"activated"`
+	Error      string    `json:"error,omitempty"`
+}
+
+func NewDrProvider(p *Parameters, clients *RegionClients) *DrProvider {
+	override, err := NewDnsOverride(p.Dr.Override)
+	if err != nil {
+		Exit(ExitConfigError, err)
+	}
+	return &DrProvider{parameter: p, clients: clients, health: NewHealthEvaluator("dr primary vip "+p.Dr.PrimaryVip, p.Dr.JdHealthThresholds), override: override}
+}
+
+func (d *DrProvider) Name() string {
+	return ModeDr
+}
+
+func (d *DrProvider) Reconcile(ctx context.Context, vipsonlocal []string) {
+	dr := d.parameter.Dr
+	if d.activated {
+		return
+	}
+
+	//配置了health表达式时由具名检查决定主vip是否健康
+	if healthy, ok := DefaultHealthChecks.VipHealthy(dr.PrimaryVip); ok {
+		if healthy {
+			return
+		}
+	} else {
+		if d.health.Due() {
+			d.health.Observe(PrimaryVipAlive(dr.PrimaryVip, dr.CheckPort))
+		}
+		if d.health.Healthy() {
+			return
+		}
+	}
+
+	//manual模式需要通过vipsidecar dr confirm确认后才切换
+	if dr.Confirm == DrConfirmManual {
+		if _, err := os.Stat(dr.ConfirmFile); err != nil {
+			log.Println("dr failover pending, run 'vipsidecar dr confirm' to activate standby vip", dr.StandbyVip)
+			return
+		}
+	} else if !allowFailover(ctx, dr.StandbyVip) {
+		return
+	}
+
+	d.Activate()
+}
+
+//启用备vip并切换dns，配置了override时临时覆盖集群内解析
+func (d *DrProvider) Activate() {
+	dr := d.parameter.Dr
+	nf := dr.StandbyNetworkInterface
+	budget := NewBudget(dr.StandbyVip, ModeDr, time.Duration(d.parameter.FailoverBudget)*time.Second)
+	defer budget.Finish()
+	budget.Enter(PhaseCloudAttach)
+	if _, err := AssignVips(d.clients.Get(nf.RangId), nf.RangId, nf.NetWorkInterfaceId, []string{dr.StandbyVip}, budget); err != nil {
+		//备vip未绑定时不切换dns，下次reconcile重试
+		log.Println("dr activate standby vip", dr.StandbyVip, "failed", err)
+		DefaultStatus.SetDrActivation(&DrActivation{Time: time.Now(), StandbyVip: dr.StandbyVip, Error: "assign: " + err.Error()})
+		return
+	}
+
+	budget.Enter(PhaseAnnounce)
+	if dr.DnsSwitchCommand != "" {
+		cmd := exec.Command("sh", "-c", dr.DnsSwitchCommand)
+		cmd.Env = append(os.Environ(), "VIPSIDECAR_DR_PRIMARY_VIP="+dr.PrimaryVip, "VIPSIDECAR_DR_STANDBY_VIP="+dr.StandbyVip)
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			log.Println("dr dns switch failed", err, string(out))
+			DefaultStatus.SetDrActivation(&DrActivation{Time: time.Now(), StandbyVip: dr.StandbyVip, Error: "dns switch: " + err.Error()})
+			return
+		}
+		log.Println("dr dns switched", string(out))
+	}
+	//dns记录TTL过期前集群内客户端仍解析到主vip，临时覆盖
+	d.override.Apply(dr.StandbyVip)
+
+	d.activated = true
+	DefaultStatus.SetDrActivation(&DrActivation{Time: time.Now(), StandbyVip: dr.StandbyVip, Activated: true})
+	os.Remove(dr.ConfirmFile)
+	log.Println("dr standby vip", dr.StandbyVip, "activated")
+}
+
+//主vip状态及备vip是否需要启用
+func (d *DrProvider) Diff(vipsonlocal []string) []string {
+	dr := d.parameter.Dr
+	nf := dr.StandbyNetworkInterface
+	lines := []string{"primary vip " + dr.PrimaryVip}
+	if PrimaryVipAlive(dr.PrimaryVip, dr.CheckPort) {
+		lines = append(lines, "    actual:  reachable")
+	} else {
+		lines = append(lines, "    actual:  unreachable")
+	}
+	lines = append(lines, "", "standby vip "+dr.StandbyVip)
+	if IpExistsOnInterface(d.clients.Get(nf.RangId), nf.RangId, nf.NetWorkInterfaceId, dr.StandbyVip) {
+		lines = append(lines, "    actual:  active on "+nf.RangId+"/"+nf.NetWorkInterfaceId)
+	} else {
+		lines = append(lines, "    actual:  inactive")
+	}
+	return append(lines, "")
+}
+
+//tcp探测主vip
+func PrimaryVipAlive(vip string, port int) bool {
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(vip, strconv.Itoa(port)), 3*time.Second)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_node_ineligible", MetricGauge, "1 while this node must not take over vips, source=spot etc.")
+}
+
+//来源为admin的不可接管原因，由/v1/pause设置
+const EligibilitySourceAdmin = "admin"
+
+//本机不应再接管vip的原因(如spot实例即将被回收)，按来源记录，存在任一原因时自动及手动接管、handoff接收均被拒绝
+type Eligibility struct {
+	mutex   sync.Mutex
+	reasons map[string]string
+}
+
+var DefaultEligibility = &Eligibility{reasons: make(map[string]string)}
+
+func (e *Eligibility) MarkIneligible(source string, reason string) {
+	e.mutex.Lock()
+	_, ok := e.reasons[source]
+	e.reasons[source] = reason
+	reasons := e.copy()
+	e.mutex.Unlock()
+	if !ok {
+		log.Println("node ineligible for vips,", source, reason)
+	}
+	DefaultMetrics.Set("vipsidecar_node_ineligible", map[string]string{"source": source}, 1)
+	DefaultStatus.SetIneligible(reasons)
+}
+
+func (e *Eligibility) Clear(source string) {
+	e.mutex.Lock()
+	_, ok := e.reasons[source]
+	delete(e.reasons, source)
+	reasons := e.copy()
+	e.mutex.Unlock()
+	if !ok {
+		return
+	}
+	log.Println("node eligible for vips again,", source, "cleared")
+	DefaultMetrics.Set("vipsidecar_node_ineligible", map[string]string{"source": source}, 0)
+	DefaultStatus.SetIneligible(reasons)
+}
+
+//注册/v1/pause：POST暂停本机接管vip(已持有的vip不受影响)，DELETE恢复，需要operator角色
+func (e *Eligibility) Register(admin *AdminServer) {
+	admin.HandleFunc(AdminApiPrefix+"/pause", RoleOperator, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "POST":
+			principal, _, _ := admin.authenticate(r)
+			if principal == "" {
+				principal = "anonymous"
+			}
+			e.MarkIneligible(EligibilitySourceAdmin, "paused by "+principal)
+		case "DELETE":
+			e.Clear(EligibilitySourceAdmin)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
+
+//不可接管时返回原因，可接管时返回空字符串
+func (e *Eligibility) Reason() string {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	sources := []string{}
+	for source := range e.reasons {
+		sources = append(sources, source)
+	}
+	sort.Strings(sources)
+	reasons := []string{}
+	for _, source := range sources {
+		reasons = append(reasons, source+": "+e.reasons[source])
+	}
+	return strings.Join(reasons, "; ")
+}
+
+//节点即将离开时手动触发的事件同样不能把vip接管回来
+func (e *Eligibility) AllowFailover(ctx context.Context, vip string) bool {
+	reason := e.Reason()
+	if reason == "" {
+		return true
+	}
+	reason = "node ineligible, " + reason
+	log.Println("failover of", vip, "suppressed,", reason)
+	DefaultMetrics.Add("vipsidecar_failovers_suppressed_total", map[string]string{"reason": "ineligible"}, 1)
+	DefaultStatus.SetSuppressedFailover(&SuppressedFailover{Time: time.Now(), Vip: vip, Reason: reason})
+	return false
+}
+
+func (e *Eligibility) copy() map[string]string {
+	if len(e.reasons) == 0 {
+		return nil
+	}
+	reasons := make(map[string]string, len(e.reasons))
+	for k, v := range e.reasons {
+		reasons[k] = v
+	}
+	return reasons
+}
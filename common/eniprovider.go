@@ -0,0 +1,379 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+//通过在云主机间挂载专用弹性网卡实现漂移，vip为该网卡上的地址
+//接管时将网卡从原云主机卸载、挂载到本机，按mac地址找到本机接口后启用并安装源地址为vip的策略路由
+type EniProvider struct {
+	parameter *Parameters
+	clients   *RegionClients
+	pool      *WorkerPool
+	states    *VipStateMachine
+	announcer *GarpAnnouncer
+	router    *PolicyRouter
+	//全部网卡的批量查询结果，各vip的reconcile共享
+	snapshot *CloudSnapshot
+}
+
+func NewEniProvider(p *Parameters, clients *RegionClients, pool *WorkerPool) *EniProvider {
+	if p.Eni.AttachTimeout <= 0 {
+		p.Eni.AttachTimeout = 60
+	}
+	states := newProviderStates()
+	router := NewPolicyRouter(JdPolicyRouting{Gateway: p.Eni.Gateway, TableBase: p.PolicyRouting.TableBase, Priority: p.PolicyRouting.Priority}, p.Vips)
+	//接口名在挂载后才能确定，路由只在释放时由回调删除
+	states.OnTransition(func(vip string, from VipState, to VipState) {
+		if to == StateReleased {
+			router.Remove(vip)
+		}
+	})
+	e := &EniProvider{parameter: p, clients: clients, pool: pool, states: states, announcer: NewGarpAnnouncer(p.Garp), router: router}
+	e.snapshot = NewCloudSnapshot(ModeEni, func() (interface{}, error) {
+		rangid, ids := p.Eni.RangId, []string{}
+		for _, nic := range p.Eni.Interfaces {
+			ids = append(ids, nic.NetworkInterfaceId)
+		}
+		networkinterfaces, err := clients.Get(rangid).DescribeNetworkInterfaces(rangid, ids)
+		if err != nil {
+			DefaultStatus.RecordError("DescribeNetworkInterfaces", err)
+		}
+		return networkinterfaces, err
+	})
+	return e
+}
+
+func (e *EniProvider) Name() string {
+	return ModeEni
+}
+
+func (e *EniProvider) Reconcile(ctx context.Context, vipsonlocal []string) {
+	config := e.parameter.Eni
+	e.states.Sync(vipsonlocal)
+	for _, nic := range config.Interfaces {
+		if ctx.Err() != nil {
+			log.Println("reconcile cancelled")
+			return
+		}
+		if ok, _ := Contain(nic.Vip, vipsonlocal); !ok {
+			continue
+		}
+		nic, vip := nic, nic.Vip
+		e.pool.Submit(vip, func() {
+			ni, err := e.describe(nic)
+			if err != nil {
+				log.Println(err)
+				//云上接口不可达时保留本机已持有的vip，恢复后重新确认挂载
+				if ReasonOf(err) == ReasonUnavailable || !DefaultProber.Reachable(config.RangId) {
+					e.states.Offline(vip, "cloud api in "+config.RangId+" unreachable")
+				}
+				return
+			}
+			//已挂载到本机，重启后接管已有挂载时重新启用接口并安装路由
+			if ni.InstanceId == config.InstanceId {
+				if e.states.State(vip) == StateBound {
+					return
+				}
+				e.states.Adopt(vip)
+				if err := e.configure(vip, ni.MacAddress); err != nil {
+					e.states.Degrade(vip, err.Error())
+				}
+				return
+			}
+			if !allowFailover(ctx, vip) {
+				return
+			}
+			if ni.InstanceId != "" && !allowPreemption(ctx, vip, ni.InstanceId) {
+				return
+			}
+			if !allowCloudCall(vip, e.parameter.Eni.RangId) {
+				return
+			}
+			epoch := e.states.Acquire(vip)
+			budget := NewBudget(vip, ModeEni, time.Duration(e.parameter.FailoverBudget)*time.Second)
+			budget.SetFence(e.states.Fence(vip, epoch))
+			budget.Track(ctx)
+			budget.Enter(PhaseFence)
+			defer budget.Finish()
+			//IPAM/CMDB中vip未预留给本服务时不挂载网卡
+			if err := DefaultIpam.Check(vip); err != nil {
+				log.Println(err)
+				e.states.Fail(vip, ReasonOf(err), "")
+				return
+			}
+			//从原云主机卸载、挂载到本机、启用接口为必需步骤，失败时回滚已完成的步骤
+			plan := NewApplyPlan(vip)
+			requestid := ""
+			if ni.InstanceId != "" && !DefaultFlags.Enabled(FlagForceDetach) {
+				log.Println(nic.NetworkInterfaceId, "is attached to", ni.InstanceId, "and feature flag", FlagForceDetach, "is disabled")
+				e.states.Fail(vip, ReasonFlagDisabled, "")
+				return
+			}
+			if previous := ni.InstanceId; previous != "" {
+				//卸载前记录意图，卸载与挂载之间进程退出时重启后据此处理
+				if err := DefaultDetachJournal.Begin(DetachIntent{Vip: vip, Mode: ModeEni, Region: config.RangId, Resource: nic.NetworkInterfaceId, From: previous, To: config.InstanceId, Epoch: epoch}); err != nil {
+					log.Println(err)
+					e.states.Fail(vip, ReasonOf(err), "")
+					return
+				}
+				budget.Enter(PhaseCloudDetach)
+				if err := plan.Step("detach from "+previous, func() error {
+					_, err := e.detach(nic, previous, budget)
+					return err
+				}, func() error {
+					_, err := e.attach(nic, previous, nil)
+					return err
+				}); err != nil {
+					plan.Fail(e.states, err, "")
+					return
+				}
+			}
+			budget.Enter(PhaseCloudAttach)
+			if err := plan.Step("attach "+nic.NetworkInterfaceId, func() (err error) {
+				requestid, err = e.attach(nic, config.InstanceId, budget)
+				return err
+			}, func() error {
+				_, err := e.detach(nic, config.InstanceId, nil)
+				return err
+			}); err != nil {
+				plan.Fail(e.states, err, requestid)
+				e.settle(vip, err)
+				return
+			}
+			budget.Enter(PhasePlumb)
+			if err := plan.Step("interface", func() error {
+				return e.configure(vip, ni.MacAddress)
+			}, func() error {
+				e.router.Remove(vip)
+				return nil
+			}); err != nil {
+				plan.Fail(e.states, err, requestid)
+				e.settle(vip, err)
+				return
+			}
+			budget.Enter(PhaseFence)
+			if err := plan.Step("fence", func() error { return e.states.Fresh(vip, requestid, epoch) }, nil); err != nil {
+				e.settle(vip, err)
+				return
+			}
+			DefaultDetachJournal.Complete(vip, "attached to "+config.InstanceId)
+			go DefaultIpam.Record(vip)
+			//网卡换到了新的云主机，免费arp更新网关中的mac地址
+			if budget.Allow("garp", time.Second) {
+				budget.Enter(PhaseAnnounce)
+				if err := plan.Optional("garp", func() error { return e.announce(vip) }); err != nil {
+					e.states.Degrade(vip, err.Error())
+				}
+			}
+		})
+	}
+}
+
+//挂载到本机失败后已回滚(网卡挂回原云主机)时结束卸载记录，卸载本身失败或回滚失败时网卡状态未知，保留到重启后处理
+func (e *EniProvider) settle(vip string, err error) {
+	var applyerr *ApplyError
+	if errors.As(err, &applyerr) && applyerr.Undo == nil {
+		DefaultDetachJournal.Complete(vip, "rolled back after "+applyerr.Error())
+	}
+}
+
+//重启后处理卸载记录：网卡已挂载时记录已无意义，未挂载且vip在本机时由reconcile挂载到本机，否则挂回原云主机
+func (e *EniProvider) RecoverDetach(intent DetachIntent, vipsonlocal []string) (string, error) {
+	var nic *JdEniInterface
+	for i := range e.parameter.Eni.Interfaces {
+		if e.parameter.Eni.Interfaces[i].NetworkInterfaceId == intent.Resource {
+			nic = &e.parameter.Eni.Interfaces[i]
+		}
+	}
+	if nic == nil {
+		return intent.Resource + " is no longer configured", nil
+	}
+	ni, err := e.describeOne(*nic)
+	if err != nil {
+		return "", err
+	}
+	if ni.InstanceId != "" {
+		return "already attached to " + ni.InstanceId, nil
+	}
+	if ok, _ := Contain(intent.Vip, vipsonlocal); ok {
+		return "", nil
+	}
+	log.Println(intent.Resource, "was detached from", intent.From, "but never attached, vip", intent.Vip, "is not on this node, attaching it back")
+	if _, err := e.attach(*nic, intent.From, nil); err != nil {
+		return "", err
+	}
+	return "attached back to " + intent.From, nil
+}
+
+//优先使用snapshotmaxage内的批量查询结果，其中没有该网卡或批量查询失败时单独查询
+func (e *EniProvider) describe(nic JdEniInterface) (*NetworkInterface, error) {
+	if value, err := e.snapshot.Get(time.Duration(e.parameter.SnapshotMaxAge) * time.Second); err == nil {
+		if ni, ok := value.(map[string]*NetworkInterface)[nic.NetworkInterfaceId]; ok {
+			return ni, nil
+		}
+	}
+	return e.describeOne(nic)
+}
+
+func (e *EniProvider) describeOne(nic JdEniInterface) (*NetworkInterface, error) {
+	rangid := e.parameter.Eni.RangId
+	ni, err := e.clients.Get(rangid).DescribeNetworkInterface(rangid, nic.NetworkInterfaceId)
+	if err != nil {
+		DefaultStatus.RecordError("DescribeNetworkInterface", err)
+	}
+	return ni, err
+}
+
+//挂载网卡到instanceid并等待挂载完成，budget为nil时不限制重试时间
+func (e *EniProvider) attach(nic JdEniInterface, instanceid string, budget *Budget) (string, error) {
+	rangid := e.parameter.Eni.RangId
+	requestid, err := budget.RetryPolicy().Do("AttachNetworkInterface", func() (string, error) {
+		return e.clients.Get(rangid).AttachNetworkInterface(rangid, instanceid, nic.NetworkInterfaceId)
+	})
+	e.snapshot.Invalidate()
+	if err != nil {
+		log.Println(err)
+		DefaultStatus.RecordError("AttachNetworkInterface", err)
+		return requestid, err
+	}
+	log.Println("attaching", nic.NetworkInterfaceId, "to", instanceid, "requestId", requestid)
+	return requestid, e.wait(nic, instanceid, budget)
+}
+
+//从instanceid卸载网卡并等待卸载完成
+func (e *EniProvider) detach(nic JdEniInterface, instanceid string, budget *Budget) (string, error) {
+	rangid := e.parameter.Eni.RangId
+	requestid, err := budget.RetryPolicy().Do("DetachNetworkInterface", func() (string, error) {
+		return e.clients.Get(rangid).DetachNetworkInterface(rangid, instanceid, nic.NetworkInterfaceId)
+	})
+	e.snapshot.Invalidate()
+	if err != nil {
+		log.Println(err)
+		DefaultStatus.RecordError("DetachNetworkInterface", err)
+		return requestid, err
+	}
+	log.Println("detaching", nic.NetworkInterfaceId, "from", instanceid, "requestId", requestid)
+	return requestid, e.wait(nic, "", budget)
+}
+
+//挂载、卸载为异步任务，轮询网卡直到挂载的云主机变为instanceid(为空表示已卸载)
+//最长等待attachtimeout秒，故障转移的预算先用完时在预算截止时间停止
+func (e *EniProvider) wait(nic JdEniInterface, instanceid string, budget *Budget) error {
+	start := time.Now()
+	timeout := start.Add(time.Duration(e.parameter.Eni.AttachTimeout) * time.Second)
+	deadline := budget.Limit(timeout)
+	for {
+		ni, err := e.describeOne(nic)
+		if err == nil && ni.InstanceId == instanceid {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			if err == nil {
+				limit := "eni.attachtimeout"
+				if deadline.Before(timeout) {
+					limit = "failoverbudget"
+				}
+				err = errors.New(nic.NetworkInterfaceId + " is " + eniAttachment(ni.InstanceId) + ", expected " + eniAttachment(instanceid) + ", gave up after " + time.Since(start).Round(time.Second).String() + " (" + limit + ")")
+			}
+			return err
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func eniAttachment(instanceid string) string {
+	if instanceid == "" {
+		return "detached"
+	}
+	return "attached to " + instanceid
+}
+
+//启用网卡对应的本机接口并安装策略路由
+func (e *EniProvider) configure(vip string, mac string) error {
+	name, err := eniInterface(mac, time.Duration(e.parameter.Eni.AttachTimeout)*time.Second)
+	if err != nil {
+		return err
+	}
+	if err := runIp("link", "set", "dev", name, "up"); err != nil {
+		return err
+	}
+	log.Println("vip", vip, "interface", name, "up")
+	return e.router.InstallVia(vip, name)
+}
+
+//按mac地址查找网卡在本机的接口名，udev重命名(eth1改为ens6等)期间名称会变化，连续两次查到相同名称才返回
+func eniInterface(mac string, timeout time.Duration) (string, error) {
+	hwaddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return "", err
+	}
+	deadline := time.Now().Add(timeout)
+	last := ""
+	for {
+		name := ""
+		if interfaces, err := net.Interfaces(); err == nil {
+			for _, iface := range interfaces {
+				if bytes.Equal(iface.HardwareAddr, hwaddr) {
+					name = iface.Name
+					break
+				}
+			}
+		}
+		if name != "" && name == last {
+			return name, nil
+		}
+		last = name
+		if time.Now().After(deadline) {
+			return "", errors.New("no interface with mac " + mac + " on this node")
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+//发送免费arp前断言网卡已挂载到本机
+func (e *EniProvider) announce(vip string) error {
+	if state := e.states.State(vip); !DefaultSafety.Assert(InvariantGarpWithoutBinding, vip, state == StateBound || state == StateOffline, "vip is "+string(state)) {
+		return NewSafetyHaltError("garp for " + vip + " refused")
+	}
+	return e.announcer.Announce(vip)
+}
+
+//网卡期望挂载与实际挂载的云主机
+func (e *EniProvider) Diff(vipsonlocal []string) []string {
+	config := e.parameter.Eni
+	lines := []string{}
+	for _, nic := range config.Interfaces {
+		lines = append(lines, "network interface "+nic.NetworkInterfaceId+" (vip "+nic.Vip+")")
+		actual := "<none>"
+		ni, err := e.describe(nic)
+		if err != nil {
+			actual = "<error: " + err.Error() + ">"
+		} else if ni.InstanceId != "" {
+			actual = ni.InstanceId
+		}
+		if ok, _ := Contain(nic.Vip, vipsonlocal); !ok {
+			lines = append(lines, "    desired: not held by this node", "    actual:  "+actual, "")
+			continue
+		}
+		lines = append(lines, "    desired: "+config.InstanceId, "    actual:  "+actual)
+		if err == nil && ni.InstanceId != config.InstanceId {
+			if ni.InstanceId != "" {
+				lines = append(lines, "  - detach from "+ni.InstanceId)
+			}
+			lines = append(lines, "  + attach to "+config.InstanceId)
+		}
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+//vip当前状态
+func (e *EniProvider) VipState(vip string) VipState {
+	return e.states.State(vip)
+}
@@ -0,0 +1,169 @@
+package common
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+//事件优先级，数值越小越优先
+const (
+	PriorityFailover = iota
+	PriorityDrift
+	PriorityRoutine
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_workqueue_depth", MetricGauge, "Items waiting in the queue, queue=events for reconcile triggers and vips for per-VIP cloud jobs.")
+	DefaultMetrics.Register("vipsidecar_workqueue_adds_total", MetricCounter, "Items added to the queue.")
+	DefaultMetrics.Register("vipsidecar_workqueue_coalesced_total", MetricCounter, "Items dropped because an equivalent item was already waiting.")
+	DefaultMetrics.Register("vipsidecar_workqueue_processed_total", MetricCounter, "Items processed.")
+	DefaultMetrics.Register("vipsidecar_workqueue_queue_seconds_total", MetricCounter, "Total time items waited in the queue before processing started.")
+	DefaultMetrics.Register("vipsidecar_workqueue_work_seconds_total", MetricCounter, "Total time spent processing items.")
+	DefaultMetrics.Register("vipsidecar_workqueue_batches_total", MetricCounter, "Cloud API mutations sent for per-interface batches of VIP changes.")
+	DefaultMetrics.Register("vipsidecar_workqueue_batched_total", MetricCounter, "VIP changes merged into per-interface batches.")
+	DefaultMetrics.Register("vipsidecar_workqueue_retries_total", MetricCounter, "Cloud API calls retried after a retryable error.")
+}
+
+//触发reconcile的事件
+type Event struct {
+	Priority int
+	Source   string
+	Time     time.Time
+}
+
+type eventHeap []Event
+
+func (h eventHeap) Len() int { return len(h) }
+func (h eventHeap) Less(i, j int) bool {
+	if h[i].Priority != h[j].Priority {
+		return h[i].Priority < h[j].Priority
+	}
+	return h[i].Time.Before(h[j].Time)
+}
+func (h eventHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *eventHeap) Push(x interface{}) { *h = append(*h, x.(Event)) }
+func (h *eventHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+//按优先级处理的事件队列，高优先级事件到达时取消正在执行的低优先级reconcile
+type EventQueue struct {
+	mutex   sync.Mutex
+	events  eventHeap
+	notify  chan struct{}
+	running *Event
+	started time.Time
+	cancel  context.CancelFunc
+}
+
+func NewEventQueue() *EventQueue {
+	return &EventQueue{notify: make(chan struct{}, 1)}
+}
+
+//加入事件，同一来源的事件在队列中只保留一个
+func (q *EventQueue) Push(priority int, source string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	labels := map[string]string{"queue": "events"}
+	DefaultMetrics.Add("vipsidecar_workqueue_adds_total", labels, 1)
+	for _, e := range q.events {
+		if e.Source == source {
+			DefaultMetrics.Add("vipsidecar_workqueue_coalesced_total", labels, 1)
+			return
+		}
+	}
+	heap.Push(&q.events, Event{Priority: priority, Source: source, Time: time.Now()})
+	DefaultMetrics.Set("vipsidecar_workqueue_depth", labels, float64(q.events.Len()))
+	if q.running != nil && priority < q.running.Priority && q.cancel != nil {
+		q.cancel()
+	}
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+}
+
+//取出优先级最高的事件，队列为空时阻塞
+func (q *EventQueue) Pop() Event {
+	for {
+		q.mutex.Lock()
+		if q.events.Len() > 0 {
+			e := heap.Pop(&q.events).(Event)
+			labels := map[string]string{"queue": "events"}
+			DefaultMetrics.Set("vipsidecar_workqueue_depth", labels, float64(q.events.Len()))
+			DefaultMetrics.Add("vipsidecar_workqueue_queue_seconds_total", labels, time.Since(e.Time).Seconds())
+			q.mutex.Unlock()
+			return e
+		}
+		q.mutex.Unlock()
+		<-q.notify
+	}
+}
+
+//手动触发的事件来源
+var manualEventSources = []string{"admin", "handoff"}
+
+type eventSourceKey struct{}
+
+//事件加入队列及开始处理的时间
+type eventTimeKey struct{}
+
+type eventTime struct {
+	pushed  time.Time
+	started time.Time
+}
+
+//ctx对应事件的来源，不是由EventQueue.Begin创建的ctx返回空
+func EventSource(ctx context.Context) string {
+	source, _ := ctx.Value(eventSourceKey{}).(string)
+	return source
+}
+
+func ManualEvent(source string) bool {
+	ok, _ := Contain(source, manualEventSources)
+	return ok
+}
+
+//开始处理事件，返回的context在更高优先级事件到达时被取消
+func (q *EventQueue) Begin(e Event) context.Context {
+	started := time.Now()
+	ctx := context.WithValue(context.Background(), eventSourceKey{}, e.Source)
+	ctx, cancel := context.WithCancel(context.WithValue(ctx, eventTimeKey{}, eventTime{pushed: e.Time, started: started}))
+	DefaultFailoverLog.Detected(e)
+	q.mutex.Lock()
+	q.running = &e
+	q.cancel = cancel
+	q.started = started
+	q.mutex.Unlock()
+	return ctx
+}
+
+//事件处理完成
+func (q *EventQueue) Done() {
+	q.mutex.Lock()
+	if q.cancel != nil {
+		q.cancel()
+	}
+	if q.running != nil {
+		labels := map[string]string{"queue": "events"}
+		DefaultMetrics.Add("vipsidecar_workqueue_work_seconds_total", labels, time.Since(q.started).Seconds())
+		DefaultMetrics.Add("vipsidecar_workqueue_processed_total", labels, 1)
+	}
+	q.running = nil
+	q.cancel = nil
+	q.mutex.Unlock()
+}
+
+//按固定间隔加入例行事件
+func (q *EventQueue) Tick(interval time.Duration) {
+	for {
+		time.Sleep(DefaultBackpressure.Next(interval))
+		q.Push(PriorityRoutine, "routine")
+	}
+}
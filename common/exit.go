@@ -0,0 +1,103 @@
+package common
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//进程退出码，runbook及重启策略据此区分退出原因
+const (
+	ExitOk             = 0
+	ExitFailure        = 1
+	ExitConfigError    = 2
+	ExitAuthError      = 3
+	ExitFencingRefused = 4
+	ExitApiError       = 5
+)
+
+var exitReasons = map[int]string{
+	ExitOk:             "ok",
+	ExitFailure:        "failure",
+	ExitConfigError:    "config",
+	ExitAuthError:      "auth",
+	ExitFencingRefused: "fencing",
+	ExitApiError:       "api",
+}
+
+//退出时写入的终止状态
+type TerminalStatus struct {
+	Time      time.Time  `json:"time"`
+	ExitCode  int        `json:"exitCode"`
+	Reason    string     `json:"reason"`
+	Message   string     `json:"message,omitempty"`
+	Pid       int        `json:"pid"`
+	StartTime time.Time  `json:"startTime"`
+	Mode      string     `json:"mode,omitempty"`
+	LocalVips []string   `json:"localVips,omitempty"`
+	LastError *LastError `json:"lastError,omitempty"`
+}
+
+var (
+	exitmutex          sync.Mutex
+	terminalstatusfile string
+	starttime          = time.Now()
+)
+
+//设置终止状态文件，为空时不写入
+func SetTerminalStatusFile(path string) {
+	exitmutex.Lock()
+	defer exitmutex.Unlock()
+	terminalstatusfile = path
+}
+
+//云上接口错误原因对应的退出码，重试或等待后可以恢复的错误返回ExitOk
+func ExitCodeOf(reason string) int {
+	switch reason {
+	case ReasonAuthExpired, ReasonForbidden:
+		return ExitAuthError
+	case ReasonNotFound, ReasonInvalid:
+		return ExitApiError
+	case ReasonStaleEpoch:
+		return ExitFencingRefused
+	}
+	return ExitOk
+}
+
+//执行清理、写入终止状态后以code退出
+func Exit(code int, err error) {
+	message := ""
+	if err != nil {
+		message = err.Error()
+		log.Println(err)
+	}
+	RunShutdownHooks()
+	exitmutex.Lock()
+	path := terminalstatusfile
+	exitmutex.Unlock()
+	if path != "" {
+		status := TerminalStatus{Time: time.Now(), ExitCode: code, Reason: exitReasons[code], Message: message, Pid: os.Getpid(), StartTime: starttime}
+		DefaultStatus.mutex.Lock()
+		status.Mode, status.LocalVips, status.LastError = DefaultStatus.Mode, DefaultStatus.LocalVips, DefaultStatus.LastError
+		DefaultStatus.mutex.Unlock()
+		if err := writeTerminalStatus(path, status); err != nil {
+			log.Println("write terminal status", err)
+		}
+	}
+	os.Exit(code)
+}
+
+//先写临时文件再改名，避免读到不完整的内容
+func writeTerminalStatus(path string, status TerminalStatus) error {
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path+".tmp", append(data, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
@@ -0,0 +1,146 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func init() {
+	registerFeature("kube-externaldns")
+	DefaultMetrics.Register("vipsidecar_externaldns_updates_total", MetricCounter, "DNSEndpoint objects applied for external-dns, result=ok or error.")
+}
+
+//以external-dns的crd source读取的DNSEndpoint(externaldns.k8s.io/v1alpha1)发布vip的dns记录，每个vip一个对象
+//vip绑定到本机时通过server-side apply写入，dns记录不随转移变化，holder注解记录当前持有者
+type ExternalDnsSource struct {
+	mutex   sync.Mutex
+	config  JdExternalDns
+	kube    *kubeClient
+	holder  string
+	updates chan string
+}
+
+var DefaultExternalDns = &ExternalDnsSource{}
+
+func (e *ExternalDnsSource) Load(config JdExternalDns) error {
+	if !config.Enabled {
+		return nil
+	}
+	if len(config.Records) == 0 {
+		return errors.New("externaldns.records must be set when externaldns is enabled")
+	}
+	for _, r := range config.Records {
+		if net.ParseIP(r.Vip) == nil || r.DnsName == "" {
+			return errors.New("externaldns.records entry " + r.DnsName + " must have a dnsname and a valid vip")
+		}
+	}
+	if config.Namespace == "" {
+		config.Namespace = "default"
+	}
+	kube, err := newKubeClient(config.ApiServer, "externaldns.apiserver")
+	if err != nil {
+		return err
+	}
+	holder, _ := os.Hostname()
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.config, e.kube, e.holder = config, kube, holder
+	if e.updates == nil {
+		e.updates = make(chan string, 100)
+		go e.run()
+	}
+	return nil
+}
+
+//状态机回调，vip绑定到本机(含启动时接管已有绑定)时更新对应的DNSEndpoint
+func (e *ExternalDnsSource) Notify(vip string, from VipState, to VipState) {
+	if to != StateBound {
+		return
+	}
+	e.mutex.Lock()
+	updates := e.updates
+	e.mutex.Unlock()
+	if updates == nil {
+		return
+	}
+	select {
+	case updates <- vip:
+	default:
+		log.Println("externaldns update queue full, dropping update of", vip)
+	}
+}
+
+//失败时重试3次
+func (e *ExternalDnsSource) run() {
+	for vip := range e.updates {
+		var err error
+		for attempt := 0; attempt < 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = e.Apply(vip); err == nil {
+				break
+			}
+		}
+		result := "ok"
+		if err != nil {
+			log.Println("externaldns apply of", vip, err)
+			DefaultStatus.RecordError("ApplyDNSEndpoint", err)
+			result = "error"
+		}
+		DefaultMetrics.Add("vipsidecar_externaldns_updates_total", map[string]string{"result": result}, 1)
+	}
+}
+
+//写入vip的DNSEndpoint，没有对应记录时不做任何操作
+func (e *ExternalDnsSource) Apply(vip string) error {
+	e.mutex.Lock()
+	config, kube, holder := e.config, e.kube, e.holder
+	e.mutex.Unlock()
+	recordtype := "A"
+	if net.ParseIP(vip).To4() == nil {
+		recordtype = "AAAA"
+	}
+	endpoints := []map[string]interface{}{}
+	for _, r := range config.Records {
+		if r.Vip != vip {
+			continue
+		}
+		endpoint := map[string]interface{}{"dnsName": r.DnsName, "recordType": recordtype, "targets": []string{vip}}
+		if r.Ttl > 0 {
+			endpoint["recordTTL"] = r.Ttl
+		}
+		endpoints = append(endpoints, endpoint)
+	}
+	if len(endpoints) == 0 {
+		return nil
+	}
+	name := "vipsidecar-" + strings.NewReplacer(".", "-", ":", "-").Replace(vip)
+	body, _ := json.Marshal(map[string]interface{}{
+		"apiVersion": "externaldns.k8s.io/v1alpha1",
+		"kind":       "DNSEndpoint",
+		"metadata": map[string]interface{}{
+			"name":        name,
+			"namespace":   config.Namespace,
+			"labels":      map[string]string{"app.kubernetes.io/managed-by": "vipsidecar"},
+			"annotations": map[string]string{"vipsidecar.jdcloud.com/holder": holder},
+		},
+		"spec": map[string]interface{}{"endpoints": endpoints},
+	})
+	path := "/apis/externaldns.k8s.io/v1alpha1/namespaces/" + url.PathEscape(config.Namespace) + "/dnsendpoints/" + name + "?fieldManager=vipsidecar&force=true"
+	if err := kube.do("PATCH", path, "application/apply-patch+yaml", body, nil); err != nil {
+		return err
+	}
+	log.Println("externaldns", name, "applied, holder", holder)
+	return nil
+}
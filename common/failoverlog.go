@@ -0,0 +1,161 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//故障转移结果
+const (
+	FailoverSucceeded string = "succeeded"
+	FailoverFailed    string = "failed"
+)
+
+//一次故障转移，从检测到故障到vip在本机绑定完成(或失败)，cause为触发的事件来源(netlink、watch、routine、admin等)
+type FailoverRecord struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Time          time.Time `json:"time"`
+	Vip           string    `json:"vip"`
+	Holder        string    `json:"holder"`
+	Mode          string    `json:"mode,omitempty"`
+	Cause         string    `json:"cause"`
+	Result        string    `json:"result"`
+	Reason        string    `json:"reason,omitempty"`
+	Duration      float64   `json:"durationSeconds"`
+	RequestId     string    `json:"requestId,omitempty"`
+	Epoch         uint64    `json:"epoch,omitempty"`
+}
+
+//从状态转换中识别故障转移，结束时交给SLO统计，配置failoverlog时追加写入文件(每行一个json)供report使用
+type FailoverLog struct {
+	mutex    sync.Mutex
+	path     string
+	mode     string
+	holder   string
+	detected Event
+	starts   map[string]Event
+	epochs   map[string]uint64
+}
+
+var DefaultFailoverLog = &FailoverLog{starts: make(map[string]Event), epochs: make(map[string]uint64)}
+
+//读取已记录的各vip最大epoch，重启后状态机从该值继续递增
+func (f *FailoverLog) Load(path string, mode string) {
+	holder, _ := os.Hostname()
+	epochs := map[string]uint64{}
+	if path != "" {
+		records, _ := ReadFailoverRecords(path, time.Time{})
+		for _, r := range records {
+			if r.Epoch > epochs[r.Vip] {
+				epochs[r.Vip] = r.Epoch
+			}
+		}
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.path, f.mode, f.holder, f.epochs = path, mode, holder, epochs
+}
+
+func (f *FailoverLog) Epoch(vip string) uint64 {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	return f.epochs[vip]
+}
+
+//事件开始处理时记录检测时间及来源
+func (f *FailoverLog) Detected(e Event) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.detected = e
+}
+
+//Acquiring开始一次故障转移，Bound或Failed结束
+func (f *FailoverLog) Observe(t Transition) {
+	f.mutex.Lock()
+	if t.To == StateAcquiring {
+		start := f.detected
+		if start.Time.IsZero() {
+			start = Event{Time: t.Time, Source: "unknown"}
+		}
+		f.starts[t.Vip] = start
+		f.mutex.Unlock()
+		return
+	}
+	start, ok := f.starts[t.Vip]
+	if !ok || (t.To != StateBound && t.To != StateFailed) {
+		f.mutex.Unlock()
+		return
+	}
+	delete(f.starts, t.Vip)
+	r := FailoverRecord{SchemaVersion: FailoverLogSchemaVersion, Time: start.Time, Vip: t.Vip, Holder: f.holder, Mode: f.mode, Cause: start.Source, Result: FailoverSucceeded, Duration: t.Time.Sub(start.Time).Seconds(), RequestId: t.RequestId, Epoch: t.Epoch}
+	if t.To == StateFailed {
+		r.Result, r.Reason = FailoverFailed, t.Reason
+	}
+	path := f.path
+	f.mutex.Unlock()
+	DefaultSlo.Record(r)
+	if path != "" {
+		if err := appendFailoverRecord(path, r); err != nil {
+			log.Println("write failoverlog", err)
+		}
+	}
+}
+
+//文件不加密，原因中的凭证及token在写入前替换
+func appendFailoverRecord(path string, r FailoverRecord) error {
+	r.Reason = DefaultRedactor.Redact(r.Reason)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(data, '\n'))
+	return err
+}
+
+//启动时将failoverlog升级到当前schema，文件由更新版本的vipsidecar写入时返回SchemaTooNewError
+func MigrateFailoverLog(path string) error {
+	if path == "" {
+		return nil
+	}
+	migrated, err := migrateJsonLines(path, FailoverLogSchemaVersion, failoverLogMigrations)
+	if migrated > 0 {
+		log.Println("migrated", migrated, "failoverlog records to schema version", FailoverLogSchemaVersion)
+	}
+	return err
+}
+
+//读取since之后开始的故障转移记录，旧版本的记录在内存中升级，无法解析的行跳过
+func ReadFailoverRecords(path string, since time.Time) ([]FailoverRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	records := []FailoverRecord{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		raw := map[string]interface{}{}
+		if json.Unmarshal(scanner.Bytes(), &raw) != nil {
+			continue
+		}
+		if err := migrateRecord(path, raw, FailoverLogSchemaVersion, failoverLogMigrations); err != nil {
+			return nil, err
+		}
+		data, _ := json.Marshal(raw)
+		r := FailoverRecord{}
+		if json.Unmarshal(data, &r) != nil || r.Time.Before(since) {
+			continue
+		}
+		records = append(records, r)
+	}
+	return records, scanner.Err()
+}
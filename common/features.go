@@ -0,0 +1,29 @@
+package common
+
+import (
+	"sort"
+	"sync"
+)
+
+//编译进当前二进制的子系统，由各子系统文件在init中注册，受build tag及GOOS控制
+var (
+	featuremutex sync.Mutex
+	features     = map[string]bool{}
+)
+
+func registerFeature(name string) {
+	featuremutex.Lock()
+	defer featuremutex.Unlock()
+	features[name] = true
+}
+
+func Features() []string {
+	featuremutex.Lock()
+	defer featuremutex.Unlock()
+	names := []string{}
+	for name := range features {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
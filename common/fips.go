@@ -0,0 +1,39 @@
+package common
+
+import (
+	"crypto/fips140"
+	"errors"
+)
+
+//使用GOEXPERIMENT=boringcrypto编译时由fips_boring.go替换
+var boringEnabled = func() bool { return false }
+
+//当前使用的FIPS加密模块：boringcrypto(GOEXPERIMENT=boringcrypto编译)、fips140(GOFIPS140编译或GODEBUG=fips140=on|only运行)，都不是时为空
+//TLS、HMAC-SHA256签名及sha256均由标准库crypto实现，模块启用后全部经过该模块，不需要单独处理
+func FipsModule() string {
+	switch {
+	case boringEnabled():
+		return "boringcrypto"
+	case fips140.Enabled():
+		if fips140.Enforced() {
+			return "fips140-only"
+		}
+		return "fips140"
+	}
+	return ""
+}
+
+//配置要求fips时校验当前二进制及运行参数，未启用FIPS模块时拒绝启动
+func CheckFips(required bool) error {
+	if required && FipsModule() == "" {
+		return errors.New("fips is required but no FIPS module is active, build with GOFIPS140=v1.0.0 or GOEXPERIMENT=boringcrypto, or run with GODEBUG=fips140=on")
+	}
+	return nil
+}
+
+//boringcrypto由fips_boring.go注册
+func init() {
+	if fips140.Enabled() {
+		registerFeature(FipsModule())
+	}
+}
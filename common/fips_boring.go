@@ -0,0 +1,15 @@
+//go:build boringcrypto
+// +build boringcrypto
+
+package common
+
+import (
+	"crypto/boring"
+	//所有tls.Config只使用FIPS认可的版本、密码套件及曲线
+	_ "crypto/tls/fipsonly"
+)
+
+func init() {
+	boringEnabled = boring.Enabled
+	registerFeature("boringcrypto")
+}
@@ -0,0 +1,198 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//运行时可开关的高风险行为
+const (
+	//自动接管已绑定在其他节点上的vip，关闭后只自动接管未绑定的vip，手动触发的事件不受影响
+	FlagPreemption string = "preemption"
+	//解除vip在其他网卡/云主机上的绑定(secondaryip模式的残留绑定、eni模式从原云主机卸载网卡)，关闭后该vip的接管失败
+	FlagForceDetach string = "forcedetach"
+)
+
+//开关状态的来源
+const (
+	FlagSourceDefault string = "default"
+	FlagSourceConfig  string = "config"
+	FlagSourceFile    string = "file"
+	FlagSourceAdmin   string = "admin"
+)
+
+type FeatureFlag struct {
+	Enabled     bool      `json:"enabled"`
+	Source      string    `json:"source"`
+	Changed     time.Time `json:"changed,omitempty"`
+	Description string    `json:"description"`
+}
+
+//特性开关，初始值来自featureflags.flags，运行时由featureflags.file(如挂载的ConfigMap)或/v1/flags修改，后写入的生效
+type FeatureFlags struct {
+	mutex sync.Mutex
+	flags map[string]*FeatureFlag
+	file  []byte
+}
+
+var DefaultFlags = &FeatureFlags{flags: map[string]*FeatureFlag{
+	FlagPreemption:  {Enabled: true, Source: FlagSourceDefault, Description: "Automatically take over vips bound on another node."},
+	FlagForceDetach: {Enabled: true, Source: FlagSourceDefault, Description: "Remove a vip's binding from other interfaces or detach its network interface from another instance."},
+}}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_feature_flag", MetricGauge, "1 when the runtime feature flag is enabled.")
+	DefaultFlags.publish()
+}
+
+func (f *FeatureFlags) Load(config JdFeatureFlags) error {
+	for name, enabled := range config.Flags {
+		if err := f.Set(name, enabled, FlagSourceConfig); err != nil {
+			return errors.New("featureflags.flags: " + err.Error())
+		}
+	}
+	if config.File == "" {
+		return nil
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10
+	}
+	go f.watch(config.File, time.Duration(config.Interval)*time.Second)
+	return nil
+}
+
+//文件内容变化时应用其中全部开关，kubelet更新ConfigMap挂载时替换符号链接，按内容而非修改时间比较
+func (f *FeatureFlags) watch(file string, interval time.Duration) {
+	failed := false
+	for {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			if !failed {
+				log.Println("feature flags file", err)
+			}
+			failed = true
+		} else if failed = false; !bytes.Equal(data, f.file) {
+			f.file = data
+			flags := map[string]bool{}
+			if err := yaml.Unmarshal(data, &flags); err != nil {
+				log.Println("feature flags file", file, err)
+			}
+			for name, enabled := range flags {
+				if err := f.Set(name, enabled, FlagSourceFile); err != nil {
+					log.Println("feature flags file", file, err)
+				}
+			}
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (f *FeatureFlags) Enabled(name string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	flag, ok := f.flags[name]
+	return ok && flag.Enabled
+}
+
+func (f *FeatureFlags) Set(name string, enabled bool, source string) error {
+	f.mutex.Lock()
+	flag, ok := f.flags[name]
+	if !ok {
+		f.mutex.Unlock()
+		return errors.New("unknown feature flag " + name + ", known flags: " + strings.Join(f.names(), ", "))
+	}
+	changed := flag.Enabled != enabled
+	flag.Enabled, flag.Source = enabled, source
+	if changed {
+		flag.Changed = time.Now()
+	}
+	f.mutex.Unlock()
+	if changed {
+		log.Println("feature flag", name, "set to", enabled, "by", source)
+	}
+	f.publish()
+	return nil
+}
+
+func (f *FeatureFlags) names() []string {
+	names := []string{}
+	for name := range f.flags {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (f *FeatureFlags) Snapshot() map[string]FeatureFlag {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	snapshot := map[string]FeatureFlag{}
+	for name, flag := range f.flags {
+		snapshot[name] = *flag
+	}
+	return snapshot
+}
+
+func (f *FeatureFlags) publish() {
+	snapshot := f.Snapshot()
+	for name, flag := range snapshot {
+		value := 0.0
+		if flag.Enabled {
+			value = 1
+		}
+		DefaultMetrics.Set("vipsidecar_feature_flag", map[string]string{"flag": name}, value)
+	}
+	DefaultStatus.SetFeatureFlags(snapshot)
+}
+
+//GET /v1/flags列出开关，PUT /v1/flags/{name}修改单个开关
+func (f *FeatureFlags) Register(admin *AdminServer) {
+	admin.HandleFunc(AdminApiPrefix+"/flags", RoleViewer, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.Snapshot())
+	})
+	admin.HandleFunc(AdminApiPrefix+"/flags/", RoleOperator, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "PUT" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		request := FeatureFlagRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Enabled == nil {
+			http.Error(w, "body must be {\"enabled\": true|false}", http.StatusBadRequest)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, AdminApiPrefix+"/flags/")
+		if err := f.Set(name, *request.Enabled, FlagSourceAdmin); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(f.Snapshot()[name])
+	})
+}
+
+type FeatureFlagRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+//preemption关闭时不自动接管已绑定在其他节点上的vip
+func allowPreemption(ctx context.Context, vip string, holder string) bool {
+	if DefaultFlags.Enabled(FlagPreemption) || ManualEvent(EventSource(ctx)) {
+		return true
+	}
+	reason := "feature flag " + FlagPreemption + " is disabled and the vip is bound on " + holder
+	log.Println("automatic failover of", vip, "suppressed,", reason)
+	DefaultMetrics.Add("vipsidecar_failovers_suppressed_total", map[string]string{"reason": "flag"}, 1)
+	DefaultStatus.SetSuppressedFailover(&SuppressedFailover{Time: time.Now(), Vip: vip, Reason: reason})
+	return false
+}
@@ -0,0 +1,97 @@
+package common
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+//抖动抑制：vip在period内移动(接管或释放)超过maxmoves次后进入hold-down，期间不再自动接管，类似BGP flap damping
+type FlapDamper struct {
+	mutex    sync.Mutex
+	config   JdFlapDamping
+	moves    map[string][]time.Time
+	holddown map[string]time.Time
+}
+
+var DefaultFlapDamper = &FlapDamper{moves: make(map[string][]time.Time), holddown: make(map[string]time.Time)}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_vip_holddown", MetricGauge, "1 while automatic failover of the VIP is held down because it flapped.")
+	DefaultMetrics.Register("vipsidecar_flap_holddowns_total", MetricCounter, "Times a VIP entered hold-down because it moved too often.")
+}
+
+//maxmoves不大于0时关闭，holddown未配置时与period相同
+func (f *FlapDamper) Load(config JdFlapDamping) {
+	if config.Period <= 0 {
+		config.Period = 10
+	}
+	if config.HoldDown <= 0 {
+		config.HoldDown = config.Period
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.config = config
+}
+
+//状态机回调，记录vip的接管及释放
+func (f *FlapDamper) OnTransition(vip string, from VipState, to VipState) {
+	if to != StateAcquiring && to != StateReleased {
+		return
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.config.MaxMoves <= 0 {
+		return
+	}
+	now := time.Now()
+	period := time.Duration(f.config.Period) * time.Minute
+	moves := []time.Time{}
+	for _, t := range append(f.moves[vip], now) {
+		if now.Sub(t) < period {
+			moves = append(moves, t)
+		}
+	}
+	f.moves[vip] = moves
+	if len(moves) <= f.config.MaxMoves {
+		return
+	}
+	if until, ok := f.holddown[vip]; ok && now.Before(until) {
+		return
+	}
+	until := now.Add(time.Duration(f.config.HoldDown) * time.Minute)
+	f.holddown[vip] = until
+	f.moves[vip] = nil
+	log.Println("ALERT vip", vip, "moved", len(moves), "times in", period, "automatic failover held down until", until.Format(time.RFC3339))
+	DefaultMetrics.Add("vipsidecar_flap_holddowns_total", map[string]string{"vip": vip}, 1)
+	DefaultMetrics.Set("vipsidecar_vip_holddown", map[string]string{"vip": vip}, 1)
+	DefaultStatus.SetHoldDown(vip, until)
+}
+
+//由ctx对应的事件触发的vip转移是否可以执行，手动触发的事件不受hold-down限制
+func (f *FlapDamper) AllowFailover(ctx context.Context, vip string) bool {
+	f.mutex.Lock()
+	until, ok := f.holddown[vip]
+	if ok && !time.Now().Before(until) {
+		delete(f.holddown, vip)
+		DefaultMetrics.Set("vipsidecar_vip_holddown", map[string]string{"vip": vip}, 0)
+		DefaultStatus.SetHoldDown(vip, time.Time{})
+		log.Println("vip", vip, "hold-down expired")
+		ok = false
+	}
+	f.mutex.Unlock()
+	if !ok || ManualEvent(EventSource(ctx)) {
+		return true
+	}
+	reason := "hold-down until " + until.Format(time.RFC3339)
+	log.Println("automatic failover of", vip, "suppressed,", reason)
+	DefaultMetrics.Add("vipsidecar_failovers_suppressed_total", map[string]string{"reason": "holddown"}, 1)
+	DefaultStatus.SetSuppressedFailover(&SuppressedFailover{Time: time.Now(), Vip: vip, Reason: reason})
+	return false
+}
+
+//自动接管vip前的检查：本机是否可接管、时间计划、抖动抑制及本机健康状态
+func allowFailover(ctx context.Context, vip string) bool {
+	return DefaultEligibility.AllowFailover(ctx, vip) && DefaultSchedule.AllowFailover(ctx, vip) && DefaultFlapDamper.AllowFailover(ctx, vip) && DefaultHealthChecks.AllowFailover(ctx, vip)
+}
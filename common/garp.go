@@ -0,0 +1,103 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+//vip绑定到本机后发送免费arp，刷新同网段主机及交换机的arp缓存
+//vip所在网段trunk到多个接口(含vlan子接口)时，在所有接口上并行发送
+type GarpAnnouncer struct {
+	config JdGarp
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_garp_sent_total", MetricCounter, "Gratuitous ARP announcements sent.")
+	DefaultMetrics.Register("vipsidecar_garp_errors_total", MetricCounter, "Gratuitous ARP announcements that failed.")
+}
+
+func NewGarpAnnouncer(config JdGarp) *GarpAnnouncer {
+	if config.Count <= 0 {
+		config.Count = 3
+	}
+	return &GarpAnnouncer{config: config}
+}
+
+//发送接口：配置了interfaces时使用配置，否则选择所有up且地址网段包含vip的接口
+func (g *GarpAnnouncer) Interfaces(vip net.IP) []string {
+	if len(g.config.Interfaces) > 0 {
+		return g.config.Interfaces
+	}
+	return SubnetInterfaces(vip)
+}
+
+//所有up且地址网段包含ip的非回环接口
+func SubnetInterfaces(vip net.IP) []string {
+	names := []string{}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		log.Println(err)
+		return names
+	}
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.Contains(vip) {
+				names = append(names, iface.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+//在所有接口上并行发送count次免费arp，间隔1秒，返回第一个失败接口的错误
+//bond/team设备从活动成员发出，源mac使用bond自身的mac
+func (g *GarpAnnouncer) Announce(vip string) error {
+	if g == nil || !g.config.Enabled {
+		return nil
+	}
+	ip := net.ParseIP(vip).To4()
+	if ip == nil {
+		return nil
+	}
+	if err := DefaultSafety.Allow("garp"); err != nil {
+		return err
+	}
+	var group Group
+	for _, name := range g.Interfaces(ip) {
+		name := name
+		group.Go(func() error {
+			iface, err := net.InterfaceByName(name)
+			if err != nil {
+				log.Println("garp", vip, err)
+				return err
+			}
+			sendif := name
+			if slave := activeSlave(name); slave != "" {
+				sendif = slave
+			}
+			for i := 0; i < g.config.Count; i++ {
+				if i > 0 {
+					time.Sleep(time.Second)
+				}
+				if err := sendGarp(sendif, iface.HardwareAddr, ip); err != nil {
+					log.Println("garp", vip, "on", name, err)
+					DefaultMetrics.Add("vipsidecar_garp_errors_total", map[string]string{"interface": name}, 1)
+					return errors.New(name + ": " + err.Error())
+				}
+				DefaultMetrics.Add("vipsidecar_garp_sent_total", map[string]string{"interface": name}, 1)
+			}
+			return nil
+		})
+	}
+	return group.Wait()
+}
@@ -0,0 +1,46 @@
+package common
+
+import (
+	"encoding/binary"
+	"golang.org/x/sys/unix"
+	"net"
+)
+
+func init() {
+	registerFeature("garp")
+}
+
+//通过AF_PACKET在接口上广播一个免费arp请求，sender与target均为ip，源mac为hwaddr
+func sendGarp(ifname string, hwaddr net.HardwareAddr, ip net.IP) error {
+	iface, err := net.InterfaceByName(ifname)
+	if err != nil {
+		return err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ARP)))
+	if err != nil {
+		return err
+	}
+	defer unix.Close(fd)
+
+	broadcast := []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	frame := make([]byte, 0, 42)
+	frame = append(frame, broadcast...)
+	frame = append(frame, hwaddr...)
+	frame = append(frame, 0x08, 0x06)
+	//arp: ethernet/ipv4, request
+	frame = append(frame, 0x00, 0x01, 0x08, 0x00, 6, 4, 0x00, 0x01)
+	frame = append(frame, hwaddr...)
+	frame = append(frame, ip...)
+	frame = append(frame, broadcast...)
+	frame = append(frame, ip...)
+
+	addr := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ARP), Ifindex: iface.Index, Halen: 6}
+	copy(addr.Addr[:], broadcast)
+	return unix.Sendto(fd, frame, 0, addr)
+}
+
+func htons(v uint16) uint16 {
+	b := make([]byte, 2)
+	binary.BigEndian.PutUint16(b, v)
+	return binary.LittleEndian.Uint16(b)
+}
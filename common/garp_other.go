@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"errors"
+	"net"
+)
+
+func sendGarp(ifname string, hwaddr net.HardwareAddr, ip net.IP) error {
+	return errors.New("gratuitous arp is only supported on linux")
+}
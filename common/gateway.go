@@ -0,0 +1,189 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//envoy gateway为每个Gateway创建的数据面pod的标签，{namespace}及{name}替换为Gateway的namespace及名称
+const DefaultGatewayPodSelector = "gateway.envoyproxy.io/owning-gateway-namespace={namespace},gateway.envoyproxy.io/owning-gateway-name={name}"
+
+func init() {
+	registerFeature("kube-gateway")
+	DefaultMetrics.Register("vipsidecar_gateway_gateways", MetricGauge, "Gateways of the configured gatewayClass, state=allocated or pending.")
+	DefaultMetrics.Register("vipsidecar_gateway_pool_free", MetricGauge, "Addresses in gateway.pool not allocated to any gateway.")
+}
+
+//为gatewayClassName为class的Gateway API Gateway从pool分配vip并写入.spec.addresses，由数据面pod所在节点之一持有vip
+//.status.addresses由gateway的控制器根据spec.addresses更新，不写入以免与其冲突
+type GatewayController struct {
+	config  JdGateway
+	kube    *kubeClient
+	holders *vipHolderSync
+	pools   *vipPools
+}
+
+//Gateway对象中用到的字段
+type kubeGateway struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		GatewayClassName string `json:"gatewayClassName"`
+		Addresses        []struct {
+			Type  string `json:"type"`
+			Value string `json:"value"`
+		} `json:"addresses"`
+	} `json:"spec"`
+}
+
+//pod对象中用到的字段
+type kubePod struct {
+	Spec struct {
+		NodeName string `json:"nodeName"`
+	} `json:"spec"`
+	Status struct {
+		Phase      string `json:"phase"`
+		Conditions []struct {
+			Type   string `json:"type"`
+			Status string `json:"status"`
+		} `json:"conditions"`
+	} `json:"status"`
+}
+
+//pool中的地址必须在vips中，由provider负责云上绑定
+func NewGatewayController(config JdGateway, vips []string, queue *EventQueue) (*GatewayController, error) {
+	if len(config.Pool) == 0 && !config.VipPools {
+		return nil, errors.New("gateway.pool must be set when gateway.class is set and gateway.vippools is not")
+	}
+	for _, vip := range config.Pool {
+		if ok, _ := Contain(vip, vips); !ok {
+			return nil, errors.New("gateway.pool address " + vip + " is not in vips")
+		}
+	}
+	config.Node = kubeNodeName(config.Node)
+	if config.PodSelector == "" {
+		config.PodSelector = DefaultGatewayPodSelector
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10
+	}
+	if err := checkOutage("gateway.outage", &config.Outage); err != nil {
+		return nil, err
+	}
+	kube, err := newKubeClient(config.ApiServer, "gateway.apiserver")
+	if err != nil {
+		return nil, err
+	}
+	controller := &GatewayController{config: config, kube: kube}
+	controller.holders = newVipHolderSync("gateway", config.Node, config.Device, config.Outage, queue)
+	if config.VipPools {
+		controller.pools = newVipPools("Gateway", vips, kube)
+	}
+	return controller, nil
+}
+
+func (g *GatewayController) Run() {
+	for {
+		if err := g.Sync(); err != nil {
+			log.Println("gateway sync", err)
+			g.holders.unavailable(err)
+		}
+		time.Sleep(time.Duration(g.config.Interval) * time.Second)
+	}
+}
+
+//spec.addresses中已有pool中的地址时保留，为其他地址或主机名时视为用户指定，不分配vip
+func (g *GatewayController) Sync() error {
+	list := struct {
+		Items []kubeGateway `json:"items"`
+	}{}
+	if err := g.kube.do("GET", "/apis/gateway.networking.k8s.io/v1/gateways", "", nil, &list); err != nil {
+		return err
+	}
+	claims := []vipClaim{}
+	for _, gw := range list.Items {
+		if gw.Spec.GatewayClassName != g.config.Class {
+			continue
+		}
+		c := gw.Metadata.claim()
+		for _, address := range gw.Spec.Addresses {
+			c.assigned = append(c.assigned, address.Value)
+		}
+		if c.requested == "" && len(gw.Spec.Addresses) > 0 {
+			c.requested = gw.Spec.Addresses[0].Value
+		}
+		claims = append(claims, c)
+	}
+	sortClaims(claims)
+	//使用VipPool时地址池及对象可使用的地址由VipPool决定
+	pool := g.config.Pool
+	var allowed func(vipClaim, string, bool) bool
+	if g.pools != nil {
+		var err error
+		if pool, err = g.pools.load(); err != nil {
+			return err
+		}
+		allowed = g.pools.allowed
+	}
+	allocation, pending, free := allocateVips(pool, claims, allowed)
+	if g.pools != nil {
+		g.pools.report(allocation)
+	}
+	DefaultMetrics.Set("vipsidecar_gateway_gateways", map[string]string{"state": "allocated"}, float64(len(allocation)))
+	DefaultMetrics.Set("vipsidecar_gateway_gateways", map[string]string{"state": "pending"}, float64(pending))
+	DefaultMetrics.Set("vipsidecar_gateway_pool_free", nil, float64(free))
+	g.holders.sync(pool, claims, allocation, g.dataplaneNodes, g.writeBack)
+	return nil
+}
+
+//ready的数据面pod所在节点
+func (g *GatewayController) dataplaneNodes(c vipClaim) ([]string, error) {
+	list := struct {
+		Items []kubePod `json:"items"`
+	}{}
+	selector := strings.NewReplacer("{namespace}", c.namespace, "{name}", c.name).Replace(g.config.PodSelector)
+	path := "/api/v1/pods?labelSelector=" + url.QueryEscape(selector)
+	if g.config.PodNamespace != "" {
+		path = "/api/v1/namespaces/" + url.PathEscape(g.config.PodNamespace) + "/pods?labelSelector=" + url.QueryEscape(selector)
+	}
+	if err := g.kube.do("GET", path, "", nil, &list); err != nil {
+		return nil, err
+	}
+	nodes := []string{}
+	for _, pod := range list.Items {
+		if pod.Spec.NodeName == "" || pod.Status.Phase != "Running" {
+			continue
+		}
+		for _, condition := range pod.Status.Conditions {
+			if condition.Type == "Ready" && condition.Status == "True" {
+				if ok, _ := Contain(pod.Spec.NodeName, nodes); !ok {
+					nodes = append(nodes, pod.Spec.NodeName)
+				}
+			}
+		}
+	}
+	return nodes, nil
+}
+
+//更新持有者注解及spec.addresses
+func (g *GatewayController) writeBack(c vipClaim, vip string) error {
+	base := "/apis/gateway.networking.k8s.io/v1/namespaces/" + url.PathEscape(c.namespace) + "/gateways/" + url.PathEscape(c.name)
+	resourceversion, err := g.kube.setHolder(base, c, g.config.Node)
+	if err != nil {
+		return err
+	}
+	if len(c.assigned) == 1 && c.assigned[0] == vip {
+		return nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": resourceversion},
+		"spec":     map[string]interface{}{"addresses": []map[string]string{{"type": "IPAddress", "value": vip}}},
+	})
+	return g.kube.do("PATCH", base, "application/merge-patch+json", patch, nil)
+}
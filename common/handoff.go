@@ -0,0 +1,322 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//可以查询单个vip状态的Provider
+type Stateful interface {
+	VipState(vip string) VipState
+}
+
+//计划内迁移：操作者请求本机(A)将vip交给对端(B)
+//A从本机接口删除vip，请求B在其接口上添加vip并等待B完成云上绑定；B失败时A恢复vip，对操作者而言是一次原子操作
+type Handoff struct {
+	parameter *Parameters
+	provider  Provider
+	queue     *EventQueue
+	client    *http.Client
+	//正在交出的vip，同一vip同时只允许一次迁移
+	mutex    sync.Mutex
+	inflight map[string]bool
+}
+
+type HandoffRequest struct {
+	Vip       string `json:"vip"`
+	Peer      string `json:"peer,omitempty"`
+	PrefixLen int    `json:"prefixLen,omitempty"`
+	//操作者调用/v1/handoff时必须为true，否则只返回影响评估
+	Confirm bool `json:"confirm,omitempty"`
+}
+
+type HandoffResult struct {
+	Vip      string         `json:"vip"`
+	Peer     string         `json:"peer,omitempty"`
+	State    string         `json:"state"`
+	Message  string         `json:"message,omitempty"`
+	Duration float64        `json:"durationSeconds"`
+	Impact   *HandoffImpact `json:"impact,omitempty"`
+}
+
+func NewHandoff(p *Parameters, provider Provider, queue *EventQueue) *Handoff {
+	if p.Handoff.Timeout <= 0 {
+		p.Handoff.Timeout = 60
+	}
+	client := &http.Client{Timeout: time.Duration(p.Handoff.Timeout+10) * time.Second}
+	if p.Handoff.PeerCaCert != "" {
+		if pem, err := ioutil.ReadFile(p.Handoff.PeerCaCert); err == nil {
+			pool := x509.NewCertPool()
+			pool.AppendCertsFromPEM(pem)
+			client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}}
+		} else {
+			log.Println("handoff peercacert", err)
+		}
+	}
+	return &Handoff{parameter: p, provider: provider, queue: queue, client: client, inflight: make(map[string]bool)}
+}
+
+//注册/v1/handoff(操作者调用)及/v1/handoff/accept(对端调用)，均需要operator角色
+func (h *Handoff) Register(admin *AdminServer) {
+	admin.HandleFunc(AdminApiPrefix+"/handoff", RoleOperator, h.serve(h.confirmed))
+	admin.HandleFunc(AdminApiPrefix+"/handoff/accept", RoleOperator, h.serve(h.Accept))
+}
+
+//操作者发起的迁移先评估影响，confirm不为true时不做修改，只返回评估结果
+func (h *Handoff) confirmed(req HandoffRequest) HandoffResult {
+	impact := EstimateHandoffImpact(req.Vip, h.provider.Name())
+	if !req.Confirm {
+		return HandoffResult{Peer: req.Peer, State: "unconfirmed", Message: "review the impact and resend with confirm set to proceed", Impact: impact}
+	}
+	log.Println("handoff", req.Vip, "confirmed, expected downtime", impact.ExpectedDowntime, "seconds,", impact.Connections, "established connections")
+	result := h.Give(req)
+	result.Impact = impact
+	return result
+}
+
+func (h *Handoff) serve(fn func(HandoffRequest) HandoffResult) func(http.ResponseWriter, *http.Request) {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		req := HandoffRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if ok, _ := Contain(req.Vip, h.parameter.VipIps()); !ok {
+			http.Error(w, "unknown vip "+req.Vip, http.StatusBadRequest)
+			return
+		}
+		start := time.Now()
+		result := fn(req)
+		result.Vip, result.Duration = req.Vip, time.Since(start).Seconds()
+		w.Header().Set("Content-Type", "application/json")
+		switch result.State {
+		case "completed":
+		case "unconfirmed":
+			w.WriteHeader(http.StatusPreconditionRequired)
+		default:
+			w.WriteHeader(http.StatusConflict)
+		}
+		json.NewEncoder(w).Encode(result)
+	}
+}
+
+//A侧：删除本机vip，请求对端接管，对端失败时恢复
+func (h *Handoff) Give(req HandoffRequest) HandoffResult {
+	result := HandoffResult{Peer: req.Peer}
+	if req.Peer == "" {
+		result.State, result.Message = "rejected", "peer must be set"
+		return result
+	}
+	if !h.begin(req.Vip) {
+		result.State, result.Message = "rejected", "handoff of "+req.Vip+" already in progress"
+		return result
+	}
+	defer h.end(req.Vip)
+	if stateful, ok := h.provider.(Stateful); ok && stateful.VipState(req.Vip) != StateBound {
+		result.State, result.Message = "rejected", "vip "+req.Vip+" is "+string(stateful.VipState(req.Vip))+" on this node, not Bound"
+		return result
+	}
+	device, prefixlen, err := removeLocalVip(req.Vip)
+	if err != nil {
+		result.State, result.Message = "rejected", err.Error()
+		return result
+	}
+	log.Println("handoff", req.Vip, "released locally, asking", req.Peer)
+	h.queue.Push(PriorityFailover, "handoff")
+
+	peerresult, err := h.callPeer(req.Peer, HandoffRequest{Vip: req.Vip, PrefixLen: prefixlen})
+	if err == nil && peerresult.State == "completed" {
+		result.State = "completed"
+		log.Println("handoff", req.Vip, "to", req.Peer, "completed")
+		return result
+	}
+	if err == nil {
+		err = errors.New(peerresult.Message)
+	}
+	//对端失败，恢复本机vip
+	log.Println("handoff", req.Vip, "to", req.Peer, "failed, rolling back", err)
+	if rberr := addLocalVip(req.Vip, device, prefixlen); rberr != nil {
+		result.State, result.Message = "failed", "peer failed: "+err.Error()+"; rollback failed: "+rberr.Error()
+		return result
+	}
+	h.queue.Push(PriorityFailover, "handoff")
+	result.State, result.Message = "rolledback", "peer failed: "+err.Error()
+	return result
+}
+
+//计划内离开本机(drain、spot回收等)时把Bound的vip交给对端，按顺序尝试peers，第一个接管成功的对端生效
+func (h *Handoff) MoveOff(vips []string, peers []string, cause string) {
+	stateful, ok := h.provider.(Stateful)
+	if !ok {
+		return
+	}
+	for _, vip := range vips {
+		if stateful.VipState(vip) != StateBound {
+			continue
+		}
+		for _, peer := range peers {
+			result := h.Give(HandoffRequest{Vip: vip, Peer: peer})
+			if result.State == "completed" {
+				log.Println(cause, "moved", vip, "to", peer)
+				break
+			}
+			log.Println(cause, "could not move", vip, "to", peer, result.State, result.Message)
+			if result.State == "failed" {
+				break
+			}
+		}
+	}
+}
+
+//B侧：在本机接口添加vip，触发reconcile并等待vip绑定完成
+func (h *Handoff) Accept(req HandoffRequest) HandoffResult {
+	result := HandoffResult{}
+	if !h.begin(req.Vip) {
+		result.State, result.Message = "rejected", "handoff of "+req.Vip+" already in progress"
+		return result
+	}
+	defer h.end(req.Vip)
+	if reason := DefaultEligibility.Reason(); reason != "" {
+		result.State, result.Message = "rejected", "node ineligible, "+reason
+		return result
+	}
+	device := h.parameter.Handoff.Device
+	if device == "" {
+		if names := SubnetInterfaces(net.ParseIP(req.Vip)); len(names) > 0 {
+			device = names[0]
+		}
+	}
+	if device == "" {
+		result.State, result.Message = "failed", "no interface for "+req.Vip+", set handoff.device"
+		return result
+	}
+	prefixlen := req.PrefixLen
+	if prefixlen <= 0 {
+		prefixlen = 32
+	}
+	if err := addLocalVip(req.Vip, device, prefixlen); err != nil {
+		result.State, result.Message = "failed", err.Error()
+		return result
+	}
+	h.queue.Push(PriorityFailover, "handoff")
+
+	stateful, ok := h.provider.(Stateful)
+	if !ok {
+		result.State = "completed"
+		return result
+	}
+	deadline := time.Now().Add(time.Duration(h.parameter.Handoff.Timeout) * time.Second)
+	for time.Now().Before(deadline) {
+		state := stateful.VipState(req.Vip)
+		if state == StateBound {
+			result.State = "completed"
+			return result
+		}
+		if state == StateFailed {
+			break
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	//未能完成绑定，删除本机vip交还给A
+	removeLocalVip(req.Vip)
+	result.State, result.Message = "failed", "vip "+req.Vip+" is "+string(stateful.VipState(req.Vip))+" on peer"
+	return result
+}
+
+func (h *Handoff) begin(vip string) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.inflight[vip] {
+		return false
+	}
+	h.inflight[vip] = true
+	return true
+}
+
+func (h *Handoff) end(vip string) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.inflight, vip)
+}
+
+func (h *Handoff) callPeer(peer string, req HandoffRequest) (HandoffResult, error) {
+	result := HandoffResult{}
+	body, err := json.Marshal(req)
+	if err != nil {
+		return result, err
+	}
+	httpreq, err := http.NewRequest("POST", strings.TrimRight(peer, "/")+AdminApiPrefix+"/handoff/accept", bytes.NewReader(body))
+	if err != nil {
+		return result, err
+	}
+	httpreq.Header.Set("Content-Type", "application/json")
+	if h.parameter.Handoff.PeerToken != "" {
+		httpreq.Header.Set("Authorization", "Bearer "+h.parameter.Handoff.PeerToken)
+	}
+	resp, err := h.client.Do(httpreq)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusConflict {
+		data, _ := ioutil.ReadAll(resp.Body)
+		return result, errors.New(resp.Status + ": " + strings.TrimSpace(string(data)))
+	}
+	return result, json.NewDecoder(resp.Body).Decode(&result)
+}
+
+//删除本机接口上的vip，返回所在接口及前缀长度
+//privileges.noplumbing时之后无法恢复，在修改前拒绝，handoff发送方不会删除本机vip
+func removeLocalVip(vip string) (string, int, error) {
+	if localPlumbingDisabled {
+		return "", 0, errors.New("cannot remove " + vip + " from this node, privileges.noplumbing is set")
+	}
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", 0, err
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.String() != vip {
+				continue
+			}
+			prefixlen, _ := ipnet.Mask.Size()
+			if out, err := exec.Command("ip", "addr", "del", vip+"/"+strconv.Itoa(prefixlen), "dev", iface.Name).CombinedOutput(); err != nil {
+				return "", 0, errors.New("remove " + vip + " from " + iface.Name + ": " + strings.TrimSpace(string(out)))
+			}
+			return iface.Name, prefixlen, nil
+		}
+	}
+	return "", 0, errors.New("vip " + vip + " is not on this node")
+}
+
+func addLocalVip(vip string, device string, prefixlen int) error {
+	if localPlumbingDisabled {
+		return errors.New("cannot add " + vip + " to " + device + ", privileges.noplumbing is set")
+	}
+	if out, err := exec.Command("ip", "addr", "add", vip+"/"+strconv.Itoa(prefixlen), "dev", device).CombinedOutput(); err != nil {
+		return errors.New("add " + vip + " to " + device + ": " + strings.TrimSpace(string(out)))
+	}
+	return nil
+}
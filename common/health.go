@@ -0,0 +1,86 @@
+package common
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//带迟滞的健康判定：健康时连续failurethreshold次失败才判定为不健康，不健康时连续successthreshold次成功才恢复
+//两种状态下使用各自的探测间隔，warmup期间的失败不计数，避免噪声导致状态来回切换
+type HealthEvaluator struct {
+	mutex     sync.Mutex
+	name      string
+	config    JdHealthThresholds
+	healthy   bool
+	failures  int
+	successes int
+	started   time.Time
+	last      time.Time
+}
+
+//初始为健康，failurethreshold默认3，successthreshold默认1
+func NewHealthEvaluator(name string, config JdHealthThresholds) *HealthEvaluator {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+	if config.SuccessThreshold <= 0 {
+		config.SuccessThreshold = 1
+	}
+	return &HealthEvaluator{name: name, config: config, healthy: true, started: time.Now()}
+}
+
+//重新开始warmup，vip绑定后调用
+func (h *HealthEvaluator) Warmup() {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.started = time.Now()
+}
+
+//是否到了下一次探测时间，健康时按failureinterval，不健康时按successinterval
+func (h *HealthEvaluator) Due() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	interval := h.config.FailureInterval
+	if !h.healthy {
+		interval = h.config.SuccessInterval
+	}
+	return h.last.IsZero() || time.Since(h.last) >= time.Duration(interval)*time.Second
+}
+
+//记录一次探测结果，返回判定后的健康状态
+func (h *HealthEvaluator) Observe(ok bool) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	now := time.Now()
+	h.last = now
+	if ok {
+		h.failures = 0
+		h.successes++
+		if !h.healthy && h.successes >= h.config.SuccessThreshold {
+			h.healthy = true
+			log.Println("health", h.name, "recovered after", h.successes, "successful checks")
+		}
+		return h.healthy
+	}
+	h.successes = 0
+	if now.Sub(h.started) < time.Duration(h.config.Warmup)*time.Second {
+		log.Println("health", h.name, "check failed during warm-up, ignored")
+		return h.healthy
+	}
+	h.failures++
+	if h.healthy {
+		log.Println("health", h.name, "check failed", h.failures, "/", h.config.FailureThreshold)
+		if h.failures >= h.config.FailureThreshold {
+			h.healthy = false
+			log.Println("health", h.name, "marked unhealthy")
+		}
+	}
+	return h.healthy
+}
+
+func (h *HealthEvaluator) Healthy() bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.healthy
+}
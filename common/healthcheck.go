@@ -0,0 +1,463 @@
+package common
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"os/exec"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HealthCheckTcp  string = "tcp"
+	HealthCheckHttp string = "http"
+	HealthCheckExec string = "exec"
+	//由外部通过POST /v1/health/{check}推送结果
+	HealthCheckExternal string = "external"
+	//读取另一站点发布到共享存储的心跳，签名正确且在ttl内更新过时为健康
+	HealthCheckHeartbeat string = "heartbeat"
+	//由healthcheck插件判定，target为插件名
+	HealthCheckPlugin string = "plugin"
+)
+
+//具名健康检查，vip及dr主vip的健康由检查结果组成的布尔表达式决定
+type HealthChecks struct {
+	mutex  sync.Mutex
+	checks map[string]*healthCheck
+	//vip对应的健康表达式
+	vips map[string]*HealthExpr
+	once sync.Once
+}
+
+type healthCheck struct {
+	config    JdHealthCheck
+	evaluator *HealthEvaluator
+	//external检查最近一次推送结果的过期时间
+	mutex   sync.Mutex
+	expires time.Time
+	//heartbeat检查读取的存储、校验签名的密钥及重放窗口
+	store  HeartbeatStore
+	keys   *HeartbeatKeys
+	window *heartbeatWindow
+	//heartbeat检查最近一次读到的心跳版本及读到时的本机单调时间
+	version  string
+	advanced time.Time
+	plugin   *Plugin
+}
+
+//外部推送的检查结果，ttl单位为秒，未指定时使用检查配置的ttl
+type HealthVerdict struct {
+	Healthy bool   `json:"healthy"`
+	Ttl     int    `json:"ttl,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+var DefaultHealthChecks = &HealthChecks{checks: make(map[string]*healthCheck), vips: make(map[string]*HealthExpr)}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_health_check", MetricGauge, "Result of each named health check after hysteresis, 1 for healthy.")
+	DefaultMetrics.Register("vipsidecar_vip_healthy", MetricGauge, "Result of the health expression of each VIP, 1 for healthy.")
+}
+
+//加载检查配置及各vip的健康表达式，表达式引用未定义的检查时返回错误
+func (h *HealthChecks) Load(p *Parameters) error {
+	checks := make(map[string]*healthCheck)
+	for _, c := range p.HealthChecks {
+		if c.Name == "" {
+			return errors.New("healthchecks: name must be set")
+		}
+		if _, ok := checks[c.Name]; ok {
+			return errors.New("healthchecks: duplicate check " + c.Name)
+		}
+		switch c.Type {
+		case HealthCheckTcp, HealthCheckHttp, HealthCheckExec, HealthCheckPlugin:
+		case HealthCheckExternal, HealthCheckHeartbeat:
+			if c.Ttl <= 0 {
+				c.Ttl = 30
+			}
+		default:
+			return errors.New("healthchecks: unknown type " + c.Type + " of check " + c.Name)
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = 3
+		}
+		if c.FailureInterval <= 0 {
+			c.FailureInterval = 10
+		}
+		if c.SuccessInterval <= 0 {
+			c.SuccessInterval = c.FailureInterval
+		}
+		check := &healthCheck{config: c, evaluator: NewHealthEvaluator("check "+c.Name, c.JdHealthThresholds)}
+		if c.Type == HealthCheckHeartbeat {
+			store, err := NewHeartbeatStore(c.Target, p.Heartbeat.Headers)
+			if err != nil {
+				return errors.New("healthchecks: check " + c.Name + ": " + err.Error())
+			}
+			keys, err := NewHeartbeatKeys(p.Heartbeat)
+			if err != nil {
+				return errors.New("healthchecks: check " + c.Name + ": " + err.Error())
+			}
+			check.store, check.keys, check.window = store, keys, newHeartbeatWindow(p.Heartbeat.MaxAge)
+		}
+		if c.Type == HealthCheckPlugin {
+			plugin, err := DefaultPlugins.Get(c.Target, PluginTypeHealthCheck)
+			if err != nil {
+				return errors.New("healthchecks: check " + c.Name + ": " + err.Error())
+			}
+			check.plugin = plugin
+		}
+		checks[c.Name] = check
+	}
+	exprs := map[string]string{}
+	for _, vip := range p.Vips {
+		if vip.Health != "" {
+			exprs[vip.Ip] = vip.Health
+		}
+	}
+	if p.Dr.Health != "" {
+		exprs[p.Dr.PrimaryVip] = p.Dr.Health
+	}
+	vips := make(map[string]*HealthExpr)
+	for vip, s := range exprs {
+		expr, err := ParseHealthExpr(s)
+		if err != nil {
+			return errors.New("health of vip " + vip + ": " + err.Error())
+		}
+		for _, name := range expr.Names() {
+			if _, ok := checks[name]; !ok {
+				return errors.New("health of vip " + vip + ": unknown check " + name)
+			}
+		}
+		vips[vip] = expr
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.checks, h.vips = checks, vips
+	return nil
+}
+
+//启动各检查的探测
+func (h *HealthChecks) Start() {
+	h.once.Do(func() {
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+		for _, c := range h.checks {
+			go c.run()
+		}
+	})
+}
+
+func (c *healthCheck) run() {
+	for {
+		//external检查的结果过期后按失败计
+		if c.config.Type == HealthCheckExternal {
+			if c.expired() && c.evaluator.Due() {
+				c.record(c.evaluator.Observe(false))
+			}
+		} else if c.evaluator.Due() {
+			healthy := c.evaluator.Observe(c.probe())
+			c.record(healthy)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (c *healthCheck) record(healthy bool) {
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	DefaultMetrics.Set("vipsidecar_health_check", map[string]string{"check": c.config.Name}, value)
+	DefaultStatus.SetHealthCheck(c.config.Name, healthy)
+}
+
+func (c *healthCheck) expired() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return time.Now().After(c.expires)
+}
+
+//记录外部推送的结果
+func (c *healthCheck) push(verdict HealthVerdict) bool {
+	ttl := verdict.Ttl
+	if ttl <= 0 {
+		ttl = c.config.Ttl
+	}
+	c.mutex.Lock()
+	c.expires = time.Now().Add(time.Duration(ttl) * time.Second)
+	c.mutex.Unlock()
+	if !verdict.Healthy {
+		log.Println("health check", c.config.Name, "reported unhealthy", verdict.Message)
+	}
+	healthy := c.evaluator.Observe(verdict.Healthy)
+	c.record(healthy)
+	return healthy
+}
+
+//执行一次探测
+func (c *healthCheck) probe() bool {
+	timeout := time.Duration(c.config.Timeout) * time.Second
+	switch c.config.Type {
+	case HealthCheckTcp:
+		conn, err := net.DialTimeout("tcp", c.config.Target, timeout)
+		if err != nil {
+			return false
+		}
+		conn.Close()
+		return true
+	case HealthCheckHttp:
+		resp, err := (&http.Client{Timeout: timeout}).Get(c.config.Target)
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode < 400
+	case HealthCheckExec:
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return exec.CommandContext(ctx, "sh", "-c", c.config.Target).Run() == nil
+	case HealthCheckPlugin:
+		verdict := HealthVerdict{}
+		if err := c.plugin.Call("check", map[string]string{"check": c.config.Name}, &verdict); err != nil {
+			log.Println("health check", c.config.Name, err)
+			return false
+		}
+		return verdict.Healthy
+	case HealthCheckHeartbeat:
+		h, err := ReadHeartbeat(c.store, c.keys)
+		if err != nil {
+			log.Println("health check", c.config.Name, err)
+			return false
+		}
+		//按心跳版本是否在ttl内变化判断，不受双方时钟跳变(如热迁移)影响，启动后首次读到的心跳视为刚更新
+		//重放或过期的心跳不算更新，只按之前接受的心跳判断
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		if err := c.window.accept(h); err != nil {
+			log.Println("health check", c.config.Name, err)
+		} else if version := h.version(); version != c.version {
+			c.version, c.advanced = version, time.Now()
+		}
+		return time.Since(c.advanced) <= time.Duration(c.config.Ttl)*time.Second
+	}
+	return false
+}
+
+//注册POST /v1/health/{check}，供应用或外部agent推送external检查的结果
+func (h *HealthChecks) Register(admin *AdminServer) {
+	prefix := AdminApiPrefix + "/health/"
+	admin.HandleFunc(prefix, RoleOperator, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, prefix)
+		h.mutex.Lock()
+		c, ok := h.checks[name]
+		h.mutex.Unlock()
+		if !ok {
+			http.Error(w, "unknown check "+name, http.StatusNotFound)
+			return
+		}
+		if c.config.Type != HealthCheckExternal {
+			http.Error(w, "check "+name+" is not external", http.StatusConflict)
+			return
+		}
+		verdict := HealthVerdict{}
+		if err := json.NewDecoder(r.Body).Decode(&verdict); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		healthy := c.push(verdict)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]interface{}{"check": name, "healthy": healthy})
+	})
+}
+
+//检查经迟滞判定后的结果，未定义的检查视为不健康
+func (h *HealthChecks) Check(name string) bool {
+	h.mutex.Lock()
+	c, ok := h.checks[name]
+	h.mutex.Unlock()
+	return ok && c.evaluator.Healthy()
+}
+
+//vip是否健康，未配置健康表达式的vip视为健康
+func (h *HealthChecks) VipHealthy(vip string) (bool, bool) {
+	h.mutex.Lock()
+	expr, ok := h.vips[vip]
+	h.mutex.Unlock()
+	if !ok {
+		return true, false
+	}
+	healthy := expr.Eval(h.Check)
+	value := 0.0
+	if healthy {
+		value = 1
+	}
+	DefaultMetrics.Set("vipsidecar_vip_healthy", map[string]string{"vip": vip}, value)
+	return healthy, true
+}
+
+//本机健康表达式不成立时不自动接管vip，手动触发的事件不受限制
+func (h *HealthChecks) AllowFailover(ctx context.Context, vip string) bool {
+	if healthy, _ := h.VipHealthy(vip); healthy || ManualEvent(EventSource(ctx)) {
+		return true
+	}
+	reason := "unhealthy"
+	log.Println("automatic failover of", vip, "suppressed,", reason)
+	DefaultMetrics.Add("vipsidecar_failovers_suppressed_total", map[string]string{"reason": "health"}, 1)
+	DefaultStatus.SetSuppressedFailover(&SuppressedFailover{Time: time.Now(), Vip: vip, Reason: reason})
+	return false
+}
+
+//健康表达式，由检查名、AND、OR、NOT及括号组成，如app_http AND (db_role OR maintenance_override)
+type HealthExpr struct {
+	op       string
+	name     string
+	operands []*HealthExpr
+}
+
+func ParseHealthExpr(s string) (*HealthExpr, error) {
+	p := &healthExprParser{tokens: tokenizeHealthExpr(s)}
+	expr, err := p.or()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, errors.New("unexpected " + p.tokens[p.pos])
+	}
+	return expr, nil
+}
+
+func tokenizeHealthExpr(s string) []string {
+	s = strings.NewReplacer("(", " ( ", ")", " ) ", "&&", " AND ", "||", " OR ", "!", " NOT ").Replace(s)
+	tokens := strings.Fields(s)
+	for i, t := range tokens {
+		switch strings.ToUpper(t) {
+		case "AND", "OR", "NOT":
+			tokens[i] = strings.ToUpper(t)
+		}
+	}
+	return tokens
+}
+
+type healthExprParser struct {
+	tokens []string
+	pos    int
+}
+
+func (p *healthExprParser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *healthExprParser) or() (*HealthExpr, error) {
+	return p.binary("OR", p.and)
+}
+
+func (p *healthExprParser) and() (*HealthExpr, error) {
+	return p.binary("AND", p.unary)
+}
+
+func (p *healthExprParser) binary(op string, next func() (*HealthExpr, error)) (*HealthExpr, error) {
+	left, err := next()
+	if err != nil {
+		return nil, err
+	}
+	operands := []*HealthExpr{left}
+	for p.peek() == op {
+		p.pos++
+		right, err := next()
+		if err != nil {
+			return nil, err
+		}
+		operands = append(operands, right)
+	}
+	if len(operands) == 1 {
+		return left, nil
+	}
+	return &HealthExpr{op: op, operands: operands}, nil
+}
+
+func (p *healthExprParser) unary() (*HealthExpr, error) {
+	switch t := p.peek(); t {
+	case "":
+		return nil, errors.New("unexpected end of expression")
+	case "NOT":
+		p.pos++
+		operand, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return &HealthExpr{op: "NOT", operands: []*HealthExpr{operand}}, nil
+	case "(":
+		p.pos++
+		expr, err := p.or()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing )")
+		}
+		p.pos++
+		return expr, nil
+	case ")", "AND", "OR":
+		return nil, errors.New("unexpected " + t)
+	default:
+		p.pos++
+		return &HealthExpr{name: t}, nil
+	}
+}
+
+//按check返回的各检查结果求值
+func (e *HealthExpr) Eval(check func(name string) bool) bool {
+	switch e.op {
+	case "AND":
+		for _, operand := range e.operands {
+			if !operand.Eval(check) {
+				return false
+			}
+		}
+		return true
+	case "OR":
+		for _, operand := range e.operands {
+			if operand.Eval(check) {
+				return true
+			}
+		}
+		return false
+	case "NOT":
+		return !e.operands[0].Eval(check)
+	}
+	return check(e.name)
+}
+
+//表达式引用的检查名
+func (e *HealthExpr) Names() []string {
+	seen := map[string]bool{}
+	var walk func(*HealthExpr)
+	walk = func(e *HealthExpr) {
+		if e.op == "" {
+			seen[e.name] = true
+		}
+		for _, operand := range e.operands {
+			walk(operand)
+		}
+	}
+	walk(e)
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
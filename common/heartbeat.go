@@ -0,0 +1,336 @@
+package common
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//发布到共享存储的心跳，另一集群或region的vipsidecar据此判断本站点是否整体失效
+//读取方只比较epoch、sequence是否变化并用本机单调时钟计时，不比较双方的墙上时间，timestamp仅供查看
+type Heartbeat struct {
+	Version   int       `json:"version,omitempty"`
+	Holder    string    `json:"holder"`
+	Epoch     int64     `json:"epoch"`
+	Sequence  uint64    `json:"sequence,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+	Vips      []string  `json:"vips"`
+	KeyId     string    `json:"keyid,omitempty"`
+	Signature string    `json:"signature"`
+}
+
+//心跳存储，url为etcd://host:2379/key(etcds使用https)时通过etcd v3 json网关读写，http(s)时对url执行PUT/GET，如oss预签名url
+type HeartbeatStore interface {
+	Put(data []byte) error
+	Get() ([]byte, error)
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_heartbeat_published_timestamp_seconds", MetricGauge, "Time of the last heartbeat successfully published to shared storage.")
+	DefaultMetrics.Register("vipsidecar_heartbeat_rejected_total", MetricCounter, "Heartbeats read from shared storage and rejected, by reason: signature, replay or expired.")
+}
+
+func NewHeartbeatStore(rawurl string, headers map[string]string) (HeartbeatStore, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Timeout: 5 * time.Second}
+	switch u.Scheme {
+	case "etcd", "etcds":
+		scheme := "http"
+		if u.Scheme == "etcds" {
+			scheme = "https"
+		}
+		return &etcdHeartbeatStore{client: client, endpoint: scheme + "://" + u.Host, key: strings.TrimPrefix(u.Path, "/")}, nil
+	case "http", "https":
+		return &httpHeartbeatStore{client: client, url: rawurl, headers: headers}, nil
+	}
+	return nil, errors.New("unsupported heartbeat url " + rawurl)
+}
+
+type httpHeartbeatStore struct {
+	client  *http.Client
+	url     string
+	headers map[string]string
+}
+
+func (s *httpHeartbeatStore) do(method string, body []byte) ([]byte, error) {
+	req, err := http.NewRequest(method, s.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range s.headers {
+		req.Header.Set(k, v)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		return nil, errors.New(method + " heartbeat: " + resp.Status)
+	}
+	return data, nil
+}
+
+func (s *httpHeartbeatStore) Put(data []byte) error {
+	_, err := s.do("PUT", data)
+	return err
+}
+
+func (s *httpHeartbeatStore) Get() ([]byte, error) {
+	return s.do("GET", nil)
+}
+
+type etcdHeartbeatStore struct {
+	client   *http.Client
+	endpoint string
+	key      string
+}
+
+func (s *etcdHeartbeatStore) call(path string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	resp, err := s.client.Post(s.endpoint+path, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("etcd " + path + ": " + resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (s *etcdHeartbeatStore) Put(data []byte) error {
+	return s.call("/v3/kv/put", map[string]string{
+		"key":   base64.StdEncoding.EncodeToString([]byte(s.key)),
+		"value": base64.StdEncoding.EncodeToString(data),
+	}, &struct{}{})
+}
+
+func (s *etcdHeartbeatStore) Get() ([]byte, error) {
+	response := struct {
+		Kvs []struct {
+			Value string `json:"value"`
+		} `json:"kvs"`
+	}{}
+	err := s.call("/v3/kv/range", map[string]string{"key": base64.StdEncoding.EncodeToString([]byte(s.key))}, &response)
+	if err != nil {
+		return nil, err
+	}
+	if len(response.Kvs) == 0 {
+		return nil, errors.New("heartbeat key " + s.key + " not found")
+	}
+	return base64.StdEncoding.DecodeString(response.Kvs[0].Value)
+}
+
+//当前发布的心跳格式，签名内容的每一项带长度前缀
+const heartbeatVersion = 2
+
+//version 2签名内容为版本、holder、epoch、timestamp、sequence、keyid、vip个数及各vip，每项为"长度:内容"，各项的边界不会因内容中的分隔符产生歧义
+//没有version的旧版本心跳签名内容为以换行及逗号连接的各项，没有sequence、keyid的更旧版本不包含这两项，只用于校验未升级的发布方
+func (h *Heartbeat) sign(secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	if h.Version >= 2 {
+		fields := []string{strconv.Itoa(h.Version), h.Holder, strconv.FormatInt(h.Epoch, 10), h.Timestamp.UTC().Format(time.RFC3339Nano),
+			strconv.FormatUint(h.Sequence, 10), h.KeyId, strconv.Itoa(len(h.Vips))}
+		for _, field := range append(fields, h.Vips...) {
+			mac.Write([]byte(strconv.Itoa(len(field)) + ":" + field))
+		}
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	mac.Write([]byte(h.Holder + "\n" + strconv.FormatInt(h.Epoch, 10) + "\n" + h.Timestamp.UTC().Format(time.RFC3339Nano) + "\n" + strings.Join(h.Vips, ",")))
+	if h.Sequence > 0 {
+		mac.Write([]byte("\n" + strconv.FormatUint(h.Sequence, 10)))
+	}
+	if h.KeyId != "" {
+		mac.Write([]byte("\n" + h.KeyId))
+	}
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+//按keyid查找心跳密钥，secret对应空keyid，用于从单个secret迁移到keys
+//轮换时先在所有站点的keys中加入新密钥，再逐个把发布方的signkey改为新密钥，最后删除旧密钥，不需要所有站点同时重启
+type HeartbeatKeys struct {
+	secrets map[string]string
+	signkey string
+}
+
+func NewHeartbeatKeys(config JdHeartbeat) (*HeartbeatKeys, error) {
+	keys := &HeartbeatKeys{secrets: map[string]string{}, signkey: config.SignKey}
+	if config.Secret != "" {
+		keys.secrets[""] = config.Secret
+	}
+	for _, key := range config.Keys {
+		if key.Id == "" || key.Secret == "" {
+			return nil, errors.New("heartbeat.keys entries must have an id and a secret")
+		}
+		if _, ok := keys.secrets[key.Id]; ok {
+			return nil, errors.New("heartbeat.keys id " + key.Id + " is duplicated")
+		}
+		keys.secrets[key.Id] = key.Secret
+	}
+	//配置了secret时默认仍用secret签名，加入keys不会立即改变签名密钥
+	if config.Secret == "" && len(config.Keys) > 0 && keys.signkey == "" {
+		keys.signkey = config.Keys[0].Id
+	}
+	if _, ok := keys.secrets[keys.signkey]; !ok {
+		if keys.signkey == "" {
+			return nil, errors.New("heartbeat.secret or heartbeat.keys must be set when publishing or checking heartbeats")
+		}
+		return nil, errors.New("heartbeat.signkey " + keys.signkey + " is not in heartbeat.keys")
+	}
+	return keys, nil
+}
+
+//使用signkey签名
+func (k *HeartbeatKeys) sign(h *Heartbeat) {
+	h.KeyId = k.signkey
+	h.Signature = h.sign(k.secrets[k.signkey])
+}
+
+func (k *HeartbeatKeys) verify(h *Heartbeat) error {
+	secret, ok := k.secrets[h.KeyId]
+	if !ok {
+		return errors.New("heartbeat of " + h.Holder + " is signed with unknown key " + strconv.Quote(h.KeyId))
+	}
+	if !hmac.Equal([]byte(h.Signature), []byte(h.sign(secret))) {
+		return errors.New("heartbeat of " + h.Holder + " has an invalid signature")
+	}
+	return nil
+}
+
+//心跳的版本，任何一项变化都说明发布方仍在更新
+func (h *Heartbeat) version() string {
+	return h.Holder + "/" + strconv.FormatInt(h.Epoch, 10) + "/" + strconv.FormatUint(h.Sequence, 10) + "/" + h.Timestamp.UTC().Format(time.RFC3339Nano)
+}
+
+//读取并校验心跳签名
+func ReadHeartbeat(store HeartbeatStore, keys *HeartbeatKeys) (*Heartbeat, error) {
+	data, err := store.Get()
+	if err != nil {
+		return nil, err
+	}
+	h := &Heartbeat{}
+	if err := json.Unmarshal(data, h); err != nil {
+		return nil, err
+	}
+	if err := keys.verify(h); err != nil {
+		DefaultMetrics.Add("vipsidecar_heartbeat_rejected_total", map[string]string{"reason": "signature"}, 1)
+		return nil, err
+	}
+	return h, nil
+}
+
+//心跳在发布方内的位置，epoch为发布方启动时间，重启后变大，同一epoch内sequence递增
+type heartbeatPosition struct {
+	epoch    int64
+	sequence uint64
+}
+
+//读取方的重放窗口，记录每个holder已接受的最新位置，能写共享存储的一方写回任何旧的合法心跳都会被拒绝
+//读取方重启后没有基准，再按时间戳拒绝超过maxage的心跳(默认300秒，为负数时不检查)
+type heartbeatWindow struct {
+	maxage time.Duration
+	latest map[string]heartbeatPosition
+}
+
+func newHeartbeatWindow(maxage int) *heartbeatWindow {
+	return &heartbeatWindow{maxage: time.Duration(maxage) * time.Second, latest: map[string]heartbeatPosition{}}
+}
+
+//与最新位置相同(未更新)或更新时返回nil，更旧时为重放
+func (w *heartbeatWindow) accept(h *Heartbeat) error {
+	if w.maxage > 0 {
+		if age := time.Since(h.Timestamp); age > w.maxage || age < -w.maxage {
+			DefaultMetrics.Add("vipsidecar_heartbeat_rejected_total", map[string]string{"reason": "expired"}, 1)
+			return errors.New("heartbeat of " + h.Holder + " is timestamped " + h.Timestamp.Format(time.RFC3339) + ", outside heartbeat.maxage")
+		}
+	}
+	current := heartbeatPosition{epoch: h.Epoch, sequence: h.Sequence}
+	latest, seen := w.latest[h.Holder]
+	if seen && (current.epoch < latest.epoch || (current.epoch == latest.epoch && current.sequence < latest.sequence)) {
+		DefaultMetrics.Add("vipsidecar_heartbeat_rejected_total", map[string]string{"reason": "replay"}, 1)
+		return errors.New("heartbeat of " + h.Holder + " epoch " + strconv.FormatInt(h.Epoch, 10) + " sequence " + strconv.FormatUint(h.Sequence, 10) + " is older than one already accepted, possible replay")
+	}
+	w.latest[h.Holder] = current
+	return nil
+}
+
+//定期发布本机心跳，epoch为进程启动时间(纳秒，同一秒内重启也会变大)，用于区分重启前后的发布方，sequence每次发布加一
+type HeartbeatPublisher struct {
+	config   JdHeartbeat
+	store    HeartbeatStore
+	keys     *HeartbeatKeys
+	epoch    int64
+	sequence uint64
+	vips     func() []string
+}
+
+func NewHeartbeatPublisher(config JdHeartbeat, vips func() []string) (*HeartbeatPublisher, error) {
+	store, err := NewHeartbeatStore(config.Url, config.Headers)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := NewHeartbeatKeys(config)
+	if err != nil {
+		return nil, err
+	}
+	if config.Holder == "" {
+		config.Holder, _ = os.Hostname()
+	}
+	if config.Interval <= 0 {
+		config.Interval = 5
+	}
+	return &HeartbeatPublisher{config: config, store: store, keys: keys, epoch: time.Now().UnixNano(), vips: vips}, nil
+}
+
+func (p *HeartbeatPublisher) Publish() error {
+	p.sequence++
+	h := &Heartbeat{Version: heartbeatVersion, Holder: p.config.Holder, Epoch: p.epoch, Sequence: p.sequence, Timestamp: time.Now().UTC(), Vips: p.vips()}
+	p.keys.sign(h)
+	data, err := json.Marshal(h)
+	if err != nil {
+		return err
+	}
+	if err := p.store.Put(data); err != nil {
+		return err
+	}
+	DefaultMetrics.Set("vipsidecar_heartbeat_published_timestamp_seconds", nil, float64(h.Timestamp.Unix()))
+	return nil
+}
+
+func (p *HeartbeatPublisher) Run() {
+	DefaultSelfChecks.Expect(SelfCheckHeartbeat, 3*time.Duration(p.config.Interval)*time.Second)
+	for {
+		err := p.Publish()
+		if err != nil {
+			log.Println("heartbeat publish failed", err)
+		}
+		DefaultSelfChecks.Report(SelfCheckHeartbeat, err)
+		time.Sleep(time.Duration(p.config.Interval) * time.Second)
+	}
+}
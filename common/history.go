@@ -0,0 +1,84 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//一次vip状态转换，seq为vip的转换序号，每次转换递增，配置hookresults时重启后继续
+type Transition struct {
+	Time      time.Time `json:"time"`
+	Vip       string    `json:"vip"`
+	From      VipState  `json:"from"`
+	To        VipState  `json:"to"`
+	Reason    string    `json:"reason"`
+	RequestId string    `json:"requestId,omitempty"`
+	Epoch     uint64    `json:"epoch"`
+	Seq       uint64    `json:"seq"`
+}
+
+//保留最近size条状态转换的环形缓冲区
+type History struct {
+	mutex   sync.Mutex
+	entries []Transition
+	next    int
+	full    bool
+}
+
+var DefaultHistory = NewHistory(100)
+
+func NewHistory(size int) *History {
+	if size <= 0 {
+		size = 100
+	}
+	return &History{entries: make([]Transition, size)}
+}
+
+//调整缓冲区大小，已有记录保留最近的部分
+func (h *History) Resize(size int) {
+	if size <= 0 {
+		return
+	}
+	old := h.List()
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.entries = make([]Transition, size)
+	h.next, h.full = 0, false
+	if len(old) > size {
+		old = old[len(old)-size:]
+	}
+	for _, t := range old {
+		h.add(t)
+	}
+}
+
+func (h *History) Add(t Transition) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.add(t)
+}
+
+func (h *History) add(t Transition) {
+	h.entries[h.next] = t
+	h.next = (h.next + 1) % len(h.entries)
+	if h.next == 0 {
+		h.full = true
+	}
+}
+
+//按时间先后返回全部记录
+func (h *History) List() []Transition {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if !h.full {
+		return append([]Transition{}, h.entries[:h.next]...)
+	}
+	return append(append([]Transition{}, h.entries[h.next:]...), h.entries[:h.next]...)
+}
+
+func (h *History) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.List())
+}
@@ -0,0 +1,253 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+//hook执行状态，running在执行前写入，进程在执行期间退出时重启后为interrupted
+const (
+	HookRunning     string = "running"
+	HookSucceeded   string = "succeeded"
+	HookFailed      string = "failed"
+	HookInterrupted string = "interrupted"
+)
+
+//一次hook执行，以hook、vip及转换序号为键，同一次转换只执行一次
+type HookResult struct {
+	SchemaVersion int       `json:"schemaVersion"`
+	Hook          string    `json:"hook"`
+	Vip           string    `json:"vip"`
+	Seq           uint64    `json:"seq"`
+	Epoch         uint64    `json:"epoch"`
+	To            VipState  `json:"to"`
+	Status        string    `json:"status"`
+	Time          time.Time `json:"time"`
+	Duration      float64   `json:"durationSeconds,omitempty"`
+	Error         string    `json:"error,omitempty"`
+}
+
+type hookKey struct {
+	hook string
+	vip  string
+	seq  uint64
+}
+
+func (r *HookResult) key() hookKey {
+	return hookKey{hook: r.Hook, vip: r.Vip, seq: r.Seq}
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_hook_runs_total", MetricCounter, "Lifecycle hook executions, result=succeeded, failed or skipped for transitions already handled.")
+}
+
+//notifier插件等生命周期hook的执行结果，配置hookresults时追加写入文件(每行一个json)，重启后已执行过的转换不再执行，vip的转换序号从记录中的最大值继续
+type HookResults struct {
+	mutex   sync.Mutex
+	path    string
+	results map[hookKey]*HookResult
+}
+
+var DefaultHookResults = &HookResults{results: make(map[hookKey]*HookResult)}
+
+//读取已记录的结果，各hook及vip只保留最新epoch的全部记录，有记录去掉或改变时压缩文件
+func (h *HookResults) Load(path string) error {
+	if path == "" {
+		return nil
+	}
+	results, records, err := readHookResults(path)
+	if err != nil {
+		return err
+	}
+	changed := false
+	latest := map[string]uint64{}
+	for k, r := range results {
+		if r.Epoch > latest[k.hook+"/"+k.vip] {
+			latest[k.hook+"/"+k.vip] = r.Epoch
+		}
+	}
+	for k, r := range results {
+		if r.Epoch < latest[k.hook+"/"+k.vip] {
+			delete(results, k)
+			continue
+		}
+		if r.Status == HookRunning {
+			log.Println("hook", r.Hook, "for vip", r.Vip, r.To, "seq", r.Seq, "was interrupted, it will not be run again")
+			r.Status = HookInterrupted
+			changed = true
+		}
+	}
+	//没有变化时不改写，privileges.drop后重新执行的进程不需要state文件所在目录的写权限
+	if changed || records != len(results) {
+		if err := writeHookResults(path, results); err != nil {
+			return err
+		}
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.path, h.results = path, results
+	h.publish()
+	return nil
+}
+
+//返回各键最后一条记录及文件中的行数
+func readHookResults(path string) (map[hookKey]*HookResult, int, error) {
+	results := map[hookKey]*HookResult{}
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return results, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	records := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		records++
+		raw := map[string]interface{}{}
+		if json.Unmarshal(scanner.Bytes(), &raw) != nil {
+			continue
+		}
+		if err := migrateRecord(path, raw, HookResultsSchemaVersion, hookResultsMigrations); err != nil {
+			return nil, 0, err
+		}
+		data, _ := json.Marshal(raw)
+		r := &HookResult{}
+		if json.Unmarshal(data, r) != nil {
+			continue
+		}
+		results[r.key()] = r
+	}
+	return results, records, scanner.Err()
+}
+
+//写临时文件后改名替换
+func writeHookResults(path string, results map[hookKey]*HookResult) error {
+	tmp, err := os.OpenFile(path+".tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	for _, r := range results {
+		data, _ := json.Marshal(r)
+		tmp.Write(append(data, '\n'))
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+//追加一条记录，返回前fsync，文件不加密，hook返回的错误中的凭证及token在写入前替换
+func (h *HookResults) append(r HookResult) error {
+	if h.path == "" {
+		return nil
+	}
+	r.Error = DefaultRedactor.Redact(r.Error)
+	data, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//已记录的vip最大epoch，重启后状态机从该值继续递增，避免未配置failoverlog时epoch回退后与已执行的记录重复
+func (h *HookResults) Epoch(vip string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	epoch := uint64(0)
+	for k, r := range h.results {
+		if k.vip == vip && r.Epoch > epoch {
+			epoch = r.Epoch
+		}
+	}
+	return epoch
+}
+
+//已记录的vip最大转换序号，重启后状态机从该值继续递增，新的转换不会与已执行的记录重复
+func (h *HookResults) Seq(vip string) uint64 {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	seq := uint64(0)
+	for k := range h.results {
+		if k.vip == vip && k.seq > seq {
+			seq = k.seq
+		}
+	}
+	return seq
+}
+
+//执行hook前调用，同一次转换(seq相同)已执行过(含执行中退出)时返回false，否则记录为running后返回true
+func (h *HookResults) Claim(hook string, t Transition) bool {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	r := &HookResult{SchemaVersion: HookResultsSchemaVersion, Hook: hook, Vip: t.Vip, Seq: t.Seq, Epoch: t.Epoch, To: t.To, Status: HookRunning, Time: time.Now()}
+	if previous, ok := h.results[r.key()]; ok {
+		log.Println("hook", hook, "for vip", t.Vip, t.To, "seq", t.Seq, "already", previous.Status, "at", previous.Time.Format(time.RFC3339), "skipping")
+		DefaultMetrics.Add("vipsidecar_hook_runs_total", map[string]string{"hook": hook, "result": "skipped"}, 1)
+		return false
+	}
+	//记录写入失败时仍然执行，之后进程退出时该转换可能再次执行
+	if err := h.append(*r); err != nil {
+		log.Println("write hookresults", err)
+	}
+	h.results[r.key()] = r
+	h.publish()
+	return true
+}
+
+//记录hook的执行结果
+func (h *HookResults) Finish(hook string, t Transition, start time.Time, err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	r := &HookResult{SchemaVersion: HookResultsSchemaVersion, Hook: hook, Vip: t.Vip, Seq: t.Seq, Epoch: t.Epoch, To: t.To, Status: HookSucceeded, Time: time.Now(), Duration: time.Since(start).Seconds()}
+	if err != nil {
+		r.Status, r.Error = HookFailed, err.Error()
+	}
+	if err := h.append(*r); err != nil {
+		log.Println("write hookresults", err)
+	}
+	h.results[r.key()] = r
+	//同一hook及vip去掉之前epoch的记录，同一epoch内的记录全部保留
+	for k, previous := range h.results {
+		if k.hook == hook && k.vip == t.Vip && previous.Epoch < t.Epoch {
+			delete(h.results, k)
+		}
+	}
+	DefaultMetrics.Add("vipsidecar_hook_runs_total", map[string]string{"hook": hook, "result": r.Status}, 1)
+	h.publish()
+}
+
+//各hook在各vip上最近一次执行的结果
+func (h *HookResults) publish() {
+	hooks := map[string]map[string]HookResult{}
+	for k, r := range h.results {
+		if hooks[k.hook] == nil {
+			hooks[k.hook] = map[string]HookResult{}
+		}
+		if previous, ok := hooks[k.hook][k.vip]; !ok || r.Time.After(previous.Time) {
+			hooks[k.hook][k.vip] = *r
+		}
+	}
+	DefaultStatus.SetHooks(hooks)
+}
@@ -0,0 +1,145 @@
+package common
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+//--debug-http时每个body最多输出的字节数，0时不输出请求及响应
+var httpDumpMaxBody int64
+
+//请求编号，用于对应请求、响应及之后输出的响应body
+var httpDumpSeq uint64
+
+//输出所有经过http.DefaultTransport的请求及响应(含sdk及thinclient访问京东云的请求)，内容经过DefaultRedactor替换后写入log
+//ConfigureTransport及InstallProxy修改的是被包装的*http.Transport，与调用顺序无关
+func EnableHttpDump(maxbody int) {
+	if maxbody <= 0 {
+		maxbody = 4096
+	}
+	httpDumpMaxBody = int64(maxbody)
+	http.DefaultTransport = WrapHttpDump(http.DefaultTransport)
+	log.Println("dumping outbound http requests and responses, body limit", maxbody, "bytes")
+}
+
+//未启用--debug-http时原样返回，用于不使用DefaultTransport的client
+func WrapHttpDump(next http.RoundTripper) http.RoundTripper {
+	if httpDumpMaxBody == 0 {
+		return next
+	}
+	return &dumpTransport{next: next}
+}
+
+//启用--debug-http后DefaultTransport被包装，取被包装的*http.Transport
+func defaultHttpTransport() (*http.Transport, bool) {
+	if d, ok := http.DefaultTransport.(*dumpTransport); ok {
+		transport, ok := d.next.(*http.Transport)
+		return transport, ok
+	}
+	transport, ok := http.DefaultTransport.(*http.Transport)
+	return transport, ok
+}
+
+type dumpTransport struct {
+	next http.RoundTripper
+}
+
+func (d *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	seq := atomic.AddUint64(&httpDumpSeq, 1)
+	prefix := "http #" + strconv.FormatUint(seq, 10)
+	//请求body需要完整读出后还原，京东云及其他接口的请求body都很小
+	var body []byte
+	if req.Body != nil {
+		data, err := ioutil.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		body = data
+		req.Body = ioutil.NopCloser(bytes.NewReader(data))
+	}
+	log.Println(prefix, "request", req.Method, req.URL.String()+"\n"+dumpHeader(req.Header)+dumpBody(body, int64(len(body))))
+	resp, err := d.next.RoundTrip(req)
+	if err != nil {
+		log.Println(prefix, "failed", err)
+		return resp, err
+	}
+	log.Println(prefix, "response", resp.Status+"\n"+dumpHeader(resp.Header))
+	//响应body可能是watch等长连接，不预先读取，在调用方读完或关闭时输出已读取的部分
+	resp.Body = &dumpReader{ReadCloser: resp.Body, prefix: prefix}
+	return resp, nil
+}
+
+func dumpHeader(header http.Header) string {
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	lines := []string{}
+	for _, key := range keys {
+		for _, value := range header[key] {
+			lines = append(lines, key+": "+value)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+//total为body的实际长度，超过限制的部分只输出长度
+func dumpBody(body []byte, total int64) string {
+	if total == 0 {
+		return ""
+	}
+	if int64(len(body)) > httpDumpMaxBody {
+		body = body[:httpDumpMaxBody]
+	}
+	s := "\n\n" + string(body)
+	if total > int64(len(body)) {
+		s += "\n... " + strconv.FormatInt(total-int64(len(body)), 10) + " more bytes"
+	}
+	return s
+}
+
+//记录调用方读取的响应body的前httpDumpMaxBody字节，读到结尾或关闭时输出一次
+type dumpReader struct {
+	io.ReadCloser
+	prefix string
+	buf    []byte
+	total  int64
+	dumped bool
+}
+
+func (d *dumpReader) Read(p []byte) (int, error) {
+	n, err := d.ReadCloser.Read(p)
+	if room := httpDumpMaxBody - int64(len(d.buf)); room > 0 {
+		if int64(n) < room {
+			room = int64(n)
+		}
+		d.buf = append(d.buf, p[:room]...)
+	}
+	d.total += int64(n)
+	if err == io.EOF {
+		d.dump()
+	}
+	return n, err
+}
+
+func (d *dumpReader) Close() error {
+	d.dump()
+	return d.ReadCloser.Close()
+}
+
+func (d *dumpReader) dump() {
+	if d.dumped {
+		return
+	}
+	d.dumped = true
+	log.Println(d.prefix, "response body", strconv.FormatInt(d.total, 10), "bytes read"+dumpBody(d.buf, d.total))
+}
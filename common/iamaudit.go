@@ -0,0 +1,137 @@
+package common
+
+import (
+	"encoding/json"
+)
+
+//vipsidecar可能用到的京东云IAM action
+const (
+	ActionDescribeNetworkInterfaces string = "vpc:describeNetworkInterfaces"
+	ActionAssignSecondaryIps        string = "vpc:assignSecondaryIps"
+	ActionUnassignSecondaryIps      string = "vpc:unassignSecondaryIps"
+	ActionDescribeDnatRule          string = "vpc:describeDnatRule"
+	ActionModifyDnatRule            string = "vpc:modifyDnatRule"
+	ActionDescribeNetworkInterface  string = "vpc:describeNetworkInterface"
+	ActionAttachNetworkInterface    string = "vm:attachNetworkInterface"
+	ActionDetachNetworkInterface    string = "vm:detachNetworkInterface"
+)
+
+//iam-audit对单个action的检查结果
+const (
+	IamAllowed  string = "allowed"
+	IamDenied   string = "denied"
+	IamUntested string = "untested"
+	IamError    string = "error"
+)
+
+//探测时使用的占位资源id，资源不存在(NotFound)说明鉴权已通过
+const iamProbeId string = "vipsidecar-iam-audit"
+
+type IamAuditResult struct {
+	Action   string
+	Required bool
+	Result   string
+	Detail   string
+}
+
+//当前配置需要的action，按mode决定
+func RequiredIamActions(p *Parameters) []string {
+	switch p.Mode {
+	case ModeNatDnat:
+		return []string{ActionDescribeDnatRule, ActionModifyDnatRule}
+	case ModeDr:
+		return []string{ActionDescribeNetworkInterfaces, ActionAssignSecondaryIps}
+	case ModeEni:
+		return []string{ActionDescribeNetworkInterfaces, ActionDescribeNetworkInterface, ActionAttachNetworkInterface, ActionDetachNetworkInterface}
+	default:
+		return []string{ActionDescribeNetworkInterfaces, ActionAssignSecondaryIps, ActionUnassignSecondaryIps}
+	}
+}
+
+//逐个检查全部已知action，只调用describe类接口；修改类action不做调用，标记为untested
+//不需要却可以调用的describe类action视为多余权限
+func IamAudit(p *Parameters, clients *RegionClients) []IamAuditResult {
+	required := RequiredIamActions(p)
+	results := []IamAuditResult{}
+	for _, action := range []string{ActionDescribeNetworkInterfaces, ActionAssignSecondaryIps, ActionUnassignSecondaryIps, ActionDescribeDnatRule, ActionModifyDnatRule, ActionDescribeNetworkInterface, ActionAttachNetworkInterface, ActionDetachNetworkInterface} {
+		ok, _ := Contain(action, required)
+		result := IamAuditResult{Action: action, Required: ok, Result: IamUntested}
+		var err error
+		switch action {
+		case ActionDescribeNetworkInterfaces:
+			regionid, ids := iamProbeInterfaces(p)
+			_, err = clients.Get(regionid).DescribeNetworkInterfacesIps(regionid, ids)
+		case ActionDescribeDnatRule:
+			regionid, natgatewayid, dnatruleid := iamProbeDnatRule(p)
+			_, err = clients.Get(regionid).DescribeDnatRule(regionid, natgatewayid, dnatruleid)
+		case ActionDescribeNetworkInterface:
+			regionid, id := iamProbeEni(p)
+			_, err = clients.Get(regionid).DescribeNetworkInterface(regionid, id)
+		default:
+			result.Detail = "mutating action, not called"
+			results = append(results, result)
+			continue
+		}
+		switch {
+		case err == nil || IsNotFound(err):
+			result.Result = IamAllowed
+		case IsPermissionDenied(err):
+			result.Result, result.Detail = IamDenied, err.Error()
+		default:
+			result.Result, result.Detail = IamError, err.Error()
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+func iamProbeInterfaces(p *Parameters) (string, []string) {
+	nf := p.Localnetworkinterface
+	if p.Mode == ModeDr {
+		nf = p.Dr.StandbyNetworkInterface
+	}
+	if nf.NetWorkInterfaceId == "" {
+		nf.NetWorkInterfaceId = iamProbeId
+	}
+	return nf.RangId, []string{nf.NetWorkInterfaceId}
+}
+
+func iamProbeEni(p *Parameters) (string, string) {
+	regionid, id := p.Eni.RangId, iamProbeId
+	if regionid == "" {
+		regionid = p.Localnetworkinterface.RangId
+	}
+	if len(p.Eni.Interfaces) > 0 {
+		id = p.Eni.Interfaces[0].NetworkInterfaceId
+	}
+	return regionid, id
+}
+
+func iamProbeDnatRule(p *Parameters) (string, string, string) {
+	natgateway := p.NatGateway
+	regionid := natgateway.RangId
+	if regionid == "" {
+		regionid = p.Localnetworkinterface.RangId
+	}
+	natgatewayid, dnatruleid := natgateway.NatGatewayId, iamProbeId
+	if natgatewayid == "" {
+		natgatewayid = iamProbeId
+	}
+	if len(natgateway.DnatRules) > 0 {
+		dnatruleid = natgateway.DnatRules[0].DnatRuleId
+	}
+	return regionid, natgatewayid, dnatruleid
+}
+
+//生成只包含所需action的京东云IAM策略文档
+func IamPolicy(actions []string) ([]byte, error) {
+	policy := map[string]interface{}{
+		"Version": "3",
+		"Statement": []map[string]interface{}{{
+			"Effect":   "Allow",
+			"Action":   actions,
+			"Resource": []string{"*"},
+		}},
+	}
+	return json.MarshalIndent(policy, "", "  ")
+}
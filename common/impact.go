@@ -0,0 +1,137 @@
+package common
+
+import (
+	"bufio"
+	"encoding/hex"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//手动迁移vip前的影响评估，预计中断时间按本机最近几次故障转移各阶段的平均耗时估算
+type HandoffImpact struct {
+	ExpectedDowntime float64            `json:"expectedDowntimeSeconds"`
+	Phases           map[string]float64 `json:"phaseSeconds,omitempty"`
+	Failovers        int                `json:"failoversObserved"`
+	ListeningPorts   []int              `json:"listeningPorts"`
+	Connections      int                `json:"establishedConnections"`
+	Conntrack        int                `json:"conntrackEntries"`
+	Notes            []string           `json:"notes,omitempty"`
+}
+
+//估算预计中断时间使用的最近故障转移数
+const recentFailovers = 20
+
+//各模式最近几次故障转移各阶段的耗时
+type PhaseLatencies struct {
+	mutex   sync.Mutex
+	samples map[string][]map[string]time.Duration
+}
+
+var DefaultPhaseLatencies = &PhaseLatencies{samples: map[string][]map[string]time.Duration{}}
+
+func (p *PhaseLatencies) Record(mode string, phases map[string]time.Duration) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	samples := append(p.samples[mode], phases)
+	if len(samples) > recentFailovers {
+		samples = samples[len(samples)-recentFailovers:]
+	}
+	p.samples[mode] = samples
+}
+
+//各阶段的平均耗时(秒)、合计及参与估算的故障转移数
+func (p *PhaseLatencies) Estimate(mode string) (map[string]float64, float64, int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	samples := p.samples[mode]
+	averages, total := map[string]float64{}, 0.0
+	for _, phases := range samples {
+		for phase, elapsed := range phases {
+			averages[phase] += elapsed.Seconds() / float64(len(samples))
+		}
+	}
+	for _, average := range averages {
+		total += average
+	}
+	return averages, total, len(samples)
+}
+
+func EstimateHandoffImpact(vip string, mode string) *HandoffImpact {
+	impact := &HandoffImpact{ListeningPorts: []int{}}
+	impact.Phases, impact.ExpectedDowntime, impact.Failovers = DefaultPhaseLatencies.Estimate(mode)
+	if impact.Failovers == 0 {
+		impact.Notes = append(impact.Notes, "no failover observed since start, expected downtime unknown")
+	}
+	listening, established, err := vipTcpSockets(vip)
+	if err != nil {
+		impact.Notes = append(impact.Notes, "tcp sockets: "+err.Error())
+	}
+	impact.ListeningPorts, impact.Connections = listening, established
+	if impact.Conntrack, err = vipConntrackEntries(vip); err != nil {
+		impact.Notes = append(impact.Notes, "conntrack: "+err.Error())
+	}
+	return impact
+}
+
+//本机监听vip(含0.0.0.0、::)的tcp端口及以vip为本端地址的已建立连接数
+func vipTcpSockets(vip string) ([]int, int, error) {
+	ip := net.ParseIP(vip)
+	ports, established := map[int]bool{}, 0
+	var lasterr error
+	for _, file := range []string{"/proc/net/tcp", "/proc/net/tcp6"} {
+		f, err := os.Open(file)
+		if err != nil {
+			lasterr = err
+			continue
+		}
+		scanner := bufio.NewScanner(f)
+		scanner.Scan()
+		for scanner.Scan() {
+			fields := strings.Fields(scanner.Text())
+			if len(fields) < 4 {
+				continue
+			}
+			local, port := parseProcNetAddr(fields[1])
+			switch fields[3] {
+			case "0A":
+				if local != nil && (local.Equal(ip) || local.IsUnspecified()) {
+					ports[port] = true
+				}
+			case "01":
+				if local != nil && local.Equal(ip) {
+					established++
+				}
+			}
+		}
+		f.Close()
+	}
+	listening := []int{}
+	for port := range ports {
+		listening = append(listening, port)
+	}
+	sort.Ints(listening)
+	return listening, established, lasterr
+}
+
+//解析/proc/net/tcp中的地址，地址按32位字以主机字节序(小端)输出
+func parseProcNetAddr(s string) (net.IP, int) {
+	parts := strings.Split(s, ":")
+	if len(parts) != 2 {
+		return nil, 0
+	}
+	raw, err := hex.DecodeString(parts[0])
+	if err != nil || (len(raw) != net.IPv4len && len(raw) != net.IPv6len) {
+		return nil, 0
+	}
+	ip := make(net.IP, len(raw))
+	for i := 0; i < len(raw); i += 4 {
+		ip[i], ip[i+1], ip[i+2], ip[i+3] = raw[i+3], raw[i+2], raw[i+1], raw[i]
+	}
+	port, _ := strconv.ParseInt(parts[1], 16, 32)
+	return ip, int(port)
+}
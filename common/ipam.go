@@ -0,0 +1,198 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//IPAM/CMDB类型
+const (
+	IpamNetbox string = "netbox"
+	IpamPlugin string = "plugin"
+)
+
+//IPAM/CMDB适配器
+type IpamAdapter interface {
+	//检查vip是否预留给service，未预留时返回NotReserved错误
+	CheckReservation(vip string, service string) error
+	//记录vip的新持有者
+	RecordHolder(vip string, holder string) error
+}
+
+//绑定vip前检查预留，绑定后记录持有者，未配置时为nil，方法可在nil上调用
+type Ipam struct {
+	adapter IpamAdapter
+	service string
+	holder  string
+}
+
+var DefaultIpam *Ipam
+
+func NewIpam(config JdIpam) (*Ipam, error) {
+	var adapter IpamAdapter
+	switch config.Type {
+	case "":
+		return nil, nil
+	case IpamNetbox:
+		if config.Url == "" {
+			return nil, errors.New("ipam.url must be set for netbox")
+		}
+		if config.ServiceField == "" {
+			config.ServiceField = "vip_service"
+		}
+		if config.HolderField == "" {
+			config.HolderField = "vip_holder"
+		}
+		adapter = &netboxIpam{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+	case IpamPlugin:
+		plugin, err := DefaultPlugins.Get(config.Plugin, PluginTypeIpam)
+		if err != nil {
+			return nil, errors.New("ipam.plugin: " + err.Error())
+		}
+		adapter = &pluginIpam{plugin: plugin}
+	default:
+		return nil, errors.New("unknown ipam type " + config.Type)
+	}
+	holder := config.Holder
+	if holder == "" {
+		holder, _ = os.Hostname()
+	}
+	return &Ipam{adapter: adapter, service: config.Service, holder: holder}, nil
+}
+
+//IPAM不可用时同样拒绝绑定，避免误用地址
+func (i *Ipam) Check(vip string) error {
+	if i == nil {
+		return nil
+	}
+	if err := i.adapter.CheckReservation(vip, i.service); err != nil {
+		DefaultStatus.RecordError("IpamCheckReservation", err)
+		return err
+	}
+	return nil
+}
+
+//记录失败只输出日志，不影响已完成的绑定
+func (i *Ipam) Record(vip string) {
+	if i == nil {
+		return
+	}
+	if err := i.adapter.RecordHolder(vip, i.holder); err != nil {
+		log.Println("ipam record holder of", vip, err)
+		DefaultStatus.RecordError("IpamRecordHolder", err)
+	}
+}
+
+//NetBox适配器：vip需在ipam/ip-addresses中存在，状态为reserved或active，且自定义字段servicefield等于service
+type netboxIpam struct {
+	config JdIpam
+	client *http.Client
+}
+
+type netboxIpAddress struct {
+	Id     int `json:"id"`
+	Status struct {
+		Value string `json:"value"`
+	} `json:"status"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+}
+
+func (n *netboxIpam) do(method string, path string, body interface{}, response interface{}) error {
+	var data []byte
+	if body != nil {
+		var err error
+		if data, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(n.config.Url, "/")+path, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+n.config.Token)
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New("netbox " + method + " " + path + ": " + resp.Status)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+func (n *netboxIpam) lookup(vip string) (*netboxIpAddress, error) {
+	response := struct {
+		Results []netboxIpAddress `json:"results"`
+	}{}
+	if err := n.do("GET", "/api/ipam/ip-addresses/?address="+url.QueryEscape(vip), nil, &response); err != nil {
+		return nil, err
+	}
+	if len(response.Results) == 0 {
+		return nil, NewNotReservedError("vip " + vip + " is not registered in netbox")
+	}
+	return &response.Results[0], nil
+}
+
+func (n *netboxIpam) CheckReservation(vip string, service string) error {
+	address, err := n.lookup(vip)
+	if err != nil {
+		return err
+	}
+	if status := address.Status.Value; status != "reserved" && status != "active" {
+		return NewNotReservedError("vip " + vip + " has status " + status + " in netbox")
+	}
+	if service != "" {
+		if owner, _ := address.CustomFields[n.config.ServiceField].(string); owner != service {
+			return NewNotReservedError("vip " + vip + " is reserved for " + strconv.Quote(owner) + " in netbox, not " + service)
+		}
+	}
+	return nil
+}
+
+func (n *netboxIpam) RecordHolder(vip string, holder string) error {
+	address, err := n.lookup(vip)
+	if err != nil {
+		return err
+	}
+	return n.do("PATCH", "/api/ipam/ip-addresses/"+strconv.Itoa(address.Id)+"/", map[string]interface{}{
+		"status":        "active",
+		"custom_fields": map[string]string{n.config.HolderField: holder},
+	}, nil)
+}
+
+//ipam插件适配器，方法为check及record
+type pluginIpam struct {
+	plugin *Plugin
+}
+
+func (p *pluginIpam) CheckReservation(vip string, service string) error {
+	response := struct {
+		Reserved bool   `json:"reserved"`
+		Reason   string `json:"reason"`
+	}{}
+	if err := p.plugin.Call("check", map[string]string{"vip": vip, "service": service}, &response); err != nil {
+		return err
+	}
+	if !response.Reserved {
+		return NewNotReservedError("vip " + vip + " is not reserved for " + service + ": " + response.Reason)
+	}
+	return nil
+}
+
+func (p *pluginIpam) RecordHolder(vip string, holder string) error {
+	return p.plugin.Call("record", map[string]string{"vip": vip, "holder": holder}, nil)
+}
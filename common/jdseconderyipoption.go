@@ -1,76 +1,64 @@
 package common
 
 import (
-	"github.com/jdcloud-api/jdcloud-sdk-go/core"
-	"github.com/jdcloud-api/jdcloud-sdk-go/services/vpc/apis"
-	"github.com/jdcloud-api/jdcloud-sdk-go/services/vpc/client"
-	"github.com/jdcloud-api/jdcloud-sdk-go/services/vpc/models"
 	"log"
 )
 
-type DefaultLogger struct {
-	Level int
-}
-
-func (logger DefaultLogger) Log(level int, message ...interface{}) {
-	if level <= logger.Level {
-		// fmt.Println(message...)
+//批量获取同一region内多块网卡上的SecondaryIps，失败时返回空结果及错误
+func GetNetworkInterfacesIps(api VpcApi, regionId string, network_interface_ids []string) (map[string][]string, error) {
+	result, err := api.DescribeNetworkInterfacesIps(regionId, network_interface_ids)
+	if err != nil {
+		log.Println(err)
+		DefaultStatus.RecordError("DescribeNetworkInterfaces", err)
+		return map[string][]string{}, err
 	}
+	return result, nil
 }
 
-func InitVpcClient(accessKey string, secretKey string) *client.VpcClient {
-	defaultlogger := DefaultLogger{}
-	defaultlogger.Level = 1
-	credentials := core.NewCredentials(accessKey, secretKey)
-	vpcclient := client.NewVpcClient(credentials)
-	vpcclient.SetLogger(defaultlogger)
-	return vpcclient
+//为网卡注册sencondaryip，返回requestId，budget为nil时不限制重试时间
+func AssignVips(api VpcApi, regionId string, network_interface_id string, ips []string, budget *Budget) (string, error) {
+	return assignVips(api, regionId, network_interface_id, ips, budget.RetryPolicy())
 }
 
-//获取网卡上的SecondaryIps
-func GetNetworkInterfaceIps(client *client.VpcClient, regionId string, network_interface_id string) []models.NetworkInterfacePrivateIp {
-	networkinterfacereq := apis.NewDescribeNetworkInterfaceRequest(regionId, network_interface_id)
-	nirespons, err := client.DescribeNetworkInterface(networkinterfacereq)
+func assignVips(api VpcApi, regionId string, network_interface_id string, ips []string, policy RetryPolicy) (string, error) {
+	requestid, err := policy.Do("AssignSecondaryIps", func() (string, error) {
+		return api.AssignSecondaryIps(regionId, network_interface_id, ips)
+	})
 	if err != nil {
-		log.Fatalln(err)
+		log.Println(err)
+		DefaultStatus.RecordError("AssignSecondaryIps", err)
+		return requestid, err
 	}
-	return nirespons.Result.NetworkInterface.SecondaryIps
+	log.Println("assigned", ips, "to", network_interface_id, "requestId", requestid)
+	return requestid, nil
+}
 
+//为网卡注销sencondaryip
+func UnAssignVips(api VpcApi, regionId string, network_interface_id string, ips []string, budget *Budget) error {
+	_, err := unassignVips(api, regionId, network_interface_id, ips, budget.RetryPolicy())
+	return err
 }
 
-//为网卡注册sencondaryip
-func AssignVips(client *client.VpcClient, regionId string, network_interface_id string, ips []string) {
-	assignsencondaryipsreq := apis.NewAssignSecondaryIpsRequest(regionId, network_interface_id)
-	assignsencondaryipsreq.SecondaryIps = ips
-	respons, err := client.AssignSecondaryIps(assignsencondaryipsreq)
+func unassignVips(api VpcApi, regionId string, network_interface_id string, ips []string, policy RetryPolicy) (string, error) {
+	requestid, err := policy.Do("UnassignSecondaryIps", func() (string, error) {
+		return api.UnassignSecondaryIps(regionId, network_interface_id, ips)
+	})
 	if err != nil {
 		log.Println(err)
+		DefaultStatus.RecordError("UnassignSecondaryIps", err)
+		return requestid, err
 	}
-	log.Println(respons)
-}
-
-//为网卡注销sencondaryip
-func UnAssignVips(client *client.VpcClient, regionId string, network_interface_id string, ips []string) {
-	unassignsecondaryipsreq := apis.NewUnassignSecondaryIpsRequest(regionId, network_interface_id)
-	unassignsecondaryipsreq.SecondaryIps = ips
-	client.UnassignSecondaryIps(unassignsecondaryipsreq)
+	log.Println("unassigned", ips, "from", network_interface_id, "requestId", requestid)
+	return requestid, nil
 }
 
 //查看NetworkInterface是否绑定某一sencondaryip
-func IpExistsOnInterface(client *client.VpcClient, regionId string, network_interface_id string, ip string) bool {
-	exists := false
-	networkinterfacereq := apis.NewDescribeNetworkInterfaceRequest(regionId, network_interface_id)
-	nirespons, err := client.DescribeNetworkInterface(networkinterfacereq)
+func IpExistsOnInterface(api VpcApi, regionId string, network_interface_id string, ip string) bool {
+	result, err := api.DescribeNetworkInterfacesIps(regionId, []string{network_interface_id})
 	if err != nil {
-		log.Fatalln(err)
-		return exists
-	}
-	ips := nirespons.Result.NetworkInterface.SecondaryIps
-	for _, sechonderyip := range ips {
-		if sechonderyip.PrivateIpAddress == ip {
-			exists = true
-		}
+		log.Println(err)
+		return false
 	}
-
-	return exists
+	ok, _ := Contain(ip, result[network_interface_id])
+	return ok
 }
@@ -0,0 +1,466 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//vip事件类型
+const (
+	VipEventOwnership string = "ownership"
+	VipEventFailure   string = "failure"
+)
+
+//kafka接口编号
+const (
+	kafkaApiProduce          int16 = 0
+	kafkaApiMetadata         int16 = 3
+	kafkaApiSaslHandshake    int16 = 17
+	kafkaApiSaslAuthenticate int16 = 36
+)
+
+//发布到kafka的vip事件，key为vip，同一vip的事件写入同一分区以保证顺序
+type VipEvent struct {
+	Time   time.Time `json:"time"`
+	Holder string    `json:"holder"`
+	Event  string    `json:"event"`
+	Vip    string    `json:"vip"`
+	From   VipState  `json:"from"`
+	To     VipState  `json:"to"`
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_kafka_events_total", MetricCounter, "VIP events exported to Kafka, result=sent or dropped.")
+}
+
+//将vip归属变化及失败事件导出到kafka，未配置brokers时不导出
+type KafkaExporter struct {
+	mutex  sync.Mutex
+	config JdKafka
+	holder string
+	events chan VipEvent
+}
+
+var DefaultKafka = &KafkaExporter{}
+
+func (k *KafkaExporter) Load(config JdKafka) error {
+	if len(config.Brokers) == 0 {
+		return nil
+	}
+	if config.Topic == "" {
+		return errors.New("kafka.topic must be set")
+	}
+	switch strings.ToLower(config.Sasl.Mechanism) {
+	case "":
+	case "plain":
+		if config.Sasl.Username == "" {
+			return errors.New("kafka.sasl.username must be set")
+		}
+	default:
+		return errors.New("kafka.sasl.mechanism " + config.Sasl.Mechanism + " is not supported, use plain")
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 10
+	}
+	if config.Tls.CaCert != "" {
+		if _, err := ioutil.ReadFile(config.Tls.CaCert); err != nil {
+			return errors.New("kafka.tls.cacert: " + err.Error())
+		}
+	}
+	holder, _ := os.Hostname()
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	k.config, k.holder = config, holder
+	if k.events == nil {
+		k.events = make(chan VipEvent, 1000)
+		go k.run()
+	}
+	return nil
+}
+
+//状态机回调，vip绑定到本机或从本机释放时导出ownership事件，转为Failed时导出failure事件
+//队列满时丢弃事件，不阻塞状态机
+func (k *KafkaExporter) Notify(vip string, from VipState, to VipState) {
+	event := VipEventOwnership
+	switch to {
+	case StateBound, StateReleased:
+	case StateFailed:
+		event = VipEventFailure
+	default:
+		return
+	}
+	k.mutex.Lock()
+	events, holder := k.events, k.holder
+	k.mutex.Unlock()
+	if events == nil {
+		return
+	}
+	select {
+	case events <- VipEvent{Time: time.Now(), Holder: holder, Event: event, Vip: vip, From: from, To: to}:
+	default:
+		log.Println("kafka event queue full, dropping event of", vip)
+		DefaultMetrics.Add("vipsidecar_kafka_events_total", map[string]string{"result": "dropped"}, 1)
+	}
+}
+
+//按顺序发送事件，失败时重试3次
+func (k *KafkaExporter) run() {
+	for event := range k.events {
+		value, _ := json.Marshal(event)
+		var err error
+		for attempt := 0; attempt < 3; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = k.Produce([]byte(event.Vip), value); err == nil {
+				break
+			}
+		}
+		result := "sent"
+		if err != nil {
+			log.Println("kafka export event of", event.Vip, err)
+			DefaultStatus.RecordError("KafkaProduce", err)
+			result = "dropped"
+		}
+		DefaultMetrics.Add("vipsidecar_kafka_events_total", map[string]string{"result": result}, 1)
+	}
+}
+
+//写入一条消息，每次通过bootstrap broker查询分区leader后连接leader发送，acks为all
+func (k *KafkaExporter) Produce(key []byte, value []byte) error {
+	k.mutex.Lock()
+	config := k.config
+	k.mutex.Unlock()
+	var conn *kafkaConn
+	var err error
+	for _, broker := range config.Brokers {
+		if conn, err = dialKafka(config, broker); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return err
+	}
+	brokers, partitions, err := conn.metadata(config.Topic)
+	conn.Close()
+	if err != nil {
+		return err
+	}
+	if len(partitions) == 0 {
+		return errors.New("kafka topic " + config.Topic + " has no partitions")
+	}
+	partition := int32(crc32.ChecksumIEEE(key) % uint32(len(partitions)))
+	leader, ok := brokers[partitions[partition]]
+	if !ok {
+		return errors.New("kafka partition " + strconv.Itoa(int(partition)) + " of " + config.Topic + " has no leader")
+	}
+	if conn, err = dialKafka(config, leader); err != nil {
+		return err
+	}
+	defer conn.Close()
+	return conn.produce(config.Topic, partition, key, value, time.Duration(config.Timeout)*time.Second)
+}
+
+//单个broker连接，按需完成tls及sasl认证
+type kafkaConn struct {
+	net.Conn
+	correlation int32
+}
+
+func dialKafka(config JdKafka, addr string) (*kafkaConn, error) {
+	timeout := time.Duration(config.Timeout) * time.Second
+	dialer := &net.Dialer{Timeout: timeout}
+	var conn net.Conn
+	var err error
+	if config.Tls.Enabled {
+		tlsconfig := &tls.Config{InsecureSkipVerify: config.Tls.InsecureSkipVerify}
+		if config.Tls.CaCert != "" {
+			pem, err := ioutil.ReadFile(config.Tls.CaCert)
+			if err != nil {
+				return nil, err
+			}
+			tlsconfig.RootCAs = x509.NewCertPool()
+			tlsconfig.RootCAs.AppendCertsFromPEM(pem)
+		}
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsconfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	c := &kafkaConn{Conn: conn}
+	if config.Sasl.Mechanism != "" {
+		if err := c.saslPlain(config.Sasl.Username, config.Sasl.Password); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+//发送请求并读取响应，请求头为v1
+func (c *kafkaConn) call(apikey int16, version int16, body []byte) (*kafkaDecoder, error) {
+	c.correlation++
+	e := &kafkaEncoder{}
+	e.int16(apikey)
+	e.int16(version)
+	e.int32(c.correlation)
+	e.string("vipsidecar")
+	e.buf.Write(body)
+	size := make([]byte, 4)
+	binary.BigEndian.PutUint32(size, uint32(e.buf.Len()))
+	if _, err := c.Write(append(size, e.buf.Bytes()...)); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(c, size); err != nil {
+		return nil, err
+	}
+	response := make([]byte, binary.BigEndian.Uint32(size))
+	if _, err := io.ReadFull(c, response); err != nil {
+		return nil, err
+	}
+	d := &kafkaDecoder{data: response}
+	if d.int32() != c.correlation {
+		return nil, errors.New("kafka response correlation id mismatch")
+	}
+	return d, d.err
+}
+
+func kafkaError(operation string, code int16) error {
+	if code == 0 {
+		return nil
+	}
+	return errors.New("kafka " + operation + " failed with error code " + strconv.Itoa(int(code)))
+}
+
+//SaslHandshake v1后使用SaslAuthenticate v0发送PLAIN凭证
+func (c *kafkaConn) saslPlain(username string, password string) error {
+	e := &kafkaEncoder{}
+	e.string("PLAIN")
+	d, err := c.call(kafkaApiSaslHandshake, 1, e.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	if err := kafkaError("sasl handshake", d.int16()); err != nil {
+		return err
+	}
+	e = &kafkaEncoder{}
+	e.bytes([]byte("\x00" + username + "\x00" + password))
+	if d, err = c.call(kafkaApiSaslAuthenticate, 0, e.buf.Bytes()); err != nil {
+		return err
+	}
+	code, message := d.int16(), d.string()
+	if code != 0 {
+		return errors.New("kafka sasl authenticate failed: " + message)
+	}
+	return d.err
+}
+
+//Metadata v1，返回broker id到地址的映射及各分区的leader
+func (c *kafkaConn) metadata(topic string) (map[int32]string, []int32, error) {
+	e := &kafkaEncoder{}
+	e.int32(1)
+	e.string(topic)
+	d, err := c.call(kafkaApiMetadata, 1, e.buf.Bytes())
+	if err != nil {
+		return nil, nil, err
+	}
+	brokers := map[int32]string{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		id, host, port := d.int32(), d.string(), d.int32()
+		d.string()
+		brokers[id] = net.JoinHostPort(host, strconv.Itoa(int(port)))
+	}
+	d.int32()
+	partitions := []int32{}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		code, name := d.int16(), d.string()
+		d.int8()
+		if name == topic {
+			if err := kafkaError("metadata of "+topic, code); err != nil {
+				return nil, nil, err
+			}
+		}
+		count := d.int32()
+		if name == topic {
+			partitions = make([]int32, count)
+		}
+		for i := int32(0); i < count && d.err == nil; i++ {
+			d.int16()
+			index, leader := d.int32(), d.int32()
+			d.int32s()
+			d.int32s()
+			if name == topic && index >= 0 && index < count {
+				partitions[index] = leader
+			}
+		}
+	}
+	return brokers, partitions, d.err
+}
+
+//Produce v3，消息格式为record batch v2
+func (c *kafkaConn) produce(topic string, partition int32, key []byte, value []byte, timeout time.Duration) error {
+	e := &kafkaEncoder{}
+	e.int16(-1)
+	e.int16(-1)
+	e.int32(int32(timeout / time.Millisecond))
+	e.int32(1)
+	e.string(topic)
+	e.int32(1)
+	e.int32(partition)
+	e.bytes(kafkaRecordBatch(key, value, time.Now()))
+	d, err := c.call(kafkaApiProduce, 3, e.buf.Bytes())
+	if err != nil {
+		return err
+	}
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.string()
+		for m := d.int32(); m > 0 && d.err == nil; m-- {
+			d.int32()
+			if err := kafkaError("produce to "+topic, d.int16()); err != nil {
+				return err
+			}
+			d.int64()
+			d.int64()
+		}
+	}
+	return d.err
+}
+
+//只包含一条消息的record batch，crc为attributes之后内容的CRC-32C
+func kafkaRecordBatch(key []byte, value []byte, t time.Time) []byte {
+	record := &kafkaEncoder{}
+	record.int8(0)
+	record.varint(0)
+	record.varint(0)
+	record.varint(int64(len(key)))
+	record.buf.Write(key)
+	record.varint(int64(len(value)))
+	record.buf.Write(value)
+	record.varint(0)
+
+	timestamp := t.UnixNano() / int64(time.Millisecond)
+	body := &kafkaEncoder{}
+	body.int16(0)
+	body.int32(0)
+	body.int64(timestamp)
+	body.int64(timestamp)
+	body.int64(-1)
+	body.int16(-1)
+	body.int32(-1)
+	body.int32(1)
+	body.varint(int64(record.buf.Len()))
+	body.buf.Write(record.buf.Bytes())
+
+	batch := &kafkaEncoder{}
+	batch.int64(0)
+	batch.int32(int32(4 + 1 + 4 + body.buf.Len()))
+	batch.int32(-1)
+	batch.int8(2)
+	batch.int32(int32(crc32.Checksum(body.buf.Bytes(), crc32.MakeTable(crc32.Castagnoli))))
+	batch.buf.Write(body.buf.Bytes())
+	return batch.buf.Bytes()
+}
+
+type kafkaEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *kafkaEncoder) int8(v int8)   { e.buf.WriteByte(byte(v)) }
+func (e *kafkaEncoder) int16(v int16) { binary.Write(&e.buf, binary.BigEndian, v) }
+func (e *kafkaEncoder) int32(v int32) { binary.Write(&e.buf, binary.BigEndian, v) }
+func (e *kafkaEncoder) int64(v int64) { binary.Write(&e.buf, binary.BigEndian, v) }
+
+func (e *kafkaEncoder) string(v string) {
+	e.int16(int16(len(v)))
+	e.buf.WriteString(v)
+}
+
+func (e *kafkaEncoder) bytes(v []byte) {
+	e.int32(int32(len(v)))
+	e.buf.Write(v)
+}
+
+//zigzag编码的变长整数
+func (e *kafkaEncoder) varint(v int64) {
+	b := make([]byte, binary.MaxVarintLen64)
+	e.buf.Write(b[:binary.PutVarint(b, v)])
+}
+
+//读取越界时记录错误，之后的读取均返回0值
+type kafkaDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *kafkaDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n < 0 || len(d.data) < n {
+		d.err = errors.New("kafka response is truncated")
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *kafkaDecoder) int8() int8 {
+	if b := d.next(1); b != nil {
+		return int8(b[0])
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int16() int16 {
+	if b := d.next(2); b != nil {
+		return int16(binary.BigEndian.Uint16(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int32() int32 {
+	if b := d.next(4); b != nil {
+		return int32(binary.BigEndian.Uint32(b))
+	}
+	return 0
+}
+
+func (d *kafkaDecoder) int64() int64 {
+	if b := d.next(8); b != nil {
+		return int64(binary.BigEndian.Uint64(b))
+	}
+	return 0
+}
+
+//长度为-1的nullable string返回空
+func (d *kafkaDecoder) string() string {
+	n := d.int16()
+	if n < 0 {
+		return ""
+	}
+	return string(d.next(int(n)))
+}
+
+func (d *kafkaDecoder) int32s() {
+	for n := d.int32(); n > 0 && d.err == nil; n-- {
+		d.int32()
+	}
+}
@@ -0,0 +1,348 @@
+package common
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+//keepalived中的vrrp_script
+type KeepalivedScript struct {
+	Name     string
+	Script   string
+	Interval int
+	Timeout  int
+	Fall     int
+	Rise     int
+	Weight   int
+}
+
+//keepalived中的vrrp_instance，只保留迁移需要的字段
+type KeepalivedInstance struct {
+	Name            string
+	State           string
+	Interface       string
+	VirtualRouterId int
+	Priority        int
+	Addresses       []KeepalivedAddress
+	TrackScripts    []string
+	TrackInterfaces []string
+}
+
+type KeepalivedAddress struct {
+	Ip  string
+	Dev string
+}
+
+type KeepalivedConfig struct {
+	Scripts   []KeepalivedScript
+	Instances []KeepalivedInstance
+	//无法迁移而被忽略的顶层配置块，如virtual_server、vrrp_sync_group
+	Ignored []string
+}
+
+//配置中的一条语句，以{开始的语句带有子语句
+type keepalivedNode struct {
+	args     []string
+	children []*keepalivedNode
+}
+
+//解析keepalived.conf，include按所在文件目录展开
+func ParseKeepalivedConf(path string) (*KeepalivedConfig, error) {
+	root := &keepalivedNode{}
+	if err := parseKeepalivedFile(path, []*keepalivedNode{root}, 0); err != nil {
+		return nil, err
+	}
+	c := &KeepalivedConfig{}
+	for _, n := range root.children {
+		if len(n.args) == 0 {
+			continue
+		}
+		switch n.args[0] {
+		case "global_defs":
+		case "vrrp_script":
+			if len(n.args) < 2 {
+				return nil, errors.New("vrrp_script without a name")
+			}
+			c.Scripts = append(c.Scripts, keepalivedScript(n))
+		case "vrrp_instance":
+			if len(n.args) < 2 {
+				return nil, errors.New("vrrp_instance without a name")
+			}
+			c.Instances = append(c.Instances, keepalivedInstance(n))
+		default:
+			c.Ignored = append(c.Ignored, strings.Join(n.args, " "))
+		}
+	}
+	return c, nil
+}
+
+func parseKeepalivedFile(path string, stack []*keepalivedNode, depth int) error {
+	if depth > 8 {
+		return errors.New("include nested too deep at " + path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	for lineno, line := range strings.Split(string(data), "\n") {
+		tokens := tokenizeKeepalivedLine(line)
+		if len(tokens) >= 2 && tokens[0] == "include" {
+			pattern := tokens[1]
+			if !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(filepath.Dir(path), pattern)
+			}
+			files, _ := filepath.Glob(pattern)
+			for _, f := range files {
+				if err := parseKeepalivedFile(f, stack, depth+1); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		args := []string{}
+		for _, t := range tokens {
+			switch t {
+			case "{":
+				node := &keepalivedNode{args: args}
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, node)
+				stack = append(stack, node)
+				args = []string{}
+			case "}":
+				if len(args) > 0 {
+					parent := stack[len(stack)-1]
+					parent.children = append(parent.children, &keepalivedNode{args: args})
+					args = []string{}
+				}
+				if len(stack) == 1 {
+					return errors.New(path + ":" + strconv.Itoa(lineno+1) + ": unexpected }")
+				}
+				stack = stack[:len(stack)-1]
+			default:
+				args = append(args, t)
+			}
+		}
+		if len(args) > 0 {
+			parent := stack[len(stack)-1]
+			parent.children = append(parent.children, &keepalivedNode{args: args})
+		}
+	}
+	return nil
+}
+
+//按空白切分一行，{}单独成词，引号内的空白保留，#及!之后为注释
+func tokenizeKeepalivedLine(line string) []string {
+	tokens := []string{}
+	current, quoted, inword := []rune{}, false, false
+	flush := func() {
+		if inword {
+			tokens = append(tokens, string(current))
+		}
+		current, inword = current[:0], false
+	}
+	for _, r := range line {
+		switch {
+		case quoted:
+			if r == '"' {
+				quoted = false
+			} else {
+				current = append(current, r)
+			}
+		case r == '"':
+			quoted, inword = true, true
+		case r == '#' || r == '!':
+			if !inword {
+				flush()
+				return tokens
+			}
+			current = append(current, r)
+		case r == '{' || r == '}':
+			flush()
+			tokens = append(tokens, string(r))
+		case r == ' ' || r == '\t' || r == '\r':
+			flush()
+		default:
+			current, inword = append(current, r), true
+		}
+	}
+	flush()
+	return tokens
+}
+
+func keepalivedScript(n *keepalivedNode) KeepalivedScript {
+	s := KeepalivedScript{Name: n.args[1], Interval: 1, Fall: 1, Rise: 1}
+	for _, c := range n.children {
+		if len(c.args) < 2 {
+			continue
+		}
+		value, _ := strconv.Atoi(c.args[1])
+		switch c.args[0] {
+		case "script":
+			s.Script = strings.Join(c.args[1:], " ")
+		case "interval":
+			s.Interval = value
+		case "timeout":
+			s.Timeout = value
+		case "fall":
+			s.Fall = value
+		case "rise":
+			s.Rise = value
+		case "weight":
+			s.Weight = value
+		}
+	}
+	return s
+}
+
+func keepalivedInstance(n *keepalivedNode) KeepalivedInstance {
+	i := KeepalivedInstance{Name: n.args[1]}
+	for _, c := range n.children {
+		if len(c.args) == 0 {
+			continue
+		}
+		switch c.args[0] {
+		case "state", "interface":
+			if len(c.args) < 2 {
+				continue
+			}
+			if c.args[0] == "state" {
+				i.State = c.args[1]
+			} else {
+				i.Interface = c.args[1]
+			}
+		case "virtual_router_id", "priority":
+			if len(c.args) < 2 {
+				continue
+			}
+			value, _ := strconv.Atoi(c.args[1])
+			if c.args[0] == "priority" {
+				i.Priority = value
+			} else {
+				i.VirtualRouterId = value
+			}
+		case "virtual_ipaddress", "virtual_ipaddress_excluded":
+			for _, a := range c.children {
+				if len(a.args) == 0 {
+					continue
+				}
+				address := KeepalivedAddress{Ip: strings.SplitN(a.args[0], "/", 2)[0]}
+				for k := 1; k+1 < len(a.args); k++ {
+					if a.args[k] == "dev" {
+						address.Dev = a.args[k+1]
+					}
+				}
+				i.Addresses = append(i.Addresses, address)
+			}
+		case "track_script":
+			for _, s := range c.children {
+				if len(s.args) > 0 {
+					i.TrackScripts = append(i.TrackScripts, s.args[0])
+				}
+			}
+		case "track_interface":
+			for _, s := range c.children {
+				if len(s.args) > 0 {
+					i.TrackInterfaces = append(i.TrackInterfaces, s.args[0])
+				}
+			}
+		}
+	}
+	return i
+}
+
+//生成等价的vipsidecar配置，vrrp_script转换为exec健康检查，track_script组成vip的健康表达式
+//vipsidecar没有vrrp，地址仍由keepalived按优先级选举后配置到网卡，vipsidecar负责将其绑定到本机弹性网卡
+//返回的notes为无法等价转换的配置，以注释形式输出
+func (c *KeepalivedConfig) Migrate() (yaml.MapSlice, []string) {
+	notes := []string{
+		"keepalived keeps running VRRP: state, priority and virtual_router_id still decide which node configures the address,",
+		"vipsidecar follows the address on the interface and binds it to this node's network interface in the cloud.",
+		"fill in accessskeyid, accesskeysecret, allnetworkinterfaces and localnetworkinterface before use.",
+	}
+	scripts := map[string]KeepalivedScript{}
+	checks := []ms{}
+	for _, s := range c.Scripts {
+		name := keepalivedCheckName(s.Name)
+		scripts[s.Name] = s
+		timeout := s.Timeout
+		if timeout <= 0 {
+			timeout = s.Interval
+		}
+		checks = append(checks, ms{
+			{Key: "name", Value: name},
+			{Key: "type", Value: HealthCheckExec},
+			{Key: "target", Value: s.Script},
+			{Key: "timeout", Value: timeout},
+			{Key: "failurethreshold", Value: s.Fall},
+			{Key: "successthreshold", Value: s.Rise},
+			{Key: "failureinterval", Value: s.Interval},
+			{Key: "successinterval", Value: s.Interval},
+		})
+		if s.Weight != 0 {
+			notes = append(notes, "vrrp_script "+s.Name+" has weight "+strconv.Itoa(s.Weight)+": keepalived only lowers the priority, in vipsidecar a failing check blocks takeover of the vips tracking it")
+		}
+	}
+	vips, seen := []ms{}, map[string]bool{}
+	for _, i := range c.Instances {
+		notes = append(notes, "vrrp_instance "+i.Name+": state "+i.State+", interface "+i.Interface+", virtual_router_id "+strconv.Itoa(i.VirtualRouterId)+", priority "+strconv.Itoa(i.Priority))
+		terms := []string{}
+		for _, t := range i.TrackScripts {
+			if _, ok := scripts[t]; !ok {
+				notes = append(notes, "vrrp_instance "+i.Name+" tracks undefined vrrp_script "+t+", skipped")
+				continue
+			}
+			terms = append(terms, keepalivedCheckName(t))
+		}
+		if len(i.TrackInterfaces) > 0 {
+			notes = append(notes, "vrrp_instance "+i.Name+" track_interface "+strings.Join(i.TrackInterfaces, " ")+" has no equivalent and is left to keepalived")
+		}
+		for _, a := range i.Addresses {
+			if seen[a.Ip] {
+				continue
+			}
+			seen[a.Ip] = true
+			vip := ms{{Key: "ip", Value: a.Ip}}
+			dev := a.Dev
+			if dev == "" {
+				dev = i.Interface
+			}
+			if dev != "" {
+				vip = append(vip, yaml.MapItem{Key: "device", Value: dev})
+			}
+			if len(terms) > 0 {
+				vip = append(vip, yaml.MapItem{Key: "health", Value: strings.Join(terms, " AND ")})
+			}
+			vips = append(vips, vip)
+		}
+	}
+	for _, block := range c.Ignored {
+		notes = append(notes, block+" is not migrated")
+	}
+	config := ms{
+		{Key: "accessskeyid", Value: ""},
+		{Key: "accesskeysecret", Value: ""},
+		{Key: "vips", Value: vips},
+	}
+	if len(checks) > 0 {
+		config = append(config, yaml.MapItem{Key: "healthchecks", Value: checks})
+	}
+	config = append(config,
+		yaml.MapItem{Key: "allnetworkinterfaces", Value: []ms{{{Key: "rangid", Value: ""}, {Key: "networkinterfaceid", Value: ""}}}},
+		yaml.MapItem{Key: "localnetworkinterface", Value: ms{{Key: "rangid", Value: ""}, {Key: "networkinterfaceid", Value: ""}}},
+	)
+	return config, notes
+}
+
+//健康表达式按空白及括号、!、&、|切分，检查名中的这些字符替换为下划线
+func keepalivedCheckName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if strings.ContainsRune(" \t()!&|", r) {
+			return '_'
+		}
+		return r
+	}, name)
+}
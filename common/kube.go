@@ -0,0 +1,72 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+//pod内service account凭证所在目录
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+//访问kubernetes API的最小client，使用pod内service account的token及CA
+type kubeClient struct {
+	apiurl string
+	client *http.Client
+}
+
+//apiserver为空时使用pod内的KUBERNETES_SERVICE_HOST，field为报错时使用的配置项名
+func newKubeClient(apiserver string, field string) (*kubeClient, error) {
+	if apiserver == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" {
+			return nil, errors.New(field + " must be set when not running in a pod")
+		}
+		apiserver = "https://" + net.JoinHostPort(host, port)
+	}
+	transport := &http.Transport{TLSClientConfig: &tls.Config{}}
+	if pem, err := ioutil.ReadFile(serviceAccountDir + "/ca.crt"); err == nil {
+		pool := x509.NewCertPool()
+		pool.AppendCertsFromPEM(pem)
+		transport.TLSClientConfig.RootCAs = pool
+	}
+	return &kubeClient{apiurl: strings.TrimRight(apiserver, "/"), client: &http.Client{Timeout: 10 * time.Second, Transport: WrapHttpDump(transport)}}, nil
+}
+
+//发送请求，out不为nil时解析响应
+func (k *kubeClient) do(method string, path string, contenttype string, body []byte, out interface{}) error {
+	req, err := http.NewRequest(method, k.apiurl+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if contenttype != "" {
+		req.Header.Set("Content-Type", contenttype)
+	}
+	//projected token会轮换，每次请求重新读取
+	if token, err := ioutil.ReadFile(serviceAccountDir + "/token"); err == nil {
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	resp, err := k.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(method + " " + path + ": " + resp.Status)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
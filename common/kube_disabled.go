@@ -0,0 +1,66 @@
+//go:build nok8s
+// +build nok8s
+
+package common
+
+import "errors"
+
+//使用nok8s编译标签时不包含kubernetes相关的子系统，配置中启用这些功能时启动失败
+var errNoKubernetes = errors.New("kubernetes support is not compiled in (built with the nok8s tag)")
+
+func init() {
+	registerFeature("nok8s")
+}
+
+func newCoreDnsOverride(config JdCoreDnsOverride) (func(content string) error, error) {
+	return nil, errors.New("dr.override.coredns: " + errNoKubernetes.Error())
+}
+
+type ExternalDnsSource struct{}
+
+var DefaultExternalDns = &ExternalDnsSource{}
+
+func (e *ExternalDnsSource) Load(config JdExternalDns) error {
+	if config.Enabled {
+		return errors.New("externaldns: " + errNoKubernetes.Error())
+	}
+	return nil
+}
+
+func (e *ExternalDnsSource) Notify(vip string, from VipState, to VipState) {}
+
+type DrainWatcher struct{}
+
+func NewDrainWatcher(config JdDrain, handoff *Handoff, vips []string) (*DrainWatcher, error) {
+	return nil, errors.New("drain: " + errNoKubernetes.Error())
+}
+
+func (d *DrainWatcher) Run() {}
+
+type LoadBalancerController struct{}
+
+func NewLoadBalancerController(config JdLoadBalancer, vips []string, queue *EventQueue) (*LoadBalancerController, error) {
+	return nil, errors.New("loadbalancer: " + errNoKubernetes.Error())
+}
+
+func (l *LoadBalancerController) Run() {}
+
+type GatewayController struct{}
+
+func NewGatewayController(config JdGateway, vips []string, queue *EventQueue) (*GatewayController, error) {
+	return nil, errors.New("gateway: " + errNoKubernetes.Error())
+}
+
+func (g *GatewayController) Run() {}
+
+type ConflictScanner struct{}
+
+func NewConflictScanner(p *Parameters) (*ConflictScanner, error) {
+	return nil, errors.New("conflicts: " + errNoKubernetes.Error())
+}
+
+func (c *ConflictScanner) Run() {}
+
+func (c *ConflictScanner) Scan() ([]VipConflict, error) {
+	return nil, errNoKubernetes
+}
@@ -0,0 +1,342 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"time"
+)
+
+//对象注解，vip指定从pool中分配的地址，pool指定分配地址的VipPool，holder记录当前持有vip的节点
+const (
+	AnnotationVip    = "vipsidecar.jdcloud.com/vip"
+	AnnotationPool   = "vipsidecar.jdcloud.com/pool"
+	AnnotationHolder = "vipsidecar.jdcloud.com/holder"
+)
+
+//需要从pool分配vip的kubernetes对象(LoadBalancer service、Gateway)
+type vipClaim struct {
+	namespace       string
+	name            string
+	resourceversion string
+	created         time.Time
+	assigned        []string //已写入对象的地址
+	requested       string   //注解或spec中指定的地址
+	pool            string   //注解指定的VipPool
+	holder          string
+}
+
+func (c vipClaim) key() string {
+	return c.namespace + "/" + c.name
+}
+
+//按创建时间排序，分配冲突时先创建的优先
+func sortClaims(claims []vipClaim) {
+	sort.Slice(claims, func(i, j int) bool {
+		if !claims[i].created.Equal(claims[j].created) {
+			return claims[i].created.Before(claims[j].created)
+		}
+		return claims[i].key() < claims[j].key()
+	})
+}
+
+//依次保留已写入对象的地址、指定的地址，其余对象按pool顺序分配空闲地址，指定了地址但不可用时不分配其他地址
+//allowed不为nil时限制对象可使用的地址，auto表示地址不是对象已有或指定的
+//每个节点对相同的对象列表得到相同的结果，返回分配结果、未分配的对象数及空闲地址数
+func allocateVips(pool []string, claims []vipClaim, allowed func(c vipClaim, vip string, auto bool) bool) (map[string]string, int, int) {
+	allocation := map[string]string{}
+	used := map[string]bool{}
+	claim := func(c vipClaim, vip string, auto bool) bool {
+		if vip == "" || used[vip] {
+			return false
+		}
+		if ok, _ := Contain(vip, pool); !ok {
+			return false
+		}
+		if allowed != nil && !allowed(c, vip, auto) {
+			return false
+		}
+		allocation[c.key()], used[vip] = vip, true
+		return true
+	}
+	for _, c := range claims {
+		for _, vip := range c.assigned {
+			if claim(c, vip, false) {
+				break
+			}
+		}
+	}
+	for _, c := range claims {
+		if _, ok := allocation[c.key()]; !ok {
+			claim(c, c.requested, false)
+		}
+	}
+	pending := 0
+	for _, c := range claims {
+		if _, ok := allocation[c.key()]; ok {
+			continue
+		}
+		allocated := false
+		if c.requested == "" {
+			for _, vip := range pool {
+				if allocated = claim(c, vip, true); allocated {
+					break
+				}
+			}
+		}
+		if !allocated {
+			pending++
+		}
+	}
+	return allocation, pending, len(pool) - len(used)
+}
+
+//当前持有者仍可用时保持不变，避免后端扩缩容时vip漂移，否则取名称最小的节点
+func pickHolder(current string, nodes []string) string {
+	if len(nodes) == 0 {
+		return ""
+	}
+	sorted := append([]string{}, nodes...)
+	sort.Strings(sorted)
+	if ok, _ := Contain(current, sorted); ok && current != "" {
+		return current
+	}
+	return sorted[0]
+}
+
+//kubernetes API不可用时的处理方式
+const (
+	//保留本机已持有的vip，可确定持有者的对象照常处理
+	OutageHold string = "hold"
+	//保留本机已持有的vip，持续不可用超过releaseafter秒后删除，避免与其他节点同时持有
+	OutageReleaseAfter string = "release-after"
+	//任何查询失败时本轮不做修改(不添加、删除vip，不回写对象)
+	OutageFreeze string = "freeze"
+)
+
+func init() {
+	registerFeature("kube-election")
+	DefaultMetrics.Register("vipsidecar_election_backend_available", MetricGauge, "0 while the kubernetes API used to choose vip holders is unavailable.")
+}
+
+func checkOutage(field string, outage *JdOutage) error {
+	switch outage.Policy {
+	case "":
+		outage.Policy = OutageHold
+	case OutageHold, OutageFreeze:
+	case OutageReleaseAfter:
+		if outage.ReleaseAfter <= 0 {
+			return errors.New(field + ".releaseafter must be positive when policy is " + OutageReleaseAfter)
+		}
+	default:
+		return errors.New(field + ".policy must be " + OutageHold + ", " + OutageReleaseAfter + " or " + OutageFreeze)
+	}
+	return nil
+}
+
+//根据分配结果及持有者在本机接口上添加或删除pool中的地址，本机接口上的vip由provider完成云上绑定
+//known记录出现过的pool地址，地址从pool中移除后也能删除本机上的vip
+type vipHolderSync struct {
+	name   string //日志前缀
+	node   string
+	device string
+	queue  *EventQueue
+	known  []string
+	outage JdOutage
+	since  time.Time //kubernetes API持续不可用的开始时间
+}
+
+func newVipHolderSync(name string, node string, device string, outage JdOutage, queue *EventQueue) *vipHolderSync {
+	DefaultMetrics.Set("vipsidecar_election_backend_available", map[string]string{"controller": name}, 1)
+	return &vipHolderSync{name: name, node: node, device: device, queue: queue, outage: outage}
+}
+
+//记录kubernetes API不可用，返回是否继续保留本机已持有的vip
+func (s *vipHolderSync) keep(err error) bool {
+	if s.since.IsZero() {
+		s.since = time.Now()
+		log.Println(s.name, "kubernetes api unavailable, outage policy", s.outage.Policy+",", err)
+		DefaultMetrics.Set("vipsidecar_election_backend_available", map[string]string{"controller": s.name}, 0)
+	}
+	return s.outage.Policy != OutageReleaseAfter || time.Since(s.since) < time.Duration(s.outage.ReleaseAfter)*time.Second
+}
+
+func (s *vipHolderSync) recovered() {
+	if s.since.IsZero() {
+		return
+	}
+	log.Println(s.name, "kubernetes api available again after", time.Since(s.since).Round(time.Second))
+	s.since = time.Time{}
+	DefaultMetrics.Set("vipsidecar_election_backend_available", map[string]string{"controller": s.name}, 1)
+}
+
+//列出对象失败，无法进行本轮同步
+func (s *vipHolderSync) unavailable(err error) {
+	if !s.keep(err) && s.release(map[string]bool{}) {
+		s.queue.Push(PriorityFailover, s.name)
+	}
+}
+
+//nodes返回可持有对象vip的节点，本机为持有者时添加vip后调用writeback回写对象
+func (s *vipHolderSync) sync(pool []string, claims []vipClaim, allocation map[string]string, nodes func(vipClaim) ([]string, error), writeback func(vipClaim, string) error) {
+	for _, vip := range pool {
+		if ok, _ := Contain(vip, s.known); !ok {
+			s.known = append(s.known, vip)
+		}
+	}
+	//先查询全部对象的可选节点，freeze时任何查询失败都不做修改
+	available := map[string][]string{}
+	var failed error
+	for _, c := range claims {
+		if _, ok := allocation[c.key()]; !ok {
+			continue
+		}
+		candidates, err := nodes(c)
+		if err != nil {
+			log.Println(s.name, c.key(), err)
+			failed = err
+			continue
+		}
+		available[c.key()] = candidates
+	}
+	keep := true
+	if failed != nil {
+		if keep = s.keep(failed); s.outage.Policy == OutageFreeze {
+			log.Println(s.name, "holders frozen while kubernetes api is unavailable")
+			return
+		}
+	} else {
+		s.recovered()
+	}
+	changed := false
+	held := map[string]bool{}
+	for _, c := range claims {
+		vip, ok := allocation[c.key()]
+		if !ok {
+			continue
+		}
+		candidates, ok := available[c.key()]
+		if !ok {
+			//无法确定持有者时按outage.policy保留本机上的vip
+			held[vip] = keep && isLocalVip(vip)
+			continue
+		}
+		if pickHolder(c.holder, candidates) != s.node {
+			continue
+		}
+		held[vip] = true
+		if !isLocalVip(vip) {
+			if reason := DefaultEligibility.Reason(); reason != "" {
+				log.Println(s.name, "not taking", vip, "node ineligible,", reason)
+				continue
+			}
+			if err := s.add(vip); err != nil {
+				log.Println(s.name, err)
+				continue
+			}
+			log.Println(s.name, c.key(), "vip", vip, "held by", s.node)
+			changed = true
+		}
+		if err := writeback(c, vip); err != nil {
+			log.Println(s.name, c.key(), err)
+		}
+	}
+	if s.release(held) || changed {
+		s.queue.Push(PriorityFailover, s.name)
+	}
+}
+
+//删除不再由本机持有(对象删除、后端迁移到其他节点、地址移出pool)的vip，返回是否有删除
+func (s *vipHolderSync) release(held map[string]bool) bool {
+	changed := false
+	for _, vip := range s.known {
+		if held[vip] || !isLocalVip(vip) {
+			continue
+		}
+		if _, _, err := removeLocalVip(vip); err != nil {
+			log.Println(s.name, err)
+			continue
+		}
+		log.Println(s.name, "released", vip)
+		changed = true
+	}
+	return changed
+}
+
+//pool中的地址使用/32，接口默认取vip所在子网的接口
+func (s *vipHolderSync) add(vip string) error {
+	device := s.device
+	if device == "" {
+		if names := SubnetInterfaces(net.ParseIP(vip)); len(names) > 0 {
+			device = names[0]
+		}
+	}
+	if device == "" {
+		return errors.New("no interface for " + vip + ", set " + s.name + ".device")
+	}
+	return addLocalVip(vip, device, 32)
+}
+
+//本机接口上是否已有该地址
+func isLocalVip(vip string) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(net.ParseIP(vip)) {
+			return true
+		}
+	}
+	return false
+}
+
+//kubernetes对象的节点名默认取环境变量NODE_NAME
+func kubeNodeName(node string) string {
+	if node == "" {
+		node = os.Getenv("NODE_NAME")
+	}
+	if node == "" {
+		node, _ = os.Hostname()
+	}
+	return node
+}
+
+//对象metadata中用到的字段
+type kubeObjectMeta struct {
+	Namespace         string            `json:"namespace"`
+	Name              string            `json:"name"`
+	ResourceVersion   string            `json:"resourceVersion"`
+	CreationTimestamp time.Time         `json:"creationTimestamp"`
+	Annotations       map[string]string `json:"annotations"`
+}
+
+func (m kubeObjectMeta) claim() vipClaim {
+	return vipClaim{namespace: m.Namespace, name: m.Name, resourceversion: m.ResourceVersion, created: m.CreationTimestamp, requested: m.Annotations[AnnotationVip], pool: m.Annotations[AnnotationPool], holder: m.Annotations[AnnotationHolder]}
+}
+
+//持有者注解不是node时更新，返回更新后的resourceVersion
+func (k *kubeClient) setHolder(path string, c vipClaim, node string) (string, error) {
+	if c.holder == node {
+		return c.resourceversion, nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": c.resourceversion,
+			"annotations":     map[string]string{AnnotationHolder: node},
+		},
+	})
+	updated := struct {
+		Metadata kubeObjectMeta `json:"metadata"`
+	}{}
+	if err := k.do("PATCH", path, "application/merge-patch+json", patch, &updated); err != nil {
+		return "", err
+	}
+	return updated.Metadata.ResourceVersion, nil
+}
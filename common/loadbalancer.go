@@ -0,0 +1,178 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/url"
+	"time"
+)
+
+func init() {
+	registerFeature("kube-loadbalancer")
+	DefaultMetrics.Register("vipsidecar_loadbalancer_services", MetricGauge, "LoadBalancer services of the configured class, state=allocated or pending.")
+	DefaultMetrics.Register("vipsidecar_loadbalancer_pool_free", MetricGauge, "Addresses in loadbalancer.pool not allocated to any service.")
+}
+
+//轻量的Service type=LoadBalancer实现：为spec.loadBalancerClass为class的service从pool分配vip，
+//由后端pod所在节点之一持有vip(在本机接口添加地址后由provider完成云上绑定)，并将vip写入.status.loadBalancer.ingress
+//每个节点按相同规则计算分配结果及持有者，不需要额外选主
+type LoadBalancerController struct {
+	config  JdLoadBalancer
+	kube    *kubeClient
+	holders *vipHolderSync
+	pools   *vipPools
+}
+
+//service对象中用到的字段
+type kubeService struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Type              string `json:"type"`
+		LoadBalancerClass string `json:"loadBalancerClass"`
+		LoadBalancerIP    string `json:"loadBalancerIP"`
+	} `json:"spec"`
+	Status struct {
+		LoadBalancer struct {
+			Ingress []struct {
+				Ip string `json:"ip"`
+			} `json:"ingress"`
+		} `json:"loadBalancer"`
+	} `json:"status"`
+}
+
+//EndpointSlice中用到的字段
+type kubeEndpointSlice struct {
+	Endpoints []struct {
+		NodeName   string `json:"nodeName"`
+		Conditions struct {
+			Ready *bool `json:"ready"`
+		} `json:"conditions"`
+	} `json:"endpoints"`
+}
+
+//pool中的地址必须在vips中，由provider负责云上绑定
+func NewLoadBalancerController(config JdLoadBalancer, vips []string, queue *EventQueue) (*LoadBalancerController, error) {
+	if len(config.Pool) == 0 && !config.VipPools {
+		return nil, errors.New("loadbalancer.pool must be set when loadbalancer.class is set and loadbalancer.vippools is not")
+	}
+	for _, vip := range config.Pool {
+		if ok, _ := Contain(vip, vips); !ok {
+			return nil, errors.New("loadbalancer.pool address " + vip + " is not in vips")
+		}
+	}
+	config.Node = kubeNodeName(config.Node)
+	if config.Interval <= 0 {
+		config.Interval = 10
+	}
+	if err := checkOutage("loadbalancer.outage", &config.Outage); err != nil {
+		return nil, err
+	}
+	kube, err := newKubeClient(config.ApiServer, "loadbalancer.apiserver")
+	if err != nil {
+		return nil, err
+	}
+	controller := &LoadBalancerController{config: config, kube: kube}
+	controller.holders = newVipHolderSync("loadbalancer", config.Node, config.Device, config.Outage, queue)
+	if config.VipPools {
+		controller.pools = newVipPools("Service", vips, kube)
+	}
+	return controller, nil
+}
+
+func (l *LoadBalancerController) Run() {
+	for {
+		if err := l.Sync(); err != nil {
+			log.Println("loadbalancer sync", err)
+			l.holders.unavailable(err)
+		}
+		time.Sleep(time.Duration(l.config.Interval) * time.Second)
+	}
+}
+
+//计算各service的vip及持有者，本机为持有者时添加vip并回写service，否则删除本机上的vip
+func (l *LoadBalancerController) Sync() error {
+	list := struct {
+		Items []kubeService `json:"items"`
+	}{}
+	if err := l.kube.do("GET", "/api/v1/services", "", nil, &list); err != nil {
+		return err
+	}
+	claims := []vipClaim{}
+	for _, svc := range list.Items {
+		if svc.Spec.Type != "LoadBalancer" || svc.Spec.LoadBalancerClass != l.config.Class {
+			continue
+		}
+		c := svc.Metadata.claim()
+		for _, ingress := range svc.Status.LoadBalancer.Ingress {
+			c.assigned = append(c.assigned, ingress.Ip)
+		}
+		if c.requested == "" {
+			c.requested = svc.Spec.LoadBalancerIP
+		}
+		claims = append(claims, c)
+	}
+	sortClaims(claims)
+	//使用VipPool时地址池及对象可使用的地址由VipPool决定
+	pool := l.config.Pool
+	var allowed func(vipClaim, string, bool) bool
+	if l.pools != nil {
+		var err error
+		if pool, err = l.pools.load(); err != nil {
+			return err
+		}
+		allowed = l.pools.allowed
+	}
+	allocation, pending, free := allocateVips(pool, claims, allowed)
+	if l.pools != nil {
+		l.pools.report(allocation)
+	}
+	DefaultMetrics.Set("vipsidecar_loadbalancer_services", map[string]string{"state": "allocated"}, float64(len(allocation)))
+	DefaultMetrics.Set("vipsidecar_loadbalancer_services", map[string]string{"state": "pending"}, float64(pending))
+	DefaultMetrics.Set("vipsidecar_loadbalancer_pool_free", nil, float64(free))
+	l.holders.sync(pool, claims, allocation, l.backingNodes, l.writeBack)
+	return nil
+}
+
+//有ready后端pod的节点
+func (l *LoadBalancerController) backingNodes(c vipClaim) ([]string, error) {
+	list := struct {
+		Items []kubeEndpointSlice `json:"items"`
+	}{}
+	path := "/apis/discovery.k8s.io/v1/namespaces/" + url.PathEscape(c.namespace) + "/endpointslices?labelSelector=" + url.QueryEscape("kubernetes.io/service-name="+c.name)
+	if err := l.kube.do("GET", path, "", nil, &list); err != nil {
+		return nil, err
+	}
+	nodes := []string{}
+	for _, slice := range list.Items {
+		for _, endpoint := range slice.Endpoints {
+			if endpoint.NodeName == "" || (endpoint.Conditions.Ready != nil && !*endpoint.Conditions.Ready) {
+				continue
+			}
+			if ok, _ := Contain(endpoint.NodeName, nodes); !ok {
+				nodes = append(nodes, endpoint.NodeName)
+			}
+		}
+	}
+	return nodes, nil
+}
+
+//更新持有者注解及status，带resourceVersion的merge patch在service被其他节点同时修改时返回冲突，下次同步重新计算
+func (l *LoadBalancerController) writeBack(c vipClaim, vip string) error {
+	base := "/api/v1/namespaces/" + url.PathEscape(c.namespace) + "/services/" + url.PathEscape(c.name)
+	resourceversion, err := l.kube.setHolder(base, c, l.config.Node)
+	if err != nil {
+		return err
+	}
+	if len(c.assigned) == 1 && c.assigned[0] == vip {
+		return nil
+	}
+	patch, _ := json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{"resourceVersion": resourceversion},
+		"status":   map[string]interface{}{"loadBalancer": map[string]interface{}{"ingress": []map[string]string{{"ip": vip}}}},
+	})
+	return l.kube.do("PATCH", base+"/status", "application/merge-patch+json", patch, nil)
+}
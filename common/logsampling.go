@@ -0,0 +1,83 @@
+package common
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//计算采样key时去掉每次都不同的requestId及长十六进制串，其余内容(含vip)相同的日志视为同一条
+var logKeyMasks = []*regexp.Regexp{
+	regexp.MustCompile(`(?i)requestid[ :=]+\S+`),
+	regexp.MustCompile(`\b[0-9a-fA-F-]{16,}\b`),
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_log_suppressed_total", MetricCounter, "Log lines suppressed by log sampling.")
+}
+
+//按消息key采样，每个周期内同一key的前first条全部输出，之后每thereafter条输出一条
+type logSampler struct {
+	mutex      sync.Mutex
+	first      int
+	thereafter int
+	period     time.Duration
+	counts     map[string]*logSample
+}
+
+type logSample struct {
+	line       string
+	seen       int
+	suppressed int
+}
+
+func newLogSampler(config JdLogSampling) *logSampler {
+	if config.Period <= 0 {
+		config.Period = 60
+	}
+	return &logSampler{first: config.First, thereafter: config.Thereafter, period: time.Duration(config.Period) * time.Second, counts: make(map[string]*logSample)}
+}
+
+func logKey(line string) string {
+	for _, mask := range logKeyMasks {
+		line = mask.ReplaceAllString(line, "*")
+	}
+	return line
+}
+
+func (s *logSampler) Allow(line string) bool {
+	key := logKey(line)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	sample, ok := s.counts[key]
+	if !ok {
+		sample = &logSample{}
+		s.counts[key] = sample
+	}
+	sample.seen++
+	sample.line = line
+	if sample.seen <= s.first || (s.thereafter > 0 && (sample.seen-s.first)%s.thereafter == 0) {
+		return true
+	}
+	sample.suppressed++
+	DefaultMetrics.Add("vipsidecar_log_suppressed_total", nil, 1)
+	return false
+}
+
+//结束当前周期，返回被抑制日志的汇总
+func (s *logSampler) Flush() []string {
+	s.mutex.Lock()
+	counts := s.counts
+	s.counts = make(map[string]*logSample)
+	s.mutex.Unlock()
+	lines := []string{}
+	for _, sample := range counts {
+		if sample.suppressed > 0 {
+			lines = append(lines, "suppressed "+strconv.Itoa(sample.suppressed)+" of "+strconv.Itoa(sample.seen)+" similar messages in the last "+s.period.String()+", last: "+sample.line)
+		}
+	}
+	sort.Strings(lines)
+	return lines
+}
@@ -0,0 +1,294 @@
+package common
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//日志输出目标
+const (
+	LogOutputStderr   string = "stderr"
+	LogOutputStdout   string = "stdout"
+	LogOutputSyslog   string = "syslog"
+	LogOutputJournald string = "journald"
+)
+
+const journaldSocket = "/run/systemd/journal/socket"
+
+//syslog severity，journald的PRIORITY取值相同
+const (
+	severityAlert   = 1
+	severityError   = 3
+	severityWarning = 4
+	severityInfo    = 6
+)
+
+//单个日志输出目标，line不含结尾换行及时间前缀
+type logSink interface {
+	Send(t time.Time, severity int, vip string, line string) error
+}
+
+//替换标准库log的输出，每行日志分发到所有配置的目标
+type logWriter struct {
+	mutex   sync.Mutex
+	sinks   []logSink
+	vips    []string
+	sampler *logSampler
+}
+
+//配置日志输出及采样，未配置outputs时输出到stderr，均未配置时保持标准库log的默认格式；所有输出都经过DefaultRedactor替换
+func ConfigureLogging(config JdLog, vips []JdVip) error {
+	if config.SdkLevel != "" {
+		level, ok := sdkLogLevels[config.SdkLevel]
+		if !ok {
+			return errors.New("unknown log.sdklevel " + config.SdkLevel + ", use off, fatal, error, warn or info")
+		}
+		sdkLogLevel = level
+	}
+	if len(config.Outputs) == 0 && config.Sampling.First <= 0 {
+		return nil
+	}
+	if len(config.Outputs) == 0 {
+		config.Outputs = []string{LogOutputStderr}
+	}
+	if config.Syslog.AppName == "" {
+		config.Syslog.AppName = "vipsidecar"
+	}
+	w := &logWriter{}
+	for _, v := range vips {
+		w.vips = append(w.vips, v.Ip)
+	}
+	for _, output := range config.Outputs {
+		switch output {
+		case LogOutputStderr:
+			w.sinks = append(w.sinks, &consoleSink{file: os.Stderr})
+		case LogOutputStdout:
+			w.sinks = append(w.sinks, &consoleSink{file: os.Stdout})
+		case LogOutputSyslog:
+			sink, err := newSyslogSink(config.Syslog)
+			if err != nil {
+				return errors.New("log.syslog: " + err.Error())
+			}
+			w.sinks = append(w.sinks, sink)
+		case LogOutputJournald:
+			sink, err := newJournaldSink(config.Syslog.AppName)
+			if err != nil {
+				return errors.New("log.outputs journald: " + err.Error())
+			}
+			w.sinks = append(w.sinks, sink)
+		default:
+			return errors.New("unknown log output " + output + ", use stderr, stdout, syslog or journald")
+		}
+	}
+	if config.Sampling.First > 0 {
+		w.sampler = newLogSampler(config.Sampling)
+		go w.flushSampler(w.sampler.period)
+	}
+	log.SetFlags(0)
+	log.SetOutput(w)
+	return nil
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	line := DefaultRedactor.Redact(strings.TrimRight(string(p), "\n"))
+	if w.sampler != nil && !w.sampler.Allow(line) {
+		return len(p), nil
+	}
+	w.send(time.Now(), line)
+	return len(p), nil
+}
+
+func (w *logWriter) send(now time.Time, line string) {
+	severity := logSeverity(line)
+	vip := ""
+	for _, v := range w.vips {
+		if strings.Contains(line, v) {
+			vip = v
+			break
+		}
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for _, sink := range w.sinks {
+		//输出失败不能再写log，避免递归
+		if err := sink.Send(now, severity, vip, line); err != nil {
+			fmt.Fprintln(os.Stderr, "log output failed:", err)
+		}
+	}
+}
+
+//每个周期结束时输出被抑制日志的汇总
+func (w *logWriter) flushSampler(period time.Duration) {
+	for range time.Tick(period) {
+		for _, line := range w.sampler.Flush() {
+			w.send(time.Now(), line)
+		}
+	}
+}
+
+//日志没有级别，根据内容推断
+func logSeverity(line string) int {
+	lower := strings.ToLower(line)
+	switch {
+	case strings.Contains(line, "ALERT"):
+		return severityAlert
+	case strings.Contains(lower, "error") || strings.Contains(lower, "failed") || strings.Contains(lower, "refused"):
+		return severityError
+	case strings.Contains(lower, "warn") || strings.Contains(lower, "skip"):
+		return severityWarning
+	}
+	return severityInfo
+}
+
+//与标准库log默认格式相同
+type consoleSink struct {
+	file *os.File
+}
+
+func (c *consoleSink) Send(t time.Time, severity int, vip string, line string) error {
+	_, err := fmt.Fprintln(c.file, t.Format("2006/01/02 15:04:05"), line)
+	return err
+}
+
+//RFC5424 syslog，address为udp://、tcp://或tls://host:port，tcp及tls使用RFC6587 octet counting分帧
+type syslogSink struct {
+	config   JdSyslog
+	scheme   string
+	host     string
+	hostname string
+	facility int
+	conn     net.Conn
+}
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "daemon": 3, "auth": 4, "syslog": 5,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+func newSyslogSink(config JdSyslog) (*syslogSink, error) {
+	u, err := url.Parse(config.Address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls" {
+		return nil, errors.New("address must be udp://, tcp:// or tls://host:port")
+	}
+	if config.Facility == "" {
+		config.Facility = "daemon"
+	}
+	facility, ok := syslogFacilities[config.Facility]
+	if !ok {
+		return nil, errors.New("unknown facility " + config.Facility)
+	}
+	hostname, _ := os.Hostname()
+	s := &syslogSink{config: config, scheme: u.Scheme, host: u.Host, hostname: hostname, facility: facility}
+	return s, s.connect()
+}
+
+//连接失败时conn保持为nil，tls.DialWithDialer失败时返回的是nil的*tls.Conn，不能直接赋给conn
+func (s *syslogSink) connect() error {
+	var conn net.Conn
+	var err error
+	switch s.scheme {
+	case "udp", "tcp":
+		conn, err = net.DialTimeout(s.scheme, s.host, 5*time.Second)
+	case "tls":
+		tlsconfig := &tls.Config{}
+		if s.config.CaCert != "" {
+			pem, err := ioutil.ReadFile(s.config.CaCert)
+			if err != nil {
+				return err
+			}
+			tlsconfig.RootCAs = x509.NewCertPool()
+			tlsconfig.RootCAs.AppendCertsFromPEM(pem)
+		}
+		var tlsconn *tls.Conn
+		tlsconn, err = tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", s.host, tlsconfig)
+		if err == nil {
+			conn = tlsconn
+		}
+	}
+	if err != nil {
+		return err
+	}
+	s.conn = conn
+	return nil
+}
+
+func (s *syslogSink) Send(t time.Time, severity int, vip string, line string) error {
+	//structured data中的vip，32473为IANA保留给文档示例的企业编号
+	data := "-"
+	if vip != "" {
+		data = `[vipsidecar@32473 vip="` + vip + `"]`
+	}
+	msg := "<" + strconv.Itoa(s.facility*8+severity) + ">1 " + t.UTC().Format(time.RFC3339Nano) + " " + s.hostname + " " + s.config.AppName + " " + strconv.Itoa(os.Getpid()) + " - " + data + " " + line
+	if s.scheme != "udp" {
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	//tcp及tls连接断开时重连一次
+	for attempt := 0; ; attempt++ {
+		if s.conn == nil {
+			if err := s.connect(); err != nil {
+				return err
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+		_, err := s.conn.Write([]byte(msg))
+		if err == nil || s.scheme == "udp" || attempt > 0 {
+			return err
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+//journald原生协议，每条日志为一个数据报，字段为KEY=value，值包含换行时使用长度前缀的二进制格式
+type journaldSink struct {
+	conn       *net.UnixConn
+	identifier string
+}
+
+func newJournaldSink(identifier string) (*journaldSink, error) {
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: journaldSocket, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	return &journaldSink{conn: conn, identifier: identifier}, nil
+}
+
+func (j *journaldSink) Send(t time.Time, severity int, vip string, line string) error {
+	fields := [][2]string{
+		{"MESSAGE", line},
+		{"PRIORITY", strconv.Itoa(severity)},
+		{"SYSLOG_IDENTIFIER", j.identifier},
+		{"SYSLOG_PID", strconv.Itoa(os.Getpid())},
+	}
+	if vip != "" {
+		fields = append(fields, [2]string{"VIPSIDECAR_VIP", vip})
+	}
+	var buf bytes.Buffer
+	for _, f := range fields {
+		if !strings.Contains(f[1], "\n") {
+			buf.WriteString(f[0] + "=" + f[1] + "\n")
+			continue
+		}
+		buf.WriteString(f[0] + "\n")
+		binary.Write(&buf, binary.LittleEndian, uint64(len(f[1])))
+		buf.WriteString(f[1] + "\n")
+	}
+	_, err := j.conn.Write(buf.Bytes())
+	return err
+}
@@ -0,0 +1,29 @@
+package common
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+//tls连接断开后重连失败，之后的日志返回错误而不是在nil连接上写入
+func TestSyslogSinkReconnectFailure(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	conn, peer := net.Pipe()
+	peer.Close()
+	s := &syslogSink{config: JdSyslog{AppName: "vipsidecar"}, scheme: "tls", host: address, hostname: "node", facility: 3, conn: conn}
+	for i := 0; i < 3; i++ {
+		if err := s.Send(time.Now(), severityInfo, "", "syslog is down"); err == nil {
+			t.Fatalf("send %d: expected an error while the syslog server is down", i)
+		}
+		if s.conn != nil {
+			t.Fatalf("send %d: conn = %#v after a failed reconnect, want nil", i, s.conn)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package common
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_maintenance_next_seconds", MetricGauge, "Seconds until the next scheduled maintenance of this instance starts, 0 while one is in progress, -1 when none is scheduled.")
+	DefaultMetrics.Register("vipsidecar_maintenance_active", MetricGauge, "1 from maintenance.lead seconds before a maintenance window starts until it ends.")
+}
+
+//本实例的一次计划内维护，start、end为RFC3339时间
+type MaintenanceEvent struct {
+	Id          string    `json:"id"`
+	Type        string    `json:"type,omitempty"`
+	Description string    `json:"description,omitempty"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+}
+
+//轮询本实例的计划内维护事件，维护开始前lead秒把vip交给对端并标记本机不可接管，维护结束后恢复
+//事件来源为返回MaintenanceEvent数组的url，由运维侧从云平台事件通知转换得到
+type MaintenanceWatcher struct {
+	config  JdMaintenance
+	handoff *Handoff
+	vips    []string
+	client  *http.Client
+	active  string
+}
+
+func NewMaintenanceWatcher(config JdMaintenance, handoff *Handoff, vips []string) (*MaintenanceWatcher, error) {
+	if config.Url == "" {
+		return nil, errors.New("maintenance.url must be set when maintenance is enabled")
+	}
+	if len(config.Peers) == 0 {
+		return nil, errors.New("maintenance.peers must be set when maintenance is enabled")
+	}
+	if config.Lead <= 0 {
+		config.Lead = 300
+	}
+	if config.Interval <= 0 {
+		config.Interval = 60
+	}
+	return &MaintenanceWatcher{config: config, handoff: handoff, vips: vips, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (m *MaintenanceWatcher) Run() {
+	for {
+		if err := m.Check(); err != nil {
+			log.Println("maintenance watch", err)
+		}
+		time.Sleep(time.Duration(m.config.Interval) * time.Second)
+	}
+}
+
+//读取事件后更新status，当前处于某个事件的[start-lead, end)内时迁出vip
+//读取失败时保持上一次的判断，不因事件源不可用而提前恢复接管
+func (m *MaintenanceWatcher) Check() error {
+	events, err := m.events()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	upcoming := []MaintenanceEvent{}
+	var active *MaintenanceEvent
+	for i, e := range events {
+		if !e.End.After(now) {
+			continue
+		}
+		upcoming = append(upcoming, e)
+		if active == nil && !now.Before(e.Start.Add(-time.Duration(m.config.Lead)*time.Second)) {
+			active = &events[i]
+		}
+	}
+	DefaultStatus.SetMaintenance(upcoming)
+	next := -1.0
+	if len(upcoming) > 0 {
+		next = upcoming[0].Start.Sub(now).Seconds()
+		if next < 0 {
+			next = 0
+		}
+	}
+	DefaultMetrics.Set("vipsidecar_maintenance_next_seconds", nil, next)
+	if active == nil {
+		if m.active != "" {
+			log.Println("maintenance", m.active, "ended")
+			m.active = ""
+			DefaultMetrics.Set("vipsidecar_maintenance_active", nil, 0)
+			DefaultEligibility.Clear("maintenance")
+		}
+		return nil
+	}
+	if m.active != active.Id {
+		m.active = active.Id
+		log.Println("maintenance", active.Id, active.Type, "from", active.Start.Format(time.RFC3339), "to", active.End.Format(time.RFC3339), "moving vips off")
+		DefaultMetrics.Set("vipsidecar_maintenance_active", nil, 1)
+		DefaultEligibility.MarkIneligible("maintenance", active.Id+" until "+active.End.Format(time.RFC3339))
+	}
+	m.handoff.MoveOff(m.vips, m.config.Peers, "maintenance")
+	return nil
+}
+
+//按开始时间排序的事件
+func (m *MaintenanceWatcher) events() ([]MaintenanceEvent, error) {
+	req, err := http.NewRequest("GET", m.config.Url, nil)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range m.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("get " + m.config.Url + ": " + resp.Status)
+	}
+	events := []MaintenanceEvent{}
+	if err := json.NewDecoder(resp.Body).Decode(&events); err != nil {
+		return nil, err
+	}
+	sort.Slice(events, func(i, j int) bool { return events[i].Start.Before(events[j].Start) })
+	return events, nil
+}
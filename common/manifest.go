@@ -0,0 +1,322 @@
+package common
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"net"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//VipPool CRD(vipsidecar.jdcloud.com/v1alpha1，cluster级别)
+const (
+	VipPoolGroup    = "vipsidecar.jdcloud.com"
+	VipPoolVersion  = "v1alpha1"
+	VipPoolResource = "vippools"
+)
+
+const (
+	ManifestContainer string = "container"
+	ManifestDaemonSet string = "daemonset"
+)
+
+//容器内配置文件路径
+const manifestConfigDir = "/etc/vipsidecar"
+
+type ManifestOptions struct {
+	Kind          string
+	Name          string
+	Namespace     string
+	Image         string
+	ConfigSecret  string
+	TokenAudience string
+}
+
+type ms = yaml.MapSlice
+
+//根据配置生成kubernetes清单，container为可嵌入Pod的sidecar容器及所需volumes，daemonset为ServiceAccount及DaemonSet
+func GenManifest(p *Parameters, o ManifestOptions) ([]byte, error) {
+	container, volumes := manifestContainer(p, o)
+	switch o.Kind {
+	case ManifestContainer:
+		return yaml.Marshal(ms{{Key: "containers", Value: []ms{container}}, {Key: "volumes", Value: volumes}, {Key: "hostNetwork", Value: true}})
+	case ManifestDaemonSet:
+		labels := ms{{Key: "app", Value: o.Name}}
+		serviceaccount := ms{
+			{Key: "apiVersion", Value: "v1"},
+			{Key: "kind", Value: "ServiceAccount"},
+			{Key: "metadata", Value: ms{{Key: "name", Value: o.Name}, {Key: "namespace", Value: o.Namespace}}},
+		}
+		daemonset := ms{
+			{Key: "apiVersion", Value: "apps/v1"},
+			{Key: "kind", Value: "DaemonSet"},
+			{Key: "metadata", Value: ms{{Key: "name", Value: o.Name}, {Key: "namespace", Value: o.Namespace}, {Key: "labels", Value: labels}}},
+			{Key: "spec", Value: ms{
+				{Key: "selector", Value: ms{{Key: "matchLabels", Value: labels}}},
+				{Key: "template", Value: ms{
+					{Key: "metadata", Value: ms{{Key: "labels", Value: labels}}},
+					{Key: "spec", Value: ms{
+						{Key: "serviceAccountName", Value: o.Name},
+						{Key: "hostNetwork", Value: true},
+						{Key: "dnsPolicy", Value: "ClusterFirstWithHostNet"},
+						{Key: "terminationGracePeriodSeconds", Value: 30},
+						{Key: "containers", Value: []ms{container}},
+						{Key: "volumes", Value: volumes},
+					}},
+				}},
+			}},
+		}
+		objects := []ms{serviceaccount, daemonset}
+		//drain需要读取本机所在节点，dr.override.coredns需要修改CoreDNS读取的ConfigMap，externaldns需要写入DNSEndpoint
+		//loadbalancer需要读取service及EndpointSlice并写入持有者注解及status，gateway需要读取数据面pod并写入Gateway
+		//vippools需要VipPool CRD，读取VipPool并写入其status，conflicts需要读取可能使用vip的对象并生成事件
+		rules := []ms{}
+		if p.Drain.Enabled {
+			rules = append(rules, ms{{Key: "apiGroups", Value: []string{""}}, {Key: "resources", Value: []string{"nodes"}}, {Key: "verbs", Value: []string{"get"}}})
+		}
+		if p.Dr.Override.CoreDns.ConfigMap != "" {
+			rules = append(rules, ms{{Key: "apiGroups", Value: []string{""}}, {Key: "resources", Value: []string{"configmaps"}}, {Key: "resourceNames", Value: []string{p.Dr.Override.CoreDns.ConfigMap}}, {Key: "verbs", Value: []string{"get", "patch"}}})
+		}
+		if p.ExternalDns.Enabled {
+			rules = append(rules, ms{{Key: "apiGroups", Value: []string{"externaldns.k8s.io"}}, {Key: "resources", Value: []string{"dnsendpoints"}}, {Key: "verbs", Value: []string{"get", "create", "patch"}}})
+		}
+		if p.LoadBalancer.Class != "" {
+			rules = append(rules,
+				ms{{Key: "apiGroups", Value: []string{""}}, {Key: "resources", Value: []string{"services"}}, {Key: "verbs", Value: []string{"list", "patch"}}},
+				ms{{Key: "apiGroups", Value: []string{""}}, {Key: "resources", Value: []string{"services/status"}}, {Key: "verbs", Value: []string{"patch"}}},
+				ms{{Key: "apiGroups", Value: []string{"discovery.k8s.io"}}, {Key: "resources", Value: []string{"endpointslices"}}, {Key: "verbs", Value: []string{"list"}}})
+		}
+		if p.Gateway.Class != "" {
+			rules = append(rules,
+				ms{{Key: "apiGroups", Value: []string{"gateway.networking.k8s.io"}}, {Key: "resources", Value: []string{"gateways"}}, {Key: "verbs", Value: []string{"list", "patch"}}},
+				ms{{Key: "apiGroups", Value: []string{""}}, {Key: "resources", Value: []string{"pods"}}, {Key: "verbs", Value: []string{"list"}}})
+		}
+		if p.LoadBalancer.VipPools || p.Gateway.VipPools {
+			objects = append(objects, vipPoolCrd())
+			rules = append(rules,
+				ms{{Key: "apiGroups", Value: []string{VipPoolGroup}}, {Key: "resources", Value: []string{VipPoolResource}}, {Key: "verbs", Value: []string{"list"}}},
+				ms{{Key: "apiGroups", Value: []string{VipPoolGroup}}, {Key: "resources", Value: []string{VipPoolResource + "/status"}}, {Key: "verbs", Value: []string{"patch"}}})
+		}
+		if p.Conflicts.Enabled {
+			rules = append(rules,
+				ms{{Key: "apiGroups", Value: []string{""}}, {Key: "resources", Value: []string{"services", "nodes"}}, {Key: "verbs", Value: []string{"list"}}},
+				ms{{Key: "apiGroups", Value: []string{"discovery.k8s.io"}}, {Key: "resources", Value: []string{"endpointslices"}}, {Key: "verbs", Value: []string{"list"}}})
+			if p.Gateway.Class != "" {
+				rules = append(rules, ms{{Key: "apiGroups", Value: []string{"gateway.networking.k8s.io"}}, {Key: "resources", Value: []string{"gateways"}}, {Key: "verbs", Value: []string{"list"}}})
+			}
+			if p.Conflicts.Events {
+				rules = append(rules, ms{{Key: "apiGroups", Value: []string{""}}, {Key: "resources", Value: []string{"events"}}, {Key: "verbs", Value: []string{"create"}}})
+			}
+		}
+		if len(rules) > 0 {
+			objects = append(objects, ms{
+				{Key: "apiVersion", Value: "rbac.authorization.k8s.io/v1"},
+				{Key: "kind", Value: "ClusterRole"},
+				{Key: "metadata", Value: ms{{Key: "name", Value: o.Name}}},
+				{Key: "rules", Value: rules},
+			}, ms{
+				{Key: "apiVersion", Value: "rbac.authorization.k8s.io/v1"},
+				{Key: "kind", Value: "ClusterRoleBinding"},
+				{Key: "metadata", Value: ms{{Key: "name", Value: o.Name}}},
+				{Key: "roleRef", Value: ms{{Key: "apiGroup", Value: "rbac.authorization.k8s.io"}, {Key: "kind", Value: "ClusterRole"}, {Key: "name", Value: o.Name}}},
+				{Key: "subjects", Value: []ms{{{Key: "kind", Value: "ServiceAccount"}, {Key: "name", Value: o.Name}, {Key: "namespace", Value: o.Namespace}}}},
+			})
+		}
+		docs := []string{}
+		for _, doc := range objects {
+			data, err := yaml.Marshal(doc)
+			if err != nil {
+				return nil, err
+			}
+			docs = append(docs, string(data))
+		}
+		return []byte(strings.Join(docs, "---\n")), nil
+	}
+	return nil, errors.New("unsupported manifest kind " + o.Kind + ", use container or daemonset")
+}
+
+//VipPool CRD，status由vipsidecar写入
+func vipPoolCrd() ms {
+	array := func(items ms) ms { return ms{{Key: "type", Value: "array"}, {Key: "items", Value: items}} }
+	str := ms{{Key: "type", Value: "string"}}
+	schema := ms{
+		{Key: "type", Value: "object"},
+		{Key: "properties", Value: ms{
+			{Key: "spec", Value: ms{
+				{Key: "type", Value: "object"},
+				{Key: "required", Value: []string{"addresses"}},
+				{Key: "properties", Value: ms{
+					{Key: "addresses", Value: array(str)},
+					{Key: "kind", Value: ms{{Key: "type", Value: "string"}, {Key: "enum", Value: []string{"Service", "Gateway"}}}},
+					{Key: "namespaces", Value: array(str)},
+					{Key: "autoAssign", Value: ms{{Key: "type", Value: "boolean"}}},
+				}},
+			}},
+			{Key: "status", Value: ms{{Key: "type", Value: "object"}, {Key: "x-kubernetes-preserve-unknown-fields", Value: true}}},
+		}},
+	}
+	column := func(name string, path string) ms {
+		return ms{{Key: "name", Value: name}, {Key: "type", Value: "integer"}, {Key: "jsonPath", Value: path}}
+	}
+	return ms{
+		{Key: "apiVersion", Value: "apiextensions.k8s.io/v1"},
+		{Key: "kind", Value: "CustomResourceDefinition"},
+		{Key: "metadata", Value: ms{{Key: "name", Value: VipPoolResource + "." + VipPoolGroup}}},
+		{Key: "spec", Value: ms{
+			{Key: "group", Value: VipPoolGroup},
+			{Key: "scope", Value: "Cluster"},
+			{Key: "names", Value: ms{{Key: "kind", Value: "VipPool"}, {Key: "listKind", Value: "VipPoolList"}, {Key: "plural", Value: VipPoolResource}, {Key: "singular", Value: "vippool"}}},
+			{Key: "versions", Value: []ms{{
+				{Key: "name", Value: VipPoolVersion},
+				{Key: "served", Value: true},
+				{Key: "storage", Value: true},
+				{Key: "subresources", Value: ms{{Key: "status", Value: ms{}}}},
+				{Key: "additionalPrinterColumns", Value: []ms{column("Allocated", ".status.allocated"), column("Free", ".status.free")}},
+				{Key: "schema", Value: ms{{Key: "openAPIV3Schema", Value: schema}}},
+			}}},
+		}},
+	}
+}
+
+//各capability及需要它的已启用功能：本机添加删除vip、配置路由及策略路由、修改net内核参数需要NET_ADMIN，免费arp、重复地址检测及抓包需要NET_RAW，privileges.noplumbing时都不需要
+func CapabilityFeatures(p *Parameters) map[string][]string {
+	features := map[string][]string{}
+	if p.Privileges.NoPlumbing {
+		return features
+	}
+	netadmin := []string{}
+	if p.Mode != ModeDr {
+		mode := p.Mode
+		if mode == "" {
+			mode = ModeSecondaryIp
+		}
+		netadmin = append(netadmin, "mode "+mode)
+	}
+	if p.PolicyRouting.Enabled {
+		netadmin = append(netadmin, "policyrouting")
+	}
+	if p.Sysctl.Managed {
+		netadmin = append(netadmin, "sysctl")
+	}
+	//handoff接收方在本机添加vip，发送方(drain、spot、maintenance)删除本机vip
+	if p.MetricsAddr != "" {
+		netadmin = append(netadmin, "handoff")
+	}
+	if p.Drain.Enabled {
+		netadmin = append(netadmin, "drain")
+	}
+	if p.Spot.Enabled {
+		netadmin = append(netadmin, "spot")
+	}
+	if p.Maintenance.Enabled {
+		netadmin = append(netadmin, "maintenance")
+	}
+	//kubernetes地址管理在持有vip的节点上添加删除vip
+	if p.LoadBalancer.Class != "" {
+		netadmin = append(netadmin, "loadbalancer")
+	}
+	if p.Gateway.Class != "" {
+		netadmin = append(netadmin, "gateway")
+	}
+	if len(netadmin) > 0 {
+		features["NET_ADMIN"] = netadmin
+	}
+	netraw := []string{}
+	if p.Garp.Enabled {
+		netraw = append(netraw, "garp")
+	}
+	if p.Dad.Enabled {
+		netraw = append(netraw, "dad")
+	}
+	if p.Capture.Enabled {
+		netraw = append(netraw, "capture")
+	}
+	if len(netraw) > 0 {
+		features["NET_RAW"] = netraw
+	}
+	return features
+}
+
+//vipsidecar需要的capabilities，由所有已启用的功能决定
+func RequiredCapabilities(p *Parameters) []string {
+	features := CapabilityFeatures(p)
+	capabilities := []string{}
+	for _, name := range []string{"NET_ADMIN", "NET_RAW"} {
+		if len(features[name]) > 0 {
+			capabilities = append(capabilities, name)
+		}
+	}
+	return capabilities
+}
+
+func manifestContainer(p *Parameters, o ManifestOptions) (ms, []ms) {
+	mounts := []ms{{{Key: "name", Value: "config"}, {Key: "mountPath", Value: manifestConfigDir}, {Key: "readOnly", Value: true}}}
+	volumes := []ms{{{Key: "name", Value: "config"}, {Key: "secret", Value: ms{{Key: "secretName", Value: o.ConfigSecret}}}}}
+
+	//联合身份使用projected service account token
+	if p.Federation.TokenFile != "" {
+		dir, file := filepath.Split(p.Federation.TokenFile)
+		mounts = append(mounts, ms{{Key: "name", Value: "token"}, {Key: "mountPath", Value: filepath.Clean(dir)}, {Key: "readOnly", Value: true}})
+		volumes = append(volumes, ms{{Key: "name", Value: "token"}, {Key: "projected", Value: ms{{Key: "sources", Value: []ms{{{Key: "serviceAccountToken", Value: ms{
+			{Key: "path", Value: file},
+			{Key: "audience", Value: o.TokenAudience},
+			{Key: "expirationSeconds", Value: 3600},
+		}}}}}}}})
+	}
+
+	//配置中引用的证书、日志及抓包目录从宿主机挂载
+	readonly := map[string]bool{}
+	for _, f := range []string{p.Admin.TlsCert, p.Admin.TlsKey, p.Admin.ClientCa, p.Handoff.PeerCaCert} {
+		if f != "" {
+			readonly[filepath.Dir(f)] = true
+		}
+	}
+	for _, f := range []string{p.Admin.AuditLog, p.Dr.ConfirmFile} {
+		if f != "" {
+			readonly[filepath.Dir(f)] = false
+		}
+	}
+	if p.Capture.Enabled && p.Capture.Dir != "" {
+		readonly[filepath.Clean(p.Capture.Dir)] = false
+	}
+	dirs := []string{}
+	for dir := range readonly {
+		dirs = append(dirs, dir)
+	}
+	sort.Strings(dirs)
+	for i, dir := range dirs {
+		name := "host-" + strconv.Itoa(i)
+		hosttype := "Directory"
+		if !readonly[dir] {
+			hosttype = "DirectoryOrCreate"
+		}
+		mounts = append(mounts, ms{{Key: "name", Value: name}, {Key: "mountPath", Value: dir}, {Key: "readOnly", Value: readonly[dir]}})
+		volumes = append(volumes, ms{{Key: "name", Value: name}, {Key: "hostPath", Value: ms{{Key: "path", Value: dir}, {Key: "type", Value: hosttype}}}})
+	}
+
+	security := ms{{Key: "capabilities", Value: ms{{Key: "add", Value: RequiredCapabilities(p)}, {Key: "drop", Value: []string{"ALL"}}}}}
+	//托管内核参数需要可写的/proc/sys
+	if p.Sysctl.Managed {
+		security = append(security, yaml.MapItem{Key: "privileged", Value: true})
+	}
+	container := ms{
+		{Key: "name", Value: o.Name},
+		{Key: "image", Value: o.Image},
+		{Key: "args", Value: []string{"--config", manifestConfigDir + "/config.yaml"}},
+		{Key: "securityContext", Value: security},
+	}
+	if (p.Drain.Enabled && p.Drain.Node == "") || (p.LoadBalancer.Class != "" && p.LoadBalancer.Node == "") || (p.Gateway.Class != "" && p.Gateway.Node == "") {
+		container = append(container, yaml.MapItem{Key: "env", Value: []ms{{{Key: "name", Value: "NODE_NAME"}, {Key: "valueFrom", Value: ms{{Key: "fieldRef", Value: ms{{Key: "fieldPath", Value: "spec.nodeName"}}}}}}}})
+	}
+	if _, port, err := net.SplitHostPort(p.MetricsAddr); err == nil {
+		n, _ := strconv.Atoi(port)
+		container = append(container,
+			yaml.MapItem{Key: "ports", Value: []ms{{{Key: "name", Value: "admin"}, {Key: "containerPort", Value: n}}}},
+			yaml.MapItem{Key: "livenessProbe", Value: ms{{Key: "tcpSocket", Value: ms{{Key: "port", Value: n}}}, {Key: "periodSeconds", Value: 10}}},
+		)
+	}
+	container = append(container, yaml.MapItem{Key: "volumeMounts", Value: mounts})
+	return container, volumes
+}
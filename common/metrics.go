@@ -0,0 +1,224 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	MetricGauge     string = "gauge"
+	MetricCounter   string = "counter"
+	MetricHistogram string = "histogram"
+)
+
+//prometheus文本格式的指标注册表
+//histogram的_bucket、_sum、_count序列保存在同一指标下，序列的key以后缀开头
+type Metrics struct {
+	mutex   sync.Mutex
+	types   map[string]string
+	help    map[string]string
+	series  map[string]map[string]float64
+	buckets map[string][]float64
+}
+
+var DefaultMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		types:   make(map[string]string),
+		help:    make(map[string]string),
+		series:  make(map[string]map[string]float64),
+		buckets: make(map[string][]float64),
+	}
+}
+
+//注册指标类型及说明
+func (m *Metrics) Register(name string, metrictype string, help string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.types[name] = metrictype
+	m.help[name] = help
+	if m.series[name] == nil {
+		m.series[name] = make(map[string]float64)
+	}
+}
+
+//注册histogram，buckets为各桶的上限，按升序排列，不包含+Inf
+func (m *Metrics) RegisterHistogram(name string, help string, buckets []float64) {
+	m.Register(name, MetricHistogram, help)
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.buckets[name] = buckets
+}
+
+//histogram记录一个观测值
+func (m *Metrics) Observe(name string, labels map[string]string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.series[name] == nil {
+		m.series[name] = make(map[string]float64)
+	}
+	series := m.series[name]
+	bucket := map[string]string{}
+	for k, v := range labels {
+		bucket[k] = v
+	}
+	for _, le := range m.buckets[name] {
+		bucket["le"] = strconv.FormatFloat(le, 'f', -1, 64)
+		//未落入的桶也输出0
+		key := "_bucket" + formatLabels(bucket)
+		count := series[key]
+		if value <= le {
+			count++
+		}
+		series[key] = count
+	}
+	bucket["le"] = "+Inf"
+	series["_bucket"+formatLabels(bucket)]++
+	series["_sum"+formatLabels(labels)] += value
+	series["_count"+formatLabels(labels)]++
+}
+
+//histogram序列key的后缀、去掉le后的标签及le，用于按标签分组、桶上限升序输出
+func splitHistogramKey(key string) (string, string, float64) {
+	suffix, labels := key, ""
+	if i := strings.Index(key, "{"); i >= 0 {
+		suffix, labels = key[:i], key[i:]
+	}
+	parsed := parseLabels(labels)
+	le, _ := strconv.ParseFloat(parsed["le"], 64)
+	delete(parsed, "le")
+	return suffix, formatLabels(parsed), le
+}
+
+func (m *Metrics) Set(name string, labels map[string]string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.series[name] == nil {
+		m.series[name] = make(map[string]float64)
+	}
+	m.series[name][formatLabels(labels)] = value
+}
+
+func (m *Metrics) Add(name string, labels map[string]string, value float64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.series[name] == nil {
+		m.series[name] = make(map[string]float64)
+	}
+	m.series[name][formatLabels(labels)] += value
+}
+
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	pairs := []string{}
+	for k, v := range labels {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, v))
+	}
+	sort.Strings(pairs)
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteText(w)
+}
+
+//以prometheus文本格式输出所有指标
+func (m *Metrics) WriteText(w io.Writer) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	names := []string{}
+	for name := range m.series {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if help, ok := m.help[name]; ok {
+			fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+		}
+		if metrictype, ok := m.types[name]; ok {
+			fmt.Fprintf(w, "# TYPE %s %s\n", name, metrictype)
+		}
+		keys := []string{}
+		for labels := range m.series[name] {
+			keys = append(keys, labels)
+		}
+		sort.Strings(keys)
+		if m.types[name] == MetricHistogram {
+			sort.SliceStable(keys, func(i, j int) bool {
+				si, li, lei := splitHistogramKey(keys[i])
+				sj, lj, lej := splitHistogramKey(keys[j])
+				if li != lj {
+					return li < lj
+				}
+				if si != sj {
+					return si < sj
+				}
+				return lei < lej
+			})
+		}
+		for _, labels := range keys {
+			fmt.Fprintf(w, "%s%s %v\n", name, labels, m.series[name][labels])
+		}
+	}
+}
+
+//单个时间序列的当前值
+type MetricSample struct {
+	Name   string
+	Type   string
+	Labels map[string]string
+	Value  float64
+}
+
+//所有时间序列的快照，按名称排序，供推送及statsd等输出使用
+func (m *Metrics) Samples() []MetricSample {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	samples := []MetricSample{}
+	for name, series := range m.series {
+		for labels, value := range series {
+			//histogram的各序列按累计计数输出
+			if m.types[name] == MetricHistogram {
+				suffix, _, _ := splitHistogramKey(labels)
+				samples = append(samples, MetricSample{Name: name + suffix, Type: MetricCounter, Labels: parseLabels(strings.TrimPrefix(labels, suffix)), Value: value})
+				continue
+			}
+			samples = append(samples, MetricSample{Name: name, Type: m.types[name], Labels: parseLabels(labels), Value: value})
+		}
+	}
+	sort.Slice(samples, func(i, j int) bool {
+		if samples[i].Name != samples[j].Name {
+			return samples[i].Name < samples[j].Name
+		}
+		return formatLabels(samples[i].Labels) < formatLabels(samples[j].Labels)
+	})
+	return samples
+}
+
+//解析formatLabels的输出
+func parseLabels(s string) map[string]string {
+	labels := map[string]string{}
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "{"), "}")
+	for s != "" {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		quoted, err := strconv.QuotedPrefix(s[eq+1:])
+		if err != nil {
+			break
+		}
+		labels[s[:eq]], _ = strconv.Unquote(quoted)
+		s = strings.TrimPrefix(s[eq+1+len(quoted):], ",")
+	}
+	return labels
+}
@@ -0,0 +1,176 @@
+package common
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+//指标推送方式
+const (
+	MetricsPushPushgateway string = "pushgateway"
+	MetricsPushRemoteWrite string = "remotewrite"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_metrics_push_total", MetricCounter, "Metric pushes to the pushgateway or remote-write endpoint, result=ok or error.")
+}
+
+//没有prometheus抓取的环境中定期推送指标，pull接口不受影响
+type MetricsPusher struct {
+	config   JdMetricsPush
+	instance string
+	client   *http.Client
+}
+
+func NewMetricsPusher(config JdMetricsPush) (*MetricsPusher, error) {
+	if config.Type != MetricsPushPushgateway && config.Type != MetricsPushRemoteWrite {
+		return nil, errors.New("metrics.push.type must be pushgateway or remotewrite")
+	}
+	if _, err := url.Parse(config.Url); err != nil || config.Url == "" {
+		return nil, errors.New("metrics.push.url is invalid")
+	}
+	if config.Job == "" {
+		config.Job = "vipsidecar"
+	}
+	if config.Interval <= 0 {
+		config.Interval = 30
+	}
+	instance := config.Instance
+	if instance == "" {
+		instance, _ = os.Hostname()
+	}
+	return &MetricsPusher{config: config, instance: instance, client: &http.Client{Timeout: 10 * time.Second}}, nil
+}
+
+func (p *MetricsPusher) Run() {
+	for {
+		time.Sleep(time.Duration(p.config.Interval) * time.Second)
+		p.PushOnce()
+	}
+}
+
+//推送一次并记录结果，退出前也会调用一次以发送最终状态
+func (p *MetricsPusher) PushOnce() {
+	var err error
+	if p.config.Type == MetricsPushPushgateway {
+		err = p.pushgateway()
+	} else {
+		err = p.remoteWrite()
+	}
+	result := "ok"
+	if err != nil {
+		log.Println("metrics push failed", err)
+		result = "error"
+	}
+	DefaultMetrics.Add("vipsidecar_metrics_push_total", map[string]string{"result": result}, 1)
+}
+
+func (p *MetricsPusher) do(method string, rawurl string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequest(method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	for k, v := range p.config.Headers {
+		req.Header.Set(k, v)
+	}
+	if p.config.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+p.config.BearerToken)
+	} else if p.config.Username != "" {
+		req.SetBasicAuth(p.config.Username, p.config.Password)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return errors.New(method + " " + rawurl + ": " + resp.Status)
+	}
+	return nil
+}
+
+//以job及instance为分组key，PUT替换该分组下的全部指标
+func (p *MetricsPusher) pushgateway() error {
+	var buf bytes.Buffer
+	DefaultMetrics.WriteText(&buf)
+	rawurl := strings.TrimRight(p.config.Url, "/") + "/metrics/job/" + url.PathEscape(p.config.Job) + "/instance/" + url.PathEscape(p.instance)
+	return p.do("PUT", rawurl, buf.Bytes(), map[string]string{"Content-Type": "text/plain; version=0.0.4"})
+}
+
+//prometheus remote write 1.0，protobuf编码的WriteRequest经snappy压缩
+func (p *MetricsPusher) remoteWrite() error {
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+	var request []byte
+	for _, sample := range DefaultMetrics.Samples() {
+		labels := map[string]string{"__name__": sample.Name, "job": p.config.Job, "instance": p.instance}
+		for k, v := range sample.Labels {
+			labels[k] = v
+		}
+		names := []string{}
+		for k := range labels {
+			names = append(names, k)
+		}
+		sort.Strings(names)
+		var series []byte
+		for _, name := range names {
+			var label []byte
+			label = protoBytes(label, 1, []byte(name))
+			label = protoBytes(label, 2, []byte(labels[name]))
+			series = protoBytes(series, 1, label)
+		}
+		var s []byte
+		s = binary.AppendUvarint(s, 1<<3|1)
+		s = binary.LittleEndian.AppendUint64(s, math.Float64bits(sample.Value))
+		s = binary.AppendUvarint(s, 2<<3)
+		s = binary.AppendUvarint(s, uint64(timestamp))
+		series = protoBytes(series, 2, s)
+		request = protoBytes(request, 1, series)
+	}
+	return p.do("POST", p.config.Url, snappyLiteral(request), map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+	})
+}
+
+//length-delimited字段
+func protoBytes(b []byte, field uint64, value []byte) []byte {
+	b = binary.AppendUvarint(b, field<<3|2)
+	b = binary.AppendUvarint(b, uint64(len(value)))
+	return append(b, value...)
+}
+
+//只使用literal的snappy block格式，不压缩但可被任何snappy解码器读取
+func snappyLiteral(data []byte) []byte {
+	b := binary.AppendUvarint(nil, uint64(len(data)))
+	for len(data) > 0 {
+		chunk := data
+		if len(chunk) > 65536 {
+			chunk = chunk[:65536]
+		}
+		n := len(chunk) - 1
+		switch {
+		case n < 60:
+			b = append(b, byte(n<<2))
+		case n < 256:
+			b = append(b, 60<<2, byte(n))
+		default:
+			b = append(b, 61<<2, byte(n), byte(n>>8))
+		}
+		b = append(b, chunk...)
+		data = data[len(chunk):]
+	}
+	return b
+}
@@ -0,0 +1,146 @@
+package common
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//NAT网关DNAT规则
+type DnatRule struct {
+	DnatRuleId        string `json:"dnatRuleId"`
+	Protocol          string `json:"protocol"`
+	ExternalPort      int    `json:"externalPort"`
+	InternalIpAddress string `json:"internalIpAddress"`
+	InternalPort      int    `json:"internalPort"`
+}
+
+//获取DNAT规则
+func GetDnatRule(api VpcApi, regionId string, natGatewayId string, dnatRuleId string) (*DnatRule, error) {
+	dnatrule, err := api.DescribeDnatRule(regionId, natGatewayId, dnatRuleId)
+	if err != nil {
+		DefaultStatus.RecordError("DescribeDnatRule", err)
+	}
+	return dnatrule, err
+}
+
+//将DNAT规则的内网地址指向internalIp，返回requestId
+func RepointDnatRule(api VpcApi, regionId string, natGatewayId string, dnatRuleId string, internalIp string, budget *Budget) (string, error) {
+	requestid, err := budget.RetryPolicy().Do("ModifyDnatRule", func() (string, error) {
+		return api.ModifyDnatRule(regionId, natGatewayId, dnatRuleId, internalIp)
+	})
+	if err != nil {
+		DefaultStatus.RecordError("ModifyDnatRule", err)
+		return requestid, err
+	}
+	log.Println("dnat rule", dnatRuleId, "repointed to", internalIp, "requestId", requestid)
+	return requestid, nil
+}
+
+//通过NAT网关DNAT规则实现漂移，vip在本机时将对应规则的内网地址改为本机地址
+type NatDnatProvider struct {
+	parameter *Parameters
+	clients   *RegionClients
+	pool      *WorkerPool
+	states    *VipStateMachine
+}
+
+func NewNatDnatProvider(p *Parameters, clients *RegionClients, pool *WorkerPool) *NatDnatProvider {
+	return &NatDnatProvider{parameter: p, clients: clients, pool: pool, states: newProviderStates()}
+}
+
+func (n *NatDnatProvider) Name() string {
+	return ModeNatDnat
+}
+
+func (n *NatDnatProvider) Reconcile(ctx context.Context, vipsonlocal []string) {
+	natgateway := n.parameter.NatGateway
+	n.states.Sync(vipsonlocal)
+	for _, rule := range natgateway.DnatRules {
+		if ctx.Err() != nil {
+			log.Println("reconcile cancelled")
+			return
+		}
+		ok, _ := Contain(rule.Vip, vipsonlocal)
+		if !ok {
+			continue
+		}
+		dnatruleid, vip := rule.DnatRuleId, rule.Vip
+		n.pool.Submit(rule.Vip+"/"+dnatruleid, func() {
+			dnatrule, err := GetDnatRule(n.clients.Get(natgateway.RangId), natgateway.RangId, natgateway.NatGatewayId, dnatruleid)
+			if err != nil {
+				log.Println(err)
+				return
+			}
+			if dnatrule.InternalIpAddress == natgateway.LocalIp {
+				n.states.Adopt(vip)
+				return
+			}
+			if !allowFailover(ctx, vip) {
+				return
+			}
+			epoch := n.states.Acquire(vip)
+			budget := NewBudget(vip, ModeNatDnat, time.Duration(n.parameter.FailoverBudget)*time.Second)
+			budget.SetFence(n.states.Fence(vip, epoch))
+			budget.Track(ctx)
+			budget.Enter(PhaseFence)
+			defer budget.Finish()
+			//IPAM/CMDB中vip未预留给本服务时不切换dnat规则
+			if err := DefaultIpam.Check(vip); err != nil {
+				log.Println(err)
+				n.states.Fail(vip, ReasonOf(err), "")
+				return
+			}
+			budget.Enter(PhaseCloudAttach)
+			requestid, err := RepointDnatRule(n.clients.Get(natgateway.RangId), natgateway.RangId, natgateway.NatGatewayId, dnatruleid, natgateway.LocalIp, budget)
+			if err != nil {
+				log.Println(err)
+				n.states.Fail(vip, ReasonOf(err), requestid)
+				return
+			}
+			budget.Enter(PhaseFence)
+			if n.states.Fresh(vip, requestid, epoch) != nil {
+				return
+			}
+			go DefaultIpam.Record(vip)
+			//校验为可选步骤
+			if budget.Allow("verify", verifyStepTime) {
+				budget.Enter(PhaseVerify)
+				if dnatrule, err := GetDnatRule(n.clients.Get(natgateway.RangId), natgateway.RangId, natgateway.NatGatewayId, dnatruleid); err == nil && dnatrule.InternalIpAddress != natgateway.LocalIp {
+					n.states.Degrade(vip, "verify failed, dnat rule points to "+dnatrule.InternalIpAddress)
+				}
+			}
+		})
+	}
+}
+
+//DNAT规则期望指向与实际指向的差异
+func (n *NatDnatProvider) Diff(vipsonlocal []string) []string {
+	natgateway := n.parameter.NatGateway
+	lines := []string{}
+	for _, rule := range natgateway.DnatRules {
+		lines = append(lines, "dnat rule "+rule.DnatRuleId+" (vip "+rule.Vip+")")
+		actual := "<unknown>"
+		dnatrule, err := GetDnatRule(n.clients.Get(natgateway.RangId), natgateway.RangId, natgateway.NatGatewayId, rule.DnatRuleId)
+		if err != nil {
+			actual = "<error: " + err.Error() + ">"
+		} else {
+			actual = dnatrule.InternalIpAddress
+		}
+		if ok, _ := Contain(rule.Vip, vipsonlocal); !ok {
+			lines = append(lines, "    desired: not held by this node", "    actual:  "+actual, "")
+			continue
+		}
+		lines = append(lines, "    desired: "+natgateway.LocalIp, "    actual:  "+actual)
+		if err == nil && actual != natgateway.LocalIp {
+			lines = append(lines, "  ~ repoint to "+natgateway.LocalIp)
+		}
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+//vip当前状态
+func (n *NatDnatProvider) VipState(vip string) VipState {
+	return n.states.State(vip)
+}
@@ -0,0 +1,101 @@
+package common
+
+import (
+	"log"
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+func init() {
+	registerFeature("netlink")
+}
+
+//rtnetlink多播组，syscall包未定义
+const (
+	rtmgrpLink       = 0x1
+	rtmgrpIpv4Ifaddr = 0x10
+)
+
+//订阅netlink地址及链路事件，vip从本机删除或新增、接口状态变化时立即触发reconcile，不必等待轮询
+//onevent的参数为事件描述
+func WatchNetlink(vips func() []string, onevent func(reason string)) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	addr := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK, Groups: rtmgrpLink | rtmgrpIpv4Ifaddr}
+	if err := syscall.Bind(fd, addr); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 65536)
+		//接口up/running状态，只在变化时触发
+		linkstates := make(map[int32]uint32)
+		for {
+			n, _, err := syscall.Recvfrom(fd, buf, 0)
+			DefaultSelfChecks.Report(SelfCheckNetlink, err)
+			if err != nil {
+				log.Println("netlink", err)
+				continue
+			}
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				log.Println("netlink", err)
+				continue
+			}
+			for _, m := range msgs {
+				switch m.Header.Type {
+				case syscall.RTM_NEWADDR, syscall.RTM_DELADDR:
+					ip := netlinkAddr(&m)
+					if ip == "" {
+						continue
+					}
+					if ok, _ := Contain(ip, vips()); ok {
+						action := "added"
+						if m.Header.Type == syscall.RTM_DELADDR {
+							action = "removed"
+						}
+						onevent("vip " + ip + " " + action)
+					}
+				case syscall.RTM_NEWLINK, syscall.RTM_DELLINK:
+					if len(m.Data) < syscall.SizeofIfInfomsg {
+						continue
+					}
+					info := (*syscall.IfInfomsg)(unsafe.Pointer(&m.Data[0]))
+					state := info.Flags & (syscall.IFF_UP | syscall.IFF_RUNNING)
+					if m.Header.Type == syscall.RTM_DELLINK {
+						state = 0
+					}
+					if previous, ok := linkstates[info.Index]; ok && previous == state {
+						continue
+					}
+					linkstates[info.Index] = state
+					name := ""
+					if iface, err := net.InterfaceByIndex(int(info.Index)); err == nil {
+						name = iface.Name
+					}
+					onevent("link " + name + " state changed")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+func netlinkAddr(m *syscall.NetlinkMessage) string {
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		return ""
+	}
+	for _, attr := range attrs {
+		if attr.Attr.Type == syscall.IFA_LOCAL || attr.Attr.Type == syscall.IFA_ADDRESS {
+			if len(attr.Value) == 4 {
+				return net.IP(attr.Value).String()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import (
+	"errors"
+)
+
+func WatchNetlink(vips func() []string, onevent func(reason string)) error {
+	return errors.New("netlink is only supported on linux")
+}
@@ -0,0 +1,41 @@
+package common
+
+import (
+	"sort"
+	"strings"
+	"sync"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_offline_vips", MetricGauge, "VIPs held by this node whose cloud binding cannot be confirmed because the cloud API is unreachable.")
+}
+
+//记录处于Offline的vip：云上接口不可达时本机继续持有vip(不删除地址、策略路由，继续响应bond切换的免费arp)，
+//期间/healthz的cloudapi按degraded报告，不因云上接口不可达判定sidecar故障，恢复后由reconcile重新确认绑定
+type OfflineTracker struct {
+	mutex sync.Mutex
+	vips  map[string]bool
+}
+
+var DefaultOffline = &OfflineTracker{vips: map[string]bool{}}
+
+func (o *OfflineTracker) OnTransition(vip string, from VipState, to VipState) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if to == StateOffline {
+		o.vips[vip] = true
+	} else {
+		delete(o.vips, vip)
+	}
+	vips := []string{}
+	for v := range o.vips {
+		vips = append(vips, v)
+	}
+	sort.Strings(vips)
+	DefaultMetrics.Set("vipsidecar_offline_vips", nil, float64(len(vips)))
+	reason := ""
+	if len(vips) > 0 {
+		reason = "offline, still holding " + strings.Join(vips, ",")
+	}
+	DefaultSelfChecks.Tolerate(SelfCheckCloudApi, reason)
+}
@@ -0,0 +1,210 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//管理接口的一个操作，request/response为请求及响应json对应的Go值，schema由其类型反射生成
+type adminOperation struct {
+	method      string
+	summary     string
+	request     interface{}
+	response    interface{}
+	contenttype string //响应不是json时的类型
+	status      int    //成功时的状态码，默认200
+	conflict    bool   //409表示业务失败，响应体同response
+	deprecated  bool
+}
+
+//已注册路径的文档，/openapi.json只包含当前进程实际注册的路径，注册了但没有文档的路径只列出角色
+var adminApiDocs = map[string][]adminOperation{
+	"/healthz": {{method: "get", summary: "Self checks of the sidecar's own dependencies, 503 when any check is failing or stale", response: struct {
+		Status string                     `json:"status"`
+		Checks map[string]SelfCheckResult `json:"checks"`
+	}{}}},
+	"/metrics":                         {{method: "get", summary: "Metrics in prometheus text format", contenttype: "text/plain"}},
+	"/openapi.json":                    {{method: "get", summary: "This document", contenttype: "application/json"}},
+	"/dashboard":                       {{method: "get", summary: "Web dashboard", contenttype: "text/html"}},
+	AdminApiPrefix + "/status":         {{method: "get", summary: "Runtime status", response: &Status{}}},
+	AdminApiPrefix + "/status/watch":   {{method: "get", summary: "Server-sent events: a status snapshot (event status) followed by transition and health events, data of the latter is a StatusEvent", contenttype: "text/event-stream"}},
+	AdminApiPrefix + "/history":        {{method: "get", summary: "Recent vip state transitions", response: []Transition{}}},
+	"/status":                          {{method: "get", summary: "Alias of " + AdminApiPrefix + "/status", response: &Status{}, deprecated: true}},
+	"/history":                         {{method: "get", summary: "Alias of " + AdminApiPrefix + "/history", response: []Transition{}, deprecated: true}},
+	AdminApiPrefix + "/reconcile":      {{method: "post", summary: "Trigger a reconcile", status: http.StatusAccepted}},
+	AdminApiPrefix + "/handoff":        {{method: "post", summary: "Hand a bound vip over to a peer, rolled back when the peer fails. Without confirm only the impact estimate is returned, with status 428", request: HandoffRequest{}, response: HandoffResult{}, conflict: true}},
+	AdminApiPrefix + "/handoff/accept": {{method: "post", summary: "Called by the peer giving a vip away, adds the vip locally and waits for it to be bound", request: HandoffRequest{}, response: HandoffResult{}, conflict: true}},
+	AdminApiPrefix + "/health/": {{method: "post", summary: "Push the result of the external health check name", request: HealthVerdict{}, response: struct {
+		Check   string `json:"check"`
+		Healthy bool   `json:"healthy"`
+	}{}}},
+	AdminApiPrefix + "/pause": {
+		{method: "post", summary: "Stop this node from taking over vips, vips already held are not affected", status: http.StatusNoContent},
+		{method: "delete", summary: "Resume taking over vips", status: http.StatusNoContent},
+	},
+	AdminApiPrefix + "/flags":  {{method: "get", summary: "Runtime feature flags", response: map[string]FeatureFlag{}}},
+	AdminApiPrefix + "/flags/": {{method: "put", summary: "Enable or disable the feature flag name until the flags file or another request changes it", request: FeatureFlagRequest{}, response: FeatureFlag{}}},
+}
+
+//StatusEvent不出现在任何json响应中，单独加入components
+var adminApiExtraSchemas = []interface{}{StatusEvent{}}
+
+//注册/openapi.json，不需要认证
+func (a *AdminServer) RegisterOpenApi() {
+	a.handlePublic("/openapi.json", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a.OpenApi())
+	}))
+}
+
+//根据已注册的路径生成OpenAPI 3文档
+func (a *AdminServer) OpenApi() map[string]interface{} {
+	a.mutex.Lock()
+	routes := map[string]string{}
+	for path, role := range a.routes {
+		routes[path] = role
+	}
+	a.mutex.Unlock()
+	schemas := map[string]interface{}{}
+	for _, v := range adminApiExtraSchemas {
+		jsonSchema(reflect.TypeOf(v), schemas)
+	}
+	paths := map[string]interface{}{}
+	for path, role := range routes {
+		item := map[string]interface{}{}
+		docs, ok := adminApiDocs[path]
+		if !ok {
+			docs = []adminOperation{{method: "get", summary: "Undocumented", contenttype: "application/octet-stream"}}
+		}
+		for _, doc := range docs {
+			item[doc.method] = doc.operation(role, a.authEnabled(), schemas)
+		}
+		//前缀路径以参数表示
+		if strings.HasSuffix(path, "/") && path != "/" && ok {
+			path += "{name}"
+			for _, op := range item {
+				op.(map[string]interface{})["parameters"] = []interface{}{map[string]interface{}{"name": "name", "in": "path", "required": true, "schema": map[string]string{"type": "string"}}}
+			}
+		}
+		paths[path] = item
+	}
+	doc := map[string]interface{}{
+		"openapi":    "3.0.3",
+		"info":       map[string]string{"title": "vipsidecar admin api", "version": strings.TrimPrefix(AdminApiPrefix, "/")},
+		"paths":      paths,
+		"components": map[string]interface{}{"schemas": schemas},
+	}
+	if a.authEnabled() {
+		doc["components"].(map[string]interface{})["securitySchemes"] = map[string]interface{}{"bearer": map[string]string{"type": "http", "scheme": "bearer"}}
+	}
+	return doc
+}
+
+func (o adminOperation) operation(role string, auth bool, schemas map[string]interface{}) map[string]interface{} {
+	status := o.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	response := map[string]interface{}{"description": http.StatusText(status)}
+	if o.response != nil {
+		response["content"] = map[string]interface{}{"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(o.response), schemas)}}
+	} else if o.contenttype != "" {
+		response["content"] = map[string]interface{}{o.contenttype: map[string]interface{}{}}
+	}
+	responses := map[string]interface{}{strconv.Itoa(status): response}
+	if o.conflict {
+		responses["409"] = map[string]interface{}{"description": "Rejected, failed or rolled back", "content": response["content"]}
+	}
+	op := map[string]interface{}{"summary": o.summary, "responses": responses}
+	if o.request != nil {
+		op["requestBody"] = map[string]interface{}{"required": true, "content": map[string]interface{}{"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(o.request), schemas)}}}
+	}
+	if o.deprecated {
+		op["deprecated"] = true
+	}
+	if role != "" {
+		op["x-vipsidecar-role"] = role
+		if auth {
+			op["security"] = []interface{}{map[string]interface{}{"bearer": []string{}}}
+			responses["401"] = map[string]string{"description": "Unauthorized"}
+			responses["403"] = map[string]string{"description": "Role not allowed"}
+		}
+	}
+	return op
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+//由Go类型生成json schema，具名结构体加入schemas并返回引用，omitempty的字段不是必需字段
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Struct:
+		if t.Name() != "" {
+			ref := map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+			if _, ok := schemas[t.Name()]; ok {
+				return ref
+			}
+			//先占位，避免递归类型无限展开
+			schemas[t.Name()] = nil
+			schemas[t.Name()] = structSchema(t, schemas)
+			return ref
+		}
+		return structSchema(t, schemas)
+	}
+	return map[string]interface{}{}
+}
+
+func structSchema(t reflect.Type, schemas map[string]interface{}) map[string]interface{} {
+	properties := map[string]interface{}{}
+	required := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.PkgPath != "" {
+			continue
+		}
+		tag := strings.Split(field.Tag.Get("json"), ",")
+		if tag[0] == "-" {
+			continue
+		}
+		name := tag[0]
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = jsonSchema(field.Type, schemas)
+		omitempty := false
+		for _, option := range tag[1:] {
+			omitempty = omitempty || option == "omitempty"
+		}
+		if !omitempty && field.Type.Kind() != reflect.Ptr {
+			required = append(required, name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		sort.Strings(required)
+		schema["required"] = required
+	}
+	return schema
+}
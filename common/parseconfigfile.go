@@ -3,17 +3,532 @@ package common
 import (
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
-	"log"
-	"os"
 )
 
 type Parameters struct {
-	AccessKeyID           string               `yaml:"accessskeyid"`
-	AccessKeySecret       string               `yaml:"accesskeysecret"`
-	Vips                  []string             `yaml:"vips"`
-	Allnetworkinterfaces  []JdNetworkInterface `yaml:"allnetworkinterfaces"`
-	Localnetworkinterface JdNetworkInterface   `yaml:"localnetworkinterface"`
-	Pollinginterval       int                  `yaml:"pollinginterval"`
+	AccessKeyID              string               `yaml:"accessskeyid"`
+	AccessKeySecret          string               `yaml:"accesskeysecret"`
+	SecondaryAccessKeyID     string               `yaml:"secondaryaccesskeyid"`
+	SecondaryAccessKeySecret string               `yaml:"secondaryaccesskeysecret"`
+	Vips                     []JdVip              `yaml:"vips"`
+	Allnetworkinterfaces     []JdNetworkInterface `yaml:"allnetworkinterfaces"`
+	Localnetworkinterface    JdNetworkInterface   `yaml:"localnetworkinterface"`
+	Fallbackinterfaces       []JdNetworkInterface `yaml:"fallbackinterfaces"`
+	Maxsecondaryips          int                  `yaml:"maxsecondaryips"`
+	Pollinginterval          int                  `yaml:"pollinginterval"`
+	Watchinterval            int                  `yaml:"watchinterval"`
+	Cloudwatchinterval       int                  `yaml:"cloudwatchinterval"`
+	SnapshotMaxAge           int                  `yaml:"snapshotmaxage"`
+	DisableNetlink           bool                 `yaml:"disablenetlink"`
+	Startuptimeout           int                  `yaml:"startuptimeout"`
+	MetricsAddr              string               `yaml:"metricsaddr"`
+	Historysize              int                  `yaml:"historysize"`
+	FailoverLog              string               `yaml:"failoverlog"`
+	Mode                     string               `yaml:"mode"`
+	Concurrency              int                  `yaml:"concurrency"`
+	VipJobInterval           int                  `yaml:"vipjobinterval"`
+	FailoverBudget           int                  `yaml:"failoverbudget"`
+	NatGateway               JdNatGateway         `yaml:"natgateway"`
+	Regions                  []JdRegion           `yaml:"regions"`
+	Dr                       JdDr                 `yaml:"dr"`
+	Eni                      JdEni                `yaml:"eni"`
+	ClockSkew                JdClockSkew          `yaml:"clockskew"`
+	Federation               JdFederation         `yaml:"federation"`
+	Admin                    JdAdmin              `yaml:"admin"`
+	Proxy                    JdProxy              `yaml:"proxy"`
+	Transport                JdTransport          `yaml:"transport"`
+	Garp                     JdGarp               `yaml:"garp"`
+	Dad                      JdDad                `yaml:"dad"`
+	Sysctl                   JdSysctl             `yaml:"sysctl"`
+	PolicyRouting            JdPolicyRouting      `yaml:"policyrouting"`
+	Handoff                  JdHandoff            `yaml:"handoff"`
+	Drain                    JdDrain              `yaml:"drain"`
+	Spot                     JdSpot               `yaml:"spot"`
+	ExternalDns              JdExternalDns        `yaml:"externaldns"`
+	LoadBalancer             JdLoadBalancer       `yaml:"loadbalancer"`
+	Gateway                  JdGateway            `yaml:"gateway"`
+	Conflicts                JdConflicts          `yaml:"conflicts"`
+	Maintenance              JdMaintenance        `yaml:"maintenance"`
+	Schedule                 JdSchedule           `yaml:"schedule"`
+	FlapDamping              JdFlapDamping        `yaml:"flapdamping"`
+	HealthChecks             []JdHealthCheck      `yaml:"healthchecks"`
+	Heartbeat                JdHeartbeat          `yaml:"heartbeat"`
+	Plugins                  []JdPlugin           `yaml:"plugins"`
+	ProviderPlugin           string               `yaml:"providerplugin"`
+	Ipam                     JdIpam               `yaml:"ipam"`
+	Kafka                    JdKafka              `yaml:"kafka"`
+	Log                      JdLog                `yaml:"log"`
+	Metrics                  JdMetrics            `yaml:"metrics"`
+	Slo                      JdSlo                `yaml:"slo"`
+	Safety                   JdSafety             `yaml:"safety"`
+	FeatureFlags             JdFeatureFlags       `yaml:"featureflags"`
+	AdaptiveInterval         JdAdaptiveInterval   `yaml:"adaptiveinterval"`
+	Probe                    JdProbe              `yaml:"probe"`
+	Traffic                  JdTraffic            `yaml:"traffic"`
+	Capture                  JdCapture            `yaml:"capture"`
+	Fips                     bool                 `yaml:"fips"`
+	Privileges               JdPrivileges         `yaml:"privileges"`
+	DetachJournal            string               `yaml:"detachjournal"`
+	HookResults              string               `yaml:"hookresults"`
+}
+
+//drop为true时以root启动后切换到user(用户名或uid，默认65534)，只保留需要的capabilities；noplumbing为true时不做任何本机网络配置，不保留capabilities
+type JdPrivileges struct {
+	Drop       bool   `yaml:"drop"`
+	User       string `yaml:"user"`
+	NoPlumbing bool   `yaml:"noplumbing"`
+}
+
+//故障转移开始时抓包，dir为pcap文件目录，duration单位秒(默认5)，snaplen默认256，maxbytes为单个文件上限(默认1MiB)，keep为保留的文件数(默认10)
+type JdCapture struct {
+	Enabled  bool   `yaml:"enabled"`
+	Dir      string `yaml:"dir"`
+	Duration int    `yaml:"duration"`
+	SnapLen  int    `yaml:"snaplen"`
+	MaxBytes int    `yaml:"maxbytes"`
+	Keep     int    `yaml:"keep"`
+}
+
+//按vip采样conntrack及所在接口的计数器，interval单位秒(默认10)
+type JdTraffic struct {
+	Enabled  bool `yaml:"enabled"`
+	Interval int  `yaml:"interval"`
+}
+
+//探测各region endpoint，interval、timeout单位为秒(默认10、5)，连续failurethreshold次(默认3)无响应时判定不可达
+type JdProbe struct {
+	Enabled          bool `yaml:"enabled"`
+	Interval         int  `yaml:"interval"`
+	Timeout          int  `yaml:"timeout"`
+	FailureThreshold int  `yaml:"failurethreshold"`
+}
+
+//按云上接口限流及延迟调整pollinginterval，min、max单位为秒(默认pollinginterval及其10倍)，latency为平均延迟阈值(毫秒，默认2000)
+type JdAdaptiveInterval struct {
+	Enabled bool `yaml:"enabled"`
+	Min     int  `yaml:"min"`
+	Max     int  `yaml:"max"`
+	Latency int  `yaml:"latency"`
+}
+
+//flags为开关初始值，file为name: true|false格式的yaml(如挂载的ConfigMap)，每interval秒(默认10)检查一次，内容变化时应用
+type JdFeatureFlags struct {
+	Flags    map[string]bool `yaml:"flags"`
+	File     string          `yaml:"file"`
+	Interval int             `yaml:"interval"`
+}
+
+//运行时安全断言，fencing为strict时绑定前确认其他网卡不再持有vip
+type JdSafety struct {
+	Fencing string `yaml:"fencing"`
+}
+
+//故障转移SLO，target如0.99，threshold为单次转移的目标耗时(秒，默认failoverbudget)，window为SLO窗口(天，默认30)
+//webhook配置时burn rate超过告警阈值POST告警json
+type JdSlo struct {
+	Target    float64 `yaml:"target"`
+	Threshold int     `yaml:"threshold"`
+	Window    int     `yaml:"window"`
+	Webhook   string  `yaml:"webhook"`
+}
+
+//backend为prometheus(默认)或statsd，metricsaddr配置时/metrics始终可用
+type JdMetrics struct {
+	Backend string        `yaml:"backend"`
+	Statsd  JdStatsd      `yaml:"statsd"`
+	Push    JdMetricsPush `yaml:"push"`
+}
+
+//address为host:port，interval单位为秒，tags为dogstatsd时附加到所有指标的标签(k:v)
+type JdStatsd struct {
+	Address   string   `yaml:"address"`
+	Prefix    string   `yaml:"prefix"`
+	DogStatsd bool     `yaml:"dogstatsd"`
+	Tags      []string `yaml:"tags"`
+	Interval  int      `yaml:"interval"`
+}
+
+//type为pushgateway或remotewrite，interval单位为秒，bearertoken与username/password二选一
+type JdMetricsPush struct {
+	Type        string            `yaml:"type"`
+	Url         string            `yaml:"url"`
+	Job         string            `yaml:"job"`
+	Instance    string            `yaml:"instance"`
+	Interval    int               `yaml:"interval"`
+	Username    string            `yaml:"username"`
+	Password    string            `yaml:"password"`
+	BearerToken string            `yaml:"bearertoken"`
+	Headers     map[string]string `yaml:"headers"`
+}
+
+//日志输出，outputs可同时包含stderr、stdout、syslog及journald，未配置时输出到stderr
+type JdLog struct {
+	Outputs  []string      `yaml:"outputs"`
+	Syslog   JdSyslog      `yaml:"syslog"`
+	Sampling JdLogSampling `yaml:"sampling"`
+	SdkLevel string        `yaml:"sdklevel"`
+}
+
+//同一消息在period秒内前first条全部输出，之后每thereafter条输出一条(为0时不再输出)，周期结束时输出被抑制条数的汇总；first为0时不采样
+type JdLogSampling struct {
+	First      int `yaml:"first"`
+	Thereafter int `yaml:"thereafter"`
+	Period     int `yaml:"period"`
+}
+
+//address为udp://、tcp://或tls://host:port，facility默认daemon，appname默认vipsidecar，同时用作journald的SYSLOG_IDENTIFIER
+type JdSyslog struct {
+	Address  string `yaml:"address"`
+	Facility string `yaml:"facility"`
+	AppName  string `yaml:"appname"`
+	CaCert   string `yaml:"cacert"`
+}
+
+//vip归属变化及失败事件导出到kafka，timeout单位为秒
+type JdKafka struct {
+	Brokers []string    `yaml:"brokers"`
+	Topic   string      `yaml:"topic"`
+	Tls     JdKafkaTls  `yaml:"tls"`
+	Sasl    JdKafkaSasl `yaml:"sasl"`
+	Timeout int         `yaml:"timeout"`
+}
+
+type JdKafkaTls struct {
+	Enabled            bool   `yaml:"enabled"`
+	CaCert             string `yaml:"cacert"`
+	InsecureSkipVerify bool   `yaml:"insecureskipverify"`
+}
+
+//目前只支持plain
+type JdKafkaSasl struct {
+	Mechanism string `yaml:"mechanism"`
+	Username  string `yaml:"username"`
+	Password  string `yaml:"password"`
+}
+
+//IPAM/CMDB对接，type为netbox或plugin，service为本服务在IPAM中登记的名称，holder默认为主机名
+//netbox中vip需处于reserved或active状态，且servicefield(默认vip_service)自定义字段等于service，绑定后将holder写入holderfield(默认vip_holder)
+type JdIpam struct {
+	Type         string `yaml:"type"`
+	Url          string `yaml:"url"`
+	Token        string `yaml:"token"`
+	Service      string `yaml:"service"`
+	ServiceField string `yaml:"servicefield"`
+	HolderField  string `yaml:"holderfield"`
+	Plugin       string `yaml:"plugin"`
+	Holder       string `yaml:"holder"`
+}
+
+//外部插件，type为provider、healthcheck、notifier或ipam，timeout单位为秒
+type JdPlugin struct {
+	Name    string `yaml:"name"`
+	Type    string `yaml:"type"`
+	Command string `yaml:"command"`
+	Timeout int    `yaml:"timeout"`
+}
+
+//发布到共享存储的心跳，secret同时用于校验heartbeat类型健康检查读取的心跳，interval单位为秒
+//keys为带id的多个密钥，轮换期间同时有效，使用signkey签名，未配置时使用secret，没有secret时使用keys中的第一个
+type JdHeartbeat struct {
+	Url      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Secret   string            `yaml:"secret"`
+	Holder   string            `yaml:"holder"`
+	Interval int               `yaml:"interval"`
+	MaxAge   int               `yaml:"maxage"`
+	Keys     []JdHeartbeatKey  `yaml:"keys"`
+	SignKey  string            `yaml:"signkey"`
+}
+
+type JdHeartbeatKey struct {
+	Id     string `yaml:"id"`
+	Secret string `yaml:"secret"`
+}
+
+//具名健康检查，target对tcp为host:port，对http为url，对exec为shell命令，timeout单位为秒
+//external检查没有target，由外部推送结果，ttl秒内没有新的推送时按失败计
+//heartbeat检查的target为另一站点的heartbeat.url，ttl秒内没有更新时按失败计
+type JdHealthCheck struct {
+	Name               string `yaml:"name"`
+	Type               string `yaml:"type"`
+	Target             string `yaml:"target"`
+	Timeout            int    `yaml:"timeout"`
+	Ttl                int    `yaml:"ttl"`
+	JdHealthThresholds `yaml:",inline"`
+}
+
+//抖动抑制配置，period及holddown单位为分钟
+type JdFlapDamping struct {
+	MaxMoves int `yaml:"maxmoves"`
+	Period   int `yaml:"period"`
+	HoldDown int `yaml:"holddown"`
+}
+
+//自动故障转移时间计划，timezone为空时使用本地时区
+type JdSchedule struct {
+	Timezone  string             `yaml:"timezone"`
+	Windows   []JdScheduleWindow `yaml:"windows"`
+	Blackouts []JdScheduleWindow `yaml:"blackouts"`
+}
+
+//cron为开始时刻(分 时 日 月 周)，duration单位为分钟
+type JdScheduleWindow struct {
+	Name     string `yaml:"name"`
+	Cron     string `yaml:"cron"`
+	Duration int    `yaml:"duration"`
+}
+
+//计划内迁移配置，peertoken为调用对端/v1/handoff/accept使用的operator token
+type JdHandoff struct {
+	PeerToken  string `yaml:"peertoken"`
+	PeerCaCert string `yaml:"peercacert"`
+	Device     string `yaml:"device"`
+	Timeout    int    `yaml:"timeout"`
+}
+
+//kubernetes节点cordon/drain时将vip交给peers中的对端(管理接口地址，按顺序尝试)
+//node默认取环境变量NODE_NAME，apiserver默认使用pod内的service account访问集群
+type JdDrain struct {
+	Enabled   bool     `yaml:"enabled"`
+	Node      string   `yaml:"node"`
+	Peers     []string `yaml:"peers"`
+	ApiServer string   `yaml:"apiserver"`
+	Interval  int      `yaml:"interval"`
+}
+
+//spot/抢占式实例回收通知，url为实例元数据中的回收通知地址，收到通知后将vip交给peers中的对端
+type JdSpot struct {
+	Enabled  bool              `yaml:"enabled"`
+	Url      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Peers    []string          `yaml:"peers"`
+	Interval int               `yaml:"interval"`
+}
+
+//计划内维护事件，url返回本实例的维护事件数组，维护开始前lead秒(默认300)将vip交给peers中的对端
+type JdMaintenance struct {
+	Enabled  bool              `yaml:"enabled"`
+	Url      string            `yaml:"url"`
+	Headers  map[string]string `yaml:"headers"`
+	Peers    []string          `yaml:"peers"`
+	Lead     int               `yaml:"lead"`
+	Interval int               `yaml:"interval"`
+}
+
+//Service type=LoadBalancer实现，class不为空时启用，为loadBalancerClass为class的service从pool(须在vips中)分配vip
+//vippools为true时从kind为Service的VipPool对象读取地址池，device为添加vip的接口，默认取vip所在子网的接口，node默认取环境变量NODE_NAME
+type JdLoadBalancer struct {
+	Class     string   `yaml:"class"`
+	Pool      []string `yaml:"pool"`
+	VipPools  bool     `yaml:"vippools"`
+	Node      string   `yaml:"node"`
+	Device    string   `yaml:"device"`
+	ApiServer string   `yaml:"apiserver"`
+	Interval  int      `yaml:"interval"`
+	Outage    JdOutage `yaml:"outage"`
+}
+
+//kubernetes API不可用时持有者选择的处理方式，policy为hold(默认)、release-after或freeze，releaseafter单位秒
+type JdOutage struct {
+	Policy       string `yaml:"policy"`
+	ReleaseAfter int    `yaml:"releaseafter"`
+}
+
+//Gateway API地址管理，class不为空时启用，为gatewayClassName为class的Gateway从pool(须在vips中)分配vip
+//vippools为true时从kind为Gateway的VipPool对象读取地址池
+//podselector为数据面pod的标签选择器，默认为envoy gateway的标签，podnamespace为空时在所有namespace中查找
+type JdGateway struct {
+	Class        string   `yaml:"class"`
+	Pool         []string `yaml:"pool"`
+	VipPools     bool     `yaml:"vippools"`
+	PodSelector  string   `yaml:"podselector"`
+	PodNamespace string   `yaml:"podnamespace"`
+	Node         string   `yaml:"node"`
+	Device       string   `yaml:"device"`
+	ApiServer    string   `yaml:"apiserver"`
+	Interval     int      `yaml:"interval"`
+	Outage       JdOutage `yaml:"outage"`
+}
+
+//定期扫描集群中与vips冲突的对象，interval单位秒(默认300)，events为true时在冲突对象上生成事件
+type JdConflicts struct {
+	Enabled   bool   `yaml:"enabled"`
+	ApiServer string `yaml:"apiserver"`
+	Interval  int    `yaml:"interval"`
+	Events    bool   `yaml:"events"`
+}
+
+//以DNSEndpoint对象发布vip的dns记录供external-dns使用，records为vip与域名的对应关系
+type JdExternalDns struct {
+	Enabled   bool          `yaml:"enabled"`
+	Namespace string        `yaml:"namespace"`
+	ApiServer string        `yaml:"apiserver"`
+	Records   []JdDnsRecord `yaml:"records"`
+}
+
+//ttl单位秒，0使用external-dns的默认值
+type JdDnsRecord struct {
+	Vip     string `yaml:"vip"`
+	DnsName string `yaml:"dnsname"`
+	Ttl     int    `yaml:"ttl"`
+}
+
+//按vip的策略路由配置
+type JdPolicyRouting struct {
+	Enabled   bool   `yaml:"enabled"`
+	Gateway   string `yaml:"gateway"`
+	Device    string `yaml:"device"`
+	TableBase int    `yaml:"tablebase"`
+	Priority  int    `yaml:"priority"`
+}
+
+//托管内核参数，settings为空时使用DefaultSysctls
+type JdSysctl struct {
+	Managed  bool              `yaml:"managed"`
+	Settings map[string]string `yaml:"settings"`
+}
+
+//重复地址检测配置，timeout单位为毫秒
+type JdDad struct {
+	Enabled bool `yaml:"enabled"`
+	Timeout int  `yaml:"timeout"`
+}
+
+//免费arp配置，interfaces为空时自动选择网段包含vip的接口
+type JdGarp struct {
+	Enabled    bool     `yaml:"enabled"`
+	Interfaces []string `yaml:"interfaces"`
+	Count      int      `yaml:"count"`
+}
+
+//访问京东云接口的连接池参数，时间单位为秒
+type JdTransport struct {
+	MaxIdleConnsPerHost int  `yaml:"maxidleconnsperhost"`
+	IdleConnTimeout     int  `yaml:"idleconntimeout"`
+	TlsHandshakeTimeout int  `yaml:"tlshandshaketimeout"`
+	DisableHttp2        bool `yaml:"disablehttp2"`
+}
+
+//访问京东云接口使用的代理，url形如http://host:3128或socks5://host:1080
+type JdProxy struct {
+	Url     string        `yaml:"url"`
+	NoProxy string        `yaml:"noproxy"`
+	Rules   []JdProxyRule `yaml:"rules"`
+}
+
+//按endpoint指定代理
+type JdProxyRule struct {
+	Endpoint string `yaml:"endpoint"`
+	Url      string `yaml:"url"`
+}
+
+//管理接口认证配置，tokens及clientca均未配置时不做认证
+type JdAdmin struct {
+	Tokens    []JdAdminToken    `yaml:"tokens"`
+	TlsCert   string            `yaml:"tlscert"`
+	TlsKey    string            `yaml:"tlskey"`
+	ClientCa  string            `yaml:"clientca"`
+	CertRoles map[string]string `yaml:"certroles"`
+	AuditLog  string            `yaml:"auditlog"`
+	Dashboard bool              `yaml:"dashboard"`
+	//允许访问管理接口及metrics的来源地址(cidr或单个地址)及调用方(token名称或cert:CN)，为空时不限制
+	AllowCidrs      []string `yaml:"allowcidrs"`
+	AllowPrincipals []string `yaml:"allowprincipals"`
+}
+
+type JdAdminToken struct {
+	Name  string `yaml:"name"`
+	Token string `yaml:"token"`
+	Role  string `yaml:"role"`
+}
+
+//OIDC联合身份配置，使用kubernetes projected service account token换取临时凭证，不再需要长期AK/SK
+type JdFederation struct {
+	TokenFile   string `yaml:"tokenfile"`
+	RoleArn     string `yaml:"rolearn"`
+	Endpoint    string `yaml:"endpoint"`
+	SessionName string `yaml:"sessionname"`
+	Duration    int    `yaml:"duration"`
+}
+
+//时钟偏差检查配置，maxskew为负数时关闭检查
+type JdClockSkew struct {
+	MaxSkew        int  `yaml:"maxskew"`
+	CheckInterval  int  `yaml:"checkinterval"`
+	PauseMutations bool `yaml:"pausemutations"`
+}
+
+//dr模式配置，主vip持续不可用时启用另一region预先准备的vip并切换dns
+type JdDr struct {
+	PrimaryVip              string `yaml:"primaryvip"`
+	CheckPort               int    `yaml:"checkport"`
+	Health                  string `yaml:"health"`
+	JdHealthThresholds      `yaml:",inline"`
+	StandbyVip              string             `yaml:"standbyvip"`
+	StandbyNetworkInterface JdNetworkInterface `yaml:"standbynetworkinterface"`
+	DnsSwitchCommand        string             `yaml:"dnsswitchcommand"`
+	Confirm                 string             `yaml:"confirm"`
+	ConfirmFile             string             `yaml:"confirmfile"`
+	Override                JdDnsOverride      `yaml:"override"`
+}
+
+//dr切换后临时将names指向备vip，hostsfile为本机hosts文件，coredns为CoreDNS hosts插件读取的ConfigMap
+type JdDnsOverride struct {
+	Names     []string          `yaml:"names"`
+	HostsFile string            `yaml:"hostsfile"`
+	CoreDns   JdCoreDnsOverride `yaml:"coredns"`
+	Duration  int               `yaml:"duration"`
+}
+
+//namespace默认kube-system，key默认vipsidecar.hosts
+type JdCoreDnsOverride struct {
+	Namespace string `yaml:"namespace"`
+	ConfigMap string `yaml:"configmap"`
+	Key       string `yaml:"key"`
+	ApiServer string `yaml:"apiserver"`
+}
+
+//健康判定迟滞参数，interval及warmup单位为秒，interval小于pollinginterval时按pollinginterval探测
+type JdHealthThresholds struct {
+	FailureThreshold int `yaml:"failurethreshold"`
+	SuccessThreshold int `yaml:"successthreshold"`
+	FailureInterval  int `yaml:"failureinterval"`
+	SuccessInterval  int `yaml:"successinterval"`
+	Warmup           int `yaml:"warmup"`
+}
+
+//vip配置，既可以直接写ip，也可以指定vip所在region
+type JdVip struct {
+	Ip     string `yaml:"ip"`
+	RangId string `yaml:"rangid"`
+	//策略路由使用的网关及接口，未配置时使用policyrouting中的配置
+	Gateway string `yaml:"gateway"`
+	Device  string `yaml:"device"`
+	//由healthchecks组成的健康表达式，不成立时不自动接管
+	Health string `yaml:"health"`
+}
+
+func (v *JdVip) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var ip string
+	if err := unmarshal(&ip); err == nil {
+		v.Ip = ip
+		return nil
+	}
+	type plain JdVip
+	return unmarshal((*plain)(v))
+}
+
+//region级别的endpoint、密钥及限流配置
+type JdRegion struct {
+	RangId          string `yaml:"rangid"`
+	Endpoint        string `yaml:"endpoint"`
+	VmEndpoint      string `yaml:"vmendpoint"`
+	Scheme          string `yaml:"scheme"`
+	AccessKeyID     string `yaml:"accessskeyid"`
+	AccessKeySecret string `yaml:"accesskeysecret"`
+	RateLimit       int    `yaml:"ratelimit"`
+	Signer          string `yaml:"signer"`
+	Proxy           string `yaml:"proxy"`
 }
 
 type JdNetworkInterface struct {
@@ -21,18 +536,71 @@ type JdNetworkInterface struct {
 	NetWorkInterfaceId string `yaml:"networkinterfaceid"`
 }
 
+//natdnat模式下的NAT网关配置
+type JdNatGateway struct {
+	RangId       string       `yaml:"rangid"`
+	NatGatewayId string       `yaml:"natgatewayid"`
+	LocalIp      string       `yaml:"localip"`
+	DnatRules    []JdDnatRule `yaml:"dnatrules"`
+}
+
+//eni模式配置，每个vip对应一块专用弹性网卡，接管时将网卡从原云主机卸载并挂载到instanceid
+//gateway为网卡所在子网的网关，接管后源地址为vip的流量经该网卡发出
+type JdEni struct {
+	RangId        string           `yaml:"rangid"`
+	InstanceId    string           `yaml:"instanceid"`
+	Gateway       string           `yaml:"gateway"`
+	AttachTimeout int              `yaml:"attachtimeout"`
+	Interfaces    []JdEniInterface `yaml:"interfaces"`
+}
+
+type JdEniInterface struct {
+	NetworkInterfaceId string `yaml:"networkinterfaceid"`
+	Vip                string `yaml:"vip"`
+}
+
+//DNAT规则与vip的对应关系
+type JdDnatRule struct {
+	DnatRuleId string `yaml:"dnatruleid"`
+	Vip        string `yaml:"vip"`
+}
+
+//全部vip地址
+func (p *Parameters) VipIps() []string {
+	ips := []string{}
+	for _, vip := range p.Vips {
+		ips = append(ips, vip.Ip)
+	}
+	return ips
+}
+
+//本机可绑定vip的网卡，localnetworkinterface在前，fallbackinterfaces按配置顺序在后
+func (p *Parameters) LocalNetworkInterfaces() []JdNetworkInterface {
+	return append([]JdNetworkInterface{p.Localnetworkinterface}, p.Fallbackinterfaces...)
+}
+
+//vip所属region，未指定时返回空
+func (p *Parameters) VipRangId(ip string) string {
+	for _, vip := range p.Vips {
+		if vip.Ip == ip {
+			return vip.RangId
+		}
+	}
+	return ""
+}
+
 func GetConfigParameters(configfile string) *Parameters {
 
 	parameters := new(Parameters)
 	yamlFile, err := ioutil.ReadFile(configfile)
 	if err != nil {
-		log.Printf("yamlFile.Get err   #%v ", err)
-		os.Exit(1)
+		Exit(ExitConfigError, err)
 	}
 	err = yaml.Unmarshal(yamlFile, parameters)
 	if err != nil {
-		log.Fatalf("Unmarshal: %v", err)
-		os.Exit(1)
+		Exit(ExitConfigError, err)
 	}
+	//所有子命令读取配置后即登记其中的凭证，之后的日志不会输出这些值
+	DefaultRedactor.AddParameters(parameters)
 	return parameters
 }
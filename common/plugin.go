@@ -0,0 +1,215 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+//插件类型
+const (
+	PluginTypeProvider    string = "provider"
+	PluginTypeHealthCheck string = "healthcheck"
+	PluginTypeNotifier    string = "notifier"
+	PluginTypeIpam        string = "ipam"
+)
+
+//外部插件：独立的可执行文件，每次调用时以方法名作为最后一个参数启动，请求及响应均为stdin/stdout上的json
+//插件与vipsidecar分别构建发布，可用于对接自有IPAM/CMDB等系统而不需要修改vipsidecar
+type Plugin struct {
+	config JdPlugin
+}
+
+//插件返回的错误
+type PluginError struct {
+	Error string `json:"error"`
+}
+
+//调用插件方法，插件以非0退出或输出{"error": "..."}时返回错误
+func (pl *Plugin) Call(method string, request interface{}, response interface{}) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(pl.config.Timeout)*time.Second)
+	defer cancel()
+	args := strings.Fields(pl.config.Command)
+	cmd := exec.CommandContext(ctx, args[0], append(args[1:], method)...)
+	cmd.Stdin = bytes.NewReader(body)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return errors.New("plugin " + pl.config.Name + " " + method + ": " + err.Error() + ": " + strings.TrimSpace(stderr.String()))
+	}
+	plerr := PluginError{}
+	if json.Unmarshal(stdout.Bytes(), &plerr) == nil && plerr.Error != "" {
+		return errors.New("plugin " + pl.config.Name + " " + method + ": " + plerr.Error)
+	}
+	if response == nil {
+		return nil
+	}
+	return json.Unmarshal(stdout.Bytes(), response)
+}
+
+type Plugins struct {
+	mutex   sync.Mutex
+	plugins map[string]*Plugin
+}
+
+var DefaultPlugins = &Plugins{plugins: make(map[string]*Plugin)}
+
+func (ps *Plugins) Load(configs []JdPlugin) error {
+	plugins := make(map[string]*Plugin)
+	for _, c := range configs {
+		if c.Name == "" || strings.TrimSpace(c.Command) == "" {
+			return errors.New("plugins: name and command must be set")
+		}
+		switch c.Type {
+		case PluginTypeProvider, PluginTypeHealthCheck, PluginTypeNotifier, PluginTypeIpam:
+		default:
+			return errors.New("plugins: unknown type " + c.Type + " of plugin " + c.Name)
+		}
+		if c.Timeout <= 0 {
+			c.Timeout = 10
+		}
+		plugins[c.Name] = &Plugin{config: c}
+	}
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	ps.plugins = plugins
+	return nil
+}
+
+//按名称及类型获取插件
+func (ps *Plugins) Get(name string, plugintype string) (*Plugin, error) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	pl, ok := ps.plugins[name]
+	if !ok || pl.config.Type != plugintype {
+		return nil, errors.New("no " + plugintype + " plugin named " + name)
+	}
+	return pl, nil
+}
+
+//vip状态变化通知，传给notifier插件的notify方法，每次转换(seq)只发送一次
+type PluginNotification struct {
+	Time   time.Time `json:"time"`
+	Vip    string    `json:"vip"`
+	From   VipState  `json:"from"`
+	To     VipState  `json:"to"`
+	Reason string    `json:"reason,omitempty"`
+	Epoch  uint64    `json:"epoch"`
+	Seq    uint64    `json:"seq"`
+}
+
+//状态机回调，异步通知所有notifier插件，已执行过的转换(含重启前)不再通知
+func (ps *Plugins) Notify(t Transition) {
+	ps.mutex.Lock()
+	defer ps.mutex.Unlock()
+	notification := PluginNotification{Time: t.Time, Vip: t.Vip, From: t.From, To: t.To, Reason: t.Reason, Epoch: t.Epoch, Seq: t.Seq}
+	for _, pl := range ps.plugins {
+		if pl.config.Type != PluginTypeNotifier {
+			continue
+		}
+		pl := pl
+		go func() {
+			if !DefaultHookResults.Claim(pl.config.Name, t) {
+				return
+			}
+			start := time.Now()
+			err := pl.Call("notify", notification, nil)
+			if err != nil {
+				log.Println(err)
+			}
+			DefaultHookResults.Finish(pl.config.Name, t, start, err)
+		}()
+	}
+}
+
+//由provider插件执行云上操作，vipsidecar负责状态机、时间计划、抖动抑制及健康检查
+type PluginProvider struct {
+	parameter *Parameters
+	plugin    *Plugin
+	states    *VipStateMachine
+}
+
+//传给provider插件reconcile方法的请求，vips为本次需要绑定到本机的vip
+type PluginReconcileRequest struct {
+	Vips                  []string           `json:"vips"`
+	Localnetworkinterface JdNetworkInterface `json:"localNetworkInterface"`
+}
+
+type PluginReconcileResult struct {
+	Vip       string `json:"vip"`
+	Bound     bool   `json:"bound"`
+	Adopted   bool   `json:"adopted"`
+	Reason    string `json:"reason,omitempty"`
+	RequestId string `json:"requestId,omitempty"`
+}
+
+func NewPluginProvider(p *Parameters, plugin *Plugin) *PluginProvider {
+	return &PluginProvider{parameter: p, plugin: plugin, states: newProviderStates()}
+}
+
+func (pp *PluginProvider) Name() string {
+	return ModePlugin
+}
+
+func (pp *PluginProvider) Reconcile(ctx context.Context, vipsonlocal []string) {
+	pp.states.Sync(vipsonlocal)
+	vips := []string{}
+	for _, vip := range vipsonlocal {
+		if pp.states.State(vip) == StateBound {
+			vips = append(vips, vip)
+			continue
+		}
+		if !allowFailover(ctx, vip) {
+			continue
+		}
+		//IPAM/CMDB中vip未预留给本服务时不交给插件绑定
+		if err := DefaultIpam.Check(vip); err != nil {
+			log.Println(err)
+			pp.states.Fail(vip, ReasonOf(err), "")
+			continue
+		}
+		vips = append(vips, vip)
+	}
+	if len(vips) == 0 {
+		return
+	}
+	if err := DefaultSafety.Allow("PluginReconcile"); err != nil {
+		log.Println(err)
+		return
+	}
+	response := struct {
+		Results []PluginReconcileResult `json:"results"`
+	}{}
+	err := pp.plugin.Call("reconcile", PluginReconcileRequest{Vips: vips, Localnetworkinterface: pp.parameter.Localnetworkinterface}, &response)
+	if err != nil {
+		log.Println(err)
+		DefaultStatus.RecordError("PluginReconcile", err)
+		return
+	}
+	for _, r := range response.Results {
+		switch {
+		case r.Bound && r.Adopted:
+			pp.states.Adopt(r.Vip)
+		case r.Bound:
+			pp.states.Fresh(r.Vip, r.RequestId, pp.states.Acquire(r.Vip))
+			go DefaultIpam.Record(r.Vip)
+		default:
+			pp.states.Fail(r.Vip, r.Reason, r.RequestId)
+		}
+	}
+}
+
+//vip当前状态
+func (pp *PluginProvider) VipState(vip string) VipState {
+	return pp.states.State(vip)
+}
@@ -0,0 +1,106 @@
+package common
+
+import (
+	"log"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+//按vip管理策略路由：vip绑定到本机后，源地址为vip的流量查找该vip独立的路由表，经指定网关发出
+//vip释放后删除规则及路由表，每个vip使用tablebase+序号的路由表
+type PolicyRouter struct {
+	config JdPolicyRouting
+	vips   []JdVip
+}
+
+func NewPolicyRouter(config JdPolicyRouting, vips []JdVip) *PolicyRouter {
+	if config.TableBase <= 0 {
+		config.TableBase = 100
+	}
+	if config.Priority <= 0 {
+		config.Priority = 1000
+	}
+	return &PolicyRouter{config: config, vips: vips}
+}
+
+//vip使用的路由表、规则优先级、网关及接口，vip单独配置的gateway、device优先
+func (r *PolicyRouter) route(vip string) (table string, pref string, gateway string, device string, ok bool) {
+	for i, v := range r.vips {
+		if v.Ip != vip {
+			continue
+		}
+		gateway, device = r.config.Gateway, r.config.Device
+		if v.Gateway != "" {
+			gateway = v.Gateway
+		}
+		if v.Device != "" {
+			device = v.Device
+		}
+		return strconv.Itoa(r.config.TableBase + i), strconv.Itoa(r.config.Priority + i), gateway, device, gateway != "" || device != ""
+	}
+	return "", "", "", "", false
+}
+
+func runIp(args ...string) error {
+	out, err := exec.Command("ip", args...).CombinedOutput()
+	if err != nil {
+		log.Println("ip", strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return err
+}
+
+//安装vip的路由表及规则，重复调用不会产生重复规则
+func (r *PolicyRouter) Install(vip string) error {
+	return r.InstallVia(vip, "")
+}
+
+//via不为空时代替配置中的接口，用于挂载后才能确定接口名的弹性网卡
+func (r *PolicyRouter) InstallVia(vip string, via string) error {
+	table, pref, gateway, device, ok := r.route(vip)
+	if !ok {
+		return nil
+	}
+	if via != "" {
+		device = via
+	}
+	args := []string{"route", "replace", "default"}
+	if gateway != "" {
+		args = append(args, "via", gateway)
+	}
+	if device != "" {
+		args = append(args, "dev", device)
+	}
+	if err := runIp(append(args, "table", table)...); err != nil {
+		return err
+	}
+	exec.Command("ip", "rule", "del", "pref", pref).Run()
+	if err := runIp("rule", "add", "pref", pref, "from", vip+"/32", "table", table); err != nil {
+		return err
+	}
+	log.Println("policy routing for", vip, "installed in table", table)
+	return nil
+}
+
+//删除vip的规则及路由表
+func (r *PolicyRouter) Remove(vip string) {
+	table, pref, _, _, ok := r.route(vip)
+	if !ok {
+		return
+	}
+	exec.Command("ip", "rule", "del", "pref", pref).Run()
+	exec.Command("ip", "route", "flush", "table", table).Run()
+	log.Println("policy routing for", vip, "removed from table", table)
+}
+
+//状态机回调：接管已有绑定时安装，释放时删除，新绑定在绑定步骤中安装
+func (r *PolicyRouter) OnTransition(vip string, from VipState, to VipState) {
+	switch to {
+	case StateBound:
+		if from != StateAcquiring {
+			r.Install(vip)
+		}
+	case StateReleased:
+		r.Remove(vip)
+	}
+}
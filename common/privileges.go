@@ -0,0 +1,143 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+//已切换到非特权用户后重新执行的进程带此环境变量，避免再次切换
+const privilegesDroppedEnv = "VIPSIDECAR_PRIVILEGES_DROPPED"
+
+//capabilities名称及对应的位
+var capabilityBits = map[string]uint{"NET_ADMIN": 12, "NET_RAW": 13}
+
+//privileges.noplumbing时handoff及kubernetes地址管理不在本机添加vip
+var localPlumbingDisabled bool
+
+//需要capabilities的本机操作，privileges.noplumbing时不能启用
+func PlumbingFeatures(p *Parameters) []string {
+	features := []string{}
+	if p.Mode == ModeEni {
+		features = append(features, "mode eni")
+	}
+	if p.PolicyRouting.Enabled {
+		features = append(features, "policyrouting")
+	}
+	if p.Garp.Enabled {
+		features = append(features, "garp")
+	}
+	if p.Dad.Enabled {
+		features = append(features, "dad")
+	}
+	if p.Capture.Enabled {
+		features = append(features, "capture")
+	}
+	if p.Sysctl.Managed {
+		features = append(features, "sysctl")
+	}
+	return features
+}
+
+//privileges.drop时以root启动，state文件升级及压缩后交给user，切换到user并只保留RequiredCapabilities，然后重新执行自身，之后所有线程及子进程(ip命令)都以该用户及capabilities运行
+//已经是非root用户或已切换过时只校验并输出当前的capabilities
+func DropPrivileges(p *Parameters) error {
+	localPlumbingDisabled = p.Privileges.NoPlumbing
+	if !p.Privileges.Drop {
+		return nil
+	}
+	keep := RequiredCapabilities(p)
+	if os.Getenv(privilegesDroppedEnv) != "" || os.Getuid() != 0 {
+		if os.Getuid() == 0 {
+			return errors.New("privileges.drop: still running as root after dropping privileges")
+		}
+		log.Println("running as uid", os.Getuid(), "gid", os.Getgid(), "with capabilities", effectiveCapabilities())
+		return nil
+	}
+	uid, gid, err := lookupUser(p.Privileges.User)
+	if err != nil {
+		return errors.New("privileges.user: " + err.Error())
+	}
+	if err := chownStateFiles(p, uid, gid); err != nil {
+		return errors.New("privileges.drop: " + err.Error())
+	}
+	features := CapabilityFeatures(p)
+	for _, name := range keep {
+		log.Println("capability", name, "required by", features[name])
+	}
+	log.Println("dropping privileges to uid", uid, "gid", gid, "keeping capabilities", keep)
+	return dropPrivileges(uid, gid, keep)
+}
+
+//切换后追加写入的文件，不存在时以root创建后交给uid，切换后的进程不再需要所在目录的写权限
+func chownStateFiles(p *Parameters, uid int, gid int) error {
+	files := []struct {
+		path string
+		perm os.FileMode
+	}{
+		{p.FailoverLog, 0644},
+		{p.DetachJournal, 0644},
+		{p.HookResults, 0644},
+		{p.Admin.AuditLog, 0600},
+	}
+	for _, f := range files {
+		if f.path == "" {
+			continue
+		}
+		file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, f.perm)
+		if err != nil {
+			return err
+		}
+		file.Close()
+		if err := os.Chown(f.path, uid, gid); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//name为用户名或uid，为空时使用65534(nobody)，gid为该用户的主组，uid不在/etc/passwd中时gid与uid相同
+func lookupUser(name string) (int, int, error) {
+	if name == "" {
+		name = "65534"
+	}
+	u, err := user.LookupId(name)
+	if err != nil {
+		u, err = user.Lookup(name)
+	}
+	if err != nil {
+		uid, converr := strconv.Atoi(name)
+		if converr != nil {
+			return 0, 0, err
+		}
+		u = &user.User{Uid: name, Gid: strconv.Itoa(uid)}
+	}
+	uid, _ := strconv.Atoi(u.Uid)
+	gid, _ := strconv.Atoi(u.Gid)
+	if uid == 0 {
+		return 0, 0, errors.New(name + " is root")
+	}
+	return uid, gid, nil
+}
+
+//当前进程有效capabilities中的已知项
+func effectiveCapabilities() []string {
+	capeff := uint64(0)
+	data, _ := ioutil.ReadFile("/proc/self/status")
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasPrefix(line, "CapEff:") {
+			capeff, _ = strconv.ParseUint(strings.TrimSpace(strings.TrimPrefix(line, "CapEff:")), 16, 64)
+		}
+	}
+	names := []string{}
+	for _, name := range []string{"NET_ADMIN", "NET_RAW"} {
+		if capeff&(1<<capabilityBits[name]) != 0 {
+			names = append(names, name)
+		}
+	}
+	return names
+}
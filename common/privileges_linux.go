@@ -0,0 +1,81 @@
+package common
+
+import (
+	"errors"
+	"golang.org/x/sys/unix"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+//capset的参数，version 3使用两组32位
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective   uint32
+	permitted   uint32
+	inheritable uint32
+}
+
+const capVersion3 = 0x20080522
+
+//setresuid、capset及ambient只作用于当前线程，锁定线程后在同一线程上切换并execve，新进程的所有线程都继承切换后的身份
+//非root用户execve后的capabilities为ambient集合，bounding集合中去掉其他capabilities，no_new_privs阻止之后通过setuid程序提权
+func dropPrivileges(uid int, gid int, keep []string) error {
+	var mask uint64
+	for _, name := range keep {
+		mask |= 1 << capabilityBits[name]
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	runtime.LockOSThread()
+	if err := unix.Prctl(unix.PR_SET_KEEPCAPS, 1, 0, 0, 0); err != nil {
+		return errors.New("PR_SET_KEEPCAPS: " + err.Error())
+	}
+	last := 40
+	if data, err := ioutil.ReadFile("/proc/sys/kernel/cap_last_cap"); err == nil {
+		last, _ = strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+	for bit := 0; bit <= last; bit++ {
+		if mask&(1<<uint(bit)) == 0 {
+			if err := unix.Prctl(unix.PR_CAPBSET_DROP, uintptr(bit), 0, 0, 0); err != nil {
+				return errors.New("PR_CAPBSET_DROP: " + err.Error())
+			}
+		}
+	}
+	if err := unix.Setgroups([]int{gid}); err != nil {
+		return errors.New("setgroups: " + err.Error())
+	}
+	if err := unix.Setresgid(gid, gid, gid); err != nil {
+		return errors.New("setresgid: " + err.Error())
+	}
+	if err := unix.Setresuid(uid, uid, uid); err != nil {
+		return errors.New("setresuid: " + err.Error())
+	}
+	header := capHeader{version: capVersion3}
+	data := [2]capData{
+		{effective: uint32(mask), permitted: uint32(mask), inheritable: uint32(mask)},
+		{effective: uint32(mask >> 32), permitted: uint32(mask >> 32), inheritable: uint32(mask >> 32)},
+	}
+	if _, _, errno := unix.RawSyscall(unix.SYS_CAPSET, uintptr(unsafe.Pointer(&header)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return errors.New("capset: " + errno.Error())
+	}
+	for _, name := range keep {
+		if err := unix.Prctl(unix.PR_CAP_AMBIENT, unix.PR_CAP_AMBIENT_RAISE, uintptr(capabilityBits[name]), 0, 0); err != nil {
+			return errors.New("raise ambient " + name + ": " + err.Error())
+		}
+	}
+	if err := unix.Prctl(unix.PR_SET_NO_NEW_PRIVS, 1, 0, 0, 0); err != nil {
+		return errors.New("PR_SET_NO_NEW_PRIVS: " + err.Error())
+	}
+	return syscall.Exec(exe, os.Args, append(os.Environ(), privilegesDroppedEnv+"=1"))
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package common
+
+import "errors"
+
+func dropPrivileges(uid int, gid int, keep []string) error {
+	return errors.New("privileges.drop is only supported on linux")
+}
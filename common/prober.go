@@ -0,0 +1,161 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_cloud_api_rtt_seconds", MetricGauge, "Round trip time of the last probe request to the region's cloud API endpoint.")
+	DefaultMetrics.Register("vipsidecar_cloud_api_reachable", MetricGauge, "1 when the region's cloud API endpoint answered the recent probes.")
+}
+
+//单个region endpoint的探测结果，通过/v1/status的cloudApi暴露
+type EndpointProbe struct {
+	Url       string    `json:"url"`
+	Reachable bool      `json:"reachable"`
+	Rtt       float64   `json:"rttSeconds"`
+	CheckedAt time.Time `json:"checkedAt"`
+	Failures  int       `json:"consecutiveFailures,omitempty"`
+	Error     string    `json:"error,omitempty"`
+}
+
+//定期向各region的endpoint发送HEAD请求，经由DefaultTransport的连接池保持一条热连接并测量rtt
+//任何http响应都算可达，连续failurethreshold次无响应时判定该region不可达：此时不发起接管，
+//避免把网络不可达记为接管失败，恢复后立即触发一次reconcile
+type EndpointProber struct {
+	mutex     sync.Mutex
+	config    JdProbe
+	endpoints map[string]string
+	probes    map[string]*EndpointProbe
+	client    *http.Client
+}
+
+var DefaultProber = &EndpointProber{probes: map[string]*EndpointProbe{}}
+
+func (e *EndpointProber) Load(config JdProbe, p *Parameters) error {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = 5
+	}
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 3
+	}
+	if config.Timeout >= config.Interval {
+		return errors.New("probe.timeout must be shorter than probe.interval")
+	}
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	e.config, e.endpoints = config, CloudEndpoints(p)
+	e.client = &http.Client{Timeout: time.Duration(config.Timeout) * time.Second}
+	return nil
+}
+
+//每个region单独探测，onrecover在region从不可达恢复时调用
+func (e *EndpointProber) Run(onrecover func(region string)) {
+	e.mutex.Lock()
+	endpoints := e.endpoints
+	e.mutex.Unlock()
+	for region, url := range endpoints {
+		go func(region string, url string) {
+			for {
+				if e.Probe(region, url) {
+					onrecover(region)
+				}
+				time.Sleep(time.Duration(e.config.Interval) * time.Second)
+			}
+		}(region, url)
+	}
+}
+
+//探测一次，返回region是否刚从不可达恢复
+func (e *EndpointProber) Probe(region string, url string) bool {
+	labels := map[string]string{"region": region}
+	start := time.Now()
+	req, err := http.NewRequest("HEAD", url, nil)
+	if err == nil {
+		var resp *http.Response
+		if resp, err = e.client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+	rtt := time.Since(start)
+	e.mutex.Lock()
+	probe, ok := e.probes[region]
+	if !ok {
+		probe = &EndpointProbe{Url: url, Reachable: true}
+		e.probes[region] = probe
+	}
+	wasreachable := probe.Reachable
+	probe.CheckedAt = start
+	if err != nil {
+		probe.Failures++
+		probe.Error = err.Error()
+		if probe.Failures >= e.config.FailureThreshold {
+			probe.Reachable = false
+		}
+	} else {
+		probe.Failures, probe.Error, probe.Reachable, probe.Rtt = 0, "", true, rtt.Seconds()
+		DefaultMetrics.Set("vipsidecar_cloud_api_rtt_seconds", labels, rtt.Seconds())
+	}
+	reachable, failures := probe.Reachable, probe.Failures
+	e.mutex.Unlock()
+	reachablevalue := 0.0
+	if reachable {
+		reachablevalue = 1
+	}
+	DefaultMetrics.Set("vipsidecar_cloud_api_reachable", labels, reachablevalue)
+	DefaultStatus.SetCloudApi(e.Snapshot())
+	switch {
+	case wasreachable && !reachable:
+		log.Println("cloud api in", region, "unreachable after", failures, "probes:", err)
+		DefaultSelfChecks.Report(SelfCheckCloudApi, errors.New("cloud api in "+region+" unreachable after "+strconv.Itoa(failures)+" probes: "+err.Error()))
+	case !wasreachable && reachable:
+		log.Println("cloud api in", region, "reachable again, rtt", rtt)
+		DefaultSelfChecks.Report(SelfCheckCloudApi, nil)
+		return true
+	}
+	return false
+}
+
+//未启用探测或尚未探测过的region视为可达
+func (e *EndpointProber) Reachable(region string) bool {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	probe, ok := e.probes[region]
+	return !ok || probe.Reachable
+}
+
+func (e *EndpointProber) Snapshot() map[string]EndpointProbe {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	snapshot := map[string]EndpointProbe{}
+	for region, probe := range e.probes {
+		snapshot[region] = *probe
+	}
+	return snapshot
+}
+
+//region不可达时不发起接管，vip保持原状态，恢复后由onrecover触发的reconcile重新处理
+func allowCloudCall(vip string, region string) bool {
+	if DefaultProber.Reachable(region) {
+		return true
+	}
+	deferFailover(vip, "cloud api in "+region+" is unreachable")
+	return false
+}
+
+func deferFailover(vip string, reason string) {
+	log.Println("failover of", vip, "deferred,", reason)
+	DefaultMetrics.Add("vipsidecar_failovers_suppressed_total", map[string]string{"reason": "unreachable"}, 1)
+	DefaultStatus.SetSuppressedFailover(&SuppressedFailover{Time: time.Now(), Vip: vip, Reason: reason})
+}
@@ -0,0 +1,266 @@
+package common
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+type ProfileOptions struct {
+	Name       string
+	Binary     string
+	ConfigFile string
+	//配置之外需要写入的路径，如--terminal-status-file
+	Writable []string
+}
+
+//影响系统调用及访问路径的功能，配置变化导致该列表变化时需要重新生成profile
+func ProfileFeatures(p *Parameters) []string {
+	features := []string{}
+	if profileNeedsPacket(p) {
+		features = append(features, "packet")
+	}
+	if profileNeedsExec(p) {
+		features = append(features, "exec")
+	}
+	if p.Privileges.Drop {
+		features = append(features, "privileges")
+	}
+	if p.Sysctl.Managed {
+		features = append(features, "sysctl")
+	}
+	for _, output := range p.Log.Outputs {
+		if output == LogOutputJournald {
+			features = append(features, "journald")
+		}
+	}
+	return features
+}
+
+//免费arp、重复地址检测及抓包使用AF_PACKET
+func profileNeedsPacket(p *Parameters) bool {
+	return !p.Privileges.NoPlumbing && (p.Garp.Enabled || p.Dad.Enabled || p.Capture.Enabled)
+}
+
+//本机地址及路由通过ip命令配置，exec健康检查、插件及dr切换dns的命令也需要创建子进程
+func profileNeedsExec(p *Parameters) bool {
+	if !p.Privileges.NoPlumbing || len(p.Plugins) > 0 || p.ProviderPlugin != "" || p.Dr.DnsSwitchCommand != "" {
+		return true
+	}
+	for _, c := range p.HealthChecks {
+		if c.Type == HealthCheckExec {
+			return true
+		}
+	}
+	return false
+}
+
+//go运行时、网络、文件及定时器使用的系统调用，各架构不存在的名称由容器运行时忽略
+var profileBaseSyscalls = []string{
+	"accept4", "arch_prctl", "bind", "brk", "clock_getres", "clock_gettime", "clock_nanosleep", "clone", "clone3", "close", "connect",
+	"epoll_create1", "epoll_ctl", "epoll_pwait", "epoll_pwait2", "epoll_wait", "eventfd2", "exit", "exit_group",
+	"faccessat", "faccessat2", "fchmod", "fchmodat", "fcntl", "fdatasync", "fstat", "fstatfs", "fsync", "ftruncate", "futex",
+	"getcwd", "getdents64", "getegid", "geteuid", "getgid", "getpeername", "getpid", "getppid", "getrandom", "getrlimit",
+	"getsockname", "getsockopt", "gettid", "gettimeofday", "getuid", "ioctl", "listen", "lseek", "madvise", "membarrier",
+	"mincore", "mkdirat", "mmap", "mprotect", "munmap", "nanosleep", "newfstatat", "openat", "pipe2", "poll", "ppoll",
+	"pread64", "prlimit64", "pwrite64", "read", "readlink", "readlinkat", "recvfrom", "recvmmsg", "recvmsg", "renameat", "renameat2",
+	"restart_syscall", "rseq", "rt_sigaction", "rt_sigprocmask", "rt_sigreturn", "sched_getaffinity", "sched_yield",
+	"sendfile", "sendmmsg", "sendmsg", "sendto", "set_robust_list", "set_tid_address", "setitimer", "setsockopt", "shutdown",
+	"sigaltstack", "splice", "statfs", "statx", "tgkill", "timer_create", "timer_delete", "timer_settime", "uname", "unlinkat",
+	"write", "writev",
+}
+
+//os/exec创建子进程及等待退出，以及子进程(ip、sh及常用命令，动态链接libc)另外使用的系统调用
+//seccomp profile对子进程同样生效，exec健康检查及插件运行的其他程序可能需要补充
+var profileExecSyscalls = []string{
+	"access", "close_range", "dup", "dup2", "dup3", "execve", "execveat", "fadvise64", "getpgrp", "getrusage", "kill", "lstat",
+	"open", "pidfd_open", "pidfd_send_signal", "pipe", "prctl", "setpgid", "stat", "times", "umask", "vfork", "wait4", "waitid",
+}
+
+//privileges.drop切换用户、capabilities并重新执行自身
+var profilePrivilegesSyscalls = []string{"capget", "capset", "execve", "prctl", "setgroups", "setresgid", "setresuid"}
+
+//socket允许的地址族
+const (
+	afUnix    = 1
+	afInet    = 2
+	afInet6   = 10
+	afNetlink = 16
+	afPacket  = 17
+)
+
+type seccompArg struct {
+	Index uint   `json:"index"`
+	Value uint64 `json:"value"`
+	Op    string `json:"op"`
+}
+
+type seccompSyscall struct {
+	Names  []string     `json:"names"`
+	Action string       `json:"action"`
+	Args   []seccompArg `json:"args,omitempty"`
+}
+
+type seccompProfile struct {
+	DefaultAction   string           `json:"defaultAction"`
+	DefaultErrnoRet uint             `json:"defaultErrnoRet"`
+	Architectures   []string         `json:"architectures"`
+	Syscalls        []seccompSyscall `json:"syscalls"`
+}
+
+//docker及kubernetes(Localhost)格式的seccomp profile，未列出的系统调用返回EPERM，socket只允许用到的地址族
+func GenSeccompProfile(p *Parameters) ([]byte, error) {
+	names := map[string]bool{}
+	for _, name := range profileBaseSyscalls {
+		names[name] = true
+	}
+	if profileNeedsExec(p) {
+		for _, name := range profileExecSyscalls {
+			names[name] = true
+		}
+	}
+	if p.Privileges.Drop {
+		for _, name := range profilePrivilegesSyscalls {
+			names[name] = true
+		}
+	}
+	allowed := []string{}
+	for name := range names {
+		allowed = append(allowed, name)
+	}
+	sort.Strings(allowed)
+	//net.Interfaces使用netlink，总是需要
+	families := []uint64{afUnix, afInet, afInet6, afNetlink}
+	if profileNeedsPacket(p) {
+		families = append(families, afPacket)
+	}
+	profile := seccompProfile{
+		DefaultAction:   "SCMP_ACT_ERRNO",
+		DefaultErrnoRet: 1,
+		Architectures:   seccompArchitectures(),
+		Syscalls:        []seccompSyscall{{Names: allowed, Action: "SCMP_ACT_ALLOW"}},
+	}
+	for _, family := range families {
+		profile.Syscalls = append(profile.Syscalls, seccompSyscall{Names: []string{"socket"}, Action: "SCMP_ACT_ALLOW", Args: []seccompArg{{Index: 0, Value: family, Op: "SCMP_CMP_EQ"}}})
+	}
+	data, err := json.MarshalIndent(profile, "", "  ")
+	return append(data, '\n'), err
+}
+
+func seccompArchitectures() []string {
+	switch runtime.GOARCH {
+	case "arm64":
+		return []string{"SCMP_ARCH_AARCH64"}
+	}
+	return []string{"SCMP_ARCH_X86_64"}
+}
+
+//AppArmor profile，只允许读取配置中引用的文件、写入配置中的日志及数据路径
+func GenAppArmorProfile(p *Parameters, o ProfileOptions) []byte {
+	lines := []string{
+		"# generated by vipsidecar genprofile, features: " + strings.Join(ProfileFeatures(p), ","),
+		"#include <tunables/global>",
+		"",
+		"profile " + o.Name + " " + o.Binary + " flags=(attach_disconnected,mediate_deleted) {",
+		"  #include <abstractions/base>",
+		"  #include <abstractions/nameservice>",
+		"",
+	}
+	for _, capability := range RequiredCapabilities(p) {
+		lines = append(lines, "  capability "+strings.ToLower(capability)+",")
+	}
+	if p.Privileges.Drop {
+		lines = append(lines, "  capability setuid,", "  capability setgid,", "  capability setpcap,")
+	}
+	lines = append(lines, "  network unix,", "  network inet,", "  network inet6,", "  network netlink raw,")
+	if profileNeedsPacket(p) {
+		lines = append(lines, "  network packet raw,")
+	}
+	lines = append(lines,
+		"  signal (receive) set=(term, int, quit, hup),",
+		"",
+		"  "+o.Binary+" mr,",
+		"  @{PROC}/@{pid}/status r,",
+		"  @{PROC}/@{pid}/net/** r,",
+		"  @{PROC}/sys/net/netfilter/** r,",
+		"  /sys/class/net/** r,",
+		"  /sys/devices/** r,",
+		"  /var/run/secrets/** r,",
+		"  /run/secrets/** r,",
+	)
+	if p.Privileges.Drop {
+		lines = append(lines, "  @{PROC}/sys/kernel/cap_last_cap r,", "  "+o.Binary+" ix,")
+	}
+	if p.Sysctl.Managed {
+		lines = append(lines, "  @{PROC}/sys/net/** rw,")
+	}
+	if profileNeedsExec(p) {
+		lines = append(lines, "  /{usr/,}{s,}bin/ip ix,", "  /{usr/,}bin/{ba,da,}sh ix,")
+		commands := []string{}
+		for _, plugin := range p.Plugins {
+			if fields := strings.Fields(plugin.Command); len(fields) > 0 && filepath.IsAbs(fields[0]) {
+				commands = append(commands, fields[0])
+			}
+		}
+		for _, command := range profilePaths(commands) {
+			lines = append(lines, "  "+command+" ix,")
+		}
+	}
+	for _, output := range p.Log.Outputs {
+		if output == LogOutputJournald {
+			lines = append(lines, "  "+journaldSocket+" w,")
+		}
+	}
+	lines = append(lines, "")
+	for _, path := range profileReadPaths(p, o) {
+		lines = append(lines, "  "+path+" r,")
+	}
+	for _, path := range profileWritePaths(p, o) {
+		lines = append(lines, "  "+path+" rwk,")
+	}
+	lines = append(lines, "}")
+	return []byte(strings.Join(lines, "\n") + "\n")
+}
+
+//配置中引用的只读文件
+func profileReadPaths(p *Parameters, o ProfileOptions) []string {
+	paths := []string{o.ConfigFile, p.FeatureFlags.File, p.Admin.TlsCert, p.Admin.TlsKey, p.Admin.ClientCa, p.Federation.TokenFile,
+		p.Log.Syslog.CaCert, p.Kafka.Tls.CaCert, p.Handoff.PeerCaCert, p.Dr.ConfirmFile}
+	return profilePaths(paths)
+}
+
+//需要写入的文件及目录，failoverlog迁移格式、detachjournal及hookresults压缩时写入同目录下的.tmp文件
+func profileWritePaths(p *Parameters, o ProfileOptions) []string {
+	paths := append([]string{p.Admin.AuditLog, p.Dr.Override.HostsFile}, o.Writable...)
+	for _, path := range []string{p.FailoverLog, p.DetachJournal, p.HookResults} {
+		if path != "" {
+			paths = append(paths, path, path+".tmp")
+		}
+	}
+	if p.Capture.Dir != "" {
+		paths = append(paths, strings.TrimRight(p.Capture.Dir, "/")+"/", strings.TrimRight(p.Capture.Dir, "/")+"/**")
+	}
+	for _, path := range o.Writable {
+		paths = append(paths, path+".tmp")
+	}
+	return profilePaths(paths)
+}
+
+func profilePaths(paths []string) []string {
+	result := []string{}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if abs, err := filepath.Abs(path); err == nil && !strings.HasSuffix(path, "/**") && !strings.HasSuffix(path, "/") {
+			path = abs
+		}
+		if ok, _ := Contain(path, result); !ok {
+			result = append(result, path)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
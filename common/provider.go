@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+	"time"
+)
+
+//vip漂移实现方式，每轮轮询时将本机持有的vip对应的云上资源指向本机
+//ctx被取消时应尽快返回，让位于更高优先级的事件
+type Provider interface {
+	Name() string
+	Reconcile(ctx context.Context, vipsonlocal []string)
+}
+
+//可输出期望状态与云上实际状态差异的Provider
+type Differ interface {
+	Diff(vipsonlocal []string) []string
+}
+
+//根据配置中的mode创建Provider，未配置时使用secondaryip方式
+//同一时刻最多concurrency个vip在执行云上操作，同一vip相邻两次操作至少间隔vipjobinterval秒
+func NewProvider(p *Parameters, clients *RegionClients) Provider {
+	pool := NewWorkerPool(p.Concurrency, time.Duration(p.VipJobInterval)*time.Second)
+	switch p.Mode {
+	case ModeNatDnat:
+		return NewNatDnatProvider(p, clients, pool)
+	case ModeDr:
+		return NewDrProvider(p, clients)
+	case ModeEni:
+		return NewEniProvider(p, clients, pool)
+	case ModePlugin:
+		plugin, _ := DefaultPlugins.Get(p.ProviderPlugin, PluginTypeProvider)
+		return NewPluginProvider(p, plugin)
+	default:
+		return NewSecondaryIpProvider(p, clients, pool)
+	}
+}
+
+//provider使用的状态机，注册抖动抑制、notifier插件、kafka导出及external-dns回调
+func newProviderStates() *VipStateMachine {
+	states := NewVipStateMachine()
+	states.OnTransition(DefaultFlapDamper.OnTransition)
+	states.Observe(DefaultPlugins.Notify)
+	states.OnTransition(DefaultKafka.Notify)
+	states.OnTransition(DefaultExternalDns.Notify)
+	states.OnTransition(DefaultOffline.OnTransition)
+	states.OnTransition(DefaultCapture.OnTransition)
+	return states
+}
@@ -0,0 +1,208 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+//按region或endpoint选择代理，支持http(CONNECT)及socks5代理
+//sdk内部使用http.DefaultTransport，代理规则通过替换DefaultTransport的Proxy生效，对所有访问京东云的请求都有效
+//优先级：region.proxy > proxy.rules > proxy.url > 环境变量HTTPS_PROXY/HTTP_PROXY；命中proxy.noproxy时直连
+type ProxySelector struct {
+	regions  map[string]*url.URL
+	rules    map[string]*url.URL
+	fallback *url.URL
+	noproxy  []string
+}
+
+func NewProxySelector(p *Parameters) (*ProxySelector, error) {
+	s := &ProxySelector{regions: make(map[string]*url.URL), rules: make(map[string]*url.URL)}
+	for _, region := range p.Regions {
+		if region.Proxy == "" {
+			continue
+		}
+		u, err := parseProxyUrl(region.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		s.regions[region.RangId] = u
+	}
+	for _, rule := range p.Proxy.Rules {
+		u, err := parseProxyUrl(rule.Url)
+		if err != nil {
+			return nil, err
+		}
+		s.rules[strings.ToLower(rule.Endpoint)] = u
+	}
+	if p.Proxy.Url != "" {
+		u, err := parseProxyUrl(p.Proxy.Url)
+		if err != nil {
+			return nil, err
+		}
+		s.fallback = u
+	}
+	for _, entry := range strings.Split(p.Proxy.NoProxy, ",") {
+		if entry = strings.ToLower(strings.TrimSpace(entry)); entry != "" {
+			s.noproxy = append(s.noproxy, entry)
+		}
+	}
+	return s, nil
+}
+
+func parseProxyUrl(raw string) (*url.URL, error) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, errors.New("unsupported proxy scheme in " + raw + ", use http, https or socks5")
+}
+
+//请求路径形如/v1/regions/{regionId}/...
+func regionOfPath(path string) string {
+	parts := strings.Split(path, "/")
+	for i := 0; i+1 < len(parts); i++ {
+		if parts[i] == "regions" {
+			return parts[i+1]
+		}
+	}
+	return ""
+}
+
+//host是否命中noproxy，支持*、域名后缀及ip/cidr
+func (s *ProxySelector) bypass(host string) bool {
+	host = strings.ToLower(host)
+	ip := net.ParseIP(host)
+	for _, entry := range s.noproxy {
+		switch {
+		case entry == "*":
+			return true
+		case ip != nil && strings.Contains(entry, "/"):
+			if _, cidr, err := net.ParseCIDR(entry); err == nil && cidr.Contains(ip) {
+				return true
+			}
+		case host == strings.TrimPrefix(entry, "."):
+			return true
+		case strings.HasSuffix(host, "."+strings.TrimPrefix(entry, ".")):
+			return true
+		}
+	}
+	return false
+}
+
+//http.Transport.Proxy，返回nil表示直连
+func (s *ProxySelector) Proxy(req *http.Request) (*url.URL, error) {
+	if s.bypass(req.URL.Hostname()) {
+		return nil, nil
+	}
+	if u, ok := s.regions[regionOfPath(req.URL.Path)]; ok {
+		return u, nil
+	}
+	if u, ok := s.rules[strings.ToLower(req.URL.Hostname())]; ok {
+		return u, nil
+	}
+	if s.fallback != nil {
+		return s.fallback, nil
+	}
+	return http.ProxyFromEnvironment(req)
+}
+
+//将代理规则安装到http.DefaultTransport
+func InstallProxy(p *Parameters) error {
+	selector, err := NewProxySelector(p)
+	if err != nil {
+		return err
+	}
+	transport, ok := defaultHttpTransport()
+	if !ok {
+		return errors.New("http.DefaultTransport is not *http.Transport, proxy rules not installed")
+	}
+	transport.Proxy = selector.Proxy
+	return nil
+}
+
+//单个region的连通性检查结果
+type ConnectivityResult struct {
+	RangId   string
+	Url      string
+	Proxy    string
+	Duration time.Duration
+	Err      error
+}
+
+//配置中用到的各region及其vpc endpoint地址
+func CloudEndpoints(p *Parameters) map[string]string {
+	regionids := []string{}
+	for _, nf := range append(append([]JdNetworkInterface{p.Localnetworkinterface}, p.Allnetworkinterfaces...), p.Dr.StandbyNetworkInterface) {
+		if ok, _ := Contain(nf.RangId, regionids); !ok && nf.RangId != "" {
+			regionids = append(regionids, nf.RangId)
+		}
+	}
+	for _, regionid := range []string{p.NatGateway.RangId, p.Eni.RangId} {
+		if ok, _ := Contain(regionid, regionids); !ok && regionid != "" {
+			regionids = append(regionids, regionid)
+		}
+	}
+	endpoints := map[string]string{}
+	for _, regionid := range regionids {
+		scheme, endpoint := DefaultVpcScheme, DefaultVpcEndpoint
+		for _, region := range p.Regions {
+			if region.RangId == regionid && region.Endpoint != "" {
+				endpoint = region.Endpoint
+				if region.Scheme != "" {
+					scheme = region.Scheme
+				}
+			}
+		}
+		endpoints[regionid] = scheme + "://" + endpoint + "/v1/regions/" + regionid + "/"
+	}
+	return endpoints
+}
+
+//经由代理访问每个region的endpoint，只检查网络连通性，不做签名请求
+func CheckConnectivity(p *Parameters) []ConnectivityResult {
+	endpoints := CloudEndpoints(p)
+	regionids := []string{}
+	for regionid := range endpoints {
+		regionids = append(regionids, regionid)
+	}
+	sort.Strings(regionids)
+	results := []ConnectivityResult{}
+	client := &http.Client{Timeout: 10 * time.Second}
+	for _, regionid := range regionids {
+		result := ConnectivityResult{RangId: regionid, Url: endpoints[regionid]}
+		req, err := http.NewRequest("HEAD", result.Url, nil)
+		if err != nil {
+			result.Err = err
+			results = append(results, result)
+			continue
+		}
+		if transport, ok := defaultHttpTransport(); ok && transport.Proxy != nil {
+			if u, _ := transport.Proxy(req); u != nil {
+				result.Proxy = u.Redacted()
+			}
+		}
+		start := time.Now()
+		resp, err := client.Do(req)
+		result.Duration = time.Since(start)
+		if err != nil {
+			result.Err = err
+		} else {
+			resp.Body.Close()
+		}
+		if result.Err != nil {
+			log.Println("connectivity check", regionid, result.Err)
+		}
+		results = append(results, result)
+	}
+	return results
+}
@@ -0,0 +1,48 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+//令牌桶限流，rate为每秒允许的请求数，rate<=0时不限流
+type RateLimiter struct {
+	mutex    sync.Mutex
+	rate     float64
+	burst    float64
+	tokens   float64
+	lasttime time.Time
+}
+
+func NewRateLimiter(rate int) *RateLimiter {
+	return &RateLimiter{
+		rate:     float64(rate),
+		burst:    float64(rate),
+		tokens:   float64(rate),
+		lasttime: time.Now(),
+	}
+}
+
+//阻塞直到获得令牌
+func (r *RateLimiter) Wait() {
+	if r == nil || r.rate <= 0 {
+		return
+	}
+	for {
+		r.mutex.Lock()
+		now := time.Now()
+		r.tokens += now.Sub(r.lasttime).Seconds() * r.rate
+		if r.tokens > r.burst {
+			r.tokens = r.burst
+		}
+		r.lasttime = now
+		if r.tokens >= 1 {
+			r.tokens--
+			r.mutex.Unlock()
+			return
+		}
+		wait := time.Duration((1 - r.tokens) / r.rate * float64(time.Second))
+		r.mutex.Unlock()
+		time.Sleep(wait)
+	}
+}
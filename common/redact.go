@@ -0,0 +1,128 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+//替换敏感内容后的占位
+const redacted = "[REDACTED]"
+
+//过短的值可能与普通日志内容重合，不按值替换
+const minSecretLength = 8
+
+//按格式识别的敏感内容，第一个分组保留，其后的值替换为占位
+var secretPatterns = []*regexp.Regexp{
+	//签名头中的AK及签名
+	regexp.MustCompile(`(?i)(Credential=)[^/\s,\[\]"]+`),
+	regexp.MustCompile(`(?i)(Signature=)[0-9a-f]+`),
+	regexp.MustCompile(`(?i)(Bearer\s+)[^\s,\[\]"]+`),
+	//请求头，含sdk以"key [value]"格式输出的头
+	regexp.MustCompile(`(?i)((?:x-jdcloud|x-jcloud)-security-token"?[ \t]*[:=]?[ \t]*\[?"?)[^\s\[\]",:][^\s\]",]*`),
+	//json及yaml中的凭证字段
+	regexp.MustCompile(`(?i)("(?:accesskeyid|secretaccesskey|accesskeysecret|sessiontoken|securitytoken|oidctoken|token)"\s*:\s*")[^"]*`),
+	regexp.MustCompile(`(?i)\b((?:secondary)?(?:accessskeyid|accesskeyid|accesskeysecret)\s*[:=]\s*)\S+`),
+}
+
+//日志输出前替换凭证、token及签名，已知的凭证值(含base64编码后的值)按值替换，其余按格式识别
+type Redactor struct {
+	mutex   sync.RWMutex
+	secrets map[string]bool
+	//按长度从长到短，避免短值先替换破坏包含它的长值
+	ordered []string
+}
+
+var DefaultRedactor = &Redactor{secrets: map[string]bool{}}
+
+//登记需要按值替换的凭证，临时凭证刷新后需要登记新值
+func (r *Redactor) Add(secrets ...string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, secret := range secrets {
+		if len(secret) < minSecretLength {
+			continue
+		}
+		for _, value := range []string{secret, base64.StdEncoding.EncodeToString([]byte(secret))} {
+			if r.secrets[value] {
+				continue
+			}
+			r.secrets[value] = true
+			i := 0
+			for i < len(r.ordered) && len(r.ordered[i]) >= len(value) {
+				i++
+			}
+			r.ordered = append(r.ordered[:i], append([]string{value}, r.ordered[i:]...)...)
+		}
+	}
+}
+
+func (r *Redactor) Redact(s string) string {
+	r.mutex.RLock()
+	for _, secret := range r.ordered {
+		if strings.Contains(s, secret) {
+			s = strings.Replace(s, secret, redacted, -1)
+		}
+	}
+	r.mutex.RUnlock()
+	for _, pattern := range secretPatterns {
+		s = pattern.ReplaceAllStringFunc(s, func(match string) string {
+			prefix := pattern.FindStringSubmatch(match)[1]
+			//已替换的值不再替换，占位的[可能被前缀吸收
+			if strings.Trim(match[len(prefix):], "[]") == strings.Trim(redacted, "[]") {
+				return match
+			}
+			return prefix + redacted
+		})
+	}
+	return s
+}
+
+//登记配置文件中的凭证、密码及token
+func (r *Redactor) AddParameters(p *Parameters) {
+	r.Add(p.AccessKeyID, p.AccessKeySecret, p.SecondaryAccessKeyID, p.SecondaryAccessKeySecret)
+	for _, region := range p.Regions {
+		r.Add(region.AccessKeyID, region.AccessKeySecret)
+	}
+	for _, t := range p.Admin.Tokens {
+		r.Add(t.Token)
+	}
+	for _, key := range p.Heartbeat.Keys {
+		r.Add(key.Secret)
+	}
+	r.Add(p.Handoff.PeerToken, p.Heartbeat.Secret, p.Ipam.Token, p.Kafka.Sasl.Password, p.Metrics.Push.Password, p.Metrics.Push.BearerToken)
+}
+
+//替换后写入out，用于未配置log.outputs时标准库log的默认输出
+type redactWriter struct {
+	out io.Writer
+}
+
+func (w *redactWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, DefaultRedactor.Redact(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+//sdk日志级别，与jdcloud-sdk-go的LogFatal、LogError、LogWarn、LogInfo取值相同，-1时不输出
+var sdkLogLevels = map[string]int{"off": -1, "fatal": 0, "error": 1, "warn": 2, "info": 3}
+
+var sdkLogLevel = -1
+
+//sdk的日志(含info级别输出的请求头、请求体及签名串)写入log，与其他日志一样在输出时替换
+func sdkLog(level int, message ...interface{}) {
+	if level > sdkLogLevel {
+		return
+	}
+	log.Println("sdk", strings.TrimSpace(fmt.Sprintln(message...)))
+}
+
+func init() {
+	log.SetOutput(&redactWriter{out: os.Stderr})
+}
@@ -0,0 +1,110 @@
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+const (
+	redactTestAccessKey = "AKTESTREDACT00000001"
+	redactTestSecretKey = "SKTESTREDACTSECRET000000001"
+	redactTestToken     = "STSTOKENREDACT0000000000001"
+	//未登记的token，只能按格式识别
+	redactTestOtherToken = "STSTOKENUNREGISTERED00000002"
+)
+
+//以debug级别(sdk info日志及--debug-http)运行一次带签名的请求，扫描全部输出中的凭证、token及签名
+func TestRedactDebugRun(t *testing.T) {
+	outputs := map[string]func() (io.Writer, func() string){
+		//未配置log.outputs时的默认输出
+		"default": func() (io.Writer, func() string) {
+			buf := &bytes.Buffer{}
+			return &redactWriter{out: buf}, buf.String
+		},
+		//配置log.outputs时的输出
+		"outputs": func() (io.Writer, func() string) {
+			file, err := ioutil.TempFile("", "vipsidecar-redact")
+			if err != nil {
+				t.Fatal(err)
+			}
+			return &logWriter{sinks: []logSink{&consoleSink{file: file}}}, func() string {
+				file.Close()
+				defer os.Remove(file.Name())
+				data, _ := ioutil.ReadFile(file.Name())
+				return string(data)
+			}
+		},
+	}
+	for name, output := range outputs {
+		writer, captured := output()
+		signature := debugRun(t, writer)
+		out := captured()
+		if !strings.Contains(out, "http #") || !strings.Contains(out, "sdk ") {
+			t.Fatalf("%s: debug output missing, got:\n%s", name, out)
+		}
+		secrets := []string{redactTestAccessKey, redactTestSecretKey, redactTestToken, redactTestOtherToken, signature,
+			base64.StdEncoding.EncodeToString([]byte(redactTestSecretKey))}
+		for _, secret := range secrets {
+			if strings.Contains(out, secret) {
+				t.Errorf("%s: %q found in log output:\n%s", name, secret, out)
+			}
+		}
+	}
+}
+
+//返回请求签名，用于在输出中查找
+func debugRun(t *testing.T, writer io.Writer) string {
+	log.SetOutput(writer)
+	defer log.SetOutput(&redactWriter{out: os.Stderr})
+	if err := ConfigureLogging(JdLog{SdkLevel: "info"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer func() { sdkLogLevel = -1 }()
+	httpDumpMaxBody = 4096
+	defer func() { httpDumpMaxBody = 0 }()
+	DefaultRedactor.AddParameters(&Parameters{AccessKeyID: redactTestAccessKey, AccessKeySecret: redactTestSecretKey})
+	//刷新后的临时凭证
+	DefaultRedactor.Add(redactTestToken)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Jdcloud-Security-Token", r.Header.Get("X-Jdcloud-Security-Token"))
+		io.WriteString(w, `{"result":{"credentials":{"accessKeyId":"`+redactTestAccessKey+`","secretAccessKey":"`+redactTestSecretKey+`","sessionToken":"`+redactTestOtherToken+`"}}}`)
+	}))
+	defer server.Close()
+
+	body := []byte(`{"accessKeyId":"` + redactTestAccessKey + `","securityToken":"` + redactTestOtherToken + `","secondaryIps":["10.0.0.5"]}`)
+	req, err := http.NewRequest("POST", server.URL+"/v1/regions/cn-north-1/networkInterfaces/port-abc:assignSecondaryIps", bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Jdcloud-Security-Token", redactTestToken)
+	signer, _ := GetSigner(SignerJdcloud2)
+	signer.Sign(req, body, "vpc", "cn-north-1", redactTestAccessKey, redactTestSecretKey, time.Now())
+	authorization := req.Header.Get("Authorization")
+	signature := authorization[strings.LastIndex(authorization, "=")+1:]
+
+	//sdk在info级别输出请求头、签名串及请求体
+	sdkLog(3, "request headers", req.Header)
+	sdkLog(3, "string to sign", "JDCLOUD2-HMAC-SHA256 Credential="+redactTestAccessKey+"/20260102/cn-north-1/vpc/jdcloud2_request")
+	sdkLog(3, "request body", string(body))
+	client := &http.Client{Transport: WrapHttpDump(http.DefaultTransport)}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	log.Println("refreshed credentials accesskeyid:", redactTestAccessKey, "secret base64", base64.StdEncoding.EncodeToString([]byte(redactTestSecretKey)))
+	return signature
+}
@@ -0,0 +1,73 @@
+package common
+
+import (
+	"sync"
+)
+
+//单个region的vpc client及其限流器
+type RegionClient struct {
+	Vpc     VpcApi
+	Limiter *RateLimiter
+}
+
+//按region维护client，未单独配置的region使用默认endpoint和全局凭证
+type RegionClients struct {
+	mutex       sync.Mutex
+	parameter   *Parameters
+	credentials CredentialProvider
+	failover    *CredentialFailover
+	clients     map[string]*RegionClient
+}
+
+func NewRegionClients(p *Parameters) *RegionClients {
+	if p.SecondaryAccessKeyID != "" {
+		DefaultStatus.SetCredentials(credentialNames[0])
+	}
+	return &RegionClients{parameter: p, credentials: NewCredentialProvider(p), failover: &CredentialFailover{}, clients: make(map[string]*RegionClient)}
+}
+
+//获取region对应的vpc client，调用前按region限流
+func (r *RegionClients) Get(regionId string) VpcApi {
+	rc := r.regionClient(regionId)
+	rc.Limiter.Wait()
+	return rc.Vpc
+}
+
+func (r *RegionClients) regionClient(regionId string) *RegionClient {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if rc, ok := r.clients[regionId]; ok {
+		return rc
+	}
+
+	region := JdRegion{}
+	for _, rg := range r.parameter.Regions {
+		if rg.RangId == regionId {
+			region = rg
+		}
+	}
+	config := ClientConfig{
+		Credentials: r.credentials,
+		Scheme:      region.Scheme,
+		Endpoint:    region.Endpoint,
+		VmEndpoint:  region.VmEndpoint,
+		Signer:      region.Signer,
+	}
+	var vpcapi VpcApi
+	switch {
+	case region.AccessKeyID != "" && region.AccessKeySecret != "":
+		config.Credentials = StaticCredentials{AccessKey: region.AccessKeyID, SecretKey: region.AccessKeySecret}
+		vpcapi = NewVpcApi(config)
+	case r.parameter.SecondaryAccessKeyID != "":
+		//全局凭证配置了备用AK/SK时，认证失败自动切换
+		secondary := config
+		secondary.Credentials = StaticCredentials{AccessKey: r.parameter.SecondaryAccessKeyID, SecretKey: r.parameter.SecondaryAccessKeySecret}
+		vpcapi = &failoverVpcApi{apis: [2]VpcApi{NewVpcApi(config), NewVpcApi(secondary)}, failover: r.failover}
+	default:
+		vpcapi = NewVpcApi(config)
+	}
+
+	rc := &RegionClient{Vpc: selfCheckVpcApi{vpcapi}, Limiter: NewRateLimiter(region.RateLimit)}
+	r.clients[regionId] = rc
+	return rc
+}
@@ -0,0 +1,183 @@
+package common
+
+import (
+	"errors"
+	"time"
+)
+
+//可演练故障转移的Provider
+//对影子vip完整执行转移路径并在结束后恢复原绑定；dryrun时只执行只读步骤，可用于生产vip
+type Rehearser interface {
+	Rehearse(vip string, dryrun bool) []RehearsalStep
+}
+
+//演练中的单个步骤，restore为演练结束后的恢复步骤，不计入转移耗时
+type RehearsalStep struct {
+	Name     string
+	Duration time.Duration
+	Skipped  bool
+	Restore  bool
+	Err      error
+}
+
+//按顺序执行并计时的演练步骤
+type rehearsal struct {
+	dryrun bool
+	steps  []RehearsalStep
+	failed bool
+}
+
+//执行一个步骤，mutating步骤在dryrun时跳过；之前有步骤失败时除恢复步骤外不再执行
+func (r *rehearsal) run(name string, mutating bool, fn func() error) bool {
+	step := RehearsalStep{Name: name}
+	if (mutating && r.dryrun) || r.failed {
+		step.Skipped = true
+		r.steps = append(r.steps, step)
+		return false
+	}
+	start := time.Now()
+	step.Err = fn()
+	step.Duration = time.Since(start)
+	r.steps = append(r.steps, step)
+	if step.Err != nil {
+		r.failed = true
+		return false
+	}
+	return true
+}
+
+//恢复步骤，即使之前的步骤失败也执行
+func (r *rehearsal) restore(name string, fn func() error) {
+	step := RehearsalStep{Name: name, Restore: true}
+	if r.dryrun {
+		step.Skipped = true
+		r.steps = append(r.steps, step)
+		return
+	}
+	start := time.Now()
+	step.Err = fn()
+	step.Duration = time.Since(start)
+	r.steps = append(r.steps, step)
+}
+
+//转移路径耗时，不含恢复步骤
+func RehearsalDuration(steps []RehearsalStep) time.Duration {
+	var total time.Duration
+	for _, step := range steps {
+		if !step.Restore {
+			total += step.Duration
+		}
+	}
+	return total
+}
+
+func (s *SecondaryIpProvider) Rehearse(vip string, dryrun bool) []RehearsalStep {
+	r := &rehearsal{dryrun: dryrun}
+	local := s.parameter.Localnetworkinterface
+	localapi := s.clients.Get(local.RangId)
+	var placement vipPlacement
+	r.run("describe", false, func() error {
+		networkinterfacevips := s.networkInterfaceVips()
+		if len(networkinterfacevips) == 0 {
+			return errors.New("describe network interfaces failed")
+		}
+		placement = s.placements(networkinterfacevips, []string{vip})[0]
+		return nil
+	})
+	r.run("dad", false, func() error {
+		return s.dad.Check(vip)
+	})
+	for _, k := range placement.stale {
+		k := k
+		r.run("unassign "+k.NetWorkInterfaceId, true, func() error {
+			_, err := DefaultRetryPolicy.Do("UnassignSecondaryIps", func() (string, error) {
+				return s.clients.Get(k.RangId).UnassignSecondaryIps(k.RangId, k.NetWorkInterfaceId, []string{vip})
+			})
+			return err
+		})
+	}
+	assigned := false
+	if !placement.onlocal {
+		assigned = r.run("assign "+local.NetWorkInterfaceId, true, func() error {
+			_, err := AssignVips(localapi, local.RangId, local.NetWorkInterfaceId, []string{vip}, nil)
+			return err
+		})
+	}
+	r.run("verify", true, func() error {
+		//已绑定在备用网卡上时校验该网卡
+		nic := local
+		if placement.onlocal {
+			nic = placement.nic
+		}
+		if !IpExistsOnInterface(s.clients.Get(nic.RangId), nic.RangId, nic.NetWorkInterfaceId, vip) {
+			return errors.New("vip " + vip + " not found on " + nic.NetWorkInterfaceId)
+		}
+		return nil
+	})
+	r.run("garp", true, func() error {
+		return s.announcer.Announce(vip)
+	})
+
+	//恢复演练前的绑定关系
+	if assigned {
+		r.restore("unassign "+local.NetWorkInterfaceId, func() error {
+			_, err := DefaultRetryPolicy.Do("UnassignSecondaryIps", func() (string, error) {
+				return localapi.UnassignSecondaryIps(local.RangId, local.NetWorkInterfaceId, []string{vip})
+			})
+			return err
+		})
+	}
+	for _, k := range placement.stale {
+		k := k
+		r.restore("assign "+k.NetWorkInterfaceId, func() error {
+			_, err := AssignVips(s.clients.Get(k.RangId), k.RangId, k.NetWorkInterfaceId, []string{vip}, nil)
+			return err
+		})
+	}
+	return r.steps
+}
+
+//vip需在natgateway.dnatrules中配置，影子vip使用单独的DNAT规则
+func (n *NatDnatProvider) Rehearse(vip string, dryrun bool) []RehearsalStep {
+	r := &rehearsal{dryrun: dryrun}
+	natgateway := n.parameter.NatGateway
+	api := n.clients.Get(natgateway.RangId)
+	dnatruleid := ""
+	for _, rule := range natgateway.DnatRules {
+		if rule.Vip == vip {
+			dnatruleid = rule.DnatRuleId
+		}
+	}
+	original := ""
+	r.run("describe", false, func() error {
+		if dnatruleid == "" {
+			return errors.New("no dnat rule configured for " + vip)
+		}
+		dnatrule, err := GetDnatRule(api, natgateway.RangId, natgateway.NatGatewayId, dnatruleid)
+		if err == nil {
+			original = dnatrule.InternalIpAddress
+		}
+		return err
+	})
+	repointed := false
+	if original != natgateway.LocalIp {
+		repointed = r.run("repoint "+dnatruleid, true, func() error {
+			_, err := RepointDnatRule(api, natgateway.RangId, natgateway.NatGatewayId, dnatruleid, natgateway.LocalIp, nil)
+			return err
+		})
+	}
+	r.run("verify", true, func() error {
+		dnatrule, err := GetDnatRule(api, natgateway.RangId, natgateway.NatGatewayId, dnatruleid)
+		if err == nil && dnatrule.InternalIpAddress != natgateway.LocalIp {
+			err = errors.New("dnat rule points to " + dnatrule.InternalIpAddress)
+		}
+		return err
+	})
+	if repointed && original != "" {
+		r.restore("repoint "+dnatruleid, func() error {
+			_, err := RepointDnatRule(api, natgateway.RangId, natgateway.NatGatewayId, dnatruleid, original, nil)
+			return err
+		})
+	}
+	return r.steps
+}
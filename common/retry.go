@@ -0,0 +1,59 @@
+package common
+
+import (
+	"log"
+	"time"
+)
+
+//修改类接口的重试策略，只重试可重试的错误，退避时间指数增长
+type RetryPolicy struct {
+	Attempts int
+	Backoff  time.Duration
+	MaxDelay time.Duration
+	//不为零时，退避后会超过Deadline则不再重试
+	Deadline time.Time
+	//不为nil时每次调用前检查fencing token，已失效时不再调用
+	Fence func() error
+}
+
+var DefaultRetryPolicy = RetryPolicy{Attempts: 3, Backoff: 500 * time.Millisecond, MaxDelay: 5 * time.Second}
+
+//执行fn，返回最后一次的requestId及错误
+func (r RetryPolicy) Do(operation string, fn func() (string, error)) (string, error) {
+	delay := r.Backoff
+	var requestid string
+	var err error
+	if err := DefaultClockGuard.Allow(operation); err != nil {
+		return "", err
+	}
+	if err := DefaultSafety.Allow(operation); err != nil {
+		return "", err
+	}
+	for attempt := 1; ; attempt++ {
+		if r.Fence != nil {
+			if err := r.Fence(); err != nil {
+				log.Println(operation, "refused", err)
+				return requestid, err
+			}
+		}
+		requestid, err = fn()
+		if err == nil || !IsRetryable(err) || attempt >= r.Attempts {
+			return requestid, err
+		}
+		//限流时加倍退避
+		if IsThrottled(err) {
+			delay *= 2
+		}
+		if delay > r.MaxDelay {
+			delay = r.MaxDelay
+		}
+		if !r.Deadline.IsZero() && time.Now().Add(delay).After(r.Deadline) {
+			log.Println(operation, "attempt", attempt, "failed, no retry within failover budget", err)
+			return requestid, err
+		}
+		log.Println(operation, "attempt", attempt, "failed, retrying in", delay, err)
+		DefaultMetrics.Add("vipsidecar_workqueue_retries_total", map[string]string{"operation": operation}, 1)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
@@ -0,0 +1,91 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+//运行时检查的安全不变式
+const (
+	//只有云上绑定已确认(状态为Bound)的vip才能发送免费arp
+	InvariantGarpWithoutBinding string = "garp-without-binding"
+	//fencing为strict时，其他网卡仍持有vip时不能绑定到本机
+	InvariantBindWithOtherHolder string = "bind-with-other-holder"
+)
+
+//fencing策略
+const (
+	FencingNone   string = ""
+	FencingStrict string = "strict"
+)
+
+const SelfCheckSafety string = "safety"
+
+//违反的不变式，通过/v1/status暴露
+type SafetyViolation struct {
+	Time      time.Time `json:"time"`
+	Invariant string    `json:"invariant"`
+	Vip       string    `json:"vip"`
+	Message   string    `json:"message"`
+}
+
+//安全断言：不变式被违反时停止所有修改类操作(云上接口、免费arp)，输出SAFETY日志并使/healthz返回503，需要人工排查后重启恢复
+type SafetyGuard struct {
+	mutex     sync.Mutex
+	fencing   string
+	violation *SafetyViolation
+}
+
+var DefaultSafety = &SafetyGuard{}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_safety_violations_total", MetricCounter, "Runtime safety invariant violations, mutations are halted after the first one.")
+	DefaultMetrics.Register("vipsidecar_mutations_halted", MetricGauge, "1 when mutations are halted because a safety invariant was violated.")
+}
+
+func (g *SafetyGuard) Load(config JdSafety) error {
+	if config.Fencing != FencingNone && config.Fencing != FencingStrict {
+		return errors.New("safety.fencing must be empty or strict")
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.fencing = config.Fencing
+	return nil
+}
+
+func (g *SafetyGuard) Strict() bool {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.fencing == FencingStrict
+}
+
+//断言不变式成立，不成立时停止修改类操作并返回false
+func (g *SafetyGuard) Assert(invariant string, vip string, ok bool, message string) bool {
+	if ok {
+		return true
+	}
+	violation := &SafetyViolation{Time: time.Now(), Invariant: invariant, Vip: vip, Message: message}
+	g.mutex.Lock()
+	if g.violation == nil {
+		g.violation = violation
+	}
+	g.mutex.Unlock()
+	log.Println("SAFETY invariant", invariant, "violated for vip", vip, message, "halting all mutations")
+	DefaultMetrics.Add("vipsidecar_safety_violations_total", map[string]string{"invariant": invariant}, 1)
+	DefaultMetrics.Set("vipsidecar_mutations_halted", nil, 1)
+	DefaultStatus.SetSafetyViolation(violation)
+	DefaultSelfChecks.Report(SelfCheckSafety, errors.New(invariant+" violated for vip "+vip+": "+message))
+	return false
+}
+
+//不变式被违反后拒绝修改类操作
+func (g *SafetyGuard) Allow(operation string) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.violation != nil {
+		return NewSafetyHaltError(operation + " halted: invariant " + g.violation.Invariant + " violated for vip " + g.violation.Vip)
+	}
+	return nil
+}
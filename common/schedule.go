@@ -0,0 +1,208 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//自动故障转移的时间计划：配置windows时只在窗口内允许自动转移，blackouts期间只允许手动转移(管理接口触发的reconcile及handoff)
+type Schedule struct {
+	mutex     sync.Mutex
+	location  *time.Location
+	windows   []scheduleWindow
+	blackouts []scheduleWindow
+}
+
+//从cron表达式匹配的时刻开始持续duration
+type scheduleWindow struct {
+	name     string
+	cron     *cronExpr
+	duration time.Duration
+}
+
+//被计划阻止的自动故障转移，通过/v1/status暴露
+type SuppressedFailover struct {
+	Time   time.Time `json:"time"`
+	Vip    string    `json:"vip"`
+	Reason string    `json:"reason"`
+}
+
+var DefaultSchedule = &Schedule{location: time.Local}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_failovers_suppressed_total", MetricCounter, "Automatic failovers suppressed outside failover windows or during blackouts.")
+}
+
+//加载配置，cron表达式有误时返回错误
+func (s *Schedule) Load(config JdSchedule) error {
+	location := time.Local
+	if config.Timezone != "" {
+		l, err := time.LoadLocation(config.Timezone)
+		if err != nil {
+			return errors.New("schedule.timezone: " + err.Error())
+		}
+		location = l
+	}
+	windows, err := parseScheduleWindows("schedule.windows", config.Windows)
+	if err != nil {
+		return err
+	}
+	blackouts, err := parseScheduleWindows("schedule.blackouts", config.Blackouts)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.location, s.windows, s.blackouts = location, windows, blackouts
+	return nil
+}
+
+func parseScheduleWindows(key string, configs []JdScheduleWindow) ([]scheduleWindow, error) {
+	windows := []scheduleWindow{}
+	for i, c := range configs {
+		item := key + "[" + strconv.Itoa(i) + "]"
+		name := c.Name
+		if name == "" {
+			name = item
+		}
+		cron, err := parseCron(c.Cron)
+		if err != nil {
+			return nil, errors.New(item + ": " + err.Error())
+		}
+		if c.Duration <= 0 {
+			return nil, errors.New(item + ": duration must be greater than 0")
+		}
+		windows = append(windows, scheduleWindow{name: name, cron: cron, duration: time.Duration(c.Duration) * time.Minute})
+	}
+	return windows, nil
+}
+
+//t时刻是否在窗口内
+func (w scheduleWindow) contains(t time.Time) bool {
+	t = t.Truncate(time.Minute)
+	for start := t; t.Sub(start) < w.duration; start = start.Add(-time.Minute) {
+		if w.cron.match(start) {
+			return true
+		}
+	}
+	return false
+}
+
+//t时刻是否允许自动故障转移，不允许时返回原因
+func (s *Schedule) Allowed(t time.Time) (bool, string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	t = t.In(s.location)
+	for _, w := range s.blackouts {
+		if w.contains(t) {
+			return false, "blackout " + w.name
+		}
+	}
+	if len(s.windows) == 0 {
+		return true, ""
+	}
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true, ""
+		}
+	}
+	return false, "outside failover windows"
+}
+
+//由ctx对应的事件触发的vip转移是否可以执行，手动触发的事件不受计划限制
+func (s *Schedule) AllowFailover(ctx context.Context, vip string) bool {
+	if ManualEvent(EventSource(ctx)) {
+		return true
+	}
+	ok, reason := s.Allowed(time.Now())
+	if ok {
+		return true
+	}
+	log.Println("automatic failover of", vip, "suppressed,", reason)
+	DefaultMetrics.Add("vipsidecar_failovers_suppressed_total", map[string]string{"reason": "schedule"}, 1)
+	DefaultStatus.SetSuppressedFailover(&SuppressedFailover{Time: time.Now(), Vip: vip, Reason: reason})
+	return false
+}
+
+//分 时 日 月 周，支持*、数字、a-b、逗号列表及/n步长，周日为0或7
+type cronExpr struct {
+	minute, hour, dom, month, dow []bool
+	domany, dowany                bool
+}
+
+var cronFields = []struct {
+	name     string
+	min, max int
+}{{"minute", 0, 59}, {"hour", 0, 23}, {"day of month", 1, 31}, {"month", 1, 12}, {"day of week", 0, 7}}
+
+func parseCron(expr string) (*cronExpr, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, errors.New("cron expression " + strconv.Quote(expr) + " must have 5 fields")
+	}
+	sets := make([][]bool, 5)
+	for i, field := range fields {
+		set, err := parseCronField(field, cronFields[i].min, cronFields[i].max)
+		if err != nil {
+			return nil, errors.New(cronFields[i].name + " " + strconv.Quote(field) + ": " + err.Error())
+		}
+		sets[i] = set
+	}
+	//周日可写作7
+	sets[4][0] = sets[4][0] || sets[4][7]
+	return &cronExpr{minute: sets[0], hour: sets[1], dom: sets[2], month: sets[3], dow: sets[4], domany: fields[2] == "*", dowany: fields[4] == "*"}, nil
+}
+
+func parseCronField(field string, min int, max int) ([]bool, error) {
+	set := make([]bool, max+1)
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n <= 0 {
+				return nil, errors.New("invalid step")
+			}
+			step, part = n, part[:i]
+		}
+		from, to := min, max
+		if part != "*" {
+			bounds := strings.SplitN(part, "-", 2)
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return nil, errors.New("invalid value")
+			}
+			from, to = n, n
+			if len(bounds) == 2 {
+				if to, err = strconv.Atoi(bounds[1]); err != nil {
+					return nil, errors.New("invalid range")
+				}
+			} else if step > 1 {
+				to = max
+			}
+		}
+		if from < min || to > max || from > to {
+			return nil, errors.New("out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max))
+		}
+		for v := from; v <= to; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+//日与周同时指定时满足其一即可，与cron一致
+func (c *cronExpr) match(t time.Time) bool {
+	if !c.minute[t.Minute()] || !c.hour[t.Hour()] || !c.month[int(t.Month())] {
+		return false
+	}
+	dom, dow := c.dom[t.Day()], c.dow[int(t.Weekday())]
+	if c.domany || c.dowany {
+		return dom && dow
+	}
+	return dom || dow
+}
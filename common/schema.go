@@ -0,0 +1,109 @@
+package common
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"strconv"
+)
+
+//持久化数据的schema版本，修改格式时递增并在migrations末尾追加从上一版本升级的函数
+//读取到比当前版本新的数据时拒绝启动，避免旧版本误解新格式或向新格式的文件写入旧格式的数据
+const (
+	FailoverLogSchemaVersion   = 1
+	DetachJournalSchemaVersion = 1
+	HookResultsSchemaVersion   = 2
+)
+
+//failoverLogMigrations[i]将版本i的记录升级到版本i+1，版本0为没有schemaVersion字段的记录
+var failoverLogMigrations = []func(record map[string]interface{}){
+	func(record map[string]interface{}) {},
+}
+
+var detachJournalMigrations = []func(record map[string]interface{}){
+	func(record map[string]interface{}) {},
+}
+
+var hookResultsMigrations = []func(record map[string]interface{}){
+	func(record map[string]interface{}) {},
+	//版本1以epoch及目标状态为键，没有转换序号，升级后序号为0，之后的转换从1开始
+	func(record map[string]interface{}) {
+		record["seq"] = 0
+	},
+}
+
+//数据schema比当前版本新时返回的错误
+type SchemaTooNewError struct {
+	Path      string
+	Version   int
+	Supported int
+}
+
+func (e *SchemaTooNewError) Error() string {
+	return e.Path + " uses schema version " + strconv.Itoa(e.Version) + " but this vipsidecar supports up to " + strconv.Itoa(e.Supported) + ", upgrade vipsidecar or move the file away"
+}
+
+//记录的schema版本，没有schemaVersion字段时为0
+func schemaVersionOf(record map[string]interface{}) int {
+	if v, ok := record["schemaVersion"].(float64); ok {
+		return int(v)
+	}
+	return 0
+}
+
+//将记录升级到当前版本
+func migrateRecord(path string, record map[string]interface{}, current int, migrations []func(map[string]interface{})) error {
+	version := schemaVersionOf(record)
+	if version > current {
+		return &SchemaTooNewError{Path: path, Version: version, Supported: current}
+	}
+	for ; version < current; version++ {
+		migrations[version](record)
+	}
+	record["schemaVersion"] = current
+	return nil
+}
+
+//升级每行一个json的文件中的所有记录，有记录需要升级时写临时文件后改名替换，返回升级的记录数
+func migrateJsonLines(path string, current int, migrations []func(map[string]interface{})) (int, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	lines := [][]byte{}
+	migrated := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		record := map[string]interface{}{}
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			return 0, errors.New(path + ": " + err.Error())
+		}
+		if schemaVersionOf(record) != current {
+			migrated++
+		}
+		if err := migrateRecord(path, record, current, migrations); err != nil {
+			return 0, err
+		}
+		line, _ := json.Marshal(record)
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil || migrated == 0 {
+		return 0, err
+	}
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return 0, err
+	}
+	for _, line := range lines {
+		tmp.Write(append(line, '\n'))
+	}
+	if err := tmp.Close(); err != nil {
+		return 0, err
+	}
+	return migrated, os.Rename(path+".tmp", path)
+}
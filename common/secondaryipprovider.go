@@ -0,0 +1,575 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//通过网卡secondaryip实现vip漂移
+type SecondaryIpProvider struct {
+	parameter *Parameters
+	clients   *RegionClients
+	pool      *WorkerPool
+	states    *VipStateMachine
+	announcer *GarpAnnouncer
+	dad       *AddressConflictDetector
+	router    *PolicyRouter
+	watchonce sync.Once
+	//变化检测与reconcile共享的绑定关系快照
+	snapshot *CloudSnapshot
+
+	//启动阶段预取的绑定关系，首次reconcile时使用
+	mutex      sync.Mutex
+	discovered *interfaceVips
+}
+
+//一次批量查询得到的各网卡绑定的vip，failed为查询失败的region
+type interfaceVips struct {
+	vips   map[JdNetworkInterface][]string
+	failed map[string]error
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_quota_remaining", MetricGauge, "Remaining quota for resources consumed by failover.")
+}
+
+func NewSecondaryIpProvider(p *Parameters, clients *RegionClients, pool *WorkerPool) *SecondaryIpProvider {
+	announcer := NewGarpAnnouncer(p.Garp)
+	states := newProviderStates()
+	var router *PolicyRouter
+	if p.PolicyRouting.Enabled {
+		router = NewPolicyRouter(p.PolicyRouting, p.Vips)
+		states.OnTransition(router.OnTransition)
+	}
+	s := &SecondaryIpProvider{parameter: p, clients: clients, pool: pool, states: states, announcer: announcer, dad: NewAddressConflictDetector(p.Dad, announcer), router: router}
+	s.snapshot = NewCloudSnapshot(ModeSecondaryIp, func() (interface{}, error) {
+		return s.describeVips(), nil
+	})
+	return s
+}
+
+func (s *SecondaryIpProvider) Name() string {
+	return ModeSecondaryIp
+}
+
+//按region批量查询所有网卡当前绑定的vip，查询失败的region中的网卡不在结果中
+func (s *SecondaryIpProvider) networkInterfaceVips() map[JdNetworkInterface][]string {
+	return s.describeVips().vips
+}
+
+func (s *SecondaryIpProvider) describeVips() *interfaceVips {
+	var wg sync.WaitGroup
+	var mutex = &sync.Mutex{}
+
+	//备用网卡不一定在allnetworkinterfaces中，一并查询
+	regioninterfaces := make(map[string][]string)
+	seen := make(map[JdNetworkInterface]bool)
+	for _, nf := range append(append([]JdNetworkInterface{}, s.parameter.Allnetworkinterfaces...), s.parameter.Fallbackinterfaces...) {
+		if seen[nf] {
+			continue
+		}
+		seen[nf] = true
+		regioninterfaces[nf.RangId] = append(regioninterfaces[nf.RangId], nf.NetWorkInterfaceId)
+	}
+
+	//当前网络接口与vip绑定关系
+	var networkinterfacevips = make(map[JdNetworkInterface][]string)
+	failed := make(map[string]error)
+	for rangid, ids := range regioninterfaces {
+		wg.Add(1)
+		rangid, ids := rangid, ids
+		go func() {
+			defer wg.Done()
+			interfaceips, err := GetNetworkInterfacesIps(s.clients.Get(rangid), rangid, ids)
+			mutex.Lock()
+			if err != nil {
+				failed[rangid] = err
+			}
+			for id, ips := range interfaceips {
+				networkinterfacevips[JdNetworkInterface{RangId: rangid, NetWorkInterfaceId: id}] = ips
+			}
+			mutex.Unlock()
+		}()
+	}
+
+	wg.Wait()
+	return &interfaceVips{vips: networkinterfacevips, failed: failed}
+}
+
+//snapshotmaxage内的绑定关系，不重复查询
+func (s *SecondaryIpProvider) cachedVips() *interfaceVips {
+	value, _ := s.snapshot.Get(time.Duration(s.parameter.SnapshotMaxAge) * time.Second)
+	return value.(*interfaceVips)
+}
+
+//启动时预取各网卡绑定关系
+func (s *SecondaryIpProvider) Discover(ctx context.Context) error {
+	current := s.describeVips()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	s.mutex.Lock()
+	s.discovered = current
+	s.mutex.Unlock()
+	return nil
+}
+
+//本机各网卡剩余可绑定的secondaryip数量，未配置上限时返回nil
+func (s *SecondaryIpProvider) quotaRemaining(networkinterfacevips map[JdNetworkInterface][]string) map[JdNetworkInterface]int {
+	max := s.parameter.Maxsecondaryips
+	if max <= 0 {
+		return nil
+	}
+	remaining := make(map[JdNetworkInterface]int)
+	for _, nf := range s.parameter.LocalNetworkInterfaces() {
+		remaining[nf] = max - len(networkinterfacevips[nf])
+		DefaultMetrics.Set("vipsidecar_quota_remaining", map[string]string{"type": "secondary_ip", "resource": nf.NetWorkInterfaceId}, float64(remaining[nf]))
+	}
+	return remaining
+}
+
+//rangid所在region的本机网卡，rangid为空时为全部本机网卡
+func (s *SecondaryIpProvider) regionInterfaces(rangid string) []JdNetworkInterface {
+	interfaces := []JdNetworkInterface{}
+	for _, nf := range s.parameter.LocalNetworkInterfaces() {
+		if rangid == "" || nf.RangId == rangid {
+			interfaces = append(interfaces, nf)
+		}
+	}
+	return interfaces
+}
+
+//新绑定的vip使用的网卡：按顺序取vip所在region中第一个未达上限的本机网卡，全部已满时返回false
+func (s *SecondaryIpProvider) pickInterface(remaining map[JdNetworkInterface]int, rangid string) (JdNetworkInterface, bool) {
+	for _, nf := range s.regionInterfaces(rangid) {
+		if remaining == nil || remaining[nf] > 0 {
+			if remaining != nil {
+				remaining[nf]--
+			}
+			return nf, true
+		}
+	}
+	return JdNetworkInterface{}, false
+}
+
+//是否为本机网卡
+func (s *SecondaryIpProvider) isLocal(nf JdNetworkInterface) bool {
+	for _, local := range s.parameter.LocalNetworkInterfaces() {
+		if local == nf {
+			return true
+		}
+	}
+	return false
+}
+
+//云上各网卡绑定vip的摘要，用于变化检测
+func (s *SecondaryIpProvider) Fingerprint() string {
+	lines := []string{}
+	for k, v := range s.cachedVips().vips {
+		ips := append([]string{}, v...)
+		sort.Strings(ips)
+		lines = append(lines, k.RangId+"/"+k.NetWorkInterfaceId+"="+strings.Join(ips, ","))
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, ";")
+}
+
+//单个vip在云上的当前绑定位置，onlocal时nic为持有vip的本机网卡
+type vipPlacement struct {
+	vip     string
+	onlocal bool
+	nic     JdNetworkInterface
+	stale   []JdNetworkInterface
+}
+
+//计算本机持有的vip当前绑定在哪些网卡上，绑定在多个本机网卡上时按网卡顺序保留第一个
+func (s *SecondaryIpProvider) placements(networkinterfacevips map[JdNetworkInterface][]string, vipsonlocal []string) []vipPlacement {
+	placements := []vipPlacement{}
+	for _, localvip := range vipsonlocal {
+		placement := vipPlacement{vip: localvip}
+		viprangid := s.parameter.VipRangId(localvip)
+		for _, nf := range s.regionInterfaces(viprangid) {
+			if ok, _ := Contain(localvip, networkinterfacevips[nf]); ok && !placement.onlocal {
+				placement.onlocal, placement.nic = true, nf
+			}
+		}
+		for k, v := range networkinterfacevips {
+			//vip指定了region时只处理该region内的网卡
+			if viprangid != "" && k.RangId != viprangid {
+				continue
+			}
+			ok, _ := Contain(localvip, v)
+			if !ok || (placement.onlocal && k == placement.nic) {
+				continue
+			}
+			placement.stale = append(placement.stale, k)
+		}
+		placements = append(placements, placement)
+	}
+	return placements
+}
+
+//获取云上绑定关系，优先使用启动阶段预取的结果
+func (s *SecondaryIpProvider) currentVips() *interfaceVips {
+	s.mutex.Lock()
+	current := s.discovered
+	s.discovered = nil
+	s.mutex.Unlock()
+	if current == nil {
+		current = s.cachedVips()
+	}
+	return current
+}
+
+//本机网卡所在region的云上接口不可达(本次查询网络不可达或探测判定不可达)时返回该region
+func (s *SecondaryIpProvider) offlineRegion(failed map[string]error) (string, bool) {
+	for _, nf := range s.parameter.LocalNetworkInterfaces() {
+		if err, ok := failed[nf.RangId]; (ok && ReasonOf(err) == ReasonUnavailable) || !DefaultProber.Reachable(nf.RangId) {
+			return nf.RangId, true
+		}
+	}
+	return "", false
+}
+
+func (s *SecondaryIpProvider) Reconcile(ctx context.Context, vipsonlocal []string) {
+	parameter := s.parameter
+	//bond/team切换活动成员后交换机学到的端口变化，重新发送免费arp
+	if parameter.Garp.Enabled {
+		s.watchonce.Do(func() {
+			go WatchBondFailover(time.Second, func(bond string, from string, to string) {
+				for _, vip := range append(s.states.InState(StateBound), s.states.InState(StateOffline)...) {
+					go s.announce(vip)
+				}
+			})
+		})
+	}
+	current := s.currentVips()
+	networkinterfacevips := current.vips
+	if ctx.Err() != nil {
+		log.Println("reconcile cancelled")
+		return
+	}
+
+	//如果在本地检查到vip,同时vip的注册网络端口不是本地网路端口，或所有网络端口中都没有注册，则注册vip到本地网络端口,同时删除老旧注册
+	//每个vip的注销、注册作为一个任务提交到任务池，单个vip的慢请求不影响其他vip
+	local := parameter.Localnetworkinterface
+	remaining := s.quotaRemaining(networkinterfacevips)
+	s.states.Sync(vipsonlocal)
+	region, offline := s.offlineRegion(current.failed)
+	for _, placement := range s.placements(networkinterfacevips, vipsonlocal) {
+		if ctx.Err() != nil {
+			log.Println("reconcile cancelled")
+			return
+		}
+		//云上绑定关系未知，本机已持有的vip保留本机配置进入Offline，其余vip推迟接管，恢复后重新确认
+		if offline {
+			if !s.states.Offline(placement.vip, "cloud api in "+region+" unreachable") {
+				deferFailover(placement.vip, "cloud api in "+region+" is unreachable")
+			}
+			continue
+		}
+		//已绑定在本机网卡上的vip直接接管，只清理其他网卡上的残留绑定
+		if placement.onlocal && len(placement.stale) == 0 {
+			s.states.Adopt(placement.vip)
+			continue
+		}
+		if placement.onlocal {
+			s.states.Degrade(placement.vip, "stale bindings on other interfaces")
+		}
+
+		//vip指定了region时只能绑定到该region的本机网卡，没有时直接失败，不发起跨region的请求
+		nic := placement.nic
+		viprangid := parameter.VipRangId(placement.vip)
+		if !placement.onlocal && len(s.regionInterfaces(viprangid)) == 0 {
+			err := NewRegionMismatchError("vip " + placement.vip + " is in region " + viprangid + ", no local interface in that region (" + localInterfaceNames(parameter.LocalNetworkInterfaces()) + ")")
+			log.Println(err)
+			DefaultStatus.RecordError("AssignSecondaryIps", err)
+			s.states.Fail(placement.vip, ReasonOf(err), "")
+			continue
+		}
+		//本机网卡secondaryip已达上限时换用下一个网卡，全部已满时直接失败，不再重试
+		if !placement.onlocal {
+			var ok bool
+			if nic, ok = s.pickInterface(remaining, viprangid); !ok {
+				err := NewQuotaExceededError("secondary ip limit " + strconv.Itoa(parameter.Maxsecondaryips) + " reached on " + localInterfaceNames(s.regionInterfaces(viprangid)) + ", cannot assign " + placement.vip)
+				log.Println(err)
+				DefaultStatus.RecordError("AssignSecondaryIps", err)
+				s.states.Fail(placement.vip, ReasonQuotaExceeded, "")
+				continue
+			}
+			if nic != local {
+				log.Println(local.NetWorkInterfaceId, "is full, assigning", placement.vip, "to", nic.NetWorkInterfaceId)
+			}
+		}
+
+		//blackout期间、窗口外或hold-down期间不自动接管vip
+		if !placement.onlocal && !allowFailover(ctx, placement.vip) {
+			continue
+		}
+		if !placement.onlocal && len(placement.stale) > 0 && !allowPreemption(ctx, placement.vip, localInterfaceNames(placement.stale)) {
+			continue
+		}
+		if !placement.onlocal && !allowCloudCall(placement.vip, nic.RangId) {
+			continue
+		}
+
+		vip, stale, onlocal := placement.vip, placement.stale, placement.onlocal
+		var budget *Budget
+		var epoch uint64
+		if !onlocal {
+			epoch = s.states.Acquire(vip)
+			budget = NewBudget(vip, ModeSecondaryIp, time.Duration(parameter.FailoverBudget)*time.Second)
+			budget.SetFence(s.states.Fence(vip, epoch))
+			budget.Track(ctx)
+			budget.Enter(PhaseFence)
+		}
+		s.pool.Submit(vip, func() {
+			defer budget.Finish()
+			defer s.snapshot.Invalidate()
+			if !onlocal {
+				if err := s.dad.Check(vip); err != nil {
+					log.Println(err)
+					DefaultStatus.RecordError("DuplicateAddressDetection", err)
+					s.states.Fail(vip, ReasonOf(err), "")
+					return
+				}
+				//IPAM/CMDB中vip未预留给本服务时不绑定
+				if err := DefaultIpam.Check(vip); err != nil {
+					log.Println(err)
+					s.states.Fail(vip, ReasonOf(err), "")
+					return
+				}
+			}
+			//forcedetach关闭时不解除其他网卡上的绑定，本机已持有的vip保持Degraded
+			if len(stale) > 0 && !DefaultFlags.Enabled(FlagForceDetach) {
+				log.Println("vip", vip, "is bound on", localInterfaceNames(stale), "and feature flag", FlagForceDetach, "is disabled")
+				if !onlocal {
+					s.states.Fail(vip, ReasonFlagDisabled, "")
+				}
+				return
+			}
+			budget.Enter(PhaseCloudDetach)
+			for _, k := range stale {
+				//注销前记录意图，注销与绑定到本机之间进程退出时重启后据此处理
+				if err := DefaultDetachJournal.Begin(DetachIntent{Vip: vip, Mode: ModeSecondaryIp, Region: k.RangId, Resource: k.NetWorkInterfaceId, From: k.NetWorkInterfaceId, To: nic.NetWorkInterfaceId, Epoch: epoch}); err != nil {
+					log.Println(err)
+					if !onlocal {
+						s.states.Fail(vip, ReasonOf(err), "")
+					}
+					return
+				}
+				if _, err := s.batch("unassign", k, vip, budget); err != nil && !onlocal && DefaultSafety.Strict() {
+					//fencing为strict时其他网卡上的绑定未解除前不绑定到本机
+					s.states.Fail(vip, ReasonOf(err), "")
+					return
+				}
+			}
+			if onlocal {
+				s.states.Adopt(vip)
+				DefaultDetachJournal.Complete(vip, "bound on "+nic.NetWorkInterfaceId)
+				return
+			}
+			if DefaultSafety.Strict() {
+				budget.Enter(PhaseFence)
+				holders, err := s.otherHolders(vip)
+				if err != nil {
+					s.states.Fail(vip, ReasonOf(err), "")
+					return
+				}
+				if !DefaultSafety.Assert(InvariantBindWithOtherHolder, vip, len(holders) == 0, "still held by "+strings.Join(holders, ",")) {
+					s.states.Fail(vip, ReasonSafetyHalt, "")
+					return
+				}
+			}
+			//绑定到本机网卡、安装策略路由为必需步骤，失败时回滚已完成的步骤
+			plan := NewApplyPlan(vip)
+			requestid := ""
+			budget.Enter(PhaseCloudAttach)
+			if err := plan.Step("assign "+nic.NetWorkInterfaceId, func() (err error) {
+				requestid, err = s.batch("assign", nic, vip, budget)
+				return err
+			}, func() error {
+				return UnAssignVips(s.clients.Get(nic.RangId), nic.RangId, nic.NetWorkInterfaceId, []string{vip}, nil)
+			}); err != nil {
+				plan.Fail(s.states, err, requestid)
+				return
+			}
+			if s.router != nil {
+				budget.Enter(PhasePlumb)
+				if err := plan.Step("policyrouting", func() error {
+					return s.router.Install(vip)
+				}, func() error {
+					s.router.Remove(vip)
+					return nil
+				}); err != nil {
+					plan.Fail(s.states, err, requestid)
+					return
+				}
+			}
+			//期间vip已被释放或有新的绑定任务时epoch失效，回滚本次绑定，状态由新的epoch决定
+			budget.Enter(PhaseFence)
+			if plan.Step("fence", func() error { return s.states.Fresh(vip, requestid, epoch) }, nil) != nil {
+				return
+			}
+			//注销不在回滚范围内，绑定失败时vip可能不在任何网卡上，记录保留到重启后处理
+			DefaultDetachJournal.Complete(vip, "bound on "+nic.NetWorkInterfaceId)
+			go DefaultIpam.Record(vip)
+			//校验、免费arp为可选步骤，失败时vip标记为Degraded
+			if budget.Allow("verify", verifyStepTime) {
+				budget.Enter(PhaseVerify)
+				if err := plan.Optional("verify", func() error {
+					if !IpExistsOnInterface(s.clients.Get(nic.RangId), nic.RangId, nic.NetWorkInterfaceId, vip) {
+						return errors.New("vip not found on " + nic.NetWorkInterfaceId)
+					}
+					return nil
+				}); err != nil {
+					s.states.Degrade(vip, err.Error())
+				}
+			}
+			//校验失败时云上绑定未确认，不发送免费arp
+			if s.states.State(vip) == StateBound && budget.Allow("garp", time.Second) {
+				budget.Enter(PhaseAnnounce)
+				if err := plan.Optional("garp", func() error { return s.announce(vip) }); err != nil {
+					s.states.Degrade(vip, err.Error())
+				}
+			}
+		})
+	}
+
+	log.Println("networkinterfacevips", networkinterfacevips)
+}
+
+//同一网卡上各vip的注册或注销经过任务池的批处理阶段合并为一次请求，op为assign或unassign
+func (s *SecondaryIpProvider) batch(op string, nf JdNetworkInterface, vip string, budget *Budget) (string, error) {
+	api := s.clients.Get(nf.RangId)
+	return s.pool.Batch(op+" "+nf.RangId+"/"+nf.NetWorkInterfaceId, vip, budget, func(vips []string, policy RetryPolicy) (string, error) {
+		if op == "assign" {
+			return assignVips(api, nf.RangId, nf.NetWorkInterfaceId, vips, policy)
+		}
+		return unassignVips(api, nf.RangId, nf.NetWorkInterfaceId, vips, policy)
+	})
+}
+
+//重启后处理注销记录：vip已绑定在某个网卡上时记录已无意义，未绑定且vip在本机时由reconcile绑定到本机，否则重新绑定到原网卡
+func (s *SecondaryIpProvider) RecoverDetach(intent DetachIntent, vipsonlocal []string) (string, error) {
+	current := s.describeVips()
+	//部分region查询失败时无法确认vip未绑定，不重新绑定
+	for region, err := range current.failed {
+		return "", errors.New("describe network interfaces in " + region + ": " + err.Error())
+	}
+	for nf, vips := range current.vips {
+		if ok, _ := Contain(intent.Vip, vips); ok {
+			return "already bound on " + nf.NetWorkInterfaceId, nil
+		}
+	}
+	if ok, _ := Contain(intent.Vip, vipsonlocal); ok {
+		return "", nil
+	}
+	log.Println("vip", intent.Vip, "was unassigned from", intent.From, "but never assigned, it is not on this node, assigning it back")
+	if _, err := AssignVips(s.clients.Get(intent.Region), intent.Region, intent.From, []string{intent.Vip}, nil); err != nil {
+		return "", err
+	}
+	return "assigned back to " + intent.From, nil
+}
+
+//发送免费arp前断言vip的云上绑定已确认
+func (s *SecondaryIpProvider) announce(vip string) error {
+	if state := s.states.State(vip); !DefaultSafety.Assert(InvariantGarpWithoutBinding, vip, state == StateBound || state == StateOffline, "vip is "+string(state)) {
+		return NewSafetyHaltError("garp for " + vip + " refused")
+	}
+	return s.announcer.Announce(vip)
+}
+
+//本机各网卡以外仍持有vip的网卡，直接查询云上状态
+func (s *SecondaryIpProvider) otherHolders(vip string) ([]string, error) {
+	byregion := map[string][]string{}
+	for _, nf := range s.parameter.Allnetworkinterfaces {
+		if s.isLocal(nf) {
+			continue
+		}
+		byregion[nf.RangId] = append(byregion[nf.RangId], nf.NetWorkInterfaceId)
+	}
+	holders := []string{}
+	for region, ids := range byregion {
+		result, err := s.clients.Get(region).DescribeNetworkInterfacesIps(region, ids)
+		if err != nil {
+			return nil, err
+		}
+		for id, ips := range result {
+			if ok, _ := Contain(vip, ips); ok {
+				holders = append(holders, region+"/"+id)
+			}
+		}
+	}
+	sort.Strings(holders)
+	return holders, nil
+}
+
+//期望状态与云上实际状态的差异，不做任何修改
+func (s *SecondaryIpProvider) Diff(vipsonlocal []string) []string {
+	local := s.parameter.Localnetworkinterface
+	localname := local.RangId + "/" + local.NetWorkInterfaceId
+	networkinterfacevips := s.networkInterfaceVips()
+	lines := []string{}
+	for _, nf := range s.parameter.Allnetworkinterfaces {
+		if _, ok := networkinterfacevips[JdNetworkInterface{RangId: nf.RangId, NetWorkInterfaceId: nf.NetWorkInterfaceId}]; !ok {
+			lines = append(lines, "! state of "+nf.RangId+"/"+nf.NetWorkInterfaceId+" unknown, actual holders may be incomplete")
+		}
+	}
+	if len(lines) > 0 {
+		lines = append(lines, "")
+	}
+	for _, vip := range s.parameter.VipIps() {
+		holders := []string{}
+		for k, v := range networkinterfacevips {
+			if ok, _ := Contain(vip, v); ok {
+				holders = append(holders, k.RangId+"/"+k.NetWorkInterfaceId)
+			}
+		}
+		sort.Strings(holders)
+		actual := strings.Join(holders, ",")
+		if actual == "" {
+			actual = "<none>"
+		}
+		lines = append(lines, "vip "+vip)
+		if ok, _ := Contain(vip, vipsonlocal); !ok {
+			lines = append(lines, "    desired: not held by this node", "    actual:  "+actual, "")
+			continue
+		}
+		//已绑定在某个本机网卡上时保留该绑定
+		desired := localname
+		if placement := s.placements(networkinterfacevips, []string{vip})[0]; placement.onlocal {
+			desired = placement.nic.RangId + "/" + placement.nic.NetWorkInterfaceId
+		}
+		lines = append(lines, "    desired: "+desired, "    actual:  "+actual)
+		for _, h := range holders {
+			if h != desired {
+				lines = append(lines, "  - unassign from "+h)
+			}
+		}
+		if ok, _ := Contain(desired, holders); !ok {
+			lines = append(lines, "  + assign to "+desired)
+		}
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+//vip当前状态
+func (s *SecondaryIpProvider) VipState(vip string) VipState {
+	return s.states.State(vip)
+}
+
+func localInterfaceNames(nfs []JdNetworkInterface) string {
+	names := []string{}
+	for _, nf := range nfs {
+		names = append(names, nf.NetWorkInterfaceId)
+	}
+	return strings.Join(names, ",")
+}
@@ -0,0 +1,231 @@
+package common
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//sidecar自身依赖的检查项
+const (
+	SelfCheckCloudApi    string = "cloudapi"
+	SelfCheckCredentials string = "credentials"
+	SelfCheckClock       string = "clock"
+	SelfCheckNetlink     string = "netlink"
+	SelfCheckHeartbeat   string = "heartbeat"
+	SelfCheckConfig      string = "config"
+)
+
+//检查项状态，unknown为尚未上报，stale为超过maxage没有上报
+const (
+	SelfCheckOk      string = "ok"
+	SelfCheckFailing string = "failing"
+	SelfCheckUnknown string = "unknown"
+	SelfCheckStale   string = "stale"
+	//failing但原因已知且不影响已持有的vip，不计入整体健康
+	SelfCheckDegraded string = "degraded"
+)
+
+//单个检查项的结果，age为距上次上报的秒数
+type SelfCheckResult struct {
+	Status    string     `json:"status"`
+	Message   string     `json:"message,omitempty"`
+	UpdatedAt *time.Time `json:"updatedAt,omitempty"`
+	Age       float64    `json:"ageSeconds"`
+}
+
+//由各组件上报的自身健康检查，/healthz返回所有检查项，任一failing或stale时返回503
+type SelfChecks struct {
+	mutex   sync.Mutex
+	results map[string]*SelfCheckResult
+	maxage  map[string]time.Duration
+	//检查项failing时按degraded报告的原因
+	tolerated map[string]string
+}
+
+var DefaultSelfChecks = &SelfChecks{results: make(map[string]*SelfCheckResult), maxage: make(map[string]time.Duration), tolerated: make(map[string]string)}
+
+//声明检查项，maxage大于0时超过maxage没有上报视为stale
+func (s *SelfChecks) Expect(name string, maxage time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.results[name]; !ok {
+		s.results[name] = &SelfCheckResult{Status: SelfCheckUnknown}
+	}
+	s.maxage[name] = maxage
+}
+
+//上报检查结果，err为nil表示正常
+func (s *SelfChecks) Report(name string, err error) {
+	now := time.Now()
+	result := &SelfCheckResult{Status: SelfCheckOk, UpdatedAt: &now}
+	if err != nil {
+		result.Status, result.Message = SelfCheckFailing, err.Error()
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.results[name] = result
+}
+
+//reason不为空时检查项failing按degraded报告，为空时取消
+func (s *SelfChecks) Tolerate(name string, reason string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if reason == "" {
+		delete(s.tolerated, name)
+		return
+	}
+	s.tolerated[name] = reason
+}
+
+//当前所有检查项及整体是否健康
+func (s *SelfChecks) Results() (map[string]SelfCheckResult, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	results := map[string]SelfCheckResult{}
+	healthy := true
+	for name, r := range s.results {
+		result := *r
+		if r.UpdatedAt != nil {
+			result.Age = time.Since(*r.UpdatedAt).Seconds()
+			if maxage := s.maxage[name]; maxage > 0 && time.Since(*r.UpdatedAt) > maxage {
+				result.Status = SelfCheckStale
+			}
+		}
+		if reason := s.tolerated[name]; reason != "" && result.Status == SelfCheckFailing {
+			result.Status, result.Message = SelfCheckDegraded, result.Message+" ("+reason+")"
+		}
+		if result.Status == SelfCheckFailing || result.Status == SelfCheckStale {
+			healthy = false
+		}
+		results[name] = result
+	}
+	return results, healthy
+}
+
+func (s *SelfChecks) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	results, healthy := s.Results()
+	status := SelfCheckOk
+	if !healthy {
+		status = SelfCheckFailing
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if !healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(struct {
+		Status string                     `json:"status"`
+		Checks map[string]SelfCheckResult `json:"checks"`
+	}{status, results})
+}
+
+//记录云上接口调用结果及耗时的VpcApi：网络不可达及服务端错误时cloudapi为failing，认证失败时credentials为failing
+type selfCheckVpcApi struct {
+	VpcApi
+}
+
+func (s selfCheckVpcApi) report(err error, latency time.Duration) {
+	DefaultBackpressure.Observe(err, latency)
+	switch ReasonOf(err) {
+	case "":
+		DefaultSelfChecks.Report(SelfCheckCloudApi, nil)
+		DefaultSelfChecks.Report(SelfCheckCredentials, nil)
+	case ReasonUnavailable, ReasonServerError:
+		DefaultSelfChecks.Report(SelfCheckCloudApi, err)
+	case ReasonAuthExpired, ReasonForbidden:
+		DefaultSelfChecks.Report(SelfCheckCloudApi, nil)
+		DefaultSelfChecks.Report(SelfCheckCredentials, err)
+	default:
+		DefaultSelfChecks.Report(SelfCheckCloudApi, nil)
+	}
+}
+
+func (s selfCheckVpcApi) DescribeNetworkInterfacesIps(regionId string, networkInterfaceIds []string) (map[string][]string, error) {
+	start := time.Now()
+	ips, err := s.VpcApi.DescribeNetworkInterfacesIps(regionId, networkInterfaceIds)
+	s.report(err, time.Since(start))
+	return ips, err
+}
+
+func (s selfCheckVpcApi) AssignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	start := time.Now()
+	requestid, err := s.VpcApi.AssignSecondaryIps(regionId, networkInterfaceId, ips)
+	s.report(err, time.Since(start))
+	return requestid, err
+}
+
+func (s selfCheckVpcApi) UnassignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	start := time.Now()
+	requestid, err := s.VpcApi.UnassignSecondaryIps(regionId, networkInterfaceId, ips)
+	s.report(err, time.Since(start))
+	return requestid, err
+}
+
+func (s selfCheckVpcApi) DescribeDnatRule(regionId string, natGatewayId string, dnatRuleId string) (*DnatRule, error) {
+	start := time.Now()
+	rule, err := s.VpcApi.DescribeDnatRule(regionId, natGatewayId, dnatRuleId)
+	s.report(err, time.Since(start))
+	return rule, err
+}
+
+func (s selfCheckVpcApi) ModifyDnatRule(regionId string, natGatewayId string, dnatRuleId string, internalIp string) (string, error) {
+	start := time.Now()
+	requestid, err := s.VpcApi.ModifyDnatRule(regionId, natGatewayId, dnatRuleId, internalIp)
+	s.report(err, time.Since(start))
+	return requestid, err
+}
+
+func (s selfCheckVpcApi) DescribeNetworkInterface(regionId string, networkInterfaceId string) (*NetworkInterface, error) {
+	start := time.Now()
+	networkinterface, err := s.VpcApi.DescribeNetworkInterface(regionId, networkInterfaceId)
+	s.report(err, time.Since(start))
+	return networkinterface, err
+}
+
+func (s selfCheckVpcApi) DescribeNetworkInterfaces(regionId string, networkInterfaceIds []string) (map[string]*NetworkInterface, error) {
+	start := time.Now()
+	networkinterfaces, err := s.VpcApi.DescribeNetworkInterfaces(regionId, networkInterfaceIds)
+	s.report(err, time.Since(start))
+	return networkinterfaces, err
+}
+
+func (s selfCheckVpcApi) AttachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	start := time.Now()
+	requestid, err := s.VpcApi.AttachNetworkInterface(regionId, instanceId, networkInterfaceId)
+	s.report(err, time.Since(start))
+	return requestid, err
+}
+
+func (s selfCheckVpcApi) DetachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	start := time.Now()
+	requestid, err := s.VpcApi.DetachNetworkInterface(regionId, instanceId, networkInterfaceId)
+	s.report(err, time.Since(start))
+	return requestid, err
+}
+
+//定期检查配置文件是否在启动后被修改，修改后需要重启才能生效
+func WatchConfigFreshness(path string, interval time.Duration) {
+	DefaultSelfChecks.Expect(SelfCheckConfig, 3*interval)
+	loaded, err := fileDigest(path)
+	DefaultSelfChecks.Report(SelfCheckConfig, err)
+	for {
+		time.Sleep(interval)
+		current, err := fileDigest(path)
+		if err == nil && current != loaded {
+			err = errors.New("config file " + path + " changed since it was loaded, restart to apply")
+		}
+		DefaultSelfChecks.Report(SelfCheckConfig, err)
+	}
+}
+
+func fileDigest(path string) ([32]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return [32]byte{}, err
+	}
+	return sha256.Sum256(data), nil
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+//退出时需要执行的清理，按注册的逆序执行
+var (
+	shutdownmutex sync.Mutex
+	shutdownhooks []shutdownHook
+)
+
+type shutdownHook struct {
+	name string
+	fn   func()
+}
+
+func RegisterShutdownHook(name string, fn func()) {
+	shutdownmutex.Lock()
+	defer shutdownmutex.Unlock()
+	shutdownhooks = append(shutdownhooks, shutdownHook{name: name, fn: fn})
+}
+
+//执行全部清理，只执行一次
+func RunShutdownHooks() {
+	shutdownmutex.Lock()
+	hooks := shutdownhooks
+	shutdownhooks = nil
+	shutdownmutex.Unlock()
+	for i := len(hooks) - 1; i >= 0; i-- {
+		log.Println("shutdown", hooks[i].name)
+		hooks[i].fn()
+	}
+}
+
+//收到SIGTERM/SIGINT时执行清理后退出
+func HandleShutdownSignals() {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGTERM, syscall.SIGINT)
+	go func() {
+		sig := <-ch
+		Exit(ExitOk, errors.New("received "+sig.String()))
+	}()
+}
@@ -0,0 +1,131 @@
+package common
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	SignerJdcloud2 string = "jdcloud2"
+)
+
+//请求签名算法，按endpoint(region)通过配置选择
+type Signer interface {
+	Name() string
+	Sign(req *http.Request, body []byte, service string, regionId string, accessKey string, secretKey string, signtime time.Time)
+}
+
+var (
+	signersmutex sync.Mutex
+	signers      = make(map[string]Signer)
+)
+
+func init() {
+	RegisterSigner(jdcloud2Signer{})
+}
+
+//注册签名算法，新的签名算法实现Signer后在init中注册
+func RegisterSigner(s Signer) {
+	signersmutex.Lock()
+	defer signersmutex.Unlock()
+	signers[s.Name()] = s
+}
+
+//按名称获取签名算法，名称为空时使用jdcloud2
+func GetSigner(name string) (Signer, error) {
+	if name == "" {
+		name = SignerJdcloud2
+	}
+	signersmutex.Lock()
+	defer signersmutex.Unlock()
+	s, ok := signers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown signer %q", name)
+	}
+	return s, nil
+}
+
+//JDCLOUD2-HMAC-SHA256签名，与sdk core/Signer.go算法一致
+type jdcloud2Signer struct{}
+
+func (s jdcloud2Signer) Name() string {
+	return SignerJdcloud2
+}
+
+func (s jdcloud2Signer) Sign(req *http.Request, body []byte, service string, regionId string, accessKey string, secretKey string, signtime time.Time) {
+	if regionId == "" {
+		regionId = "jdcloud-api"
+	}
+	formattedtime := signtime.UTC().Format("20060102T150405Z")
+	formattedshorttime := signtime.UTC().Format("20060102")
+	req.Header.Set("x-jdcloud-date", formattedtime)
+	//已指定nonce时保留，便于用固定向量校验签名结果
+	if req.Header.Get("x-jdcloud-nonce") == "" {
+		nonce := make([]byte, 16)
+		rand.Read(nonce)
+		req.Header.Set("x-jdcloud-nonce", hex.EncodeToString(nonce))
+	}
+
+	headers := []string{"host"}
+	values := map[string]string{"host": req.URL.Host}
+	for k, v := range req.Header {
+		canonicalkey := http.CanonicalHeaderKey(k)
+		if canonicalkey == "Authorization" || canonicalkey == "User-Agent" || canonicalkey == "X-Jdcloud-Request-Id" {
+			continue
+		}
+		lowerkey := strings.ToLower(k)
+		headers = append(headers, lowerkey)
+		values[lowerkey] = strings.Join(v, ",")
+	}
+	sort.Strings(headers)
+	canonicalheaders := []string{}
+	for _, k := range headers {
+		canonicalheaders = append(canonicalheaders, k+":"+strings.Join(strings.Fields(values[k]), " "))
+	}
+	signedheaders := strings.Join(headers, ";")
+
+	uri := req.URL.EscapedPath()
+	if uri == "" {
+		uri = "/"
+	}
+	bodydigest := sha256.Sum256(body)
+	canonicalstring := strings.Join([]string{
+		req.Method,
+		uri,
+		req.URL.RawQuery,
+		strings.Join(canonicalheaders, "\n") + "\n",
+		signedheaders,
+		hex.EncodeToString(bodydigest[:]),
+	}, "\n")
+
+	credentialstring := strings.Join([]string{formattedshorttime, regionId, service, "jdcloud2_request"}, "/")
+	canonicaldigest := sha256.Sum256([]byte(canonicalstring))
+	stringtosign := strings.Join([]string{
+		"JDCLOUD2-HMAC-SHA256",
+		formattedtime,
+		credentialstring,
+		hex.EncodeToString(canonicaldigest[:]),
+	}, "\n")
+
+	key := signHmac([]byte("JDCLOUD2"+secretKey), []byte(formattedshorttime))
+	key = signHmac(key, []byte(regionId))
+	key = signHmac(key, []byte(service))
+	key = signHmac(key, []byte("jdcloud2_request"))
+	signature := hex.EncodeToString(signHmac(key, []byte(stringtosign)))
+
+	req.Header.Set("Authorization", "JDCLOUD2-HMAC-SHA256 Credential="+accessKey+"/"+credentialstring+", SignedHeaders="+signedheaders+", Signature="+signature)
+}
+
+func signHmac(key []byte, data []byte) []byte {
+	hash := hmac.New(sha256.New, key)
+	hash.Write(data)
+	return hash.Sum(nil)
+}
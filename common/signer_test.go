@@ -0,0 +1,58 @@
+package common
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+//固定nonce、时间、请求体及凭证的签名向量，期望值由独立实现计算
+func TestSignerGoldenVectors(t *testing.T) {
+	signtime := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	body := []byte(`{"secondaryIps":["10.0.0.5"]}`)
+	cases := []struct {
+		signer        string
+		authorization string
+		headers       map[string]string
+	}{
+		{
+			signer:        SignerJdcloud2,
+			authorization: "JDCLOUD2-HMAC-SHA256 Credential=AKTESTEXAMPLE0001/20260102/cn-north-1/vpc/jdcloud2_request, SignedHeaders=content-type;host;x-forwarded-for;x-jdcloud-date;x-jdcloud-nonce, Signature=850fb235ace98a94f8f8b46b1204fc5ac38d581f79607b297abc78bc6d7d99e0",
+			headers:       map[string]string{"X-Jdcloud-Date": "20260102T030405Z"},
+		},
+	}
+	for _, c := range cases {
+		signer, err := GetSigner(c.signer)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "https://vpc.jdcloud-api.com/v1/regions/cn-north-1/networkInterfaces/port-abc:assignSecondaryIps?b=2&a=x%20y", strings.NewReader(string(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "vipsidecar")
+		req.Header.Set("X-Forwarded-For", "10.1.1.1")
+		req.Header.Set("x-jdcloud-nonce", "0123456789abcdef0123456789abcdef")
+		signer.Sign(req, body, "vpc", "cn-north-1", "AKTESTEXAMPLE0001", "SKTESTEXAMPLESECRET0001", signtime)
+		if got := req.Header.Get("Authorization"); got != c.authorization {
+			t.Errorf("%s Authorization\n got: %s\nwant: %s", c.signer, got, c.authorization)
+		}
+		for k, v := range c.headers {
+			if got := req.Header.Get(k); got != v {
+				t.Errorf("%s %s = %q, want %q", c.signer, k, got, v)
+			}
+		}
+	}
+}
+
+//未指定签名算法时使用jdcloud2，未知名称返回错误
+func TestGetSigner(t *testing.T) {
+	if s, err := GetSigner(""); err != nil || s.Name() != SignerJdcloud2 {
+		t.Errorf("GetSigner(\"\") = %v, %v", s, err)
+	}
+	if _, err := GetSigner("jdcloud9"); err == nil {
+		t.Error("GetSigner(\"jdcloud9\") should fail")
+	}
+}
@@ -0,0 +1,177 @@
+package common
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+//burn rate告警窗口及阈值，1h窗口超过14.4表示约2天耗尽30天的错误预算，6h超过6表示约5天耗尽
+var sloAlertWindows = []struct {
+	window    time.Duration
+	name      string
+	threshold float64
+}{
+	{time.Hour, "1h", 14.4},
+	{6 * time.Hour, "6h", 6},
+	{3 * 24 * time.Hour, "3d", 1},
+}
+
+//故障转移SLI：从检测到故障(触发reconcile的事件到达)到vip在本机绑定完成的耗时，不超过threshold为good
+//接管失败按bad计，启动时接管已有绑定不计入
+type SloTracker struct {
+	mutex     sync.Mutex
+	config    JdSlo
+	events    []sloEvent
+	alertedAt map[string]time.Time
+	client    *http.Client
+}
+
+type sloEvent struct {
+	time time.Time
+	good bool
+}
+
+//SLO当前状态，通过/v1/status暴露
+type SloStatus struct {
+	Target          float64            `json:"target"`
+	Threshold       float64            `json:"thresholdSeconds"`
+	Good            int                `json:"good"`
+	Bad             int                `json:"bad"`
+	BudgetRemaining float64            `json:"errorBudgetRemaining"`
+	BurnRates       map[string]float64 `json:"burnRates"`
+}
+
+var DefaultSlo = &SloTracker{alertedAt: make(map[string]time.Time), client: &http.Client{Timeout: 10 * time.Second}}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_failover_sli_seconds", MetricGauge, "Time from failure detection to the VIP being bound on this node for the last failover.")
+	DefaultMetrics.Register("vipsidecar_slo_events_total", MetricCounter, "Failovers counted against the SLO, result=good or bad.")
+	DefaultMetrics.Register("vipsidecar_slo_burn_rate", MetricGauge, "Error budget burn rate over the window, 1 consumes the budget exactly over the SLO window.")
+	DefaultMetrics.Register("vipsidecar_slo_error_budget_remaining", MetricGauge, "Fraction of the error budget left in the SLO window.")
+}
+
+//target为0时关闭，threshold未配置时使用failoverbudget
+func (s *SloTracker) Load(config JdSlo, failoverbudget int) error {
+	if config.Target == 0 {
+		return nil
+	}
+	if config.Target <= 0 || config.Target >= 1 {
+		return errors.New("slo.target must be between 0 and 1, e.g. 0.99")
+	}
+	if config.Threshold <= 0 {
+		config.Threshold = failoverbudget
+	}
+	if config.Threshold <= 0 {
+		return errors.New("slo.threshold must be set when failoverbudget is not")
+	}
+	if config.Window <= 0 {
+		config.Window = 30
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.config = config
+	go s.run()
+	return nil
+}
+
+//记录一次结束的故障转移
+func (s *SloTracker) Record(r FailoverRecord) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.config.Target == 0 {
+		return
+	}
+	good := r.Result == FailoverSucceeded && r.Duration <= float64(s.config.Threshold)
+	if r.Result == FailoverSucceeded {
+		DefaultMetrics.Set("vipsidecar_failover_sli_seconds", map[string]string{"vip": r.Vip}, r.Duration)
+	}
+	result := "good"
+	if !good {
+		result = "bad"
+	}
+	DefaultMetrics.Add("vipsidecar_slo_events_total", map[string]string{"result": result}, 1)
+	s.events = append(s.events, sloEvent{time: time.Now(), good: good})
+	go s.Evaluate()
+}
+
+//window内bad占比与错误预算之比
+func (s *SloTracker) burnRate(now time.Time, window time.Duration) (float64, int, int) {
+	good, bad := 0, 0
+	for _, e := range s.events {
+		if now.Sub(e.time) > window {
+			continue
+		}
+		if e.good {
+			good++
+		} else {
+			bad++
+		}
+	}
+	if good+bad == 0 {
+		return 0, 0, 0
+	}
+	return float64(bad) / float64(good+bad) / (1 - s.config.Target), good, bad
+}
+
+//更新burn rate指标及status，超过阈值时告警，每个窗口每小时最多告警一次
+func (s *SloTracker) Evaluate() {
+	s.mutex.Lock()
+	now := time.Now()
+	slowindow := time.Duration(s.config.Window) * 24 * time.Hour
+	events := []sloEvent{}
+	for _, e := range s.events {
+		if now.Sub(e.time) <= slowindow {
+			events = append(events, e)
+		}
+	}
+	s.events = events
+	burn, good, bad := s.burnRate(now, slowindow)
+	status := &SloStatus{Target: s.config.Target, Threshold: float64(s.config.Threshold), Good: good, Bad: bad, BudgetRemaining: 1 - burn, BurnRates: map[string]float64{}}
+	DefaultMetrics.Set("vipsidecar_slo_error_budget_remaining", nil, 1-burn)
+	alerts := []map[string]interface{}{}
+	for _, w := range sloAlertWindows {
+		rate, _, _ := s.burnRate(now, w.window)
+		status.BurnRates[w.name] = rate
+		DefaultMetrics.Set("vipsidecar_slo_burn_rate", map[string]string{"window": w.name}, rate)
+		if rate <= w.threshold || now.Sub(s.alertedAt[w.name]) < time.Hour {
+			continue
+		}
+		s.alertedAt[w.name] = now
+		log.Println("ALERT failover slo burn rate", rate, "over", w.name, "exceeds", w.threshold)
+		alerts = append(alerts, map[string]interface{}{"window": w.name, "burnRate": rate, "threshold": w.threshold})
+	}
+	webhook := s.config.Webhook
+	s.mutex.Unlock()
+	DefaultStatus.SetSlo(status)
+	if webhook == "" {
+		return
+	}
+	hostname, _ := os.Hostname()
+	for _, alert := range alerts {
+		alert["time"], alert["holder"], alert["target"], alert["errorBudgetRemaining"] = now, hostname, status.Target, status.BudgetRemaining
+		body, _ := json.Marshal(alert)
+		resp, err := s.client.Post(webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("slo webhook", err)
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Println("slo webhook", resp.Status)
+		}
+	}
+}
+
+//没有新的故障转移时burn rate随时间下降，定期刷新
+func (s *SloTracker) run() {
+	for {
+		s.Evaluate()
+		time.Sleep(time.Minute)
+	}
+}
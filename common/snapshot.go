@@ -0,0 +1,75 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_snapshot_fetches_total", MetricCounter, "Bulk describe calls made to refresh a cloud state snapshot.")
+	DefaultMetrics.Register("vipsidecar_snapshot_hits_total", MetricCounter, "Reads of a cloud state snapshot served without calling the cloud API.")
+	DefaultMetrics.Register("vipsidecar_snapshot_age_seconds", MetricGauge, "Age of the cloud state snapshot when it was last read.")
+}
+
+//云上状态快照，由一次批量查询得到，maxage内的读取共享同一结果，同时发起的读取只查询一次
+//修改云上状态后调用Invalidate，下一次读取重新查询
+type CloudSnapshot struct {
+	mutex   sync.Mutex
+	name    string
+	fetch   func() (interface{}, error)
+	value   interface{}
+	taken   time.Time
+	pending chan struct{}
+	err     error
+	//每次Invalidate加一，查询期间发生变化时结果不缓存
+	generation uint64
+}
+
+func NewCloudSnapshot(name string, fetch func() (interface{}, error)) *CloudSnapshot {
+	return &CloudSnapshot{name: name, fetch: fetch}
+}
+
+//读取不超过maxage的快照，maxage为0时总是重新查询(仍与正在进行的查询合并)
+func (c *CloudSnapshot) Get(maxage time.Duration) (interface{}, error) {
+	labels := map[string]string{"snapshot": c.name}
+	c.mutex.Lock()
+	if c.pending == nil && !c.taken.IsZero() && time.Since(c.taken) <= maxage {
+		value, age := c.value, time.Since(c.taken)
+		c.mutex.Unlock()
+		DefaultMetrics.Add("vipsidecar_snapshot_hits_total", labels, 1)
+		DefaultMetrics.Set("vipsidecar_snapshot_age_seconds", labels, age.Seconds())
+		return value, nil
+	}
+	if pending := c.pending; pending != nil {
+		c.mutex.Unlock()
+		<-pending
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+		DefaultMetrics.Add("vipsidecar_snapshot_hits_total", labels, 1)
+		return c.value, c.err
+	}
+	pending, generation := make(chan struct{}), c.generation
+	c.pending = pending
+	c.mutex.Unlock()
+
+	DefaultMetrics.Add("vipsidecar_snapshot_fetches_total", labels, 1)
+	value, err := c.fetch()
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.value, c.err, c.pending = value, err, nil
+	//查询失败或查询期间云上状态被修改时不缓存，下一次读取重新查询
+	c.taken = time.Time{}
+	if err == nil && generation == c.generation {
+		c.taken = time.Now()
+	}
+	close(pending)
+	DefaultMetrics.Set("vipsidecar_snapshot_age_seconds", labels, 0)
+	return value, err
+}
+
+func (c *CloudSnapshot) Invalidate() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.taken = time.Time{}
+	c.generation++
+}
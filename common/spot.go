@@ -0,0 +1,93 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_spot_termination_notice", MetricGauge, "1 once the instance metadata reported that this spot instance is about to be reclaimed.")
+}
+
+//轮询实例元数据中的spot/抢占式实例回收通知，收到通知后立即通过handoff把vip交给对端并把本机标记为不可接管，
+//不必等到实例被回收后由对端经过完整的故障检测时间再接管
+type SpotWatcher struct {
+	config  JdSpot
+	handoff *Handoff
+	vips    []string
+	client  *http.Client
+	notice  string
+}
+
+func NewSpotWatcher(config JdSpot, handoff *Handoff, vips []string) (*SpotWatcher, error) {
+	if config.Url == "" {
+		return nil, errors.New("spot.url must be set when spot is enabled")
+	}
+	if len(config.Peers) == 0 {
+		return nil, errors.New("spot.peers must be set when spot is enabled")
+	}
+	if config.Interval <= 0 {
+		config.Interval = 5
+	}
+	return &SpotWatcher{config: config, handoff: handoff, vips: vips, client: &http.Client{Timeout: 2 * time.Second}}, nil
+}
+
+func (s *SpotWatcher) Run() {
+	for {
+		if err := s.Check(); err != nil {
+			log.Println("spot watch", err)
+		}
+		time.Sleep(time.Duration(s.config.Interval) * time.Second)
+	}
+}
+
+//回收通知不会撤销，收到后每次检查都把仍然Bound的vip交给对端，直到实例被回收
+func (s *SpotWatcher) Check() error {
+	if s.notice == "" {
+		notice, err := s.poll()
+		if err != nil || notice == "" {
+			return err
+		}
+		s.notice = notice
+		log.Println("ALERT spot termination notice", notice)
+		DefaultMetrics.Set("vipsidecar_spot_termination_notice", nil, 1)
+		DefaultEligibility.MarkIneligible("spot", "termination notice "+notice)
+	}
+	s.handoff.MoveOff(s.vips, s.config.Peers, "spot")
+	return nil
+}
+
+//404或空响应(以及false)表示没有通知，其它200响应的内容即为通知(通常为回收时间)
+func (s *SpotWatcher) poll() (string, error) {
+	req, err := http.NewRequest("GET", s.config.Url, nil)
+	if err != nil {
+		return "", err
+	}
+	for k, v := range s.config.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("get " + s.config.Url + ": " + resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	notice := strings.TrimSpace(string(body))
+	if strings.EqualFold(notice, "false") {
+		return "", nil
+	}
+	return notice, nil
+}
@@ -0,0 +1,49 @@
+package common
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+//启动时可并行预取云上状态的Provider
+type Discoverer interface {
+	Discover(ctx context.Context) error
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_startup_duration_seconds", MetricGauge, "Time from process start to the first completed reconcile.")
+}
+
+//启动阶段并行获取本机vip及云上状态，整体受timeout限制，返回本机vip
+func Discover(provider Provider, localvips func() []string, timeout time.Duration) []string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	vipsonlocal := []string{}
+	g, gctx := WithContext(ctx)
+	g.Go(func() error {
+		vipsonlocal = localvips()
+		return nil
+	})
+	if discoverer, ok := provider.(Discoverer); ok {
+		g.Go(func() error {
+			return discoverer.Discover(gctx)
+		})
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- g.Wait()
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			log.Println("startup discovery", err)
+		}
+	case <-ctx.Done():
+		log.Println("startup discovery exceeded", timeout)
+		return localvips()
+	}
+	return vipsonlocal
+}
@@ -0,0 +1,264 @@
+package common
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"sync"
+	"time"
+)
+
+//vip在本机的状态
+type VipState string
+
+const (
+	StatePending   VipState = "Pending"
+	StateAcquiring VipState = "Acquiring"
+	StateBound     VipState = "Bound"
+	StateDegraded  VipState = "Degraded"
+	//云上接口不可达，无法确认本机持有的vip的云上绑定，保留本机配置
+	StateOffline   VipState = "Offline"
+	StateReleasing VipState = "Releasing"
+	StateReleased  VipState = "Released"
+	StateFailed    VipState = "Failed"
+)
+
+var AllVipStates = []VipState{StatePending, StateAcquiring, StateBound, StateDegraded, StateOffline, StateReleasing, StateReleased, StateFailed}
+
+//允许的状态转换
+var vipTransitions = map[VipState][]VipState{
+	StatePending:   {StateAcquiring, StateBound, StateDegraded, StateFailed, StateReleasing},
+	StateAcquiring: {StateBound, StateDegraded, StateFailed, StateReleasing},
+	StateBound:     {StateDegraded, StateOffline, StateReleasing},
+	StateDegraded:  {StateAcquiring, StateBound, StateOffline, StateFailed, StateReleasing},
+	StateOffline:   {StateAcquiring, StateBound, StateDegraded, StateFailed, StateReleasing},
+	StateReleasing: {StateReleased, StateFailed},
+	StateReleased:  {StatePending, StateAcquiring, StateBound, StateDegraded, StateFailed},
+	StateFailed:    {StatePending, StateAcquiring, StateBound, StateReleasing},
+}
+
+//各状态的最长停留时间，超时转为Failed
+var vipStateTimeouts = map[VipState]time.Duration{
+	StateAcquiring: 2 * time.Minute,
+	StateReleasing: 2 * time.Minute,
+	StateDegraded:  10 * time.Minute,
+}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_vip_state", MetricGauge, "Current state of each VIP on this node, 1 for the active state.")
+	DefaultMetrics.Register("vipsidecar_binds_total", MetricCounter, "VIP bindings taken by this node, kind=adopt for existing bindings and kind=fresh for new ones.")
+}
+
+//单个vip的状态
+//epoch为fencing token，每次开始绑定或释放时递增，进行中的修改操作携带开始时的epoch，epoch变化后不再生效
+type VipStatus struct {
+	State  VipState  `json:"state"`
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason"`
+	Epoch  uint64    `json:"epoch"`
+	Seq    uint64    `json:"seq"`
+}
+
+//vip状态机，所有状态变化都经过Transition检查
+type VipStateMachine struct {
+	mutex     sync.Mutex
+	vips      map[string]*VipStatus
+	listeners []func(vip string, from VipState, to VipState)
+	observers []func(t Transition)
+}
+
+//注册状态变化回调，回调在状态机锁内同步执行，不能再调用状态机
+func (m *VipStateMachine) OnTransition(fn func(vip string, from VipState, to VipState)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.listeners = append(m.listeners, fn)
+}
+
+//注册接收完整状态转换(含epoch、原因及requestId)的回调，与OnTransition相同在状态机锁内同步执行
+func (m *VipStateMachine) Observe(fn func(t Transition)) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.observers = append(m.observers, fn)
+}
+
+func NewVipStateMachine() *VipStateMachine {
+	return &VipStateMachine{vips: make(map[string]*VipStatus)}
+}
+
+//当前状态，未记录的vip为Pending
+func (m *VipStateMachine) State(vip string) VipState {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if st, ok := m.vips[vip]; ok {
+		return st.State
+	}
+	return StatePending
+}
+
+//处于state的全部vip
+func (m *VipStateMachine) InState(state VipState) []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	vips := []string{}
+	for vip, st := range m.vips {
+		if st.State == state {
+			vips = append(vips, vip)
+		}
+	}
+	return vips
+}
+
+//状态转换，不允许的转换返回错误且状态不变
+func (m *VipStateMachine) Transition(vip string, to VipState, reason string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.transition(vip, to, reason, "")
+}
+
+//requestid为触发本次转换的云上请求，用于关联历史记录与京东云工单
+func (m *VipStateMachine) transition(vip string, to VipState, reason string, requestid string) error {
+	st, ok := m.vips[vip]
+	if !ok {
+		//从failoverlog及hookresults恢复上次的epoch及转换序号，重启后不会回退
+		epoch := DefaultFailoverLog.Epoch(vip)
+		if hooks := DefaultHookResults.Epoch(vip); hooks > epoch {
+			epoch = hooks
+		}
+		st = &VipStatus{State: StatePending, Since: time.Now(), Epoch: epoch, Seq: DefaultHookResults.Seq(vip)}
+		m.vips[vip] = st
+	}
+	if st.State == to {
+		return nil
+	}
+	allowed := false
+	for _, s := range vipTransitions[st.State] {
+		if s == to {
+			allowed = true
+		}
+	}
+	if !allowed {
+		err := fmt.Errorf("vip %s: transition %s -> %s not allowed", vip, st.State, to)
+		log.Println(err)
+		return err
+	}
+	if to == StateAcquiring || to == StateReleasing {
+		st.Epoch++
+	}
+	st.Seq++
+	log.Println("vip", vip, st.State, "->", to, reason, requestid, "epoch", st.Epoch, "seq", st.Seq)
+	t := Transition{Time: time.Now(), Vip: vip, From: st.State, To: to, Reason: reason, RequestId: requestid, Epoch: st.Epoch, Seq: st.Seq}
+	DefaultHistory.Add(t)
+	DefaultFailoverLog.Observe(t)
+	DefaultStatusWatch.Publish(StatusEvent{Type: "transition", Time: t.Time, Transition: &t})
+	from := st.State
+	st.State, st.Since, st.Reason = to, time.Now(), reason
+	for _, s := range AllVipStates {
+		value := 0.0
+		if s == to {
+			value = 1
+		}
+		DefaultMetrics.Set("vipsidecar_vip_state", map[string]string{"vip": vip, "state": string(s)}, value)
+	}
+	DefaultStatus.SetVipStatus(vip, *st)
+	for _, fn := range m.listeners {
+		fn(vip, from, to)
+	}
+	for _, fn := range m.observers {
+		fn(t)
+	}
+	return nil
+}
+
+//开始将vip绑定到本机，已绑定的vip在云上丢失绑定时先转为Degraded，返回本次绑定的epoch
+func (m *VipStateMachine) Acquire(vip string) uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if st, ok := m.vips[vip]; ok && st.State == StateBound {
+		m.transition(vip, StateDegraded, "binding lost", "")
+	}
+	m.transition(vip, StateAcquiring, "assigning to local", "")
+	return m.vips[vip].Epoch
+}
+
+//vip已正确绑定到本机，首次发现时接管，不再解绑重绑
+func (m *VipStateMachine) Adopt(vip string) {
+	m.bound(vip, "adopt", "")
+}
+
+//vip由本机新绑定，epoch为Acquire返回的值，期间vip已被释放或重新开始绑定时拒绝
+func (m *VipStateMachine) Fresh(vip string, requestid string, epoch uint64) error {
+	if err := m.Fence(vip, epoch)(); err != nil {
+		log.Println(err)
+		return err
+	}
+	m.bound(vip, "fresh", requestid)
+	return nil
+}
+
+//检查epoch是否仍为vip当前的epoch，用于拒绝已失效的绑定任务及其重试
+func (m *VipStateMachine) Fence(vip string, epoch uint64) func() error {
+	return func() error {
+		m.mutex.Lock()
+		defer m.mutex.Unlock()
+		if st, ok := m.vips[vip]; ok && st.Epoch != epoch {
+			return NewStaleEpochError("vip " + vip + " epoch " + strconv.FormatUint(epoch, 10) + " superseded by " + strconv.FormatUint(st.Epoch, 10))
+		}
+		return nil
+	}
+}
+
+func (m *VipStateMachine) bound(vip string, kind string, requestid string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if st, ok := m.vips[vip]; ok && st.State == StateBound {
+		return
+	}
+	if m.transition(vip, StateBound, kind, requestid) == nil {
+		DefaultMetrics.Add("vipsidecar_binds_total", map[string]string{"vip": vip, "kind": kind}, 1)
+	}
+}
+
+//vip在本机但云上绑定不完整(残留绑定或被其他网卡抢占)
+func (m *VipStateMachine) Degrade(vip string, reason string) {
+	m.Transition(vip, StateDegraded, reason)
+}
+
+//云上接口不可达时本机持有(Bound、Degraded)的vip转为Offline，Offline不超时，返回vip是否由本机持有
+func (m *VipStateMachine) Offline(vip string, reason string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	st, ok := m.vips[vip]
+	if !ok {
+		return false
+	}
+	switch st.State {
+	case StateOffline:
+		return true
+	case StateBound, StateDegraded:
+		return m.transition(vip, StateOffline, reason, "") == nil
+	}
+	return false
+}
+
+func (m *VipStateMachine) Fail(vip string, reason string, requestid string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.transition(vip, StateFailed, reason, requestid)
+}
+
+//不再由本机持有的vip经Releasing转为Released，并检查各状态超时
+func (m *VipStateMachine) Sync(vipsonlocal []string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	for vip, st := range m.vips {
+		if ok, _ := Contain(vip, vipsonlocal); !ok && st.State != StateReleased {
+			if m.transition(vip, StateReleasing, "vip removed from local interface", "") == nil {
+				m.transition(vip, StateReleased, "released", "")
+			}
+			continue
+		}
+		if timeout, ok := vipStateTimeouts[st.State]; ok && time.Since(st.Since) > timeout {
+			m.transition(vip, StateFailed, "timeout in "+string(st.State), "")
+		}
+	}
+}
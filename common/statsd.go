@@ -0,0 +1,116 @@
+package common
+
+import (
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//指标输出方式
+const (
+	MetricsBackendPrometheus string = "prometheus"
+	MetricsBackendStatsd     string = "statsd"
+)
+
+//单个udp包的最大长度，避免超过常见MTU被分片
+const statsdMaxPacket = 1432
+
+//定期将指标发送到statsd，gauge直接发送当前值，counter发送距上次发送的增量
+//dogstatsd为true时标签使用#k:v扩展，否则按标签名排序后将标签值拼接到指标名
+type StatsdEmitter struct {
+	config JdStatsd
+	conn   net.Conn
+	last   map[string]float64
+}
+
+func NewStatsdEmitter(config JdStatsd) (*StatsdEmitter, error) {
+	if config.Address == "" {
+		return nil, errors.New("metrics.statsd.address must be set when metrics.backend is statsd")
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10
+	}
+	conn, err := net.Dial("udp", config.Address)
+	if err != nil {
+		return nil, err
+	}
+	return &StatsdEmitter{config: config, conn: conn, last: make(map[string]float64)}, nil
+}
+
+func (s *StatsdEmitter) Run() {
+	for {
+		time.Sleep(time.Duration(s.config.Interval) * time.Second)
+		s.Flush()
+	}
+}
+
+func (s *StatsdEmitter) Flush() {
+	packet := []byte{}
+	for _, sample := range DefaultMetrics.Samples() {
+		line := s.line(sample)
+		if line == "" {
+			continue
+		}
+		if len(packet) > 0 && len(packet)+1+len(line) > statsdMaxPacket {
+			s.send(packet)
+			packet = packet[:0]
+		}
+		if len(packet) > 0 {
+			packet = append(packet, '\n')
+		}
+		packet = append(packet, line...)
+	}
+	if len(packet) > 0 {
+		s.send(packet)
+	}
+}
+
+func (s *StatsdEmitter) send(packet []byte) {
+	if _, err := s.conn.Write(packet); err != nil {
+		log.Println("statsd send failed", err)
+	}
+}
+
+func (s *StatsdEmitter) line(sample MetricSample) string {
+	names := []string{}
+	for k := range sample.Labels {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	name := s.config.Prefix + sample.Name
+	tags := append([]string{}, s.config.Tags...)
+	for _, k := range names {
+		if s.config.DogStatsd {
+			tags = append(tags, k+":"+statsdEscape(sample.Labels[k], false))
+		} else {
+			name += "." + statsdEscape(sample.Labels[k], true)
+		}
+	}
+	value, metrictype := sample.Value, "g"
+	if sample.Type == MetricCounter {
+		key := formatLabels(sample.Labels)
+		value, s.last[sample.Name+key] = sample.Value-s.last[sample.Name+key], sample.Value
+		if value == 0 {
+			return ""
+		}
+		metrictype = "c"
+	}
+	line := name + ":" + strconv.FormatFloat(value, 'f', -1, 64) + "|" + metrictype
+	if s.config.DogStatsd && len(tags) > 0 {
+		line += "|#" + strings.Join(tags, ",")
+	}
+	return line
+}
+
+//statsd协议中:|@#及逗号有特殊含义，拼接到指标名时点号为层级分隔符
+func statsdEscape(v string, name bool) string {
+	v = strings.NewReplacer(":", "_", "|", "_", "@", "_", "#", "_", ",", "_", " ", "_").Replace(v)
+	if name {
+		v = strings.Replace(v, ".", "_", -1)
+	}
+	return v
+}
@@ -0,0 +1,252 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//最近一次云上接口错误
+type LastError struct {
+	Time      time.Time `json:"time"`
+	Operation string    `json:"operation"`
+	Message   string    `json:"message"`
+	Reason    string    `json:"reason"`
+	RequestId string    `json:"requestId,omitempty"`
+}
+
+//vip与集群中其他对象的冲突
+type VipConflict struct {
+	Vip       string `json:"vip"`
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Field     string `json:"field"`
+	Reason    string `json:"reason"`
+}
+
+func (c VipConflict) Object() string {
+	if c.Namespace != "" {
+		return c.Kind + " " + c.Namespace + "/" + c.Name
+	}
+	return c.Kind + " " + c.Name
+}
+
+func (c VipConflict) String() string {
+	return c.Vip + " " + c.Reason + ": " + c.Object() + " " + c.Field
+}
+
+//sidecar运行状态，通过/status以json格式暴露
+type Status struct {
+	mutex sync.Mutex
+	Mode  string `json:"mode"`
+	//编译进当前二进制的子系统
+	Features  []string             `json:"features"`
+	LocalVips []string             `json:"localVips"`
+	Vips      map[string]VipStatus `json:"vips"`
+	LastError *LastError           `json:"lastError,omitempty"`
+	ClockSkew *ClockSkewCondition  `json:"clockSkew,omitempty"`
+	//配置了备用凭证时当前使用的凭证
+	Credentials string `json:"credentials,omitempty"`
+	//最近一次超出预算的故障转移
+	LastBudgetOverrun *BudgetOverrun `json:"lastBudgetOverrun,omitempty"`
+	//最近一次被时间计划阻止的自动故障转移
+	LastSuppressedFailover *SuppressedFailover `json:"lastSuppressedFailover,omitempty"`
+	//因频繁移动处于hold-down的vip及结束时间
+	HoldDown map[string]time.Time `json:"holdDown,omitempty"`
+	//各具名健康检查的结果
+	HealthChecks map[string]bool `json:"healthChecks,omitempty"`
+	//故障转移SLO及错误预算消耗
+	Slo *SloStatus `json:"slo,omitempty"`
+	//kubernetes节点已cordon，vip正在迁出
+	Draining bool `json:"draining,omitempty"`
+	//本机不再接管vip的原因，按来源区分
+	Ineligible map[string]string `json:"ineligible,omitempty"`
+	//尚未结束的计划内维护事件
+	Maintenance []MaintenanceEvent `json:"maintenance,omitempty"`
+	//上次集群扫描发现的vip冲突
+	Conflicts []VipConflict `json:"conflicts,omitempty"`
+	//各region云上接口endpoint的探测结果
+	CloudApi map[string]EndpointProbe `json:"cloudApi,omitempty"`
+	//运行时特性开关及来源
+	FeatureFlags map[string]FeatureFlag `json:"featureFlags,omitempty"`
+	//第一个被违反的安全不变式，存在时所有修改类操作已停止
+	SafetyViolation *SafetyViolation `json:"safetyViolation,omitempty"`
+	//各hook在各vip上最近一次执行的结果
+	Hooks map[string]map[string]HookResult `json:"hooks,omitempty"`
+	//dr模式最近一次启用备vip的结果
+	DrActivation *DrActivation `json:"drActivation,omitempty"`
+}
+
+var DefaultStatus = &Status{}
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_api_errors_total", MetricCounter, "Cloud API calls that returned an error.")
+}
+
+//记录云上接口错误
+func (s *Status) RecordError(operation string, err error) {
+	s.mutex.Lock()
+	s.LastError = &LastError{
+		Time:      time.Now(),
+		Operation: operation,
+		Message:   err.Error(),
+		Reason:    ReasonOf(err),
+		RequestId: RequestIdOf(err),
+	}
+	s.mutex.Unlock()
+	DefaultMetrics.Add("vipsidecar_api_errors_total", map[string]string{"operation": operation, "reason": ReasonOf(err)}, 1)
+}
+
+//最近一次云上接口错误，没有错误时返回nil
+func (s *Status) Last() *LastError {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.LastError == nil {
+		return nil
+	}
+	last := *s.LastError
+	return &last
+}
+
+func (s *Status) SetSlo(slo *SloStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Slo = slo
+}
+
+func (s *Status) SetSafetyViolation(violation *SafetyViolation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.SafetyViolation == nil {
+		s.SafetyViolation = violation
+	}
+}
+
+func (s *Status) SetFeatures(features []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Features = features
+}
+
+func (s *Status) SetLocalVips(mode string, vips []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Mode = mode
+	s.LocalVips = vips
+}
+
+func (s *Status) SetVipStatus(vip string, st VipStatus) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.Vips == nil {
+		s.Vips = make(map[string]VipStatus)
+	}
+	s.Vips[vip] = st
+}
+
+func (s *Status) SetClockSkew(condition *ClockSkewCondition) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.ClockSkew = condition
+}
+
+func (s *Status) SetDraining(draining bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Draining = draining
+}
+
+func (s *Status) SetIneligible(reasons map[string]string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Ineligible = reasons
+}
+
+func (s *Status) SetConflicts(conflicts []VipConflict) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Conflicts = conflicts
+}
+
+func (s *Status) SetCloudApi(probes map[string]EndpointProbe) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.CloudApi = probes
+}
+
+func (s *Status) SetFeatureFlags(flags map[string]FeatureFlag) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.FeatureFlags = flags
+}
+
+func (s *Status) SetMaintenance(events []MaintenanceEvent) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Maintenance = events
+}
+
+func (s *Status) SetHooks(hooks map[string]map[string]HookResult) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Hooks = hooks
+}
+
+func (s *Status) SetCredentials(name string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.Credentials = name
+}
+
+func (s *Status) SetBudgetOverrun(overrun *BudgetOverrun) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.LastBudgetOverrun = overrun
+}
+
+func (s *Status) SetDrActivation(activation *DrActivation) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.DrActivation = activation
+}
+
+func (s *Status) SetSuppressedFailover(suppressed *SuppressedFailover) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.LastSuppressedFailover = suppressed
+}
+
+//until为零值时清除
+func (s *Status) SetHoldDown(vip string, until time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if until.IsZero() {
+		delete(s.HoldDown, vip)
+		return
+	}
+	if s.HoldDown == nil {
+		s.HoldDown = make(map[string]time.Time)
+	}
+	s.HoldDown[vip] = until
+}
+
+func (s *Status) SetHealthCheck(name string, healthy bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.HealthChecks == nil {
+		s.HealthChecks = make(map[string]bool)
+	}
+	if previous, ok := s.HealthChecks[name]; !ok || previous != healthy {
+		DefaultStatusWatch.Publish(StatusEvent{Type: "health", Time: time.Now(), Check: name, Healthy: &healthy})
+	}
+	s.HealthChecks[name] = healthy
+}
+
+func (s *Status) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
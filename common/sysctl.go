@@ -0,0 +1,100 @@
+package common
+
+import (
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+//vip正常工作需要的arp相关内核参数，sysctl.settings未配置时使用
+var DefaultSysctls = map[string]string{
+	"net.ipv4.conf.all.arp_ignore":   "1",
+	"net.ipv4.conf.all.arp_announce": "2",
+	"net.ipv4.conf.all.rp_filter":    "2",
+}
+
+//托管内核参数：启动时设置并记录原值，退出时恢复
+type SysctlManager struct {
+	settings map[string]string
+	original map[string]string
+}
+
+func NewSysctlManager(config JdSysctl) *SysctlManager {
+	settings := config.Settings
+	if len(settings) == 0 {
+		settings = DefaultSysctls
+	}
+	return &SysctlManager{settings: settings, original: make(map[string]string)}
+}
+
+//参数名转换为/proc/sys下的路径，net.ipv4.conf.<接口>.<参数>中的接口名可以包含"."(vlan子接口)
+func sysctlPath(key string) string {
+	const confprefix = "net.ipv4.conf."
+	if strings.HasPrefix(key, confprefix) {
+		rest := key[len(confprefix):]
+		if i := strings.LastIndex(rest, "."); i > 0 {
+			return "/proc/sys/net/ipv4/conf/" + rest[:i] + "/" + rest[i+1:]
+		}
+	}
+	return "/proc/sys/" + strings.Replace(key, ".", "/", -1)
+}
+
+func (m *SysctlManager) keys() []string {
+	keys := []string{}
+	for key := range m.settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+//检查参数是否可以修改(权限不足、/proc/sys只读等)，返回警告
+func (m *SysctlManager) Check() []error {
+	warnings := []error{}
+	for _, key := range m.keys() {
+		f, err := os.OpenFile(sysctlPath(key), os.O_WRONLY, 0)
+		if err != nil {
+			warnings = append(warnings, errors.New("sysctl "+key+" cannot be applied: "+err.Error()))
+			continue
+		}
+		f.Close()
+	}
+	return warnings
+}
+
+//设置参数，已是期望值的参数不修改也不恢复
+func (m *SysctlManager) Apply() {
+	for _, key := range m.keys() {
+		path := sysctlPath(key)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			log.Println("sysctl", key, err)
+			continue
+		}
+		current := strings.TrimSpace(string(data))
+		if current == m.settings[key] {
+			continue
+		}
+		if err := ioutil.WriteFile(path, []byte(m.settings[key]), 0644); err != nil {
+			log.Println("sysctl", key, err)
+			continue
+		}
+		m.original[key] = current
+		log.Println("sysctl", key, current, "->", m.settings[key])
+	}
+}
+
+//恢复被修改的参数
+func (m *SysctlManager) Restore() {
+	for key, value := range m.original {
+		if err := ioutil.WriteFile(sysctlPath(key), []byte(value), 0644); err != nil {
+			log.Println("sysctl restore", key, err)
+			continue
+		}
+		log.Println("sysctl", key, "restored to", value)
+	}
+	m.original = make(map[string]string)
+}
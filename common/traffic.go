@@ -0,0 +1,137 @@
+package common
+
+import (
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	DefaultMetrics.Register("vipsidecar_vip_connections", MetricGauge, "Active conntrack entries of the vip: established tcp connections and all other tracked flows.")
+	DefaultMetrics.Register("vipsidecar_vip_new_connections_per_second", MetricGauge, "Conntrack entries of the vip that appeared since the previous sample, per second.")
+	DefaultMetrics.Register("vipsidecar_vip_bytes_total", MetricCounter, "Bytes of the vip's tracked connections, rx towards the vip and tx from it. Requires net.netfilter.nf_conntrack_acct=1.")
+	DefaultMetrics.Register("vipsidecar_vip_interface_bytes_total", MetricCounter, "Byte counters of the interface currently holding the vip.")
+}
+
+//定期采样conntrack及vip所在接口的计数器，按vip输出连接数、新建连接速率及流量，用于确认故障转移后流量是否随vip迁移
+//conntrack只能看到采样时仍存在的连接，两次采样之间建立并结束的连接不计入
+type TrafficSampler struct {
+	config   JdTraffic
+	vips     []string
+	previous map[string]conntrackEntry
+	sampled  time.Time
+	failed   bool
+}
+
+var DefaultTraffic = &TrafficSampler{}
+
+func (t *TrafficSampler) Load(config JdTraffic, vips []string) error {
+	if !config.Enabled {
+		return nil
+	}
+	if config.Interval <= 0 {
+		config.Interval = 10
+	}
+	t.config, t.vips = config, vips
+	return nil
+}
+
+func (t *TrafficSampler) Run() {
+	if !t.config.Enabled {
+		return
+	}
+	for {
+		t.Sample()
+		time.Sleep(time.Duration(t.config.Interval) * time.Second)
+	}
+}
+
+func (t *TrafficSampler) Sample() {
+	now := time.Now()
+	for _, vip := range t.vips {
+		if device := localVipDevice(vip); device != "" {
+			for _, direction := range []string{"rx", "tx"} {
+				data, err := ioutil.ReadFile("/sys/class/net/" + device + "/statistics/" + direction + "_bytes")
+				if err != nil {
+					continue
+				}
+				value, _ := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+				DefaultMetrics.Set("vipsidecar_vip_interface_bytes_total", map[string]string{"vip": vip, "device": device, "direction": direction}, value)
+			}
+		}
+	}
+	entries, err := readConntrack()
+	if err != nil {
+		if !t.failed {
+			log.Println("traffic sampling without conntrack,", err)
+		}
+		t.failed = true
+		return
+	}
+	t.failed = false
+	current := map[string]conntrackEntry{}
+	for _, vip := range t.vips {
+		active, created := 0, 0
+		var rx, tx uint64
+		for _, e := range entries {
+			if !e.involves(vip) {
+				continue
+			}
+			key := e.key()
+			current[key] = e
+			if e.proto != "tcp" || e.state == "ESTABLISHED" {
+				active++
+			}
+			previous, seen := t.previous[key]
+			if !seen {
+				created++
+			}
+			//两次采样间的增量，五元组被新连接复用时计数会变小，按新连接计
+			for i, tuple := range e.tuples {
+				delta := tuple.bytes
+				if seen && previous.tuples[i].bytes <= tuple.bytes {
+					delta -= previous.tuples[i].bytes
+				}
+				if tuple.dst == vip {
+					rx += delta
+				}
+				if tuple.src == vip {
+					tx += delta
+				}
+			}
+		}
+		labels := map[string]string{"vip": vip}
+		DefaultMetrics.Set("vipsidecar_vip_connections", labels, float64(active))
+		//第一次采样时没有对比基准，不输出新建速率及流量
+		if t.previous == nil {
+			continue
+		}
+		DefaultMetrics.Set("vipsidecar_vip_new_connections_per_second", labels, float64(created)/now.Sub(t.sampled).Seconds())
+		DefaultMetrics.Add("vipsidecar_vip_bytes_total", map[string]string{"vip": vip, "direction": "rx"}, float64(rx))
+		DefaultMetrics.Add("vipsidecar_vip_bytes_total", map[string]string{"vip": vip, "direction": "tx"}, float64(tx))
+	}
+	t.previous, t.sampled = current, now
+}
+
+//本机持有vip的接口，vip不在本机时返回空
+func localVipDevice(vip string) string {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return ""
+	}
+	for _, iface := range interfaces {
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.String() == vip {
+				return iface.Name
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,37 @@
+package common
+
+import (
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"time"
+)
+
+//调整http.DefaultTransport的连接池参数
+//sdk每次请求都新建http.Client，但都使用DefaultTransport，调整后所有访问京东云的请求共用同一个连接池
+//默认每个host只保留2个空闲连接，reconcile间隔较短、并发较高时连接会被反复关闭重建
+func ConfigureTransport(config JdTransport) error {
+	transport, ok := defaultHttpTransport()
+	if !ok {
+		return errors.New("http.DefaultTransport is not *http.Transport, transport settings not applied")
+	}
+	if config.MaxIdleConnsPerHost <= 0 {
+		config.MaxIdleConnsPerHost = 16
+	}
+	transport.MaxIdleConnsPerHost = config.MaxIdleConnsPerHost
+	if transport.MaxIdleConns < config.MaxIdleConnsPerHost {
+		transport.MaxIdleConns = config.MaxIdleConnsPerHost
+	}
+	if config.IdleConnTimeout > 0 {
+		transport.IdleConnTimeout = time.Duration(config.IdleConnTimeout) * time.Second
+	}
+	if config.TlsHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = time.Duration(config.TlsHandshakeTimeout) * time.Second
+	}
+	//TLSNextProto为非nil的空map时不使用http/2
+	if config.DisableHttp2 {
+		transport.ForceAttemptHTTP2 = false
+		transport.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+	}
+	return nil
+}
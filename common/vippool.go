@@ -0,0 +1,210 @@
+//go:build !nok8s
+// +build !nok8s
+
+package common
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+//单个VipPool展开后的最大地址数
+const vipPoolMaxAddresses = 4096
+
+func init() {
+	registerFeature("vippool")
+	DefaultMetrics.Register("vipsidecar_vippool_addresses", MetricGauge, "Addresses in a VipPool, state=allocated, free or unusable (not in vips or already in another pool).")
+}
+
+//VipPool对象，spec.kind为使用该pool的对象类型(Service或Gateway，默认Service)
+//namespaces不为空时只分配给这些namespace中的对象，autoAssign为false时只分配给通过注解指定该pool的对象
+type kubeVipPool struct {
+	Metadata kubeObjectMeta `json:"metadata"`
+	Spec     struct {
+		Addresses  []string `json:"addresses"`
+		Kind       string   `json:"kind"`
+		Namespaces []string `json:"namespaces"`
+		AutoAssign *bool    `json:"autoAssign"`
+	} `json:"spec"`
+	Status VipPoolStatus `json:"status"`
+}
+
+//写入VipPool的status
+type VipPoolStatus struct {
+	Allocated   int                 `json:"allocated"`
+	Free        int                 `json:"free"`
+	Unusable    []string            `json:"unusable,omitempty"`
+	Allocations []VipPoolAllocation `json:"allocations,omitempty"`
+}
+
+type VipPoolAllocation struct {
+	Address string `json:"address"`
+	Owner   string `json:"owner"`
+}
+
+type vipPool struct {
+	name       string
+	addresses  []string
+	namespaces []string
+	autoassign bool
+	unusable   []string
+	status     VipPoolStatus
+}
+
+//从kind对应的VipPool读取可分配的地址，地址必须在vips中(由provider负责云上绑定)，同一地址出现在多个pool中时只属于名称最小的pool
+type vipPools struct {
+	kind  string
+	vips  []string
+	kube  *kubeClient
+	pools []vipPool
+}
+
+func newVipPools(kind string, vips []string, kube *kubeClient) *vipPools {
+	return &vipPools{kind: kind, vips: vips, kube: kube}
+}
+
+//返回按pool名称及配置顺序排列的全部可用地址
+func (v *vipPools) load() ([]string, error) {
+	list := struct {
+		Items []kubeVipPool `json:"items"`
+	}{}
+	if err := v.kube.do("GET", "/apis/"+VipPoolGroup+"/"+VipPoolVersion+"/"+VipPoolResource, "", nil, &list); err != nil {
+		return nil, err
+	}
+	sort.Slice(list.Items, func(i, j int) bool { return list.Items[i].Metadata.Name < list.Items[j].Metadata.Name })
+	pools := []vipPool{}
+	addresses := []string{}
+	for _, item := range list.Items {
+		kind := item.Spec.Kind
+		if kind == "" {
+			kind = "Service"
+		}
+		if kind != v.kind {
+			continue
+		}
+		pool := vipPool{name: item.Metadata.Name, namespaces: item.Spec.Namespaces, autoassign: item.Spec.AutoAssign == nil || *item.Spec.AutoAssign, status: item.Status}
+		expanded, err := expandAddresses(item.Spec.Addresses)
+		if err != nil {
+			pool.unusable = append(pool.unusable, err.Error())
+		}
+		for _, vip := range expanded {
+			if ok, _ := Contain(vip, v.vips); !ok {
+				pool.unusable = append(pool.unusable, vip+" is not in vips")
+				continue
+			}
+			if ok, _ := Contain(vip, addresses); ok {
+				pool.unusable = append(pool.unusable, vip+" is already in another pool")
+				continue
+			}
+			pool.addresses = append(pool.addresses, vip)
+			addresses = append(addresses, vip)
+		}
+		pools = append(pools, pool)
+	}
+	v.pools = pools
+	return addresses, nil
+}
+
+//对象可使用的地址：注解指定pool时只能使用该pool，否则只自动分配autoAssign的pool，且pool限制了namespace时对象须在其中
+func (v *vipPools) allowed(c vipClaim, vip string, auto bool) bool {
+	for _, pool := range v.pools {
+		if ok, _ := Contain(vip, pool.addresses); !ok {
+			continue
+		}
+		if c.pool != "" && c.pool != pool.name {
+			return false
+		}
+		if auto && c.pool == "" && !pool.autoassign {
+			return false
+		}
+		if len(pool.namespaces) > 0 {
+			ok, _ := Contain(c.namespace, pool.namespaces)
+			return ok
+		}
+		return true
+	}
+	return false
+}
+
+//更新各pool的使用情况指标及status，各节点计算结果相同，只在与现有status不同时写入
+func (v *vipPools) report(allocation map[string]string) {
+	owners := map[string]string{}
+	for key, vip := range allocation {
+		owners[vip] = v.kind + " " + key
+	}
+	for _, pool := range v.pools {
+		status := VipPoolStatus{Unusable: pool.unusable}
+		for _, vip := range pool.addresses {
+			if owner, ok := owners[vip]; ok {
+				status.Allocations = append(status.Allocations, VipPoolAllocation{Address: vip, Owner: owner})
+			}
+		}
+		status.Allocated, status.Free = len(status.Allocations), len(pool.addresses)-len(status.Allocations)
+		DefaultMetrics.Set("vipsidecar_vippool_addresses", map[string]string{"pool": pool.name, "state": "allocated"}, float64(status.Allocated))
+		DefaultMetrics.Set("vipsidecar_vippool_addresses", map[string]string{"pool": pool.name, "state": "free"}, float64(status.Free))
+		DefaultMetrics.Set("vipsidecar_vippool_addresses", map[string]string{"pool": pool.name, "state": "unusable"}, float64(len(status.Unusable)))
+		if reflect.DeepEqual(status, pool.status) {
+			continue
+		}
+		//merge patch中的列表整体替换，为空时写入null删除该字段
+		patch, _ := json.Marshal(map[string]interface{}{"status": map[string]interface{}{
+			"allocated": status.Allocated, "free": status.Free, "unusable": status.Unusable, "allocations": status.Allocations,
+		}})
+		path := "/apis/" + VipPoolGroup + "/" + VipPoolVersion + "/" + VipPoolResource + "/" + url.PathEscape(pool.name) + "/status"
+		if err := v.kube.do("PATCH", path, "application/merge-patch+json", patch, nil); err != nil {
+			log.Println("vippool", pool.name, "status", err)
+		}
+	}
+}
+
+//展开地址列表，每项为单个地址、cidr(如10.0.0.64/28)或范围(如10.0.0.10-10.0.0.20)
+func expandAddresses(entries []string) ([]string, error) {
+	addresses := []string{}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		var first, last uint32
+		switch {
+		case strings.Contains(entry, "/"):
+			_, ipnet, err := net.ParseCIDR(entry)
+			if err != nil || ipnet.IP.To4() == nil {
+				return addresses, errors.New("invalid cidr " + entry)
+			}
+			ones, bits := ipnet.Mask.Size()
+			first = binary.BigEndian.Uint32(ipnet.IP.To4())
+			last = first + uint32(1)<<uint(bits-ones) - 1
+		case strings.Contains(entry, "-"):
+			parts := strings.SplitN(entry, "-", 2)
+			from, to := net.ParseIP(strings.TrimSpace(parts[0])).To4(), net.ParseIP(strings.TrimSpace(parts[1])).To4()
+			if from == nil || to == nil || binary.BigEndian.Uint32(from) > binary.BigEndian.Uint32(to) {
+				return addresses, errors.New("invalid range " + entry)
+			}
+			first, last = binary.BigEndian.Uint32(from), binary.BigEndian.Uint32(to)
+		default:
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return addresses, errors.New("invalid address " + entry)
+			}
+			addresses = append(addresses, ip.String())
+			continue
+		}
+		if last-first >= vipPoolMaxAddresses {
+			return addresses, errors.New(entry + " has more than 4096 addresses")
+		}
+		for n := first; ; n++ {
+			ip := make(net.IP, 4)
+			binary.BigEndian.PutUint32(ip, n)
+			addresses = append(addresses, ip.String())
+			if n == last {
+				break
+			}
+		}
+	}
+	return addresses, nil
+}
@@ -0,0 +1,45 @@
+package common
+
+//provider使用的云上接口，默认基于jdcloud-sdk-go实现(vpcapi_sdk.go)，
+//使用-tags thinclient编译时使用内置的精简client(vpcapi_thin.go)，不再链接sdk
+//修改类接口返回x-jdcloud-request-id，接口错误以*ApiError返回
+type VpcApi interface {
+	//批量获取同一region内多块网卡上的SecondaryIps
+	DescribeNetworkInterfacesIps(regionId string, networkInterfaceIds []string) (map[string][]string, error)
+	AssignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error)
+	UnassignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error)
+	DescribeDnatRule(regionId string, natGatewayId string, dnatRuleId string) (*DnatRule, error)
+	ModifyDnatRule(regionId string, natGatewayId string, dnatRuleId string, internalIp string) (string, error)
+	DescribeNetworkInterface(regionId string, networkInterfaceId string) (*NetworkInterface, error)
+	//批量获取同一region内多块网卡，不存在的网卡不出现在结果中
+	DescribeNetworkInterfaces(regionId string, networkInterfaceIds []string) (map[string]*NetworkInterface, error)
+	//弹性网卡的挂载、卸载属于云主机接口，请求返回后异步完成
+	AttachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error)
+	DetachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error)
+}
+
+//弹性网卡，instanceId为空表示未挂载到云主机
+type NetworkInterface struct {
+	NetworkInterfaceId string `json:"networkInterfaceId"`
+	InstanceId         string `json:"instanceId"`
+	MacAddress         string `json:"macAddress"`
+	DeviceIndex        int    `json:"deviceIndex"`
+}
+
+//创建client所需的配置
+type ClientConfig struct {
+	Credentials CredentialProvider
+	Scheme      string
+	Endpoint    string
+	VmEndpoint  string
+	Signer      string
+}
+
+//请求携带临时凭证的header，值为base64编码的SessionToken
+const SecurityTokenHeader string = "x-jdcloud-security-token"
+
+const (
+	DefaultVpcScheme   string = "https"
+	DefaultVpcEndpoint string = "vpc.jdcloud-api.com"
+	DefaultVmEndpoint  string = "vm.jdcloud-api.com"
+)
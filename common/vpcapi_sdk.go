@@ -0,0 +1,381 @@
+//go:build !thinclient
+// +build !thinclient
+
+package common
+
+import (
+	"encoding/json"
+	"github.com/jdcloud-api/jdcloud-sdk-go/core"
+	jdcommon "github.com/jdcloud-api/jdcloud-sdk-go/services/common/models"
+	"github.com/jdcloud-api/jdcloud-sdk-go/services/vpc/apis"
+	"github.com/jdcloud-api/jdcloud-sdk-go/services/vpc/client"
+	"sync"
+)
+
+func init() {
+	registerFeature("sdkclient")
+}
+
+//sdk日志按log.sdklevel输出，经过DefaultRedactor替换
+type DefaultLogger struct{}
+
+func (logger DefaultLogger) Log(level int, message ...interface{}) {
+	sdkLog(level, message...)
+}
+
+func InitVpcClient(accessKey string, secretKey string) *client.VpcClient {
+	defaultlogger := DefaultLogger{}
+	credentials := core.NewCredentials(accessKey, secretKey)
+	vpcclient := client.NewVpcClient(credentials)
+	vpcclient.SetLogger(defaultlogger)
+	return vpcclient
+}
+
+//sdk内部固定使用jdcloud2签名，其他签名算法需要使用thinclient编译
+func SignerSupported(name string) bool {
+	return name == "" || name == SignerJdcloud2
+}
+
+//基于jdcloud-sdk-go的VpcApi实现
+type sdkVpcApi struct {
+	config      ClientConfig
+	mutex       sync.Mutex
+	credentials Credentials
+	vpcclient   *client.VpcClient
+}
+
+func NewVpcApi(config ClientConfig) VpcApi {
+	return &sdkVpcApi{config: config}
+}
+
+//sdk client的凭证在创建时固定，凭证变化(临时凭证刷新)时重建client，返回需要携带的SessionToken
+func (s *sdkVpcApi) client() (*client.VpcClient, string, error) {
+	credentials, err := s.config.Credentials.Credentials()
+	if err != nil {
+		return nil, "", err
+	}
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.vpcclient == nil || s.credentials.AccessKey != credentials.AccessKey || s.credentials.SecretKey != credentials.SecretKey {
+		vpcclient := InitVpcClient(credentials.AccessKey, credentials.SecretKey)
+		if s.config.Endpoint != "" {
+			sdkconfig := core.NewConfig()
+			sdkconfig.SetEndpoint(s.config.Endpoint)
+			if s.config.Scheme != "" {
+				sdkconfig.SetScheme(s.config.Scheme)
+			}
+			vpcclient.SetConfig(sdkconfig)
+		}
+		s.vpcclient = vpcclient
+	}
+	s.credentials = credentials
+	return s.vpcclient, credentials.SessionToken, nil
+}
+
+//云主机接口使用与vpc相同的凭证，endpoint及签名使用的服务名不同
+func (s *sdkVpcApi) vmClient() (core.JDCloudClient, string, error) {
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return core.JDCloudClient{}, "", err
+	}
+	vmclient := vpcclient.JDCloudClient
+	vmclient.ServiceName = "vm"
+	vmclient.Config.Endpoint = DefaultVmEndpoint
+	if s.config.VmEndpoint != "" {
+		vmclient.Config.Endpoint = s.config.VmEndpoint
+	}
+	return vmclient, token, nil
+}
+
+//临时凭证需要携带SessionToken，sdk发送时自动做base64编码
+func withSecurityToken(req *core.JDCloudRequest, token string) {
+	if token != "" {
+		req.AddHeader(SecurityTokenHeader, token)
+	}
+}
+
+//sdk只在网络错误时返回err，接口错误需要检查响应中的error
+func apiError(requestId string, e core.ErrorResponse) error {
+	if e.Code != 0 {
+		return &ApiError{RequestId: requestId, Code: e.Code, Status: e.Status, Message: e.Message}
+	}
+	return nil
+}
+
+//每次请求最多查询100块网卡
+func (s *sdkVpcApi) DescribeNetworkInterfacesIps(regionId string, networkInterfaceIds []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return result, err
+	}
+	pagesize := 100
+	for start := 0; start < len(networkInterfaceIds); start += pagesize {
+		end := start + pagesize
+		if end > len(networkInterfaceIds) {
+			end = len(networkInterfaceIds)
+		}
+		networkinterfacesreq := apis.NewDescribeNetworkInterfacesRequest(regionId)
+		networkinterfacesreq.SetPageSize(pagesize)
+		networkinterfacesreq.SetFilters([]jdcommon.Filter{{Name: "networkInterfaceIds", Values: networkInterfaceIds[start:end]}})
+		withSecurityToken(&networkinterfacesreq.JDCloudRequest, token)
+		nirespons, err := vpcclient.DescribeNetworkInterfaces(networkinterfacesreq)
+		if err != nil {
+			return result, err
+		}
+		if err := apiError(nirespons.RequestID, nirespons.Error); err != nil {
+			return result, err
+		}
+		for _, ni := range nirespons.Result.NetworkInterfaces {
+			ips := []string{}
+			for _, secondaryip := range ni.SecondaryIps {
+				ips = append(ips, secondaryip.PrivateIpAddress)
+			}
+			result[ni.NetworkInterfaceId] = ips
+		}
+	}
+	return result, nil
+}
+
+func (s *sdkVpcApi) AssignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return "", err
+	}
+	assignsencondaryipsreq := apis.NewAssignSecondaryIpsRequest(regionId, networkInterfaceId)
+	assignsencondaryipsreq.SecondaryIps = ips
+	withSecurityToken(&assignsencondaryipsreq.JDCloudRequest, token)
+	respons, err := vpcclient.AssignSecondaryIps(assignsencondaryipsreq)
+	if err != nil {
+		return "", err
+	}
+	return respons.RequestID, apiError(respons.RequestID, respons.Error)
+}
+
+func (s *sdkVpcApi) UnassignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return "", err
+	}
+	unassignsecondaryipsreq := apis.NewUnassignSecondaryIpsRequest(regionId, networkInterfaceId)
+	unassignsecondaryipsreq.SecondaryIps = ips
+	withSecurityToken(&unassignsecondaryipsreq.JDCloudRequest, token)
+	respons, err := vpcclient.UnassignSecondaryIps(unassignsecondaryipsreq)
+	if err != nil {
+		return "", err
+	}
+	return respons.RequestID, apiError(respons.RequestID, respons.Error)
+}
+
+func (s *sdkVpcApi) DescribeDnatRule(regionId string, natGatewayId string, dnatRuleId string) (*DnatRule, error) {
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	req := NewDescribeDnatRuleRequest(regionId, natGatewayId, dnatRuleId)
+	withSecurityToken(&req.JDCloudRequest, token)
+	resp, err := vpcclient.Send(req, vpcclient.ServiceName)
+	if err != nil {
+		return nil, err
+	}
+	jdResp := &DescribeDnatRuleResponse{}
+	if err := json.Unmarshal(resp, jdResp); err != nil {
+		return nil, err
+	}
+	if err := apiError(jdResp.RequestID, jdResp.Error); err != nil {
+		return nil, err
+	}
+	return &jdResp.Result.DnatRule, nil
+}
+
+func (s *sdkVpcApi) ModifyDnatRule(regionId string, natGatewayId string, dnatRuleId string, internalIp string) (string, error) {
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return "", err
+	}
+	req := NewModifyDnatRuleRequest(regionId, natGatewayId, dnatRuleId, internalIp)
+	withSecurityToken(&req.JDCloudRequest, token)
+	resp, err := vpcclient.Send(req, vpcclient.ServiceName)
+	if err != nil {
+		return "", err
+	}
+	jdResp := &ModifyDnatRuleResponse{}
+	if err := json.Unmarshal(resp, jdResp); err != nil {
+		return "", err
+	}
+	return jdResp.RequestID, apiError(jdResp.RequestID, jdResp.Error)
+}
+
+func (s *sdkVpcApi) DescribeNetworkInterface(regionId string, networkInterfaceId string) (*NetworkInterface, error) {
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	req := apis.NewDescribeNetworkInterfaceRequest(regionId, networkInterfaceId)
+	withSecurityToken(&req.JDCloudRequest, token)
+	resp, err := vpcclient.DescribeNetworkInterface(req)
+	if err != nil {
+		return nil, err
+	}
+	if err := apiError(resp.RequestID, resp.Error); err != nil {
+		return nil, err
+	}
+	ni := resp.Result.NetworkInterface
+	return &NetworkInterface{NetworkInterfaceId: ni.NetworkInterfaceId, InstanceId: ni.InstanceId, MacAddress: ni.MacAddress, DeviceIndex: ni.DeviceIndex}, nil
+}
+
+func (s *sdkVpcApi) DescribeNetworkInterfaces(regionId string, networkInterfaceIds []string) (map[string]*NetworkInterface, error) {
+	result := make(map[string]*NetworkInterface)
+	vpcclient, token, err := s.client()
+	if err != nil {
+		return result, err
+	}
+	pagesize := 100
+	for start := 0; start < len(networkInterfaceIds); start += pagesize {
+		end := start + pagesize
+		if end > len(networkInterfaceIds) {
+			end = len(networkInterfaceIds)
+		}
+		req := apis.NewDescribeNetworkInterfacesRequest(regionId)
+		req.SetPageSize(pagesize)
+		req.SetFilters([]jdcommon.Filter{{Name: "networkInterfaceIds", Values: networkInterfaceIds[start:end]}})
+		withSecurityToken(&req.JDCloudRequest, token)
+		resp, err := vpcclient.DescribeNetworkInterfaces(req)
+		if err != nil {
+			return result, err
+		}
+		if err := apiError(resp.RequestID, resp.Error); err != nil {
+			return result, err
+		}
+		for _, ni := range resp.Result.NetworkInterfaces {
+			result[ni.NetworkInterfaceId] = &NetworkInterface{NetworkInterfaceId: ni.NetworkInterfaceId, InstanceId: ni.InstanceId, MacAddress: ni.MacAddress, DeviceIndex: ni.DeviceIndex}
+		}
+	}
+	return result, nil
+}
+
+func (s *sdkVpcApi) AttachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	return s.sendVm(NewNetworkInterfaceActionRequest("attachNetworkInterface", regionId, instanceId, networkInterfaceId))
+}
+
+func (s *sdkVpcApi) DetachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	return s.sendVm(NewNetworkInterfaceActionRequest("detachNetworkInterface", regionId, instanceId, networkInterfaceId))
+}
+
+func (s *sdkVpcApi) sendVm(req *NetworkInterfaceActionRequest) (string, error) {
+	vmclient, token, err := s.vmClient()
+	if err != nil {
+		return "", err
+	}
+	withSecurityToken(&req.JDCloudRequest, token)
+	resp, err := vmclient.Send(req, vmclient.ServiceName)
+	if err != nil {
+		return "", err
+	}
+	jdResp := &NetworkInterfaceActionResponse{}
+	if err := json.Unmarshal(resp, jdResp); err != nil {
+		return "", err
+	}
+	return jdResp.RequestID, apiError(jdResp.RequestID, jdResp.Error)
+}
+
+//当前vendor的sdk版本未包含NAT网关接口，按sdk生成代码的格式在此声明DNAT规则相关请求
+type DescribeDnatRuleRequest struct {
+	core.JDCloudRequest
+	RegionId     string `json:"regionId"`
+	NatGatewayId string `json:"natGatewayId"`
+	DnatRuleId   string `json:"dnatRuleId"`
+}
+
+func (r DescribeDnatRuleRequest) GetRegionId() string {
+	return r.RegionId
+}
+
+type DescribeDnatRuleResponse struct {
+	RequestID string             `json:"requestId"`
+	Error     core.ErrorResponse `json:"error"`
+	Result    struct {
+		DnatRule DnatRule `json:"dnatRule"`
+	} `json:"result"`
+}
+
+type ModifyDnatRuleRequest struct {
+	core.JDCloudRequest
+	RegionId          string `json:"regionId"`
+	NatGatewayId      string `json:"natGatewayId"`
+	DnatRuleId        string `json:"dnatRuleId"`
+	InternalIpAddress string `json:"internalIpAddress"`
+}
+
+func (r ModifyDnatRuleRequest) GetRegionId() string {
+	return r.RegionId
+}
+
+type ModifyDnatRuleResponse struct {
+	RequestID string             `json:"requestId"`
+	Error     core.ErrorResponse `json:"error"`
+}
+
+func NewDescribeDnatRuleRequest(regionId string, natGatewayId string, dnatRuleId string) *DescribeDnatRuleRequest {
+	return &DescribeDnatRuleRequest{
+		JDCloudRequest: core.JDCloudRequest{
+			URL:     "/regions/{regionId}/natGateways/{natGatewayId}/dnatRules/{dnatRuleId}",
+			Method:  "GET",
+			Version: "v1",
+		},
+		RegionId:     regionId,
+		NatGatewayId: natGatewayId,
+		DnatRuleId:   dnatRuleId,
+	}
+}
+
+func NewModifyDnatRuleRequest(regionId string, natGatewayId string, dnatRuleId string, internalIp string) *ModifyDnatRuleRequest {
+	return &ModifyDnatRuleRequest{
+		JDCloudRequest: core.JDCloudRequest{
+			URL:     "/regions/{regionId}/natGateways/{natGatewayId}/dnatRules/{dnatRuleId}",
+			Method:  "PATCH",
+			Version: "v1",
+		},
+		RegionId:          regionId,
+		NatGatewayId:      natGatewayId,
+		DnatRuleId:        dnatRuleId,
+		InternalIpAddress: internalIp,
+	}
+}
+
+//sdk中未包含云主机服务，按sdk生成代码的格式声明挂载、卸载弹性网卡的请求
+type NetworkInterfaceActionRequest struct {
+	core.JDCloudRequest
+	RegionId           string `json:"regionId"`
+	InstanceId         string `json:"instanceId"`
+	NetworkInterfaceId string `json:"networkInterfaceId"`
+	AutoDelete         *bool  `json:"autoDelete,omitempty"`
+}
+
+func (r NetworkInterfaceActionRequest) GetRegionId() string {
+	return r.RegionId
+}
+
+type NetworkInterfaceActionResponse struct {
+	RequestID string             `json:"requestId"`
+	Error     core.ErrorResponse `json:"error"`
+}
+
+//action为attachNetworkInterface或detachNetworkInterface，挂载的网卡不随云主机删除
+func NewNetworkInterfaceActionRequest(action string, regionId string, instanceId string, networkInterfaceId string) *NetworkInterfaceActionRequest {
+	req := &NetworkInterfaceActionRequest{
+		JDCloudRequest: core.JDCloudRequest{
+			URL:     "/regions/{regionId}/instances/{instanceId}:" + action,
+			Method:  "POST",
+			Version: "v1",
+		},
+		RegionId:           regionId,
+		InstanceId:         instanceId,
+		NetworkInterfaceId: networkInterfaceId,
+	}
+	if action == "attachNetworkInterface" {
+		autodelete := false
+		req.AutoDelete = &autodelete
+	}
+	return req
+}
@@ -0,0 +1,230 @@
+//go:build thinclient
+// +build thinclient
+
+package common
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+func init() {
+	registerFeature("thinclient")
+}
+
+//不依赖jdcloud-sdk-go的精简VpcApi实现，只包含用到的几个接口及签名算法
+type thinVpcApi struct {
+	config     ClientConfig
+	signer     Signer
+	httpclient *http.Client
+}
+
+//精简client支持所有已注册的签名算法
+func SignerSupported(name string) bool {
+	_, err := GetSigner(name)
+	return err == nil
+}
+
+func NewVpcApi(config ClientConfig) VpcApi {
+	if config.Scheme == "" {
+		config.Scheme = DefaultVpcScheme
+	}
+	if config.Endpoint == "" {
+		config.Endpoint = DefaultVpcEndpoint
+	}
+	if config.VmEndpoint == "" {
+		config.VmEndpoint = DefaultVmEndpoint
+	}
+	signer, err := GetSigner(config.Signer)
+	if err != nil {
+		log.Fatalln(err)
+	}
+	return &thinVpcApi{config: config, signer: signer, httpclient: &http.Client{Timeout: 10 * time.Second}}
+}
+
+type thinResponse struct {
+	RequestID string `json:"requestId"`
+	Error     struct {
+		Code    int    `json:"code"`
+		Status  string `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+	Result json.RawMessage `json:"result"`
+}
+
+//发送签名请求，result不为nil时解析响应中的result，返回requestId
+func (t *thinVpcApi) do(method string, path string, query url.Values, body interface{}, regionId string, result interface{}) (string, error) {
+	return t.send("vpc", t.config.Endpoint, method, path, query, body, regionId, result)
+}
+
+func (t *thinVpcApi) send(service string, endpoint string, method string, path string, query url.Values, body interface{}, regionId string, result interface{}) (string, error) {
+	payload := []byte{}
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return "", err
+		}
+		payload = b
+	}
+	requrl := t.config.Scheme + "://" + endpoint + "/v1" + path
+	if len(query) > 0 {
+		requrl += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, requrl, bytes.NewReader(payload))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "vipsidecar-thinclient")
+	credentials, err := t.config.Credentials.Credentials()
+	if err != nil {
+		return "", err
+	}
+	if credentials.SessionToken != "" {
+		req.Header.Set(SecurityTokenHeader, base64.StdEncoding.EncodeToString([]byte(credentials.SessionToken)))
+	}
+	t.signer.Sign(req, payload, service, regionId, credentials.AccessKey, credentials.SecretKey, time.Now())
+
+	resp, err := t.httpclient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	requestid := resp.Header.Get("x-jdcloud-request-id")
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return requestid, err
+	}
+	jdResp := &thinResponse{}
+	if err := json.Unmarshal(data, jdResp); err != nil {
+		return requestid, err
+	}
+	if jdResp.RequestID != "" {
+		requestid = jdResp.RequestID
+	}
+	if jdResp.Error.Code != 0 {
+		return requestid, &ApiError{RequestId: requestid, Code: jdResp.Error.Code, Status: jdResp.Error.Status, Message: jdResp.Error.Message}
+	}
+	if result != nil && len(jdResp.Result) > 0 {
+		return requestid, json.Unmarshal(jdResp.Result, result)
+	}
+	return requestid, nil
+}
+
+func (t *thinVpcApi) DescribeNetworkInterfacesIps(regionId string, networkInterfaceIds []string) (map[string][]string, error) {
+	result := make(map[string][]string)
+	pagesize := 100
+	for start := 0; start < len(networkInterfaceIds); start += pagesize {
+		end := start + pagesize
+		if end > len(networkInterfaceIds) {
+			end = len(networkInterfaceIds)
+		}
+		query := url.Values{}
+		query.Set("pageSize", strconv.Itoa(pagesize))
+		query.Set("filters.1.name", "networkInterfaceIds")
+		for i, id := range networkInterfaceIds[start:end] {
+			query.Set(fmt.Sprintf("filters.1.values.%d", i+1), id)
+		}
+		page := struct {
+			NetworkInterfaces []struct {
+				NetworkInterfaceId string `json:"networkInterfaceId"`
+				SecondaryIps       []struct {
+					PrivateIpAddress string `json:"privateIpAddress"`
+				} `json:"secondaryIps"`
+			} `json:"networkInterfaces"`
+		}{}
+		if _, err := t.do("GET", "/regions/"+url.PathEscape(regionId)+"/networkInterfaces/", query, nil, regionId, &page); err != nil {
+			return result, err
+		}
+		for _, ni := range page.NetworkInterfaces {
+			ips := []string{}
+			for _, secondaryip := range ni.SecondaryIps {
+				ips = append(ips, secondaryip.PrivateIpAddress)
+			}
+			result[ni.NetworkInterfaceId] = ips
+		}
+	}
+	return result, nil
+}
+
+func (t *thinVpcApi) AssignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	path := "/regions/" + url.PathEscape(regionId) + "/networkInterfaces/" + url.PathEscape(networkInterfaceId) + ":assignSecondaryIps"
+	return t.do("POST", path, nil, map[string]interface{}{"secondaryIps": ips}, regionId, nil)
+}
+
+func (t *thinVpcApi) UnassignSecondaryIps(regionId string, networkInterfaceId string, ips []string) (string, error) {
+	path := "/regions/" + url.PathEscape(regionId) + "/networkInterfaces/" + url.PathEscape(networkInterfaceId) + ":unassignSecondaryIps"
+	return t.do("POST", path, nil, map[string]interface{}{"secondaryIps": ips}, regionId, nil)
+}
+
+func (t *thinVpcApi) DescribeDnatRule(regionId string, natGatewayId string, dnatRuleId string) (*DnatRule, error) {
+	path := "/regions/" + url.PathEscape(regionId) + "/natGateways/" + url.PathEscape(natGatewayId) + "/dnatRules/" + url.PathEscape(dnatRuleId)
+	result := struct {
+		DnatRule DnatRule `json:"dnatRule"`
+	}{}
+	if _, err := t.do("GET", path, nil, nil, regionId, &result); err != nil {
+		return nil, err
+	}
+	return &result.DnatRule, nil
+}
+
+func (t *thinVpcApi) ModifyDnatRule(regionId string, natGatewayId string, dnatRuleId string, internalIp string) (string, error) {
+	path := "/regions/" + url.PathEscape(regionId) + "/natGateways/" + url.PathEscape(natGatewayId) + "/dnatRules/" + url.PathEscape(dnatRuleId)
+	return t.do("PATCH", path, nil, map[string]interface{}{"internalIpAddress": internalIp}, regionId, nil)
+}
+
+func (t *thinVpcApi) DescribeNetworkInterface(regionId string, networkInterfaceId string) (*NetworkInterface, error) {
+	path := "/regions/" + url.PathEscape(regionId) + "/networkInterfaces/" + url.PathEscape(networkInterfaceId)
+	result := struct {
+		NetworkInterface NetworkInterface `json:"networkInterface"`
+	}{}
+	if _, err := t.do("GET", path, nil, nil, regionId, &result); err != nil {
+		return nil, err
+	}
+	return &result.NetworkInterface, nil
+}
+
+func (t *thinVpcApi) DescribeNetworkInterfaces(regionId string, networkInterfaceIds []string) (map[string]*NetworkInterface, error) {
+	result := make(map[string]*NetworkInterface)
+	pagesize := 100
+	for start := 0; start < len(networkInterfaceIds); start += pagesize {
+		end := start + pagesize
+		if end > len(networkInterfaceIds) {
+			end = len(networkInterfaceIds)
+		}
+		query := url.Values{}
+		query.Set("pageSize", strconv.Itoa(pagesize))
+		query.Set("filters.1.name", "networkInterfaceIds")
+		for i, id := range networkInterfaceIds[start:end] {
+			query.Set(fmt.Sprintf("filters.1.values.%d", i+1), id)
+		}
+		page := struct {
+			NetworkInterfaces []NetworkInterface `json:"networkInterfaces"`
+		}{}
+		if _, err := t.do("GET", "/regions/"+url.PathEscape(regionId)+"/networkInterfaces/", query, nil, regionId, &page); err != nil {
+			return result, err
+		}
+		for i := range page.NetworkInterfaces {
+			result[page.NetworkInterfaces[i].NetworkInterfaceId] = &page.NetworkInterfaces[i]
+		}
+	}
+	return result, nil
+}
+
+func (t *thinVpcApi) AttachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	path := "/regions/" + url.PathEscape(regionId) + "/instances/" + url.PathEscape(instanceId) + ":attachNetworkInterface"
+	return t.send("vm", t.config.VmEndpoint, "POST", path, nil, map[string]interface{}{"networkInterfaceId": networkInterfaceId, "autoDelete": false}, regionId, nil)
+}
+
+func (t *thinVpcApi) DetachNetworkInterface(regionId string, instanceId string, networkInterfaceId string) (string, error) {
+	path := "/regions/" + url.PathEscape(regionId) + "/instances/" + url.PathEscape(instanceId) + ":detachNetworkInterface"
+	return t.send("vm", t.config.VmEndpoint, "POST", path, nil, map[string]interface{}{"networkInterfaceId": networkInterfaceId}, regionId, nil)
+}
@@ -0,0 +1,98 @@
+package common
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+)
+
+//订阅者的事件缓冲，消费过慢时断开，由客户端重新连接并以新的快照重新同步
+const statusWatchBuffer = 64
+
+//推送给订阅者的状态变化，type为transition(vip状态转换)或health(健康检查结果变化)
+type StatusEvent struct {
+	Type       string      `json:"type"`
+	Time       time.Time   `json:"time"`
+	Transition *Transition `json:"transition,omitempty"`
+	Check      string      `json:"check,omitempty"`
+	Healthy    *bool       `json:"healthy,omitempty"`
+}
+
+//将vip状态转换及健康检查变化实时推送给/v1/status/watch的订阅者，代替轮询/v1/status
+type StatusWatch struct {
+	mutex       sync.Mutex
+	subscribers map[chan StatusEvent]bool
+}
+
+var DefaultStatusWatch = &StatusWatch{subscribers: make(map[chan StatusEvent]bool)}
+
+func (w *StatusWatch) Subscribe() chan StatusEvent {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	events := make(chan StatusEvent, statusWatchBuffer)
+	w.subscribers[events] = true
+	return events
+}
+
+func (w *StatusWatch) Unsubscribe(events chan StatusEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.subscribers[events] {
+		delete(w.subscribers, events)
+		close(events)
+	}
+}
+
+//不阻塞，缓冲已满的订阅者被断开
+func (w *StatusWatch) Publish(event StatusEvent) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	for events := range w.subscribers {
+		select {
+		case events <- event:
+		default:
+			delete(w.subscribers, events)
+			close(events)
+		}
+	}
+}
+
+//server-sent events：连接后先发送一次status快照，之后推送transition及health事件，每15秒发送一次注释保持连接
+func (w *StatusWatch) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	events := w.Subscribe()
+	defer w.Unsubscribe(events)
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+	DefaultStatus.mutex.Lock()
+	snapshot, _ := json.Marshal(DefaultStatus)
+	DefaultStatus.mutex.Unlock()
+	rw.Write([]byte("event: status\ndata: " + string(snapshot) + "\n\n"))
+	flusher.Flush()
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			data, _ := json.Marshal(event)
+			if _, err := rw.Write([]byte("event: " + event.Type + "\ndata: " + string(data) + "\n\n")); err != nil {
+				return
+			}
+		case <-keepalive.C:
+			if _, err := rw.Write([]byte(": keepalive\n\n")); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,61 @@
+package common
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+//支持变化检测的Provider，Fingerprint返回云上绑定关系的摘要
+type Watchable interface {
+	Fingerprint() string
+}
+
+//变化检测：周期性比较本机vip及云上绑定关系，发生变化时立即触发reconcile，而不必等待下一个轮询周期
+//本机vip变化按failover优先级处理，云上绑定关系变化按drift优先级处理
+type ChangeWatcher struct {
+	queue         *EventQueue
+	localvips     func() []string
+	provider      Provider
+	localinterval time.Duration
+	cloudinterval time.Duration
+}
+
+func NewChangeWatcher(queue *EventQueue, localvips func() []string, provider Provider, localinterval int, cloudinterval int) *ChangeWatcher {
+	return &ChangeWatcher{
+		queue:         queue,
+		localvips:     localvips,
+		provider:      provider,
+		localinterval: time.Duration(localinterval) * time.Second,
+		cloudinterval: time.Duration(cloudinterval) * time.Second,
+	}
+}
+
+func (w *ChangeWatcher) Start() {
+	if w.localinterval > 0 {
+		go w.watch("local", PriorityFailover, func() time.Duration { return w.localinterval }, func() string {
+			vips := w.localvips()
+			sort.Strings(vips)
+			return strings.Join(vips, ",")
+		})
+	}
+	if watchable, ok := w.provider.(Watchable); ok && w.cloudinterval > 0 {
+		//轮询云上接口，间隔随reconcile间隔一起按限流情况调整
+		go w.watch("cloud", PriorityDrift, func() time.Duration { return DefaultBackpressure.Scale(w.cloudinterval) }, watchable.Fingerprint)
+	}
+}
+
+func (w *ChangeWatcher) watch(source string, priority int, interval func() time.Duration, fingerprint func() string) {
+	last := fingerprint()
+	for {
+		time.Sleep(interval())
+		current := fingerprint()
+		if current == last {
+			continue
+		}
+		log.Println(source, "change detected", last, "->", current)
+		last = current
+		w.queue.Push(priority, source)
+	}
+}
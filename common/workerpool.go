@@ -0,0 +1,187 @@
+package common
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+//排队中的任务及入队时间
+type poolJob struct {
+	run    func()
+	queued time.Time
+}
+
+//同一网卡的修改等待合并的时间
+const batchWindow = 100 * time.Millisecond
+
+//一个批次中的item(vip)及各自的预算，done关闭后results中为各item的结果
+type poolBatch struct {
+	items      []string
+	budgets    []*Budget
+	done       chan struct{}
+	requestids map[string]string
+	errs       map[string]error
+}
+
+//有界并发的任务池，同一key的任务串行执行，尚未开始的旧任务会被同key的新任务替换
+//interval大于0时同一key相邻两个任务的开始时间至少间隔interval，避免单个vip频繁调用云上接口
+//不同vip的任务对同一网卡的修改经过批处理阶段合并为一次云上请求
+type WorkerPool struct {
+	mutex    sync.Mutex
+	sem      chan struct{}
+	interval time.Duration
+	running  map[string]bool
+	pending  map[string]poolJob
+	started  map[string]time.Time
+	waiting  int
+	batches  map[string]*poolBatch
+}
+
+func NewWorkerPool(concurrency int, interval time.Duration) *WorkerPool {
+	if concurrency <= 0 {
+		concurrency = 1
+	}
+	return &WorkerPool{
+		sem:      make(chan struct{}, concurrency),
+		interval: interval,
+		running:  make(map[string]bool),
+		pending:  make(map[string]poolJob),
+		started:  make(map[string]time.Time),
+		batches:  make(map[string]*poolBatch),
+	}
+}
+
+//提交任务，key相同的任务不会并发执行
+func (w *WorkerPool) Submit(key string, job func()) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	DefaultMetrics.Add("vipsidecar_workqueue_adds_total", map[string]string{"queue": "vips"}, 1)
+	if w.running[key] {
+		if _, ok := w.pending[key]; ok {
+			DefaultMetrics.Add("vipsidecar_workqueue_coalesced_total", map[string]string{"queue": "vips"}, 1)
+		} else {
+			w.waiting++
+		}
+		w.pending[key] = poolJob{run: job, queued: time.Now()}
+		DefaultMetrics.Set("vipsidecar_workqueue_depth", map[string]string{"queue": "vips"}, float64(w.waiting))
+		return
+	}
+	w.running[key] = true
+	w.waiting++
+	DefaultMetrics.Set("vipsidecar_workqueue_depth", map[string]string{"queue": "vips"}, float64(w.waiting))
+	go w.run(key, poolJob{run: job, queued: time.Now()})
+}
+
+//key当前是否有任务在执行或排队
+func (w *WorkerPool) Busy(key string) bool {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.running[key]
+}
+
+func (w *WorkerPool) run(key string, job poolJob) {
+	labels := map[string]string{"queue": "vips"}
+	for job.run != nil {
+		w.mutex.Lock()
+		wait := w.interval - time.Since(w.started[key])
+		w.mutex.Unlock()
+		if w.interval > 0 && wait > 0 {
+			time.Sleep(wait)
+		}
+		w.sem <- struct{}{}
+		start := time.Now()
+		w.mutex.Lock()
+		w.started[key] = start
+		w.waiting--
+		DefaultMetrics.Set("vipsidecar_workqueue_depth", labels, float64(w.waiting))
+		w.mutex.Unlock()
+		DefaultMetrics.Add("vipsidecar_workqueue_queue_seconds_total", labels, start.Sub(job.queued).Seconds())
+		job.run()
+		<-w.sem
+		DefaultMetrics.Add("vipsidecar_workqueue_work_seconds_total", labels, time.Since(start).Seconds())
+		DefaultMetrics.Add("vipsidecar_workqueue_processed_total", labels, 1)
+
+		w.mutex.Lock()
+		job = w.pending[key]
+		delete(w.pending, key)
+		if job.run == nil {
+			delete(w.running, key)
+		}
+		w.mutex.Unlock()
+	}
+}
+
+//只能在任务内调用：item加入key(操作及网卡)的批次，batchWindow后以批次中的全部item调用一次call并返回本item的结果
+//等待期间让出并发名额，使同一网卡其他vip的任务能够加入同一批次；批次请求因不可重试的错误失败时逐个重新调用，单个vip的错误不影响其他vip
+func (w *WorkerPool) Batch(key string, item string, budget *Budget, call func(items []string, policy RetryPolicy) (string, error)) (string, error) {
+	w.mutex.Lock()
+	batch, ok := w.batches[key]
+	if !ok {
+		batch = &poolBatch{done: make(chan struct{}), requestids: make(map[string]string), errs: make(map[string]error)}
+		w.batches[key] = batch
+		go w.flush(key, batch, call)
+	}
+	batch.items = append(batch.items, item)
+	batch.budgets = append(batch.budgets, budget)
+	w.mutex.Unlock()
+	<-w.sem
+	<-batch.done
+	w.sem <- struct{}{}
+	return batch.requestids[item], batch.errs[item]
+}
+
+func (w *WorkerPool) flush(key string, batch *poolBatch, call func(items []string, policy RetryPolicy) (string, error)) {
+	defer close(batch.done)
+	time.Sleep(batchWindow)
+	w.mutex.Lock()
+	delete(w.batches, key)
+	w.mutex.Unlock()
+	labels := map[string]string{"queue": "vips"}
+	DefaultMetrics.Add("vipsidecar_workqueue_batches_total", labels, 1)
+	DefaultMetrics.Add("vipsidecar_workqueue_batched_total", labels, float64(len(batch.items)))
+	//epoch已失效的item不再修改，截止时间取各item中最早的
+	items, budgets := []string{}, []*Budget{}
+	policy := DefaultRetryPolicy
+	for i, item := range batch.items {
+		budget := batch.budgets[i]
+		if fence := budget.RetryPolicy().Fence; fence != nil {
+			if err := fence(); err != nil {
+				batch.errs[item] = err
+				continue
+			}
+		}
+		items, budgets = append(items, item), append(budgets, budget)
+		if deadline := budget.RetryPolicy().Deadline; !deadline.IsZero() && (policy.Deadline.IsZero() || deadline.Before(policy.Deadline)) {
+			policy.Deadline = deadline
+		}
+	}
+	if len(items) == 0 {
+		return
+	}
+	//重试前全部item都已失效时不再调用，部分失效的item由各自任务的fence步骤回滚
+	policy.Fence = func() error {
+		var err error
+		for _, budget := range budgets {
+			fence := budget.RetryPolicy().Fence
+			if fence == nil {
+				return nil
+			}
+			if err = fence(); err == nil {
+				return nil
+			}
+		}
+		return err
+	}
+	requestid, err := call(items, policy)
+	if err != nil && len(items) > 1 && !IsRetryable(err) {
+		log.Println("batch", key, "of", len(items), "failed, retrying one by one", err)
+		for i, item := range items {
+			batch.requestids[item], batch.errs[item] = call([]string{item}, budgets[i].RetryPolicy())
+		}
+		return
+	}
+	for _, item := range items {
+		batch.requestids[item], batch.errs[item] = requestid, err
+	}
+}
@@ -0,0 +1,109 @@
+package simulator
+
+import (
+	"errors"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"strconv"
+)
+
+//脚本事件类型
+const (
+	EventUnhealthy = "unhealthy"
+	EventHealthy   = "healthy"
+	EventCrash     = "crash"
+	EventRecover   = "recover"
+	EventPartition = "partition"
+	EventHeal      = "heal"
+	EventClockJump = "clockjump"
+	EventApiError  = "apierror"
+)
+
+//不变式名称
+const (
+	InvariantTwoOwners          = "two-owners"
+	InvariantBoundWithoutHealth = "bound-without-health"
+)
+
+//故障转移场景：若干节点竞争同一组vip，按tick(虚拟秒)执行脚本事件
+type Scenario struct {
+	Name  string   `yaml:"name"`
+	Vips  []string `yaml:"vips"`
+	Nodes []Node   `yaml:"nodes"`
+	//租约时长(tick)，持有者未续约超过该时长后其他节点可以接管，默认3
+	LeaseDuration int     `yaml:"leaseduration"`
+	Ticks         int     `yaml:"ticks"`
+	Events        []Event `yaml:"events"`
+	//预期被违反的不变式，为空表示所有不变式都应成立
+	Expect []string `yaml:"expect"`
+}
+
+type Node struct {
+	Name string `yaml:"name"`
+}
+
+//at为事件发生的tick；clockjump的seconds为节点本地时钟的跳变量，可为负；apierror的count为接下来失败的云上修改请求数
+type Event struct {
+	At      int    `yaml:"at"`
+	Type    string `yaml:"type"`
+	Node    string `yaml:"node"`
+	Seconds int    `yaml:"seconds"`
+	Count   int    `yaml:"count"`
+}
+
+func LoadScenario(path string) (*Scenario, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	s := &Scenario{}
+	if err := yaml.UnmarshalStrict(data, s); err != nil {
+		return nil, errors.New(path + ": " + err.Error())
+	}
+	if s.Name == "" {
+		s.Name = path
+	}
+	return s, s.Validate()
+}
+
+//检查场景，并为未配置的项设置默认值
+func (s *Scenario) Validate() error {
+	if len(s.Vips) == 0 || len(s.Nodes) == 0 {
+		return errors.New(s.Name + ": vips and nodes must be set")
+	}
+	names := map[string]bool{}
+	for _, n := range s.Nodes {
+		if n.Name == "" || names[n.Name] {
+			return errors.New(s.Name + ": node names must be set and unique")
+		}
+		names[n.Name] = true
+	}
+	if s.LeaseDuration <= 0 {
+		s.LeaseDuration = 3
+	}
+	if s.Ticks <= 0 {
+		s.Ticks = 30
+	}
+	for i, e := range s.Events {
+		where := s.Name + ": event " + strconv.Itoa(i) + " "
+		switch e.Type {
+		case EventApiError:
+			if e.Count <= 0 {
+				return errors.New(where + "apierror needs count")
+			}
+			continue
+		case EventUnhealthy, EventHealthy, EventCrash, EventRecover, EventPartition, EventHeal, EventClockJump:
+		default:
+			return errors.New(where + "unknown type " + e.Type)
+		}
+		if !names[e.Node] {
+			return errors.New(where + "unknown node " + e.Node)
+		}
+	}
+	for _, name := range s.Expect {
+		if name != InvariantTwoOwners && name != InvariantBoundWithoutHealth {
+			return errors.New(s.Name + ": unknown invariant " + name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,225 @@
+package simulator
+
+import (
+	"fmt"
+	common "github.com/jiashiwen/vipsidecar/common"
+	"sort"
+	"strings"
+)
+
+//用脚本事件驱动vip状态机，检查不变式，既可以在测试中调用Run，也可以通过simulate命令运行场景文件
+//
+//选主使用共享租约建模：健康且能访问租约的节点按配置顺序尝试获取或续约，
+//持有者按本地时钟计算租约到期时间，其他节点按自己的本地时钟判断租约是否过期，因此时钟跳变会导致提前接管；
+//分区的节点无法访问租约，但在自己计算的到期时间之前仍认为自己是持有者。
+//云上每个vip只有一个绑定者，节点每个tick按是否持有租约reconcile一次：Sync后对持有的vip接管或绑定。
+type simNode struct {
+	name        string
+	machine     *common.VipStateMachine
+	alive       bool
+	healthy     bool
+	partitioned bool
+	offset      int
+	//本节点认为的租约到期时间(本地时钟)，大于当前时间表示持有租约
+	expiry int
+}
+
+//违反的不变式
+type Violation struct {
+	Tick      int      `json:"tick"`
+	Invariant string   `json:"invariant"`
+	Vip       string   `json:"vip"`
+	Nodes     []string `json:"nodes"`
+}
+
+func (v Violation) String() string {
+	return fmt.Sprintf("t=%d %s vip %s nodes %s", v.Tick, v.Invariant, v.Vip, strings.Join(v.Nodes, ","))
+}
+
+type Result struct {
+	Scenario   string      `json:"scenario"`
+	Failovers  int         `json:"failovers"`
+	Violations []Violation `json:"violations"`
+	Trace      []string    `json:"trace"`
+}
+
+//违反的不变式与场景预期一致时通过
+func (r *Result) Passed(s *Scenario) bool {
+	violated := map[string]bool{}
+	for _, v := range r.Violations {
+		violated[v.Invariant] = true
+	}
+	if len(violated) != len(s.Expect) {
+		return false
+	}
+	for _, name := range s.Expect {
+		if !violated[name] {
+			return false
+		}
+	}
+	return true
+}
+
+type simulation struct {
+	scenario *Scenario
+	nodes    []*simNode
+	tick     int
+	//租约持有者及到期时间，到期时间按持有者的本地时钟计算
+	holder    string
+	expiry    int
+	cloud     map[string]string
+	apierrors int
+	result    *Result
+}
+
+//运行场景，同一tick内先执行事件，再依次reconcile各节点，最后检查不变式
+func Run(s *Scenario) (*Result, error) {
+	if err := s.Validate(); err != nil {
+		return nil, err
+	}
+	sim := &simulation{scenario: s, cloud: make(map[string]string), result: &Result{Scenario: s.Name, Violations: []Violation{}, Trace: []string{}}}
+	for _, n := range s.Nodes {
+		node := &simNode{name: n.Name, alive: true, healthy: true}
+		sim.start(node)
+		sim.nodes = append(sim.nodes, node)
+	}
+	for sim.tick = 0; sim.tick < s.Ticks; sim.tick++ {
+		for _, e := range s.Events {
+			if e.At == sim.tick {
+				sim.apply(e)
+			}
+		}
+		for _, node := range sim.nodes {
+			sim.reconcile(node)
+		}
+		sim.check()
+	}
+	return sim.result, nil
+}
+
+func (sim *simulation) trace(format string, args ...interface{}) {
+	sim.result.Trace = append(sim.result.Trace, fmt.Sprintf("t=%d ", sim.tick)+fmt.Sprintf(format, args...))
+}
+
+//启动节点进程，状态机从空状态开始
+func (sim *simulation) start(node *simNode) {
+	node.machine = common.NewVipStateMachine()
+	node.machine.OnTransition(func(vip string, from common.VipState, to common.VipState) {
+		sim.trace("%s %s %s -> %s", node.name, vip, from, to)
+	})
+}
+
+func (sim *simulation) node(name string) *simNode {
+	for _, node := range sim.nodes {
+		if node.name == name {
+			return node
+		}
+	}
+	return nil
+}
+
+func (sim *simulation) apply(e Event) {
+	if e.Type == EventApiError {
+		sim.apierrors += e.Count
+		sim.trace("next %d cloud api calls fail", e.Count)
+		return
+	}
+	node := sim.node(e.Node)
+	switch e.Type {
+	case EventUnhealthy:
+		node.healthy = false
+	case EventHealthy:
+		node.healthy = true
+	case EventCrash:
+		//进程退出，不再续约，持有的租约到期后由其他节点接管
+		node.alive, node.expiry = false, 0
+	case EventRecover:
+		node.alive = true
+		sim.start(node)
+	case EventPartition:
+		node.partitioned = true
+	case EventHeal:
+		node.partitioned = false
+	case EventClockJump:
+		node.offset += e.Seconds
+		sim.trace("%s clock jumps %+ds", e.Node, e.Seconds)
+		return
+	}
+	sim.trace("%s %s", e.Node, e.Type)
+}
+
+//按租约决定节点是否持有vip
+func (sim *simulation) elect(node *simNode) bool {
+	now := sim.tick + node.offset
+	if !node.healthy {
+		if !node.partitioned && sim.holder == node.name {
+			sim.holder = ""
+		}
+		node.expiry = 0
+		return false
+	}
+	if node.partitioned {
+		return now < node.expiry
+	}
+	if sim.holder == node.name || sim.holder == "" || now >= sim.expiry {
+		if sim.holder != node.name {
+			sim.trace("%s takes the lease", node.name)
+		}
+		sim.holder, sim.expiry = node.name, now+sim.scenario.LeaseDuration
+		node.expiry = sim.expiry
+		return true
+	}
+	node.expiry = 0
+	return false
+}
+
+func (sim *simulation) reconcile(node *simNode) {
+	if !node.alive {
+		return
+	}
+	vipsonlocal := []string{}
+	if sim.elect(node) {
+		vipsonlocal = sim.scenario.Vips
+	}
+	node.machine.Sync(vipsonlocal)
+	for _, vip := range vipsonlocal {
+		if sim.cloud[vip] == node.name {
+			node.machine.Adopt(vip)
+			continue
+		}
+		epoch := node.machine.Acquire(vip)
+		if sim.apierrors > 0 {
+			sim.apierrors--
+			node.machine.Fail(vip, common.ReasonUnavailable, "")
+			continue
+		}
+		sim.cloud[vip] = node.name
+		sim.result.Failovers++
+		node.machine.Fresh(vip, "", epoch)
+	}
+}
+
+func (sim *simulation) check() {
+	for _, vip := range sim.scenario.Vips {
+		owners := []string{}
+		for _, node := range sim.nodes {
+			if !node.alive || node.machine.State(vip) != common.StateBound {
+				continue
+			}
+			owners = append(owners, node.name)
+			if !node.healthy {
+				sim.violate(InvariantBoundWithoutHealth, vip, []string{node.name})
+			}
+		}
+		if len(owners) > 1 {
+			sort.Strings(owners)
+			sim.violate(InvariantTwoOwners, vip, owners)
+		}
+	}
+}
+
+func (sim *simulation) violate(invariant string, vip string, nodes []string) {
+	v := Violation{Tick: sim.tick, Invariant: invariant, Vip: vip, Nodes: nodes}
+	sim.result.Violations = append(sim.result.Violations, v)
+	sim.trace("VIOLATION %s", v)
+}
@@ -0,0 +1,128 @@
+package simulator
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	//状态机的转换日志由trace代替
+	log.SetOutput(ioutil.Discard)
+	os.Exit(m.Run())
+}
+
+//testdata中的场景，每个场景违反的不变式都应与expect一致
+func TestScenarios(t *testing.T) {
+	paths, err := filepath.Glob("testdata/*.yaml")
+	if err != nil || len(paths) == 0 {
+		t.Fatal("no scenarios in testdata", err)
+	}
+	for _, path := range paths {
+		scenario, err := LoadScenario(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Run(scenario)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Passed(scenario) {
+			t.Errorf("%s: violations %v, expected %v\n%s", scenario.Name, result.Violations, scenario.Expect, strings.Join(result.Trace, "\n"))
+		}
+	}
+}
+
+//持有者退出后，其他节点在租约到期后(云上请求失败时每失败一次推迟一个tick)接管全部vip，且不出现两个持有者
+func TestFailoverWithinBudget(t *testing.T) {
+	cases := []struct {
+		path   string
+		crash  int
+		budget int
+	}{
+		{path: "testdata/crash-failover.yaml", crash: 5, budget: 3},
+		{path: "testdata/api-errors.yaml", crash: 4, budget: 3 + 2},
+	}
+	for _, c := range cases {
+		scenario, err := LoadScenario(c.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		result, err := Run(scenario)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(result.Violations) != 0 {
+			t.Errorf("%s: unexpected violations %v", scenario.Name, result.Violations)
+		}
+		for _, vip := range scenario.Vips {
+			tick := boundAfter(result.Trace, "b", vip, c.crash)
+			if tick < 0 || tick-c.crash > c.budget {
+				t.Errorf("%s: vip %s bound on b at t=%d after crash at t=%d, budget %d ticks\n%s", scenario.Name, vip, tick, c.crash, c.budget, strings.Join(result.Trace, "\n"))
+			}
+		}
+	}
+}
+
+//持有者时钟正常、其他节点时钟向前跳变时提前接管，出现两个持有者
+func TestClockJumpDetectsTwoOwners(t *testing.T) {
+	scenario, err := LoadScenario("testdata/clock-jump.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Run(scenario)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Violations) == 0 || result.Violations[0].Invariant != InvariantTwoOwners || result.Violations[0].Tick != 6 {
+		t.Fatalf("expected two-owners at t=6, got %v", result.Violations)
+	}
+	if nodes := strings.Join(result.Violations[0].Nodes, ","); nodes != "a,b" {
+		t.Errorf("two-owners nodes = %s, want a,b", nodes)
+	}
+}
+
+//场景检查拒绝未知的事件类型、节点及不变式
+func TestValidate(t *testing.T) {
+	base := func() *Scenario {
+		return &Scenario{Name: "s", Vips: []string{"10.0.0.10"}, Nodes: []Node{{Name: "a"}}}
+	}
+	s := base()
+	s.Events = []Event{{Type: "reboot", Node: "a"}}
+	if s.Validate() == nil {
+		t.Error("unknown event type accepted")
+	}
+	s = base()
+	s.Events = []Event{{Type: EventCrash, Node: "z"}}
+	if s.Validate() == nil {
+		t.Error("unknown node accepted")
+	}
+	s = base()
+	s.Expect = []string{"split-brain"}
+	if s.Validate() == nil {
+		t.Error("unknown invariant accepted")
+	}
+	s = base()
+	if err := s.Validate(); err != nil || s.LeaseDuration != 3 || s.Ticks != 30 {
+		t.Errorf("defaults not applied: %v %d %d", err, s.LeaseDuration, s.Ticks)
+	}
+}
+
+//trace中vip在since之后第一次在node上变为Bound的tick，没有时返回-1
+func boundAfter(trace []string, node string, vip string, since int) int {
+	for _, line := range trace {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[1] != node || fields[2] != vip || fields[len(fields)-1] != "Bound" {
+			continue
+		}
+		tick, err := strconv.Atoi(strings.TrimPrefix(fields[0], "t="))
+		if err == nil && tick > since {
+			return tick
+		}
+	}
+	return -1
+}